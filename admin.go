@@ -0,0 +1,664 @@
+package sql_exporter
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/free/sql_exporter/config"
+	"github.com/free/sql_exporter/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+var (
+	adminTokenFile = kingpin.Flag("admin.token-file",
+		"File containing the bearer token required by the admin API. The admin API is disabled if not set.").String()
+	adminStateFile = kingpin.Flag("admin.state-file",
+		"File the admin API persists runtime changes (added or paused targets, paused collectors) to and restores "+
+			"them from.").String()
+)
+
+const (
+	// adminAPIPrefix is the path prefix of the admin API.
+	adminAPIPrefix = "/api/v1/"
+	// Maximum size of a collector definition submitted for preview.
+	previewMaxBodySize = 1 << 20
+)
+
+// managedTarget is a Target along with its identity and runtime state, as managed by the admin API.
+type managedTarget struct {
+	job      string
+	instance string
+	dsn      config.Secret // only set for targets added at runtime
+	dynamic  bool          // true if added at runtime, rather than defined in the configuration file
+	paused   bool
+	// Time the target is automatically resumed at, zero if paused indefinitely.
+	pausedUntil time.Time
+	target      Target
+}
+
+// isPaused returns true if the target is paused at time now.
+func (mt *managedTarget) isPaused(now time.Time) bool {
+	return mt.paused && pausedAt(mt.pausedUntil, now)
+}
+
+// targetSet is the set of targets of an exporter, which may be modified at runtime via the admin API.
+type targetSet struct {
+	mtx     sync.RWMutex
+	targets []*managedTarget
+}
+
+// newTargetSet returns a targetSet with the given (configured) targets.
+func newTargetSet(targets []Target) *targetSet {
+	ts := &targetSet{targets: make([]*managedTarget, 0, len(targets))}
+	for _, t := range targets {
+		labels := t.Labels()
+		ts.targets = append(ts.targets, &managedTarget{job: labels["job"], instance: labels["instance"], target: t})
+	}
+	return ts
+}
+
+// activeByJob returns the targets that are not paused, grouped by job, along with the job names in configuration order.
+// In single target mode, the only job name is empty.
+func (ts *targetSet) activeByJob() ([]string, map[string][]Target) {
+	ts.mtx.RLock()
+	defer ts.mtx.RUnlock()
+
+	now := time.Now()
+	var jobs []string
+	targets := make(map[string][]Target)
+	for _, mt := range ts.targets {
+		if mt.isPaused(now) {
+			continue
+		}
+		if _, found := targets[mt.job]; !found {
+			jobs = append(jobs, mt.job)
+		}
+		targets[mt.job] = append(targets[mt.job], mt.target)
+	}
+	return jobs, targets
+}
+
+// active returns the targets that are not paused.
+func (ts *targetSet) active() []Target {
+	ts.mtx.RLock()
+	defer ts.mtx.RUnlock()
+
+	now := time.Now()
+	targets := make([]Target, 0, len(ts.targets))
+	for _, mt := range ts.targets {
+		if !mt.isPaused(now) {
+			targets = append(targets, mt.target)
+		}
+	}
+	return targets
+}
+
+// all returns all targets, including paused ones.
+func (ts *targetSet) all() []Target {
+	ts.mtx.RLock()
+	defer ts.mtx.RUnlock()
+
+	targets := make([]Target, 0, len(ts.targets))
+	for _, mt := range ts.targets {
+		targets = append(targets, mt.target)
+	}
+	return targets
+}
+
+// status returns the state of all targets at time now.
+func (ts *targetSet) status(now time.Time) []TargetStatus {
+	ts.mtx.RLock()
+	defer ts.mtx.RUnlock()
+
+	status := make([]TargetStatus, 0, len(ts.targets))
+	for _, mt := range ts.targets {
+		st := TargetStatus{Job: mt.job, Instance: mt.instance, Dynamic: mt.dynamic, Paused: mt.isPaused(now)}
+		if st.Paused {
+			st.PausedUntil = mt.pausedUntil
+		}
+		status = append(status, st)
+	}
+	return status
+}
+
+// find returns the index of the target with the given job and instance names, or -1. The caller must hold the lock.
+func (ts *targetSet) find(job, instance string) int {
+	for i, mt := range ts.targets {
+		if mt.job == job && mt.instance == instance {
+			return i
+		}
+	}
+	return -1
+}
+
+// lookup returns the target with the given instance name and, if not empty, job name. The job may only be omitted if
+// the instance name is unique across jobs.
+func (ts *targetSet) lookup(job, instance string) (*target, error) {
+	var found *managedTarget
+	ts.mtx.RLock()
+	for _, mt := range ts.targets {
+		if mt.instance == instance && (job == "" || mt.job == job) {
+			if found != nil {
+				ts.mtx.RUnlock()
+				return nil, fmt.Errorf("target %q defined by multiple jobs, job required", instance)
+			}
+			found = mt
+		}
+	}
+	ts.mtx.RUnlock()
+	if found == nil {
+		return nil, fmt.Errorf("unknown target %q", instance)
+	}
+
+	t, ok := found.target.(*target)
+	if !ok {
+		return nil, fmt.Errorf("target %q does not support running individual collectors", instance)
+	}
+	return t, nil
+}
+
+// adminState is the runtime state of the admin API, as persisted to the state file.
+type adminState struct {
+	Targets          []adminStateTarget `json:"targets"`
+	Paused           []adminStateTarget `json:"paused"`
+	PausedCollectors []adminStateTarget `json:"paused_collectors"`
+}
+
+// adminStateTarget identifies a target (or collector) in the admin API state file and, for targets added at runtime,
+// its data source name or, for paused targets, the time it is automatically resumed at.
+type adminStateTarget struct {
+	Job       string        `json:"job,omitempty"`
+	Instance  string        `json:"instance,omitempty"`
+	Collector string        `json:"collector,omitempty"`
+	DSN       config.Secret `json:"data_source_name,omitempty"`
+	Until     *time.Time    `json:"until,omitempty"`
+}
+
+// adminStatus is the JSON representation of a target or collector returned by the admin API. The DSN is deliberately
+// omitted.
+type adminStatus struct {
+	Job         string     `json:"job,omitempty"`
+	Instance    string     `json:"instance,omitempty"`
+	Collector   string     `json:"collector,omitempty"`
+	Dynamic     bool       `json:"dynamic,omitempty"`
+	Paused      bool       `json:"paused"`
+	PausedUntil *time.Time `json:"paused_until,omitempty"`
+}
+
+// untilPtr returns a pointer to until, or nil if zero.
+func untilPtr(until time.Time) *time.Time {
+	if until.IsZero() {
+		return nil
+	}
+	return &until
+}
+
+// adminHandler serves the admin API:
+//
+//	GET    /api/v1/targets                            lists all targets
+//	PUT    /api/v1/targets/{job}/{instance}           adds a target or replaces the data source name of one added at
+//	                                                  runtime, body: {"data_source_name": "..."}
+//	DELETE /api/v1/targets/{job}/{instance}           removes a target added at runtime
+//	POST   /api/v1/targets/{job}/{instance}/pause     stops scraping a target, optionally ?duration=2h
+//	POST   /api/v1/targets/{job}/{instance}/resume    resumes scraping a paused target
+//	GET    /api/v1/collectors                         lists all collectors
+//	POST   /api/v1/collectors/{name}/pause            stops running a collector on all targets, optionally ?duration=2h
+//	POST   /api/v1/collectors/{name}/resume           resumes running a paused collector
+//	POST   /api/v1/preview?job=...&target=...         runs a collector or metric definition (YAML body) once on a target
+//	                                                  and returns the samples, optionally ?timeout=5s&limit=100&explain=true
+type adminHandler struct {
+	config     *config.Config
+	targets    *targetSet
+	collectors []string
+	token      string
+	stateFile  string
+	// Targets added at runtime but assigned to other exporter replicas' shards (see --shard.total), restored from the
+	// state file and not scraped, only written back to it so they survive resharding.
+	otherShards []adminStateTarget
+}
+
+// newAdminHandler returns the admin API handler for the given config and targets, restoring any state persisted to
+// stateFile. It returns nil if tokenFile is empty, i.e. the admin API is disabled.
+func newAdminHandler(c *config.Config, targets *targetSet, tokenFile, stateFile string) (*adminHandler, error) {
+	if tokenFile == "" {
+		return nil, nil
+	}
+	buf, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return nil, err
+	}
+	token := strings.TrimSpace(string(buf))
+	if token == "" {
+		return nil, fmt.Errorf("empty admin API token in %s", tokenFile)
+	}
+
+	collectors := make([]string, 0, len(c.Collectors))
+	for _, cc := range c.Collectors {
+		collectors = append(collectors, cc.Name)
+	}
+	h := &adminHandler{
+		config:     c,
+		targets:    targets,
+		collectors: collectors,
+		token:      token,
+		stateFile:  stateFile,
+	}
+	if err := h.restore(); err != nil {
+		return nil, fmt.Errorf("restoring admin API state from %s: %s", stateFile, err)
+	}
+	if err := prometheus.Register(&pauseMetrics{targets: targets, collectors: collectors}); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// ServeHTTP implements http.Handler.
+func (h *adminHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	auth := req.Header.Get("Authorization")
+	if subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+h.token)) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(req.URL.Path, adminAPIPrefix), "/")
+	parts := strings.Split(path, "/")
+
+	var until time.Time
+	if d := req.URL.Query().Get("duration"); d != "" {
+		duration, err := model.ParseDuration(d)
+		if err != nil || duration <= 0 {
+			http.Error(w, fmt.Sprintf("Invalid duration %q", d), http.StatusBadRequest)
+			return
+		}
+		until = time.Now().Add(time.Duration(duration))
+	}
+
+	var err error
+	switch {
+	case len(parts) == 1 && parts[0] == "targets" && req.Method == http.MethodGet:
+		h.listTargets(w)
+		return
+	case len(parts) == 3 && parts[0] == "targets" && req.Method == http.MethodPut:
+		var body adminStateTarget
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = h.add(parts[1], parts[2], body.DSN)
+	case len(parts) == 3 && parts[0] == "targets" && req.Method == http.MethodDelete:
+		err = h.remove(parts[1], parts[2])
+	case len(parts) == 4 && parts[0] == "targets" && req.Method == http.MethodPost && isPauseAction(parts[3]):
+		err = h.setTargetPaused(parts[1], parts[2], parts[3] == "pause", until)
+	case len(parts) == 1 && parts[0] == "collectors" && req.Method == http.MethodGet:
+		h.listCollectors(w)
+		return
+	case len(parts) == 3 && parts[0] == "collectors" && req.Method == http.MethodPost && isPauseAction(parts[2]):
+		err = h.setCollectorPaused(parts[1], parts[2] == "pause", until)
+	case len(parts) == 1 && parts[0] == "preview" && req.Method == http.MethodPost:
+		h.preview(w, req)
+		return
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		log.Warningf("Admin API request %s %s failed: %s", req.Method, req.URL.Path, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Infof("Admin API request %s %s succeeded", req.Method, req.URL.Path)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// isPauseAction returns true if action is one of "pause" or "resume".
+func isPauseAction(action string) bool {
+	return action == "pause" || action == "resume"
+}
+
+// listTargets writes the JSON encoded list of targets to w.
+func (h *adminHandler) listTargets(w http.ResponseWriter) {
+	status := h.targets.status(time.Now())
+	targets := make([]adminStatus, 0, len(status))
+	for _, ts := range status {
+		targets = append(targets, adminStatus{
+			Job:         ts.Job,
+			Instance:    ts.Instance,
+			Dynamic:     ts.Dynamic,
+			Paused:      ts.Paused,
+			PausedUntil: untilPtr(ts.PausedUntil),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(targets)
+}
+
+// listCollectors writes the JSON encoded list of collectors to w.
+func (h *adminHandler) listCollectors(w http.ResponseWriter) {
+	status := collectorPauses.status(h.collectors, time.Now())
+	collectors := make([]adminStatus, 0, len(status))
+	for _, cs := range status {
+		collectors = append(collectors, adminStatus{
+			Collector:   cs.Name,
+			Paused:      cs.Paused,
+			PausedUntil: untilPtr(cs.PausedUntil),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(collectors)
+}
+
+// preview runs the collector definition in the request body once on the requested target and writes the JSON encoded
+// CollectorPreview to w.
+func (h *adminHandler) preview(w http.ResponseWriter, req *http.Request) {
+	params := req.URL.Query()
+	timeout := previewDefaultTimeout
+	if v := params.Get("timeout"); v != "" {
+		d, err := model.ParseDuration(v)
+		if err != nil || d <= 0 || time.Duration(d) > previewMaxTimeout {
+			http.Error(w, fmt.Sprintf("Invalid timeout %q, at most %s", v, previewMaxTimeout), http.StatusBadRequest)
+			return
+		}
+		timeout = time.Duration(d)
+	}
+	var rowLimit int
+	if v := params.Get("limit"); v != "" {
+		var err error
+		if rowLimit, err = strconv.Atoi(v); err != nil || rowLimit <= 0 {
+			http.Error(w, fmt.Sprintf("Invalid limit %q", v), http.StatusBadRequest)
+			return
+		}
+	}
+	explain := params.Get("explain") == "true"
+
+	buf, err := io.ReadAll(io.LimitReader(req.Body, previewMaxBodySize))
+	if err != nil {
+		http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	cc, err := parsePreviewCollector(buf)
+	if err != nil {
+		http.Error(w, "Invalid collector definition: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	job := params.Get("job")
+	t, err := h.targets.lookup(job, params.Get("target"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var metricPrefix string
+	if jc := h.jobConfig(t.constLabels["job"]); jc != nil {
+		metricPrefix = jc.MetricPrefix
+	}
+
+	log.Infof("Admin API request %s %s: previewing collector on target %q", req.Method, req.URL.Path, t.name)
+	preview, err := previewCollector(req.Context(), t, cc, metricPrefix, timeout, rowLimit, explain)
+	if err != nil {
+		log.Warningf("Admin API request %s %s failed: %s", req.Method, req.URL.Path, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(preview)
+}
+
+// add adds a target with the given data source name to the job. If the target was already added at runtime, its data
+// source name is replaced instead (e.g. to rotate credentials) without interrupting scrapes in progress.
+func (h *adminHandler) add(job, instance string, dsn config.Secret) error {
+	h.targets.mtx.Lock()
+	defer h.targets.mtx.Unlock()
+
+	if i := h.targets.find(job, instance); i != -1 && h.targets.targets[i].dynamic {
+		if err := h.replaceLocked(h.targets.targets[i], dsn); err != nil {
+			return err
+		}
+	} else if err := h.addLocked(job, instance, dsn); err != nil {
+		return err
+	}
+	return h.persistLocked()
+}
+
+// replaceLocked replaces the data source name of a target added at runtime. Must be called with the target set lock
+// held.
+func (h *adminHandler) replaceLocked(mt *managedTarget, dsn config.Secret) error {
+	if dsn == "" {
+		return fmt.Errorf("missing data source name")
+	}
+	// Collectors' queries are prepared for the driver, it cannot change.
+	if driver, previous := config.DSNDriver(string(dsn)), config.DSNDriver(string(mt.dsn)); driver != previous {
+		return fmt.Errorf("cannot replace %s data source name of target %q with a %s one", previous, mt.instance, driver)
+	}
+	t, ok := mt.target.(*target)
+	if !ok {
+		return fmt.Errorf("cannot replace the data source name of target %q", mt.instance)
+	}
+	jc := h.jobConfig(mt.job)
+	if jc == nil {
+		return fmt.Errorf("unknown job %q", mt.job)
+	}
+	if _, err := t.setDataSources([]string{jobTargetDataSourceName(jc, dsn)}); err != nil {
+		return err
+	}
+	mt.dsn = dsn
+	return nil
+}
+
+// jobConfig returns the configuration of the named job, nil if not found.
+func (h *adminHandler) jobConfig(job string) *config.JobConfig {
+	for _, j := range h.config.Jobs {
+		if j.Name == job {
+			return j
+		}
+	}
+	return nil
+}
+
+// addLocked creates and adds a target to the job. The caller must hold the lock.
+func (h *adminHandler) addLocked(job, instance string, dsn config.Secret) error {
+	jc := h.jobConfig(job)
+	if jc == nil {
+		return fmt.Errorf("unknown job %q", job)
+	}
+	if !jc.IsEnabled() {
+		return fmt.Errorf("job %q is disabled", job)
+	}
+	if instance == "" || dsn == "" {
+		return fmt.Errorf("missing instance name or data source name")
+	}
+	if !inShard(job, instance) {
+		return fmt.Errorf("target %q of job %q is assigned to another exporter replica's shard", instance, job)
+	}
+	if h.targets.find(job, instance) != -1 {
+		return fmt.Errorf("target %q already defined for job %q", instance, job)
+	}
+
+	t, err := newJobTarget(jc, h.config.Globals, fmt.Sprintf("job=%q", job), instance, dsn, nil, nil)
+	if err != nil {
+		return err
+	}
+	h.targets.targets = append(h.targets.targets, &managedTarget{
+		job:      job,
+		instance: instance,
+		dsn:      dsn,
+		dynamic:  true,
+		target:   t,
+	})
+	return nil
+}
+
+// remove removes a target previously added at runtime.
+func (h *adminHandler) remove(job, instance string) error {
+	h.targets.mtx.Lock()
+	defer h.targets.mtx.Unlock()
+
+	i := h.targets.find(job, instance)
+	if i == -1 {
+		return fmt.Errorf("unknown target %q of job %q", instance, job)
+	}
+	mt := h.targets.targets[i]
+	if !mt.dynamic {
+		return fmt.Errorf("target %q of job %q is defined in the configuration file and cannot be removed", instance, job)
+	}
+	h.targets.targets = append(h.targets.targets[:i], h.targets.targets[i+1:]...)
+	// Scrapes in progress complete on the target's DB handles, which are only closed (and the target's process metrics
+	// deleted) afterwards.
+	if err := mt.target.Close(); err != nil {
+		log.Warningf("Closing removed target %q of job %q: %s", instance, job, err)
+	}
+	return h.persistLocked()
+}
+
+// setTargetPaused pauses (until the given time, or indefinitely if zero) or resumes a target.
+func (h *adminHandler) setTargetPaused(job, instance string, paused bool, until time.Time) error {
+	h.targets.mtx.Lock()
+	defer h.targets.mtx.Unlock()
+
+	i := h.targets.find(job, instance)
+	if i == -1 {
+		return fmt.Errorf("unknown target %q of job %q", instance, job)
+	}
+	h.targets.targets[i].paused = paused
+	h.targets.targets[i].pausedUntil = until
+	return h.persistLocked()
+}
+
+// setCollectorPaused pauses (until the given time, or indefinitely if zero) or resumes a collector.
+func (h *adminHandler) setCollectorPaused(name string, paused bool, until time.Time) error {
+	if h.config.Collector(name) == nil {
+		return fmt.Errorf("unknown collector %q", name)
+	}
+
+	h.targets.mtx.Lock()
+	defer h.targets.mtx.Unlock()
+
+	if paused {
+		collectorPauses.pause(name, until)
+	} else {
+		collectorPauses.resume(name)
+	}
+	return h.persistLocked()
+}
+
+// restore applies the state persisted to the state file, if any.
+func (h *adminHandler) restore() error {
+	if h.stateFile == "" {
+		return nil
+	}
+	buf, err := os.ReadFile(h.stateFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var state adminState
+	if err := json.Unmarshal(buf, &state); err != nil {
+		return err
+	}
+
+	h.targets.mtx.Lock()
+	defer h.targets.mtx.Unlock()
+	for _, st := range state.Targets {
+		// Jobs may have been removed from (or disabled in) the configuration file since, and targets added to it.
+		if jc := h.jobConfig(st.Job); jc == nil {
+			log.Warningf("Job %q no longer defined, dropping its dynamic target %q", st.Job, st.Instance)
+			continue
+		} else if !jc.IsEnabled() {
+			log.Warningf("Job %q is disabled, dropping its dynamic target %q", st.Job, st.Instance)
+			continue
+		}
+		if !inShard(st.Job, st.Instance) {
+			log.Infof("Target %q of job %q assigned to another exporter replica's shard, not scraping it",
+				st.Instance, st.Job)
+			h.otherShards = append(h.otherShards, st)
+			continue
+		}
+		if h.targets.find(st.Job, st.Instance) != -1 {
+			log.Warningf("Target %q of job %q now defined in the configuration file, dropping the dynamic target",
+				st.Instance, st.Job)
+			continue
+		}
+		if err := h.addLocked(st.Job, st.Instance, st.DSN); err != nil {
+			return err
+		}
+	}
+	// Targets and collectors may have been removed from the configuration file since, ignore them.
+	for _, st := range state.Paused {
+		if i := h.targets.find(st.Job, st.Instance); i != -1 {
+			h.targets.targets[i].paused = true
+			if st.Until != nil {
+				h.targets.targets[i].pausedUntil = *st.Until
+			}
+		}
+	}
+	for _, st := range state.PausedCollectors {
+		if h.config.Collector(st.Collector) != nil {
+			var until time.Time
+			if st.Until != nil {
+				until = *st.Until
+			}
+			collectorPauses.pause(st.Collector, until)
+		}
+	}
+	return nil
+}
+
+// persistLocked writes the current state to the state file, if any. The caller must hold the lock.
+func (h *adminHandler) persistLocked() error {
+	if h.stateFile == "" {
+		return nil
+	}
+	var (
+		state = adminState{Targets: append([]adminStateTarget(nil), h.otherShards...)}
+		now   = time.Now()
+	)
+	for _, mt := range h.targets.targets {
+		if mt.dynamic {
+			state.Targets = append(state.Targets, adminStateTarget{Job: mt.job, Instance: mt.instance, DSN: mt.dsn})
+		}
+		if mt.isPaused(now) {
+			state.Paused = append(state.Paused,
+				adminStateTarget{Job: mt.job, Instance: mt.instance, Until: untilPtr(mt.pausedUntil)})
+		}
+	}
+	for _, cs := range collectorPauses.status(h.collectors, now) {
+		if cs.Paused {
+			state.PausedCollectors = append(state.PausedCollectors,
+				adminStateTarget{Collector: cs.Name, Until: untilPtr(cs.PausedUntil)})
+		}
+	}
+	buf, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file and rename it, so the state is never left half written. It contains DSNs, so it is
+	// only readable by the owner.
+	tmp, err := os.CreateTemp(filepath.Dir(h.stateFile), filepath.Base(h.stateFile)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), h.stateFile)
+}
@@ -0,0 +1,180 @@
+package sql_exporter
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/free/sql_exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestAdminRestoreAndRemove(t *testing.T) {
+	dir := t.TempDir()
+	results := filepath.Join(dir, "results.yml")
+	if err := os.WriteFile(results, []byte(testResults), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dsn := "testdriver://" + filepath.ToSlash(results)
+	// The state file refers to a job since removed from the configuration, which must not fail startup.
+	stateFile := filepath.Join(dir, "state.json")
+	state := `{"targets": [
+  {"job": "removed", "instance": "db1", "data_source_name": "` + dsn + `"},
+  {"job": "pg", "instance": "db2", "data_source_name": "` + dsn + `"}
+]}`
+	if err := os.WriteFile(stateFile, []byte(state), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := config.Parse([]byte(`
+jobs:
+  - job_name: pg
+    collectors: [pg_database]
+    static_configs:
+      - targets:
+          db1: '` + dsn + `'
+collectors:
+  - collector_name: pg_database
+    min_interval: 1h
+    metrics:
+      - metric_name: pg_xact_commit_total
+        type: counter
+        help: 'Committed transactions.'
+        key_labels: [datname]
+        values: [xact_commit]
+        query_ref: xact
+    queries:
+      - query_name: xact
+        query: SELECT datname, xact_commit FROM pg_stat_database
+        result_checksum: true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err := NewJob(c.Jobs[0], c.Globals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &adminHandler{config: c, targets: newTargetSet(job.Targets()), stateFile: stateFile}
+	if err := h.restore(); err != nil {
+		t.Fatalf("unexpected error restoring state: %s", err)
+	}
+	if st := h.targets.status(time.Now()); len(st) != 2 || st[1].Instance != "db2" || !st[1].Dynamic {
+		t.Fatalf("unexpected targets after restore: %+v", st)
+	}
+	defer func() {
+		for _, t := range h.targets.all() {
+			t.Close()
+		}
+	}()
+
+	// Scrape twice, so that both a fresh and a cached collection are recorded.
+	e := &exporter{config: c, targets: h.targets, ctx: context.Background()}
+	for i := 0; i < 2; i++ {
+		if _, err := e.Gather(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	series := func() int {
+		ch := make(chan prometheus.Metric)
+		go func() {
+			for _, c := range []prometheus.Collector{collectorLastSuccess, collectorCachedScrapes, queryResultChecksum,
+				targetFlaps, targetLastStateChange} {
+				c.Collect(ch)
+			}
+			close(ch)
+		}()
+		n := 0
+		for range ch {
+			n++
+		}
+		return n
+	}
+	before := series()
+
+	if err := h.remove("pg", "db2"); err != nil {
+		t.Fatal(err)
+	}
+	// One series per metric, for the removed target.
+	if after := series(); after != before-5 {
+		t.Errorf("expected the removed target's 5 series to be deleted, got %d series before and %d after", before, after)
+	}
+}
+
+func TestAdminShard(t *testing.T) {
+	defer func(index, total int) { *shardIndex, *shardTotal = index, total }(*shardIndex, *shardTotal)
+	*shardIndex, *shardTotal = 0, 2
+	// Pick a target name in this replica's shard and one in the other's.
+	var mine, theirs string
+	for i := 0; mine == "" || theirs == ""; i++ {
+		if name := fmt.Sprintf("db%d", i); inShard("pg", name) {
+			mine = name
+		} else {
+			theirs = name
+		}
+	}
+
+	dir := t.TempDir()
+	results := filepath.Join(dir, "results.yml")
+	if err := os.WriteFile(results, []byte(testResults), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dsn := "testdriver://" + filepath.ToSlash(results)
+	stateFile := filepath.Join(dir, "state.json")
+	state := `{"targets": [{"job": "pg", "instance": "` + theirs + `", "data_source_name": "` + dsn + `"}]}`
+	if err := os.WriteFile(stateFile, []byte(state), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := config.Parse([]byte(`
+jobs:
+  - job_name: pg
+    collectors: [pg_database]
+    static_configs: [{targets: {}}]
+collectors:
+  - collector_name: pg_database
+    metrics:
+      - metric_name: pg_xact_commit_total
+        type: counter
+        help: 'Committed transactions.'
+        key_labels: [datname]
+        values: [xact_commit]
+        query: SELECT datname, xact_commit FROM pg_stat_database
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &adminHandler{config: c, targets: newTargetSet(nil), stateFile: stateFile}
+	if err := h.restore(); err != nil {
+		t.Fatalf("unexpected error restoring state: %s", err)
+	}
+	defer func() {
+		for _, t := range h.targets.all() {
+			t.Close()
+		}
+	}()
+	if st := h.targets.status(time.Now()); len(st) != 0 {
+		t.Errorf("restored a target of another shard: %+v", st)
+	}
+
+	if err := h.add("pg", theirs, config.Secret(dsn)); err == nil || !strings.Contains(err.Error(), "another") {
+		t.Errorf("expected a target of another shard to be rejected, got %v", err)
+	}
+	if err := h.add("pg", mine, config.Secret(dsn)); err != nil {
+		t.Fatal(err)
+	}
+	// Both targets are persisted, so that the other shard's survives resharding.
+	buf, err := os.ReadFile(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{mine, theirs} {
+		if !strings.Contains(string(buf), `"instance": "`+name+`"`) {
+			t.Errorf("missing target %q in state file:\n%s", name, buf)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package sql_exporter
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/free/sql_exporter/config"
+	"github.com/free/sql_exporter/errors"
+)
+
+var (
+	// Protects auditLogs.
+	auditLogsMtx sync.Mutex
+	// Open audit logs, keyed by type and path (or tag), so that all queries share one writer.
+	auditLogs = make(map[string]*auditLog)
+)
+
+// auditRecord is a record of one statement execution (or ping, or transaction boundary), see config.AuditLogConfig.
+type auditRecord struct {
+	Time      string        `json:"ts"`
+	ScrapeID  string        `json:"scrape_id,omitempty"`
+	Job       string        `json:"job,omitempty"`
+	Instance  string        `json:"instance,omitempty"`
+	Target    string        `json:"target,omitempty"`
+	Collector string        `json:"collector,omitempty"`
+	Query     string        `json:"query,omitempty"`
+	Op        string        `json:"op"`
+	Statement string        `json:"statement,omitempty"`
+	Args      []interface{} `json:"args,omitempty"`
+	Seconds   float64       `json:"seconds"`
+	Rows      int           `json:"rows"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// auditLog writes audit records to a file or syslog, one JSON object per record.
+type auditLog struct {
+	mtx  sync.Mutex
+	w    io.Writer
+	args bool // whether statement arguments are recorded
+}
+
+// openAuditLog returns the audit log for the provided config, opening it on first use. It returns nil if ac is nil,
+// i.e. auditing is disabled.
+func openAuditLog(ac *config.AuditLogConfig) (*auditLog, error) {
+	if ac == nil {
+		return nil, nil
+	}
+	key := ac.Type + ":" + ac.Path
+	if ac.Type == config.AuditLogSyslog {
+		key = ac.Type + ":" + ac.Tag
+	}
+
+	auditLogsMtx.Lock()
+	defer auditLogsMtx.Unlock()
+
+	if al, found := auditLogs[key]; found {
+		return al, nil
+	}
+	var (
+		w   io.Writer
+		err error
+	)
+	if ac.Type == config.AuditLogSyslog {
+		w, err = newSyslogWriter(ac.Tag)
+	} else {
+		w, err = os.OpenFile(ac.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	al := &auditLog{w: w, args: ac.LogArgs}
+	auditLogs[key] = al
+	return al, nil
+}
+
+// write outputs the provided record.
+func (al *auditLog) write(logContext string, record *auditRecord) errors.WithContext {
+	buf, err := json.Marshal(record)
+	if err != nil {
+		return errors.Wrapf(logContext, err, "encoding audit record failed")
+	}
+	buf = append(buf, '\n')
+
+	al.mtx.Lock()
+	defer al.mtx.Unlock()
+	if _, err := al.w.Write(buf); err != nil {
+		return errors.Wrapf(logContext, err, "writing audit record failed")
+	}
+	return nil
+}
+
+// auditScope identifies what initiated a statement: the scrape and, for collector queries, the collector and query.
+type auditScope struct {
+	scrapeID  string
+	collector string
+	query     string
+}
+
+// auditKey is the context key under which the auditScope is stored.
+type auditKey struct{}
+
+// withAuditScope returns a copy of ctx carrying the provided audit scope.
+func withAuditScope(ctx context.Context, scope auditScope) context.Context {
+	return context.WithValue(ctx, auditKey{}, scope)
+}
+
+// auditScopeFrom returns the audit scope carried by ctx, empty if none.
+func auditScopeFrom(ctx context.Context) auditScope {
+	scope, _ := ctx.Value(auditKey{}).(auditScope)
+	return scope
+}
+
+// newScrapeID returns a random identifier for a scrape, to correlate the audit records of all queries it executed.
+func newScrapeID() string {
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(id[:])
+}
+
+// redactDSN returns the provided data source name with passwords replaced by "xxxxx", see
+// config.DataSourceName.Redacted. Invalid data source names are replaced altogether, as there is no telling where their
+// password is.
+func redactDSN(dsn string) string {
+	parsed, err := config.ParseDataSourceName(dsn)
+	if err != nil {
+		return DriverName(dsn) + "://xxxxx"
+	}
+	return parsed.Redacted()
+}
@@ -0,0 +1,431 @@
+package sql_exporter
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"reflect"
+	"time"
+)
+
+// Audited operations, the `op` field of audit records.
+const (
+	auditOpQuery    = "query"
+	auditOpExec     = "exec"
+	auditOpPing     = "ping"
+	auditOpBegin    = "begin"
+	auditOpCommit   = "commit"
+	auditOpRollback = "rollback"
+)
+
+// connAuditor writes audit records for the statements executed on the connections to one data source of a target.
+type connAuditor struct {
+	log           *auditLog
+	job, instance string
+	target        string // data source name, redacted
+	logContext    string
+}
+
+// record writes an audit record for an operation started at start, initiated from ctx. Errors writing the record are
+// logged.
+func (ca *connAuditor) record(
+	ctx context.Context, op, statement string, args []driver.NamedValue, start time.Time, rows int, err error) {
+	scope := auditScopeFrom(ctx)
+	record := &auditRecord{
+		Time:      start.Format(time.RFC3339Nano),
+		ScrapeID:  scope.scrapeID,
+		Job:       ca.job,
+		Instance:  ca.instance,
+		Target:    ca.target,
+		Collector: scope.collector,
+		Query:     scope.query,
+		Op:        op,
+		Statement: statement,
+		Seconds:   time.Since(start).Seconds(),
+		Rows:      rows,
+	}
+	if len(args) > 0 && ca.log.args {
+		record.Args = make([]interface{}, len(args))
+		for i, arg := range args {
+			record.Args[i] = arg.Value
+		}
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	if err := ca.log.write(ca.logContext, record); err != nil {
+		Logf(SeverityError, "%s", err)
+	}
+}
+
+// auditConnector wraps a driver.Connector, auditing everything sent over its connections: statements (as executed,
+// with their arguments), pings and transaction boundaries, no matter whether they run collector queries or e.g. detect
+// target metadata. Optional driver interfaces are passed through.
+type auditConnector struct {
+	driver.Connector
+	auditor *connAuditor
+}
+
+// Connect implements driver.Connector.
+func (c *auditConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &auditConn{conn: conn, auditor: c.auditor}, nil
+}
+
+// auditConn wraps a driver.Conn, see auditConnector.
+type auditConn struct {
+	conn    driver.Conn
+	auditor *connAuditor
+}
+
+// Prepare implements driver.Conn.
+func (c *auditConn) Prepare(query string) (driver.Stmt, error) {
+	return c.PrepareContext(context.Background(), query)
+}
+
+// PrepareContext implements driver.ConnPrepareContext. Preparing isn't audited, executing the statement is.
+func (c *auditConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var (
+		stmt driver.Stmt
+		err  error
+	)
+	if cpc, ok := c.conn.(driver.ConnPrepareContext); ok {
+		stmt, err = cpc.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	as := &auditStmt{stmt: stmt, query: query, auditor: c.auditor}
+	if _, ok := stmt.(driver.ColumnConverter); ok {
+		return &auditStmtConverter{as}, nil
+	}
+	return as, nil
+}
+
+// Close implements driver.Conn.
+func (c *auditConn) Close() error {
+	return c.conn.Close()
+}
+
+// Begin implements driver.Conn.
+func (c *auditConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+// BeginTx implements driver.ConnBeginTx, with the same restrictions as database/sql for drivers not implementing it.
+func (c *auditConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	start := time.Now()
+	var (
+		tx  driver.Tx
+		err error
+	)
+	if cbt, ok := c.conn.(driver.ConnBeginTx); ok {
+		tx, err = cbt.BeginTx(ctx, opts)
+	} else if opts.Isolation != 0 {
+		err = errors.New("sql: driver does not support non-default isolation level")
+	} else if opts.ReadOnly {
+		err = errors.New("sql: driver does not support read-only transactions")
+	} else {
+		tx, err = c.conn.Begin()
+	}
+	c.auditor.record(ctx, auditOpBegin, "", nil, start, 0, err)
+	if err != nil {
+		return nil, err
+	}
+	return &auditTx{tx: tx, ctx: ctx, auditor: c.auditor}, nil
+}
+
+// QueryContext implements driver.QueryerContext. If the driver doesn't, database/sql prepares the query instead.
+func (c *auditConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	qc, ok := c.conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	rows, err := qc.QueryContext(ctx, query, args)
+	if err == driver.ErrSkip {
+		return nil, err
+	}
+	return auditRows(ctx, c.auditor, query, args, start, rows, err)
+}
+
+// ExecContext implements driver.ExecerContext. If the driver doesn't, database/sql prepares the statement instead.
+func (c *auditConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	ec, ok := c.conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	result, err := ec.ExecContext(ctx, query, args)
+	if err != driver.ErrSkip {
+		c.auditor.record(ctx, auditOpExec, query, args, start, 0, err)
+	}
+	return result, err
+}
+
+// Ping implements driver.Pinger.
+func (c *auditConn) Ping(ctx context.Context) error {
+	p, ok := c.conn.(driver.Pinger)
+	if !ok {
+		return nil
+	}
+	start := time.Now()
+	err := p.Ping(ctx)
+	c.auditor.record(ctx, auditOpPing, "", nil, start, 0, err)
+	return err
+}
+
+// ResetSession implements driver.SessionResetter.
+func (c *auditConn) ResetSession(ctx context.Context) error {
+	if sr, ok := c.conn.(driver.SessionResetter); ok {
+		return sr.ResetSession(ctx)
+	}
+	return nil
+}
+
+// IsValid implements driver.Validator.
+func (c *auditConn) IsValid() bool {
+	if v, ok := c.conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+// CheckNamedValue implements driver.NamedValueChecker, falling back to the default conversion if the driver doesn't.
+func (c *auditConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if nvc, ok := c.conn.(driver.NamedValueChecker); ok {
+		return nvc.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+// auditStmt wraps a driver.Stmt, see auditConnector.
+type auditStmt struct {
+	stmt    driver.Stmt
+	query   string
+	auditor *connAuditor
+}
+
+// auditStmtConverter is an auditStmt of a driver.Stmt implementing driver.ColumnConverter.
+type auditStmtConverter struct {
+	*auditStmt
+}
+
+// ColumnConverter implements driver.ColumnConverter.
+func (s *auditStmtConverter) ColumnConverter(idx int) driver.ValueConverter {
+	return s.stmt.(driver.ColumnConverter).ColumnConverter(idx)
+}
+
+// Close implements driver.Stmt.
+func (s *auditStmt) Close() error {
+	return s.stmt.Close()
+}
+
+// NumInput implements driver.Stmt.
+func (s *auditStmt) NumInput() int {
+	return s.stmt.NumInput()
+}
+
+// Exec implements driver.Stmt.
+func (s *auditStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.ExecContext(context.Background(), valuesToNamedValues(args))
+}
+
+// Query implements driver.Stmt.
+func (s *auditStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.QueryContext(context.Background(), valuesToNamedValues(args))
+}
+
+// ExecContext implements driver.StmtExecContext.
+func (s *auditStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	var (
+		result driver.Result
+		err    error
+	)
+	if sec, ok := s.stmt.(driver.StmtExecContext); ok {
+		result, err = sec.ExecContext(ctx, args)
+	} else {
+		var values []driver.Value
+		if values, err = namedValuesToValues(args); err == nil {
+			result, err = s.stmt.Exec(values)
+		}
+	}
+	s.auditor.record(ctx, auditOpExec, s.query, args, start, 0, err)
+	return result, err
+}
+
+// QueryContext implements driver.StmtQueryContext.
+func (s *auditStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	var (
+		rows driver.Rows
+		err  error
+	)
+	if sqc, ok := s.stmt.(driver.StmtQueryContext); ok {
+		rows, err = sqc.QueryContext(ctx, args)
+	} else {
+		var values []driver.Value
+		if values, err = namedValuesToValues(args); err == nil {
+			rows, err = s.stmt.Query(values)
+		}
+	}
+	return auditRows(ctx, s.auditor, s.query, args, start, rows, err)
+}
+
+// valuesToNamedValues converts positional arguments to named values.
+func valuesToNamedValues(args []driver.Value) []driver.NamedValue {
+	nvs := make([]driver.NamedValue, len(args))
+	for i, v := range args {
+		nvs[i] = driver.NamedValue{Ordinal: i + 1, Value: v}
+	}
+	return nvs
+}
+
+// namedValuesToValues converts named values to positional arguments, for drivers not supporting named arguments.
+func namedValuesToValues(args []driver.NamedValue) ([]driver.Value, error) {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		if arg.Name != "" {
+			return nil, errors.New("sql: driver does not support the use of Named Parameters")
+		}
+		values[i] = arg.Value
+	}
+	return values, nil
+}
+
+// auditTx wraps a driver.Tx, see auditConnector.
+type auditTx struct {
+	tx      driver.Tx
+	ctx     context.Context // the transaction's context, for its audit scope
+	auditor *connAuditor
+}
+
+// Commit implements driver.Tx.
+func (tx *auditTx) Commit() error {
+	start := time.Now()
+	err := tx.tx.Commit()
+	tx.auditor.record(tx.ctx, auditOpCommit, "", nil, start, 0, err)
+	return err
+}
+
+// Rollback implements driver.Tx.
+func (tx *auditTx) Rollback() error {
+	start := time.Now()
+	err := tx.tx.Rollback()
+	tx.auditor.record(tx.ctx, auditOpRollback, "", nil, start, 0, err)
+	return err
+}
+
+// auditRows returns rows, wrapped so that the query is audited once they are closed (along with the number of rows
+// read). If the query failed, it is audited right away.
+func auditRows(ctx context.Context, auditor *connAuditor, query string, args []driver.NamedValue, start time.Time,
+	rows driver.Rows, err error) (driver.Rows, error) {
+	if err != nil {
+		auditor.record(ctx, auditOpQuery, query, args, start, 0, err)
+		return nil, err
+	}
+	return &auditedRows{rows: rows, ctx: ctx, auditor: auditor, query: query, args: args, start: start}, nil
+}
+
+// auditedRows wraps a driver.Rows, see auditRows. The optional column type interfaces are passed through, returning
+// what database/sql defaults to for drivers not implementing them.
+type auditedRows struct {
+	rows    driver.Rows
+	ctx     context.Context
+	auditor *connAuditor
+	query   string
+	args    []driver.NamedValue
+	start   time.Time
+	n       int   // number of rows read
+	err     error // first error reading rows, other than io.EOF
+	closed  bool
+}
+
+// Columns implements driver.Rows.
+func (r *auditedRows) Columns() []string {
+	return r.rows.Columns()
+}
+
+// Close implements driver.Rows.
+func (r *auditedRows) Close() error {
+	err := r.rows.Close()
+	if !r.closed {
+		r.closed = true
+		r.auditor.record(r.ctx, auditOpQuery, r.query, r.args, r.start, r.n, r.err)
+	}
+	return err
+}
+
+// Next implements driver.Rows.
+func (r *auditedRows) Next(dest []driver.Value) error {
+	err := r.rows.Next(dest)
+	if err == nil {
+		r.n++
+	} else if err != io.EOF && r.err == nil {
+		r.err = err
+	}
+	return err
+}
+
+// HasNextResultSet implements driver.RowsNextResultSet.
+func (r *auditedRows) HasNextResultSet() bool {
+	if nrs, ok := r.rows.(driver.RowsNextResultSet); ok {
+		return nrs.HasNextResultSet()
+	}
+	return false
+}
+
+// NextResultSet implements driver.RowsNextResultSet.
+func (r *auditedRows) NextResultSet() error {
+	if nrs, ok := r.rows.(driver.RowsNextResultSet); ok {
+		return nrs.NextResultSet()
+	}
+	return io.EOF
+}
+
+// ColumnTypeScanType implements driver.RowsColumnTypeScanType.
+func (r *auditedRows) ColumnTypeScanType(index int) reflect.Type {
+	if ct, ok := r.rows.(driver.RowsColumnTypeScanType); ok {
+		return ct.ColumnTypeScanType(index)
+	}
+	return reflect.TypeOf(new(interface{})).Elem()
+}
+
+// ColumnTypeDatabaseTypeName implements driver.RowsColumnTypeDatabaseTypeName.
+func (r *auditedRows) ColumnTypeDatabaseTypeName(index int) string {
+	if ct, ok := r.rows.(driver.RowsColumnTypeDatabaseTypeName); ok {
+		return ct.ColumnTypeDatabaseTypeName(index)
+	}
+	return ""
+}
+
+// ColumnTypeLength implements driver.RowsColumnTypeLength.
+func (r *auditedRows) ColumnTypeLength(index int) (int64, bool) {
+	if ct, ok := r.rows.(driver.RowsColumnTypeLength); ok {
+		return ct.ColumnTypeLength(index)
+	}
+	return 0, false
+}
+
+// ColumnTypeNullable implements driver.RowsColumnTypeNullable.
+func (r *auditedRows) ColumnTypeNullable(index int) (bool, bool) {
+	if ct, ok := r.rows.(driver.RowsColumnTypeNullable); ok {
+		return ct.ColumnTypeNullable(index)
+	}
+	return false, false
+}
+
+// ColumnTypePrecisionScale implements driver.RowsColumnTypePrecisionScale.
+func (r *auditedRows) ColumnTypePrecisionScale(index int) (int64, int64, bool) {
+	if ct, ok := r.rows.(driver.RowsColumnTypePrecisionScale); ok {
+		return ct.ColumnTypePrecisionScale(index)
+	}
+	return 0, 0, false
+}
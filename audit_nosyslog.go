@@ -0,0 +1,15 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package sql_exporter
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+)
+
+// newSyslogWriter returns an error, syslog is not supported on this platform.
+func newSyslogWriter(tag string) (io.Writer, error) {
+	return nil, fmt.Errorf("syslog audit log not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,14 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package sql_exporter
+
+import (
+	"io"
+	"log/syslog"
+)
+
+// newSyslogWriter returns a writer sending every write to the local syslog daemon as one message, with the provided tag.
+func newSyslogWriter(tag string) (io.Writer, error) {
+	return syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+}
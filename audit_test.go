@@ -0,0 +1,74 @@
+package sql_exporter
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	for _, logArgs := range []bool{false, true} {
+		path := filepath.ToSlash(filepath.Join(t.TempDir(), "audit.log"))
+		e := newTestExporter(t, testResults, fmt.Sprintf(`
+global:
+  audit_log:
+    path: '%s'
+    log_args: %t
+jobs:
+  - job_name: pg
+    collectors: [pg_database]
+    static_configs:
+      - targets:
+          db1: 'RESULTS'
+collectors:
+  - collector_name: pg_database
+    metrics:
+      - metric_name: pg_xact_commit_total
+        type: counter
+        help: 'Committed transactions.'
+        key_labels: [datname]
+        values: [xact_commit]
+        query_ref: xact
+    queries:
+      - query_name: xact
+        query: SELECT datname, xact_commit FROM pg_stat_database WHERE xact_commit >= :min
+        params:
+          min: '0'
+`, path, logArgs))
+		if _, err := gatherText(t, e); err != nil {
+			t.Fatalf("unexpected scrape error: %s", err)
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var records []auditRecord
+		for s := bufio.NewScanner(f); s.Scan(); {
+			var r auditRecord
+			if err := json.Unmarshal(s.Bytes(), &r); err != nil {
+				t.Fatalf("invalid audit record %q: %s", s.Text(), err)
+			}
+			records = append(records, r)
+		}
+		f.Close()
+		// The statement is recorded as executed, with its arguments only if log_args is set.
+		if len(records) != 1 {
+			t.Fatalf("expected 1 audit record, got %+v", records)
+		}
+		r := records[0]
+		if r.Op != auditOpQuery || r.Job != "pg" || r.Instance != "db1" || r.Collector != "pg_database" ||
+			r.Query != "xact" || r.Statement != "SELECT datname, xact_commit FROM pg_stat_database WHERE xact_commit >= ?" ||
+			r.Rows != 2 || r.ScrapeID == "" || r.Error != "" {
+			t.Errorf("unexpected audit record %+v", r)
+		}
+		if logArgs && (len(r.Args) != 1 || r.Args[0] != "0") {
+			t.Errorf("expected args [0] with log_args, got %v", r.Args)
+		} else if !logArgs && r.Args != nil {
+			t.Errorf("expected no args without log_args, got %v", r.Args)
+		}
+	}
+}
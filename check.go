@@ -0,0 +1,105 @@
+package sql_exporter
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/free/sql_exporter/config"
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	checkViolationsName = "sql_check_violations"
+	checkViolationsHelp = "Number of rows violating the check."
+)
+
+// CheckFamily evaluates a check from SQL query result rows: every row is a violation. Violations are counted per
+// distinct combination of annotation values, exported as `sql_check_violations`.
+type CheckFamily struct {
+	config *config.CheckConfig
+	desc   MetricDesc
+	// Labels of the family besides const labels and `check`: the annotations of all checks, see
+	// config.GlobalConfig.CheckAnnotations. Only those of this check are populated, the others are left empty.
+	labels []string
+	// Index in labels of each of the check's annotations.
+	indexes []int
+}
+
+// NewCheckFamily creates a new CheckFamily with the given check config and const labels (e.g. job and instance). All
+// check families share the same help text and labels, annotations being those of all checks (a superset of the
+// check's own), so that they may be exported together as one metric family.
+func NewCheckFamily(
+	logContext string, cc *config.CheckConfig, constLabels []*dto.LabelPair, annotations []string) *CheckFamily {
+	logContext = fmt.Sprintf("%s, check=%q", logContext, cc.Name)
+
+	labelPairs := append(constLabels[:0:0], constLabels...)
+	labelPairs = append(labelPairs, &dto.LabelPair{
+		Name:  proto.String("check"),
+		Value: proto.String(cc.Name),
+	})
+	sort.Sort(labelPairSorter(labelPairs))
+
+	labels := annotations
+	indexes := make([]int, len(cc.Annotations))
+	for i, a := range cc.Annotations {
+		indexes[i] = -1
+		for j, l := range labels {
+			if l == a {
+				indexes[i] = j
+			}
+		}
+		// Not expected with a loaded config, but don't lose the annotation.
+		if indexes[i] < 0 {
+			labels = append(labels[:len(labels):len(labels)], a)
+			indexes[i] = len(labels) - 1
+		}
+	}
+
+	return &CheckFamily{
+		config: cc,
+		desc: NewAutomaticMetricDesc(
+			logContext, checkViolationsName, checkViolationsHelp, prometheus.GaugeValue, labelPairs, labels...),
+		labels:  labels,
+		indexes: indexes,
+	}
+}
+
+// checkViolations counts the violations of a check during one collection, keyed by annotation values.
+type checkViolations struct {
+	counts map[string]float64
+	values map[string][]string
+}
+
+// newViolations returns an empty violation count for the check.
+func (cf *CheckFamily) newViolations() *checkViolations {
+	return &checkViolations{
+		counts: make(map[string]float64),
+		values: make(map[string][]string),
+	}
+}
+
+// Add records a violation, from a query output map.
+func (cf *CheckFamily) Add(v *checkViolations, row map[string]interface{}) {
+	values := make([]string, len(cf.labels))
+	for i, a := range cf.config.Annotations {
+		values[cf.indexes[i]] = row[a].(string)
+	}
+	key := strings.Join(values, "\xff")
+	v.counts[key]++
+	v.values[key] = values
+}
+
+// Collect exports the violations. Without any violations, a single zero value series is exported (with empty
+// annotations) so that the check is visibly passing rather than absent.
+func (cf *CheckFamily) Collect(v *checkViolations, ch chan<- Metric) {
+	if len(v.counts) == 0 {
+		ch <- NewMetric(cf.desc, 0, make([]string, len(cf.labels))...)
+		return
+	}
+	for key, count := range v.counts {
+		ch <- NewMetric(cf.desc, count, v.values[key]...)
+	}
+}
@@ -0,0 +1,48 @@
+package sql_exporter
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var queryResultChecksum = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "sql_exporter_query_result_checksum",
+	Help: "Checksum of the full result set of the last complete execution of the query on the target, independent " +
+		"of row order. Only exported for queries with result_checksum enabled.",
+}, []string{"job", "instance", "collector", "query"})
+
+func init() {
+	prometheus.MustRegister(queryResultChecksum)
+}
+
+// newQueryChecksum returns the result checksum gauge of the named query of the named collector, running on the target
+// identified by constLabels (job and instance).
+func newQueryChecksum(constLabels []*dto.LabelPair, collector, query string) prometheus.Gauge {
+	job, instance := jobAndInstance(constLabels)
+	return queryResultChecksum.WithLabelValues(job, instance, collector, query)
+}
+
+// rowChecksum returns a hash of all columns of a result row. Row checksums are summed into the result checksum, so
+// that it does not depend on row order but still changes if a row is duplicated or removed.
+func rowChecksum(row map[string]interface{}) uint64 {
+	columns := make([]string, 0, len(row))
+	for column := range row {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+	h := fnv.New64a()
+	for _, column := range columns {
+		fmt.Fprintf(h, "%s\x00%v\x00", column, row[column])
+	}
+	return h.Sum64()
+}
+
+// checksumValue converts a result checksum to a gauge value, keeping its 53 most significant bits so that it is
+// exactly representable as a float64.
+func checksumValue(sum uint64) float64 {
+	return float64(sum >> 11)
+}
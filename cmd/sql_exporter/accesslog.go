@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/free/sql_exporter/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var accessLog = kingpin.Flag("web.access-log",
+	"Log every HTTP request: client, method, path, status and duration.").Bool()
+
+var scrapeRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "sql_exporter_scrape_requests_total",
+	Help: "Number of requests for the metrics path, by client: the verified client certificate's common name, if any, " +
+		"else the client IP address.",
+}, []string{"client"})
+
+func init() {
+	prometheus.MustRegister(scrapeRequests)
+}
+
+// AccessLogHandlerFor returns an http.Handler counting requests for metricsPath by client and, if --web.access-log is
+// set, logging every request, before passing it on to h. Meant to tell apart multiple Prometheus servers scraping the
+// same exporter, e.g. when overlapping scrapes occasionally double the load on the database.
+func AccessLogHandlerFor(metricsPath string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		client := clientOf(req)
+		if req.URL.Path == metricsPath {
+			scrapeRequests.WithLabelValues(client).Inc()
+		}
+		if !*accessLog {
+			h.ServeHTTP(w, req)
+			return
+		}
+
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(sw, req)
+		log.Infof("%s %s %s %d %.3fs %q timeout=%q", client, req.Method, req.URL.RequestURI(), sw.status,
+			time.Since(start).Seconds(), req.UserAgent(), req.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"))
+	})
+}
+
+// clientOf identifies the client making req: by the common name of its verified certificate, if any, else by its IP.
+func clientOf(req *http.Request) string {
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 && len(req.TLS.VerifiedChains[0]) > 0 {
+		if cn := req.TLS.VerifiedChains[0][0].Subject.CommonName; cn != "" {
+			return cn
+		}
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// statusWriter is an http.ResponseWriter recording the response status code.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
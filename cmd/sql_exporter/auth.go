@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/free/sql_exporter/config"
+)
+
+// AuthHandlerFor returns an http.Handler requiring the bearer token or basic auth credentials configured in wc before
+// passing requests on to h. It returns h itself if wc is nil or configures neither.
+func AuthHandlerFor(wc *config.WebConfig, h http.Handler) http.Handler {
+	switch {
+	case wc == nil:
+		return h
+	case wc.BearerToken != "":
+		expected := []byte("Bearer " + string(wc.BearerToken))
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if subtle.ConstantTimeCompare([]byte(req.Header.Get("Authorization")), expected) != 1 {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			h.ServeHTTP(w, req)
+		})
+	case wc.BasicAuth != nil:
+		username, password := []byte(wc.BasicAuth.Username), []byte(wc.BasicAuth.Password)
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			u, p, ok := req.BasicAuth()
+			// Compare both, so the response time doesn't tell whether the username was right.
+			userOK := subtle.ConstantTimeCompare([]byte(u), username) == 1
+			passOK := subtle.ConstantTimeCompare([]byte(p), password) == 1
+			if !ok || !userOK || !passOK {
+				w.Header().Set("WWW-Authenticate", `Basic realm="sql_exporter", charset="UTF-8"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			h.ServeHTTP(w, req)
+		})
+	}
+	return h
+}
@@ -0,0 +1,26 @@
+//go:build zstd
+// +build zstd
+
+package main
+
+import (
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Builds with the zstd tag (such as release builds, see .promu.yml) prefer zstd over gzip.
+func init() {
+	compressors = append([]compressor{{"zstd", newZstdWriter}}, compressors...)
+}
+
+// newZstdWriter returns a zstd compressing writer, using the fastest compression level: expositions are compressed on
+// every scrape.
+func newZstdWriter(w io.Writer) io.WriteCloser {
+	zw, err := zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedFastest))
+	if err != nil {
+		// Only possible with invalid options.
+		panic(err)
+	}
+	return zw
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"html/template"
+	"io"
 	"net/http"
 
 	"github.com/free/sql_exporter"
@@ -28,6 +30,8 @@ const (
           h1, h2 { font-weight: 500; }
           a { color: #337ab7; }
           a:hover, a:focus { color: #23527c; }
+          table { border-collapse: collapse; }
+          th, td { padding: 5px 15px 5px 0; text-align: left; border-bottom: 1px solid #ddd; }
         </style>
       </head>
       <body>
@@ -35,6 +39,7 @@ const (
           <div class="navbar-header"><a href="/">Prometheus SQL Exporter</a></div>
           <div><a href="{{ .MetricsPath }}">Metrics</a></div>
           <div><a href="/config">Configuration</a></div>
+          <div><a href="/targets">Targets</a></div>
           <div><a href="/debug/pprof">Profiling</a></div>
           <div><a href="{{ .DocsUrl }}">Help</a></div>
         </div>
@@ -49,10 +54,123 @@ const (
     {{- end }}
 
     {{ define "content.config" -}}
+      {{- if .ShowWarnings }}
+      <h2>Warnings</h2>
+      {{- if .Warnings }}
+      <ul>
+        {{- range .Warnings }}
+        <li>{{ . }}</li>
+        {{- end }}
+      </ul>
+      {{- else }}
+      <p>None.</p>
+      {{- end }}
+      {{- end }}
       <h2>Configuration</h2>
       <pre>{{ .Config }}</pre>
     {{- end }}
 
+    {{ define "content.targets" -}}
+      <h2>Targets</h2>
+      <table>
+        <tr><th>Job</th><th>Instance</th><th>Source</th><th>State</th></tr>
+        {{- range .Targets }}
+        <tr>
+          <td>{{ .Job }}</td>
+          <td>{{ .Instance }}</td>
+          <td>{{ if .Dynamic }}admin API{{ else }}configuration{{ end }}</td>
+          <td>{{ template "pause" . }}</td>
+        </tr>
+        {{- end }}
+      </table>
+      <h2>Collectors</h2>
+      <table>
+        <tr><th>Name</th><th>State</th></tr>
+        {{- range .Collectors }}
+        <tr>
+          <td>{{ .Name }}</td>
+          <td>{{ template "pause" . }}</td>
+        </tr>
+        {{- end }}
+      </table>
+      <h2>Largest collectors</h2>
+      <table>
+        <tr><th>Job</th><th>Target</th><th>Collector</th><th>Samples</th><th>Bytes</th></tr>
+        {{- range .Sizes }}
+        <tr>
+          <td>{{ .Job }}</td>
+          <td>{{ .Instance }}</td>
+          <td>{{ .Collector }}</td>
+          <td>{{ .Samples }}</td>
+          <td>{{ .Bytes }}</td>
+        </tr>
+        {{- end }}
+      </table>
+      <h2>Recent errors</h2>
+      <table>
+        <tr><th>Time</th><th>Count</th><th>Job</th><th>Target</th><th>Collector</th><th>Query</th><th>Error</th></tr>
+        {{- range .Errors }}
+        <tr>
+          <td>{{ .Time.Format "2006-01-02 15:04:05 MST" }}</td>
+          <td>{{ .Count }}</td>
+          <td>{{ .Job }}</td>
+          <td>{{ .Target }}</td>
+          <td>{{ .Collector }}</td>
+          <td>{{ .Query }}</td>
+          <td>{{ .Error }}</td>
+        </tr>
+        {{- end }}
+      </table>
+    {{- end }}
+
+    {{ define "content.preview" -}}
+      <h2>Preview collector</h2>
+      <p>Runs a collector or single metric definition once on a target and shows the resulting samples, without changing
+        the configuration. Requires the admin API token.</p>
+      <form id="preview">
+        <p>
+          <select name="target">
+            {{- range .Targets }}
+            <option value="{{ .Job }}/{{ .Instance }}">{{ if .Job }}{{ .Job }}/{{ end }}{{ .Instance }}</option>
+            {{- end }}
+          </select>
+          Timeout <input name="timeout" value="10s" size="5">
+          Row limit <input name="limit" size="5">
+          <label><input type="checkbox" name="explain"> Explain</label>
+          Admin token <input type="password" name="token">
+          <button type="submit">Run</button>
+        </p>
+        <textarea name="definition" rows="20" cols="120" placeholder="metric_name: ...&#10;type: gauge&#10;help: ...&#10;values: [...]&#10;query: ..."></textarea>
+      </form>
+      <pre id="result"></pre>
+      <script>
+        document.getElementById("preview").addEventListener("submit", function(e) {
+          e.preventDefault();
+          var f = e.target, sep = f.target.value.indexOf("/");
+          var params = new URLSearchParams({job: f.target.value.slice(0, sep), target: f.target.value.slice(sep + 1),
+            timeout: f.timeout.value, limit: f.limit.value, explain: f.explain.checked});
+          var result = document.getElementById("result");
+          result.textContent = "Running...";
+          fetch("/api/v1/preview?" + params, {method: "POST", body: f.definition.value,
+              headers: {"Authorization": "Bearer " + f.token.value}})
+            .then(function(resp) { return resp.ok ? resp.json() : resp.text().then(function(t) { throw t; }); })
+            .then(function(p) {
+              var out = p.samples;
+              if (p.errors) { out += "\n# Errors:\n" + p.errors.join("\n"); }
+              for (var q in p.plans || {}) { out += "\n# Plan of query " + q + ":\n" + p.plans[q]; }
+              result.textContent = out + "\n# " + p.metrics + " samples in " + p.seconds.toFixed(3) + "s";
+            })
+            .catch(function(err) { result.textContent = "Error: " + err; });
+        });
+      </script>
+    {{- end }}
+
+    {{ define "pause" -}}
+      {{ if .Paused -}}
+        paused{{ if not .PausedUntil.IsZero }} until {{ .PausedUntil.Format "2006-01-02 15:04:05 MST" }}{{ end }}
+      {{- else }}active{{ end }}
+    {{- end }}
+
     {{ define "content.error" -}}
       <h2>Error</h2>
       <pre>{{ .Err }}</pre>
@@ -65,17 +183,27 @@ type tdata struct {
 	DocsUrl     string
 
 	// `/config` only
-	Config string
+	Config       string
+	ShowWarnings bool     // whether to list Warnings, i.e. `/config?warnings=1`
+	Warnings     []string // problems found when loading the configuration, see config.Config.Warnings()
+
+	// `/targets` and `/preview` only
+	Targets    []sql_exporter.TargetStatus
+	Collectors []sql_exporter.CollectorStatus
+	Errors     []sql_exporter.ScrapeError
+	Sizes      []sql_exporter.CollectorSize
 
 	// `/error` only
 	Err error
 }
 
 var (
-	allTemplates   = template.Must(template.New("").Parse(templates))
-	homeTemplate   = pageTemplate("home")
-	configTemplate = pageTemplate("config")
-	errorTemplate  = pageTemplate("error")
+	allTemplates    = template.Must(template.New("").Parse(templates))
+	homeTemplate    = pageTemplate("home")
+	configTemplate  = pageTemplate("config")
+	targetsTemplate = pageTemplate("targets")
+	previewTemplate = pageTemplate("preview")
+	errorTemplate   = pageTemplate("error")
 )
 
 func pageTemplate(name string) *template.Template {
@@ -86,29 +214,102 @@ func pageTemplate(name string) *template.Template {
 // HomeHandlerFunc is the HTTP handler for the home page (`/`).
 func HomeHandlerFunc(metricsPath string) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		homeTemplate.Execute(w, &tdata{
+		servePage(w, r, homeTemplate, &tdata{
 			MetricsPath: metricsPath,
 			DocsUrl:     docsUrl,
 		})
 	}
 }
 
-// ConfigHandlerFunc is the HTTP handler for the `/config` page. It outputs the configuration marshaled in YAML format.
+// ConfigHandlerFunc is the HTTP handler for the `/config` page. It outputs the configuration marshaled in YAML format,
+// preceded by the configuration warnings if the `warnings=1` URL parameter is set.
 func ConfigHandlerFunc(metricsPath string, exporter sql_exporter.Exporter) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		config, err := exporter.Config().YAML()
+		data, err := configPageData(metricsPath, exporter, r.URL.Query().Get("warnings") == "1")
 		if err != nil {
 			HandleError(err, metricsPath, w, r)
 			return
 		}
-		configTemplate.Execute(w, &tdata{
+		servePage(w, r, configTemplate, data)
+	}
+}
+
+// configPageData returns the data the `/config` page is rendered from, listing the configuration warnings first if
+// showWarnings is true.
+func configPageData(metricsPath string, exporter sql_exporter.Exporter, showWarnings bool) (*tdata, error) {
+	config, err := exporter.Config().YAML()
+	if err != nil {
+		return nil, err
+	}
+	return &tdata{
+		MetricsPath:  metricsPath,
+		DocsUrl:      docsUrl,
+		Config:       string(config),
+		ShowWarnings: showWarnings,
+		Warnings:     exporter.Config().Warnings(),
+	}, nil
+}
+
+// TargetsHandlerFunc is the HTTP handler for the `/targets` page. It outputs the runtime state of all targets and
+// collectors, e.g. whether paused via the admin API, and the most recent scrape errors.
+func TargetsHandlerFunc(metricsPath string, exporter sql_exporter.Exporter) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		servePage(w, r, targetsTemplate, targetsPageData(metricsPath, exporter, *topCollectors))
+	}
+}
+
+// targetsPageData returns the data the `/targets` page is rendered from, listing the topCollectors largest collectors
+// (all of them if not positive).
+func targetsPageData(metricsPath string, exporter sql_exporter.Exporter, topCollectors int) *tdata {
+	return &tdata{
+		MetricsPath: metricsPath,
+		DocsUrl:     docsUrl,
+		Targets:     exporter.TargetStatus(),
+		Collectors:  exporter.CollectorStatus(),
+		Errors:      exporter.RecentErrors(),
+		Sizes:       topCollectorSizes(exporter.CollectorSizes(), topCollectors),
+	}
+}
+
+// PreviewHandlerFunc is the HTTP handler for the `/preview` page. It lets an operator run a collector definition once on a
+// target, via the admin API, and shows the resulting samples.
+func PreviewHandlerFunc(metricsPath string, exporter sql_exporter.Exporter) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		servePage(w, r, previewTemplate, &tdata{
 			MetricsPath: metricsPath,
 			DocsUrl:     docsUrl,
-			Config:      string(config),
+			Targets:     exporter.TargetStatus(),
 		})
 	}
 }
 
+// renderPage renders the page template t from data into w. Pages are deterministic given their data, so they may be
+// rendered from a fixture exporter and compared with previously rendered (golden) pages, see testdata/.
+func renderPage(w io.Writer, t *template.Template, data *tdata) error {
+	return t.Execute(w, data)
+}
+
+// servePage renders the page template t from data and writes it to w. The page is rendered into a buffer first, so
+// that template errors (e.g. a field no longer defined) are served as errors rather than a silently truncated page.
+func servePage(w http.ResponseWriter, r *http.Request, t *template.Template, data *tdata) {
+	var buf bytes.Buffer
+	if err := renderPage(&buf, t, data); err != nil {
+		sql_exporter.Logf(sql_exporter.SeverityError, "Error rendering %s: %s", r.URL.Path, err)
+		HandleError(err, data.MetricsPath, w, r)
+		return
+	}
+	w.Header().Set(contentTypeHeader, "text/html; charset=utf-8")
+	buf.WriteTo(w)
+}
+
+// topCollectorSizes returns the first n of sizes, all of them if n is not positive.
+func topCollectorSizes(sizes []sql_exporter.CollectorSize, n int) []sql_exporter.CollectorSize {
+	if n > 0 && len(sizes) > n {
+		return sizes[:n]
+	}
+	return sizes
+}
+
 // HandleError is an error handler that other handlers defer to in case of error. It is important to not have written
 // anything to w before calling HandleError(), or the 500 status code won't be set (and the content might be mixed up).
 func HandleError(err error, metricsPath string, w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/free/sql_exporter"
+	"github.com/free/sql_exporter/config"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var (
+	diffCmd = kingpin.Command("diff",
+		"Compare the metric names and label sets produced with old and new collector files, e.g. a collector bundle "+
+			"upgrade.")
+	diffOldFiles = diffCmd.Flag("old",
+		"Old collector files (comma separated globs or URLs, as in collector_files).").Required().String()
+	diffNewFiles = diffCmd.Flag("new",
+		"New collector files (comma separated globs or URLs, as in collector_files).").Required().String()
+	diffJob      = diffCmd.Flag("job", "Only compare the series of this job, in jobs mode.").String()
+	diffInstance = diffCmd.Flag("target", "Only compare the series of this target (instance name), in jobs mode.").String()
+	diffTimeout  = diffCmd.Flag("timeout", "Timeout of each scrape.").Default("30s").Duration()
+)
+
+// seriesSignature identifies a set of series by metric name and label names, e.g. `pg_locks{datname,mode}`.
+type seriesSignature string
+
+// diff implements the `diff` subcommand: it scrapes the exporter configured in configFile twice, once with the old
+// collector files and once with the new ones (replacing collector_files), and prints which metric names and label sets
+// only one of them produced, to tell whether upgrading a collector bundle renames series. It returns the exit code:
+// exitOK if both produced the same metric names and label sets, exitError if not.
+func diff(configFile string) int {
+	scrape := func(collectorFiles string) (map[seriesSignature]int, int) {
+		c, err := config.LoadWithCollectorFiles(configFile, strings.Split(collectorFiles, ","))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading configuration with collector files %s: %s\n", collectorFiles, err)
+			return nil, exitConfig
+		}
+		exporter, err := sql_exporter.New(c)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating exporter with collector files %s: %s\n", collectorFiles, err)
+			return nil, exporterExitCode(err)
+		}
+		defer exporter.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), *diffTimeout)
+		defer cancel()
+		mfs, err := exporter.GatherContext(ctx)
+		if err != nil {
+			// Partial results are still worth comparing, if the errors are the same for both.
+			fmt.Fprintf(os.Stderr, "Errors scraping with collector files %s:\n%s\n", collectorFiles, err)
+		}
+		return seriesSignatures(mfs, *diffJob, *diffInstance), exitOK
+	}
+	oldSeries, code := scrape(*diffOldFiles)
+	if code != exitOK {
+		return code
+	}
+	newSeries, code := scrape(*diffNewFiles)
+	if code != exitOK {
+		return code
+	}
+
+	signatures := make([]seriesSignature, 0, len(oldSeries)+len(newSeries))
+	for s := range oldSeries {
+		signatures = append(signatures, s)
+	}
+	for s := range newSeries {
+		if _, found := oldSeries[s]; !found {
+			signatures = append(signatures, s)
+		}
+	}
+	sort.Slice(signatures, func(i, j int) bool { return signatures[i] < signatures[j] })
+
+	changed := 0
+	for _, s := range signatures {
+		oldCount, inOld := oldSeries[s]
+		newCount, inNew := newSeries[s]
+		switch {
+		case !inNew:
+			fmt.Printf("- %s (%d series)\n", s, oldCount)
+		case !inOld:
+			fmt.Printf("+ %s (%d series)\n", s, newCount)
+		default:
+			continue
+		}
+		changed++
+	}
+	fmt.Printf("%d metric name and label sets removed or added, %d unchanged.\n",
+		changed, len(signatures)-changed)
+	if changed > 0 {
+		return exitError
+	}
+	return exitOK
+}
+
+// seriesSignatures returns the number of series in mfs by signature (metric name and label names), only counting
+// series with the given job and instance labels, if not empty.
+func seriesSignatures(mfs []*dto.MetricFamily, job, instance string) map[seriesSignature]int {
+	signatures := make(map[seriesSignature]int)
+	for _, mf := range mfs {
+	series:
+		for _, m := range mf.Metric {
+			names := make([]string, 0, len(m.Label))
+			for _, lp := range m.Label {
+				switch {
+				case lp.GetName() == "job" && job != "" && lp.GetValue() != job:
+					continue series
+				case lp.GetName() == "instance" && instance != "" && lp.GetValue() != instance:
+					continue series
+				}
+				names = append(names, lp.GetName())
+			}
+			sort.Strings(names)
+			signatures[seriesSignature(mf.GetName()+"{"+strings.Join(names, ",")+"}")]++
+		}
+	}
+	return signatures
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/free/sql_exporter"
+	"github.com/free/sql_exporter/log"
+)
+
+// Process exit codes, distinct per category of fatal error so that service managers may react differently, e.g. not
+// restart in a loop on configuration errors but do restart on a port conflict.
+const (
+	exitOK     = 0
+	exitError  = 1 // any other error, e.g. lint problems or a failed connectivity test
+	exitUsage  = 2 // invalid command line flags or arguments, same as the flag package
+	exitConfig = 3 // the configuration could not be loaded or is invalid
+	exitListen = 4 // the web listener failed, e.g. address already in use or unreadable TLS certificates
+)
+
+// Categories of fatal errors, reported along with the exit code, see fatal.
+var exitCategories = map[int]string{
+	exitError:  "error",
+	exitUsage:  "usage",
+	exitConfig: "config",
+	exitListen: "listen",
+}
+
+// fatal logs err and exits with the given code, after writing a machine-readable line describing the failure to
+// stderr: a JSON object with `fatal` (the category), `exit_code` and `error` fields.
+func fatal(code int, err error) {
+	log.Errorf("Fatal %s error: %s", exitCategories[code], err)
+	line, _ := json.Marshal(struct {
+		Category string `json:"fatal"`
+		ExitCode int    `json:"exit_code"`
+		Error    string `json:"error"`
+	}{exitCategories[code], code, err.Error()})
+	fmt.Fprintln(os.Stderr, string(line))
+	os.Exit(code)
+}
+
+// exporterExitCode returns the exit code for an error returned by sql_exporter.NewExporter: exitUsage for invalid
+// flags, exitConfig otherwise.
+func exporterExitCode(err error) int {
+	if _, ok := err.(*sql_exporter.FlagError); ok {
+		return exitUsage
+	}
+	return exitConfig
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/alecthomas/kingpin/v2"
+)
+
+// flagEnvPrefix is the prefix of the environment variables overriding flag defaults.
+const flagEnvPrefix = "SQL_EXPORTER_"
+
+// flagEnvName returns the environment variable overriding the default of the named flag, e.g.
+// SQL_EXPORTER_WEB_LISTEN_ADDRESS for --web.listen-address.
+func flagEnvName(name string) string {
+	return flagEnvPrefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(name))
+}
+
+// setFlagEnvars makes every visible flag of app (other than --help and --version, but including those registered by
+// the exporter library) overridable by an environment variable, see flagEnvName. Flags explicitly set on the command
+// line take precedence. Subcommand flags are not affected.
+func setFlagEnvars(app *kingpin.Application) {
+	for _, f := range app.Model().Flags {
+		if !f.Hidden && f.Name != "help" && f.Name != "version" {
+			app.GetFlag(f.Name).Envar(flagEnvName(f.Name))
+		}
+	}
+}
+
+// normalizeArgs returns args with single dash long flags (e.g. `-config.file=x`, as accepted by the flag package the
+// exporter used to parse its command line with) replaced by their double dash equivalents, which kingpin expects. -h is
+// the only short flag. Arguments following `--` and values such as `-1` are left alone.
+func normalizeArgs(args []string) []string {
+	normalized := make([]string, len(args))
+	copy(normalized, args)
+	for i, arg := range normalized {
+		if arg == "--" {
+			break
+		}
+		if len(arg) > 2 && arg[0] == '-' && arg[1] >= 'a' && arg[1] <= 'z' {
+			normalized[i] = "-" + arg
+		}
+	}
+	return normalized
+}
+
+// flagGroup is a set of flags listed together in the usage message.
+type flagGroup struct {
+	Name  string
+	Flags []*kingpin.FlagModel
+}
+
+// groupFlags groups flags by prefix (e.g. all `web.*` flags together), general flags (without a prefix) first and the
+// rest sorted by prefix.
+func groupFlags(flags []*kingpin.FlagModel) []flagGroup {
+	groups := make(map[string][]*kingpin.FlagModel)
+	for _, f := range flags {
+		group := "general"
+		if i := strings.IndexByte(f.Name, '.'); i > 0 {
+			group = f.Name[:i]
+		}
+		groups[group] = append(groups[group], f)
+	}
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		if name != "general" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	result := make([]flagGroup, 0, len(groups))
+	for _, name := range append([]string{"general"}, names...) {
+		if len(groups[name]) > 0 {
+			result = append(result, flagGroup{title(name), groups[name]})
+		}
+	}
+	return result
+}
+
+// title returns s with its first letter in upper case.
+func title(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+// usageFuncs are the functions available to usageTemplate, in addition to kingpin's.
+var usageFuncs = template.FuncMap{"GroupFlags": groupFlags, "Title": title}
+
+// usageTemplate is kingpin's default usage template, with the application flags grouped by prefix (see groupFlags) and
+// listed after the selected command's own flags, if any.
+const usageTemplate = `{{define "FormatCommand" -}}
+{{if .FlagSummary}} {{.FlagSummary}}{{end -}}
+{{range .Args}}{{if not .Hidden}} {{if not .Required}}[{{end}}{{if .PlaceHolder}}{{.PlaceHolder}}{{else}}<{{.Name}}>{{end}}{{if .Value|IsCumulative}}...{{end}}{{if not .Required}}]{{end}}{{end}}{{end -}}
+{{end -}}
+
+{{define "FormatCommands" -}}
+{{range .FlattenedCommands -}}
+{{if not .Hidden -}}
+  {{.FullCommand}}{{if .Default}}*{{end}}{{template "FormatCommand" .}}
+{{.Help|Wrap 4}}
+{{end -}}
+{{end -}}
+{{end -}}
+
+{{define "FormatUsage" -}}
+{{template "FormatCommand" .}}{{if .Commands}} <command> [<args> ...]{{end}}
+{{if .Help}}
+{{.Help|Wrap 0 -}}
+{{end -}}
+
+{{end -}}
+
+{{if .Context.SelectedCommand -}}
+usage: {{.App.Name}} {{.Context.SelectedCommand}}{{template "FormatUsage" .Context.SelectedCommand}}
+{{if .Context.SelectedCommand.Flags -}}
+{{.Context.SelectedCommand.Name|Title}} flags:
+{{.Context.SelectedCommand.Flags|FlagsToTwoColumns|FormatTwoColumns}}
+{{end -}}
+{{if .Context.Args -}}
+Args:
+{{.Context.Args|ArgsToTwoColumns|FormatTwoColumns}}
+{{end -}}
+{{else -}}
+usage: {{.App.Name}}{{template "FormatUsage" .App}}
+{{end -}}
+{{range .App.Flags|GroupFlags -}}
+{{.Name}} flags:
+{{.Flags|FlagsToTwoColumns|FormatTwoColumns}}
+{{end -}}
+{{if not .Context.SelectedCommand -}}
+Commands:
+{{template "FormatCommands" .App}}
+{{end -}}
+`
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/alecthomas/kingpin/v2"
+)
+
+func TestNormalizeArgs(t *testing.T) {
+	args := []string{"-config.file=x.yml", "--web.listen-address", ":9400", "-h", "--demo.min-value", "-1", "ping",
+		"--", "-dsn"}
+	want := []string{"--config.file=x.yml", "--web.listen-address", ":9400", "-h", "--demo.min-value", "-1", "ping",
+		"--", "-dsn"}
+	if got := normalizeArgs(args); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestSetFlagEnvars(t *testing.T) {
+	app := kingpin.New("sql_exporter", "")
+	listenAddress := app.Flag("web.listen-address", "").Default(":9399").String()
+	metricsPath := app.Flag("web.metrics-path", "").Default("/metrics").String()
+	cmd := app.Command("ping", "")
+	dsn := cmd.Flag("dsn", "").String()
+	setFlagEnvars(app)
+
+	t.Setenv("SQL_EXPORTER_WEB_LISTEN_ADDRESS", ":9400")
+	t.Setenv("SQL_EXPORTER_WEB_METRICS_PATH", "/env")
+	t.Setenv("SQL_EXPORTER_DSN", "postgres://env")
+	if _, err := app.Parse([]string{"--web.metrics-path=/flag", "ping"}); err != nil {
+		t.Fatal(err)
+	}
+	// Environment variables override defaults, flags override environment variables, subcommand flags are not affected.
+	if *listenAddress != ":9400" || *metricsPath != "/flag" || *dsn != "" {
+		t.Errorf("expected :9400, /flag and no DSN, got %q, %q and %q", *listenAddress, *metricsPath, *dsn)
+	}
+}
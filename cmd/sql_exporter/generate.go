@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/free/sql_exporter/config"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	generateCmd = kingpin.Command("generate",
+		"Write a Prometheus scrape config or starter alerting rules for the configured exporter to stdout.")
+	generateWhat = generateCmd.Arg("what", "What to generate.").Required().Enum("prometheus-config", "alerts")
+	generateJob  = generateCmd.Flag("job",
+		"Name of the Prometheus job scraping the exporter.").Default("sql_exporter").String()
+	generateTarget = generateCmd.Flag("target",
+		"Address Prometheus scrapes the exporter at. Defaults to localhost and the port of --web.listen-address.").String()
+)
+
+// defaultStalenessThreshold is how long a collector may go without a successful run before the generated staleness alert
+// fires, unless its max_staleness or min_interval call for a longer one.
+const defaultStalenessThreshold = 10 * time.Minute
+
+// promScrapeConfig is the subset of the Prometheus scrape_config generated for the exporter.
+type promScrapeConfig struct {
+	JobName       string             `yaml:"job_name"`
+	HonorLabels   bool               `yaml:"honor_labels,omitempty"`
+	MetricsPath   string             `yaml:"metrics_path"`
+	Scheme        string             `yaml:"scheme,omitempty"`
+	ScrapeTimeout model.Duration     `yaml:"scrape_timeout,omitempty"`
+	Authorization map[string]string  `yaml:"authorization,omitempty"`
+	BasicAuth     map[string]string  `yaml:"basic_auth,omitempty"`
+	TLSConfig     map[string]string  `yaml:"tls_config,omitempty"`
+	StaticConfigs []promStaticConfig `yaml:"static_configs"`
+}
+
+// promStaticConfig is a Prometheus static_config.
+type promStaticConfig struct {
+	Targets []string `yaml:"targets"`
+}
+
+// promRuleGroup is a Prometheus alerting rule group.
+type promRuleGroup struct {
+	Name  string     `yaml:"name"`
+	Rules []promRule `yaml:"rules"`
+}
+
+// promRule is a Prometheus alerting rule.
+type promRule struct {
+	Alert       string            `yaml:"alert"`
+	Expr        string            `yaml:"expr"`
+	For         model.Duration    `yaml:"for,omitempty"`
+	Labels      map[string]string `yaml:"labels,omitempty"`
+	Annotations map[string]string `yaml:"annotations,omitempty"`
+}
+
+// generate implements the `generate` subcommand: it writes a Prometheus scrape config (`generate prometheus-config`)
+// or starter alerting rules (`generate alerts`) for the exporter configuration in configFile to stdout. It returns the
+// exit code.
+func generate(configFile string) int {
+	exporterTarget := *generateTarget
+	if exporterTarget == "" {
+		_, port, err := net.SplitHostPort(*listenAddress)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid --web.listen-address %q: %s\n", *listenAddress, err)
+			return exitError
+		}
+		exporterTarget = net.JoinHostPort("localhost", port)
+	}
+
+	c, err := config.Load(configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading configuration: %s\n", err)
+		return exitConfig
+	}
+
+	var out interface{}
+	switch *generateWhat {
+	case "prometheus-config":
+		out = map[string]interface{}{"scrape_configs": scrapeConfigsFor(c, *generateJob, exporterTarget)}
+	case "alerts":
+		out = map[string]interface{}{"groups": []*promRuleGroup{alertsFor(c, *generateJob)}}
+	}
+	buf, err := yaml.Marshal(out)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error generating %s: %s\n", *generateWhat, err)
+		return exitError
+	}
+	fmt.Printf("# Generated by `sql_exporter generate %s` from %s.\n", *generateWhat, configFile)
+	os.Stdout.Write(buf)
+	return exitOK
+}
+
+// scrapeConfigsFor returns the Prometheus scrape configs for scraping the exporter configured by c at target: one for
+// the collected metrics (job jobName) and one for the exporter's own process metrics (job jobName + "_process").
+func scrapeConfigsFor(c *config.Config, jobName, target string) []*promScrapeConfig {
+	metrics := scrapeConfigFor(c, jobName, *metricsPath, target)
+	// In jobs mode the exporter sets the job and instance labels of the databases it collects from.
+	metrics.HonorLabels = c.Target == nil
+	process := scrapeConfigFor(c, jobName+"_process", "/sql_exporter_metrics", target)
+	// Process metrics about targets (e.g. collector last success) carry the targets' job and instance labels.
+	process.HonorLabels = true
+	return []*promScrapeConfig{metrics, process}
+}
+
+// scrapeConfigFor returns a Prometheus scrape config for scraping path of the exporter configured by c at target.
+func scrapeConfigFor(c *config.Config, jobName, path, target string) *promScrapeConfig {
+	sc := &promScrapeConfig{
+		JobName:       jobName,
+		MetricsPath:   path,
+		ScrapeTimeout: c.Globals.ScrapeTimeout,
+		StaticConfigs: []promStaticConfig{{Targets: []string{target}}},
+	}
+	if web := c.Web; web != nil {
+		if web.BearerToken != "" {
+			sc.Authorization = map[string]string{"credentials_file": "/path/to/sql_exporter_token"}
+		}
+		if web.BasicAuth != nil {
+			sc.BasicAuth = map[string]string{
+				"username":      web.BasicAuth.Username,
+				"password_file": "/path/to/sql_exporter_password",
+			}
+		}
+		if web.TLS != nil {
+			sc.Scheme = "https"
+			sc.TLSConfig = map[string]string{"ca_file": "/path/to/sql_exporter_ca.crt"}
+			if web.TLS.ClientCAFile != "" {
+				sc.TLSConfig["cert_file"] = "/path/to/prometheus.crt"
+				sc.TLSConfig["key_file"] = "/path/to/prometheus.key"
+			}
+		}
+	}
+	return sc
+}
+
+// alertsFor returns starter alerting rules for the exporter configured by c, scraped by the Prometheus job jobName: the
+// exporter being down, targets being down (jobs mode only), collectors going stale and queries being quarantined or
+// truncated.
+func alertsFor(c *config.Config, jobName string) *promRuleGroup {
+	rules := []promRule{{
+		Alert:       "SQLExporterDown",
+		Expr:        fmt.Sprintf(`up{job=~%q} == 0`, jobName+"|"+jobName+"_process"),
+		For:         model.Duration(5 * time.Minute),
+		Labels:      map[string]string{"severity": "critical"},
+		Annotations: map[string]string{"summary": "SQL exporter {{ $labels.instance }} cannot be scraped."},
+	}}
+
+	var collectors []*config.CollectorConfig
+	if c.Target != nil {
+		collectors = c.Target.Collectors()
+	} else {
+		jobs := make([]string, 0, len(c.Jobs))
+		for _, jc := range c.Jobs {
+			if !jc.IsEnabled() {
+				continue
+			}
+			jobs = append(jobs, jc.Name)
+			collectors = append(collectors, jc.Collectors()...)
+		}
+		if len(jobs) > 0 {
+			rules = append(rules, promRule{
+				Alert:  "SQLTargetDown",
+				Expr:   fmt.Sprintf(`up{job=~%q} == 0`, strings.Join(jobs, "|")),
+				For:    model.Duration(5 * time.Minute),
+				Labels: map[string]string{"severity": "critical"},
+				Annotations: map[string]string{
+					"summary": "Database {{ $labels.job }}/{{ $labels.instance }} is unreachable from the SQL exporter.",
+				},
+			})
+		}
+	}
+
+	// One staleness rule per distinct collector, its threshold based on how often the collector is expected to run.
+	seen := make(map[string]bool, len(collectors))
+	names := make([]string, 0, len(collectors))
+	thresholds := make(map[string]time.Duration, len(collectors))
+	for _, cc := range collectors {
+		if seen[cc.Name] || !cc.IsEnabled() {
+			continue
+		}
+		seen[cc.Name] = true
+		names = append(names, cc.Name)
+		threshold := defaultStalenessThreshold
+		if d := 3 * time.Duration(cc.MinInterval); d > threshold {
+			threshold = d
+		}
+		if d := time.Duration(cc.MaxStaleness); d > threshold {
+			threshold = d
+		}
+		thresholds[cc.Name] = threshold
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		rules = append(rules, promRule{
+			Alert: "SQLCollectorStale",
+			Expr: fmt.Sprintf(`time() - sql_exporter_collector_last_success_timestamp_seconds{collector=%q} > %d`,
+				name, int64(thresholds[name].Seconds())),
+			Labels: map[string]string{"severity": "warning"},
+			Annotations: map[string]string{
+				"summary": fmt.Sprintf("Collector %s has not run successfully on {{ $labels.instance }} for %s.",
+					name, model.Duration(thresholds[name])),
+			},
+		})
+	}
+
+	if c.Globals.Quarantine != nil {
+		rules = append(rules, promRule{
+			Alert:  "SQLQueryQuarantined",
+			Expr:   "sql_exporter_query_quarantined > 0",
+			Labels: map[string]string{"severity": "warning"},
+			Annotations: map[string]string{
+				"summary": "Query {{ $labels.collector }}/{{ $labels.query }} is failing repeatedly on {{ $labels.instance }}.",
+			},
+		})
+	}
+	rules = append(rules, promRule{
+		Alert:  "SQLQueryTruncated",
+		Expr:   "increase(sql_exporter_query_truncated_total[15m]) > 0",
+		Labels: map[string]string{"severity": "warning"},
+		Annotations: map[string]string{
+			"summary": "Results of query {{ $labels.collector }}/{{ $labels.query }} on {{ $labels.instance }} are " +
+				"incomplete ({{ $labels.reason }}).",
+		},
+	})
+	return &promRuleGroup{Name: "sql_exporter", Rules: rules}
+}
@@ -0,0 +1,42 @@
+module github.com/free/sql_exporter/cmd/sql_exporter
+
+go 1.22
+
+require (
+	github.com/free/sql_exporter v0.0.0-00010101000000-000000000000
+	github.com/free/sql_exporter/drivers/clickhouse v0.0.0-00010101000000-000000000000
+	github.com/golang/protobuf v1.5.2
+	github.com/klauspost/compress v1.18.0
+	github.com/prometheus/client_golang v1.12.2
+	github.com/prometheus/client_model v0.2.0
+	github.com/prometheus/common v0.32.1
+	gopkg.in/yaml.v2 v2.4.0
+)
+
+require (
+	github.com/alecthomas/units v0.0.0-20211218093645-b94a6e3cc137 // indirect
+	github.com/xhit/go-str2duration/v2 v2.1.0 // indirect
+)
+
+require (
+	github.com/ClickHouse/clickhouse-go v1.4.3 // indirect
+	github.com/alecthomas/kingpin/v2 v2.4.0
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.1.2 // indirect
+	github.com/cloudflare/golz4 v0.0.0-20150217214814-ef862a3cdc58 // indirect
+	github.com/denisenkom/go-mssqldb v0.0.0-20191124224453-732737034ffd // indirect
+	github.com/go-sql-driver/mysql v1.5.0 // indirect
+	github.com/golang-sql/civil v0.0.0-20190719163853-cb61b32ac6fe // indirect
+	github.com/lib/pq v1.3.0 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/prometheus/procfs v0.7.3 // indirect
+	go.starlark.net v0.0.0-20230302034142-4b1e35fe2254 // indirect
+	golang.org/x/crypto v0.10.0 // indirect
+	golang.org/x/sys v0.10.0 // indirect
+	google.golang.org/protobuf v1.27.1 // indirect
+)
+
+replace (
+	github.com/free/sql_exporter => ../..
+	github.com/free/sql_exporter/drivers/clickhouse => ../../drivers/clickhouse
+)
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// jobResult is the outcome of gathering one job, see gatherJobs.
+type jobResult struct {
+	job   string
+	named bool // whether the gatherer provided its job name, else its families are never encoded early
+	mfs   []*dto.MetricFamily
+	err   error
+}
+
+// gatherJobs runs all gatherers concurrently and returns one channel per gatherer, in the same order, receiving its
+// result. Every job's metric families are sanitized and sorted through prometheus.Gatherers, same as when merged.
+func gatherJobs(gatherers prometheus.Gatherers) []chan jobResult {
+	results := make([]chan jobResult, len(gatherers))
+	for i, g := range gatherers {
+		results[i] = make(chan jobResult, 1)
+		go func(g prometheus.Gatherer, result chan<- jobResult) {
+			var r jobResult
+			if jg, ok := g.(interface{ Job() string }); ok {
+				r.job, r.named = jg.Job(), true
+			}
+			r.mfs, r.err = g.Gather()
+			sanitized, err := gathered(r.mfs).Gather()
+			r.mfs, r.err = sanitized, appendErrors(appendErrors(nil, r.err), err).MaybeUnwrap()
+			result <- r
+		}(g, results[i])
+	}
+	return results
+}
+
+// gathered returns a Gatherers returning mfs.
+func gathered(mfs []*dto.MetricFamily) prometheus.Gatherers {
+	return prometheus.Gatherers{prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) { return mfs, nil })}
+}
+
+// appendErrors appends err to errs, flattening it if a prometheus.MultiError.
+func appendErrors(errs prometheus.MultiError, err error) prometheus.MultiError {
+	if multiErr, ok := err.(prometheus.MultiError); ok {
+		return append(errs, multiErr...)
+	} else if err != nil {
+		return append(errs, err)
+	}
+	return errs
+}
+
+// familyOwners remembers which job exported each metric family in past scrapes. A family only ever exported by one job
+// may be encoded as soon as that job is gathered; the others (and families never seen before) only once all jobs are,
+// as the text format doesn't allow a family to be split.
+type familyOwners struct {
+	mtx    sync.Mutex
+	owners map[string]string // family name to the job exporting it
+	shared map[string]bool   // families exported by several jobs
+}
+
+// newFamilyOwners returns a familyOwners with no history.
+func newFamilyOwners() *familyOwners {
+	return &familyOwners{owners: make(map[string]string), shared: make(map[string]bool)}
+}
+
+// exclusive returns true if the named family was only ever exported by job.
+func (fo *familyOwners) exclusive(name, job string) bool {
+	fo.mtx.Lock()
+	defer fo.mtx.Unlock()
+	owner, found := fo.owners[name]
+	return found && owner == job && !fo.shared[name]
+}
+
+// observe records the families exported by job.
+func (fo *familyOwners) observe(job string, mfs []*dto.MetricFamily) {
+	fo.mtx.Lock()
+	defer fo.mtx.Unlock()
+	for _, mf := range mfs {
+		if owner, found := fo.owners[mf.GetName()]; !found {
+			fo.owners[mf.GetName()] = job
+		} else if owner != job {
+			fo.shared[mf.GetName()] = true
+		}
+	}
+}
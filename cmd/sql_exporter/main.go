@@ -1,14 +1,16 @@
 package main
 
 import (
-	"flag"
 	"fmt"
 	"net/http"
 	"os"
 	"runtime"
 
+	"github.com/alecthomas/kingpin/v2"
 	"github.com/free/sql_exporter"
-	log "github.com/golang/glog"
+	"github.com/free/sql_exporter/config"
+	_ "github.com/free/sql_exporter/drivers/clickhouse" // register the ClickHouse driver
+	"github.com/free/sql_exporter/log"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/common/version"
@@ -16,14 +18,34 @@ import (
 )
 
 var (
-	showVersion   = flag.Bool("version", false, "Print version information.")
-	listenAddress = flag.String("web.listen-address", ":9399", "Address to listen on for web interface and telemetry.")
-	metricsPath   = flag.String("web.metrics-path", "/metrics", "Path under which to expose metrics.")
-	configFile    = flag.String("config.file", "sql_exporter.yml", "SQL Exporter configuration file name.")
+	showDrivers   = kingpin.Flag("drivers", "Print the database drivers compiled in, with their versions.").Bool()
+	listenAddress = kingpin.Flag("web.listen-address",
+		"Address to listen on for web interface and telemetry.").Default(":9399").String()
+	metricsPath = kingpin.Flag("web.metrics-path", "Path under which to expose metrics.").Default("/metrics").String()
+	configFile  = kingpin.Flag("config.file",
+		"SQL Exporter configuration file name, - for stdin.").Default("sql_exporter.yml").String()
+	configDir = kingpin.Flag("config.dir",
+		"Directory of configuration files (*.yml) merged in lexical order, e.g. a mounted ConfigMap. Overrides config.file.").
+		String()
+	// --config.check, as in other exporters, is an alias of --config.lint.
+	lintConfig = kingpin.Flag("config.lint",
+		"Check metric names against Prometheus naming conventions and exit. Alias: --config.check.").Bool()
+	checkConfig   = kingpin.Flag("config.check", "Alias of --config.lint.").Hidden().Bool()
+	topCollectors = kingpin.Flag("web.top-collectors",
+		"Number of largest collectors (by size of their metrics in the last scrape) listed on the /targets page, 0 for all.").
+		Default("10").Int()
+	sortExposition = kingpin.Flag("web.sort-exposition",
+		"Sort the exposition deterministically (metrics with equal label values by label names too), for diffable output.").
+		Default("true").Bool()
+	logFormat = kingpin.Flag("log.format",
+		"Output format of log messages, one of logfmt or json.").Default("logfmt").Enum("logfmt", "json")
+	logVerbosity = kingpin.Flag("log.verbosity",
+		"Verbosity of debug log messages, 0 (none) to 2 (e.g. query texts).").Default("0").Int()
 )
 
 func init() {
 	prometheus.MustRegister(version.NewCollector("sql_exporter"))
+	kingpin.Command("serve", "Run the exporter (the default command).").Default()
 }
 
 func main() {
@@ -32,40 +54,91 @@ func main() {
 		runtime.SetMutexProfileFraction(1)
 	}
 
-	// Override --alsologtostderr default value.
-	if alsoLogToStderr := flag.Lookup("alsologtostderr"); alsoLogToStderr != nil {
-		alsoLogToStderr.DefValue = "true"
-		alsoLogToStderr.Value.Set("true")
-	}
-	// Override the config.file default with the CONFIG environment variable, if set. If the flag is explicitly set, it
-	// will end up overriding either.
+	// Override the config.file default with the CONFIG environment variable, if set. SQL_EXPORTER_CONFIG_FILE overrides
+	// it in turn and, like all flags, if the flag is explicitly set, it will end up overriding either.
 	if envConfigFile := os.Getenv("CONFIG"); envConfigFile != "" {
-		*configFile = envConfigFile
+		kingpin.CommandLine.GetFlag("config.file").Default(envConfigFile)
+	}
+	kingpin.Version(version.Print("sql_exporter"))
+	kingpin.HelpFlag.Short('h')
+	kingpin.CommandLine.UsageTemplate(usageTemplate).UsageFuncs(usageFuncs)
+	setFlagEnvars(kingpin.CommandLine)
+	command, err := kingpin.CommandLine.Parse(normalizeArgs(os.Args[1:]))
+	if err != nil {
+		fatal(exitUsage, err)
+	}
+	log.SetHandler(log.NewHandler(os.Stderr, *logFormat == "json"))
+	log.SetVerbosity(*logVerbosity)
+	if *configDir != "" {
+		*configFile = *configDir
 	}
-	flag.Parse()
 
-	if *showVersion {
-		fmt.Println(version.Print("sql_exporter"))
-		os.Exit(0)
+	if *showDrivers {
+		for _, d := range sql_exporter.Drivers() {
+			fmt.Printf("%-12s %-40s %s\n", d.Name, d.Package, d.Version)
+		}
+		os.Exit(exitOK)
+	}
+
+	if *lintConfig || *checkConfig {
+		os.Exit(lint(*configFile))
+	}
+	switch command {
+	case generateCmd.FullCommand():
+		os.Exit(generate(*configFile))
+	case pingCmd.FullCommand():
+		os.Exit(ping())
+	case diffCmd.FullCommand():
+		os.Exit(diff(*configFile))
 	}
 
 	log.Infof("Starting SQL exporter %s %s", version.Info(), version.BuildContext())
 
 	exporter, err := sql_exporter.NewExporter(*configFile)
 	if err != nil {
-		log.Fatalf("Error creating exporter: %s", err)
+		fatal(exporterExitCode(err), fmt.Errorf("error creating exporter: %s", err))
 	}
+	go watchDataSources(exporter, *configFile, *configWatchInterval)
 
-	// Setup and start webserver.
+	// Setup and start webserver. All endpoints except /healthz (for load balancers) and the admin API (which requires its
+	// own token) require the authentication configured in the `web` section, if any.
+	auth := func(h http.Handler) http.Handler { return AuthHandlerFor(exporter.Config().Web, h) }
 	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) { http.Error(w, "OK", http.StatusOK) })
-	http.HandleFunc("/", HomeHandlerFunc(*metricsPath))
-	http.HandleFunc("/config", ConfigHandlerFunc(*metricsPath, exporter))
-	http.Handle(*metricsPath, ExporterHandlerFor(exporter))
+	http.Handle("/", auth(http.HandlerFunc(HomeHandlerFunc(*metricsPath))))
+	http.Handle("/config", auth(http.HandlerFunc(ConfigHandlerFunc(*metricsPath, exporter))))
+	http.Handle("/targets", auth(http.HandlerFunc(TargetsHandlerFunc(*metricsPath, exporter))))
+	http.Handle("/debug/collector", auth(TraceHandlerFor(exporter)))
+	http.Handle(*metricsPath, auth(ExporterHandlerFor(exporter)))
+	// Unlike the rest of the admin API, recent errors are read only and available regardless of the admin token.
+	http.Handle("/api/v1/errors", auth(ErrorsHandlerFor(exporter)))
+	if adminHandler := exporter.AdminHandler(); adminHandler != nil {
+		http.Handle("/api/v1/", adminHandler)
+		http.Handle("/preview", auth(http.HandlerFunc(PreviewHandlerFunc(*metricsPath, exporter))))
+	}
 	// Expose exporter metrics separately, for debugging purposes.
-	http.Handle("/sql_exporter_metrics", promhttp.Handler())
+	http.Handle("/sql_exporter_metrics", auth(promhttp.Handler()))
 
 	log.Infof("Listening on %s", *listenAddress)
-	log.Fatal(http.ListenAndServe(*listenAddress, nil))
+	err = serve(*listenAddress, exporter.Config().Web, AccessLogHandlerFor(*metricsPath, http.DefaultServeMux))
+	fatal(exitListen, err)
+}
+
+// lint loads the configuration file and prints any metric naming problems, returning the exit code: exitOK if there are
+// none, exitError if there are, exitConfig if the configuration could not be loaded.
+func lint(configFile string) int {
+	c, err := config.Load(configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading configuration: %s\n", err)
+		return exitConfig
+	}
+	problems := c.LintMetricNames()
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	if len(problems) > 0 {
+		return exitError
+	}
+	return exitOK
 }
 
 // LogFunc is an adapter to allow the use of any function as a promhttp.Logger. If f is a function, LogFunc(f) is a
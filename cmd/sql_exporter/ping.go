@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/free/sql_exporter"
+)
+
+var (
+	pingCmd = kingpin.Command("ping",
+		"Test connectivity to a data source name step by step, printing the outcome and timing of every step.")
+	pingDSN = pingCmd.Flag("dsn",
+		"Data source name to test, as it would appear in the configuration file.").Required().String()
+	pingTimeout = pingCmd.Flag("timeout", "Timeout of the whole test.").Default("10s").Duration()
+)
+
+// ping implements the `ping` subcommand: it tests connectivity to the data source name given by --dsn step by step,
+// printing the outcome and timing of every step and troubleshooting hints if any failed. It returns the exit code.
+func ping() int {
+	ctx, cancel := context.WithTimeout(context.Background(), *pingTimeout)
+	defer cancel()
+	r := sql_exporter.PingDataSource(ctx, *pingDSN, *pingTimeout)
+	fmt.Printf("Testing %s\n", r.DSN)
+	for _, s := range r.Steps {
+		status := "OK"
+		if s.Err != nil {
+			status = "FAILED"
+		}
+		fmt.Printf("  %-8s %-6s %10s", s.Name, status, s.Duration.Round(time.Microsecond))
+		if s.Err != nil {
+			fmt.Printf("  %s", s.Err)
+		} else if s.Detail != "" {
+			fmt.Printf("  %s", s.Detail)
+		}
+		fmt.Println()
+	}
+	if r.Err() == nil {
+		fmt.Println("Success.")
+		return exitOK
+	}
+	for _, hint := range r.Hints {
+		fmt.Printf("Hint: %s\n", hint)
+	}
+	return exitError
+}
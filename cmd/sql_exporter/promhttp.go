@@ -1,96 +1,286 @@
 package main
 
 import (
-	"bytes"
+	"bufio"
 	"compress/gzip"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/free/sql_exporter"
-	log "github.com/golang/glog"
+	"github.com/free/sql_exporter/config"
+	"github.com/golang/protobuf/proto"
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/expfmt"
 )
 
 const (
 	contentTypeHeader     = "Content-Type"
-	contentLengthHeader   = "Content-Length"
 	contentEncodingHeader = "Content-Encoding"
 	acceptEncodingHeader  = "Accept-Encoding"
 )
 
+var expositionBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "sql_exporter_exposition_bytes",
+	Help: "Size in bytes of the last metrics exposition, uncompressed (encoding=\"identity\") and as sent, if compressed.",
+}, []string{"encoding"})
+
+func init() {
+	prometheus.MustRegister(expositionBytes)
+}
+
 // ExporterHandlerFor returns an http.Handler for the provided Exporter.
 func ExporterHandlerFor(exporter sql_exporter.Exporter) http.Handler {
+	owners := newFamilyOwners()
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		ctx, cancel := contextFor(req, exporter)
-		defer cancel()
-
-		// Go through prometheus.Gatherers to sanitize and sort metrics.
-		gatherer := prometheus.Gatherers{exporter.WithContext(ctx)}
-		mfs, err := gatherer.Gather()
+		scrapeLabels, err := scrapeLabelsFor(req, exporter.Config().Web)
 		if err != nil {
-			log.Infof("Error gathering metrics: %s", err)
-			if len(mfs) == 0 {
-				http.Error(w, "No metrics gathered, "+err.Error(), http.StatusInternalServerError)
-				return
-			}
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
+		ctx, cancel := contextFor(req, exporter)
+		defer cancel()
 
+		// Write the exposition to the client through a fixed size buffer as it is encoded, rather than encoding all of
+		// it into memory first (to set Content-Length), and release every metric family once encoded.
 		contentType := expfmt.Negotiate(req.Header)
-		buf := getBuf()
+		header := w.Header()
+		header.Set(contentTypeHeader, string(contentType))
+		sent := &countingWriter{w: w}
+		buf := getBuf(sent)
 		defer giveBuf(buf)
 		writer, encoding := decorateWriter(req, buf)
-		enc := expfmt.NewEncoder(writer, contentType)
-		var errs prometheus.MultiError
-		for _, mf := range mfs {
-			if err := enc.Encode(mf); err != nil {
-				errs = append(errs, err)
-				log.Infof("Error encoding metric family %q: %s", mf.GetName(), err)
+		if encoding != "" {
+			header.Set(contentEncodingHeader, encoding)
+		}
+		counter := &countingWriter{w: writer}
+		enc := expfmt.NewEncoder(counter, contentType)
+		var (
+			encoded    int
+			encodeErrs prometheus.MultiError
+		)
+		encode := func(mfs []*dto.MetricFamily) {
+			if len(scrapeLabels) > 0 {
+				addLabels(mfs, scrapeLabels)
+			}
+			if *sortExposition {
+				sql_exporter.SortMetricFamilies(mfs)
+			}
+			for i, mf := range mfs {
+				if err := enc.Encode(mf); err != nil {
+					encodeErrs = append(encodeErrs, err)
+					sql_exporter.Logf(sql_exporter.SeverityInfo, "Error encoding metric family %q: %s", mf.GetName(), err)
+				} else {
+					encoded++
+				}
+				mfs[i] = nil
 			}
 		}
-		if closer, ok := writer.(io.Closer); ok {
-			closer.Close()
+
+		// Gather all jobs concurrently (so one misbehaving job doesn't hold up or break the others). In job order, the
+		// metric families only ever exported by that job are encoded as soon as it is gathered, so they needn't all be
+		// held in memory at once. The others are merged across jobs through prometheus.Gatherers (which also sanitizes
+		// and sorts metrics) and encoded last.
+		var (
+			gatherErrs prometheus.MultiError
+			held       prometheus.Gatherers
+			streamed   = make(map[string]string) // family name to the job it was encoded for
+		)
+		for _, results := range gatherJobs(exporter.JobGatherers(ctx)) {
+			result := <-results
+			gatherErrs = appendErrors(gatherErrs, result.err)
+			var exclusive, shared []*dto.MetricFamily
+			for _, mf := range result.mfs {
+				if job, found := streamed[mf.GetName()]; found {
+					// Only possible if the job started exporting a family so far exported by another job alone.
+					gatherErrs = append(gatherErrs, fmt.Errorf("metric family %q of job %q already exported by job %q, "+
+						"dropped from this scrape", mf.GetName(), result.job, job))
+				} else if result.named && owners.exclusive(mf.GetName(), result.job) {
+					exclusive = append(exclusive, mf)
+				} else {
+					shared = append(shared, mf)
+				}
+			}
+			if result.named {
+				owners.observe(result.job, result.mfs)
+			}
+			for _, mf := range exclusive {
+				streamed[mf.GetName()] = result.job
+			}
+			encode(exclusive)
+			held = append(held, gathered(shared)...)
+		}
+		mfs, err := held.Gather()
+		gatherErrs = appendErrors(gatherErrs, err)
+		encode(mfs)
+
+		// Log errors one by one, so repeated ones (e.g. for a target that's down) may be deduplicated.
+		for _, err := range gatherErrs {
+			sql_exporter.Logf(sql_exporter.SeverityInfo, "Error gathering metrics: %s", err)
 		}
-		if errs.MaybeUnwrap() != nil && buf.Len() == 0 {
-			http.Error(w, "No metrics encoded, "+errs.Error(), http.StatusInternalServerError)
+		// Nothing was written to the client yet in either case, so there is still time to report the failure. Jobs
+		// failing altogether still export `up` for their targets, so the former only happens if there are none.
+		if len(gatherErrs) > 0 && encoded == 0 && len(encodeErrs) == 0 {
+			header.Del(contentEncodingHeader)
+			http.Error(w, "No metrics gathered, "+gatherErrs.Error(), http.StatusInternalServerError)
 			return
 		}
-		header := w.Header()
-		header.Set(contentTypeHeader, string(contentType))
-		header.Set(contentLengthHeader, fmt.Sprint(buf.Len()))
+		if len(encodeErrs) > 0 && counter.n == 0 {
+			header.Del(contentEncodingHeader)
+			http.Error(w, "No metrics encoded, "+encodeErrs.Error(), http.StatusInternalServerError)
+			return
+		}
+		if closer, ok := writer.(io.Closer); ok {
+			closer.Close()
+		}
+		buf.Flush()
+		expositionBytes.WithLabelValues("identity").Set(float64(counter.n))
 		if encoding != "" {
-			header.Set(contentEncodingHeader, encoding)
+			expositionBytes.WithLabelValues(encoding).Set(float64(sent.n))
 		}
-		w.Write(buf.Bytes())
 	})
 }
 
+// scrapeLabelsFor returns the labels req's URL parameters add to all series of the scrape (e.g. `?label_env=prod`, see
+// config.ScrapeLabelParamPrefix), sorted by name. Labels not listed in web.scrape_labels are an error; empty values are
+// ignored, same as empty labels.
+func scrapeLabelsFor(req *http.Request, wc *config.WebConfig) ([]*dto.LabelPair, error) {
+	var labels []*dto.LabelPair
+	for param, values := range req.URL.Query() {
+		if !strings.HasPrefix(param, config.ScrapeLabelParamPrefix) {
+			continue
+		}
+		name := strings.TrimPrefix(param, config.ScrapeLabelParamPrefix)
+		if !wc.AllowsScrapeLabel(name) {
+			return nil, fmt.Errorf("label %q (parameter %q) is not listed in web.scrape_labels", name, param)
+		}
+		if len(values) > 1 {
+			return nil, fmt.Errorf("parameter %q repeated", param)
+		}
+		if !utf8.ValidString(values[0]) {
+			return nil, fmt.Errorf("value of parameter %q is not valid UTF-8", param)
+		}
+		if values[0] != "" {
+			labels = append(labels, &dto.LabelPair{Name: proto.String(name), Value: proto.String(values[0])})
+		}
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].GetName() < labels[j].GetName() })
+	return labels, nil
+}
+
+// addLabels adds labels to every series in mfs, except series already having a label of the same name, whose own
+// value takes precedence.
+func addLabels(mfs []*dto.MetricFamily, labels []*dto.LabelPair) {
+	for _, mf := range mfs {
+		for _, m := range mf.Metric {
+			// Series may share their label pairs, so copy rather than append to them.
+			merged := make([]*dto.LabelPair, len(m.Label), len(m.Label)+len(labels))
+			copy(merged, m.Label)
+		next:
+			for _, lp := range labels {
+				for _, existing := range m.Label {
+					if existing.GetName() == lp.GetName() {
+						continue next
+					}
+				}
+				merged = append(merged, lp)
+			}
+			sort.Slice(merged, func(i, j int) bool { return merged[i].GetName() < merged[j].GetName() })
+			m.Label = merged
+		}
+	}
+}
+
+// TraceHandlerFor returns an http.Handler running a single collector (`name` parameter) on a single target (`target`
+// and optionally `job` parameters) of the provided Exporter and writing its JSON encoded timing breakdown. An optional
+// `limit` parameter limits every query to that many result rows.
+func TraceHandlerFor(exporter sql_exporter.Exporter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx, cancel := contextFor(req, exporter)
+		defer cancel()
+
+		params := req.URL.Query()
+		var rowLimit int
+		if v := params.Get("limit"); v != "" {
+			var err error
+			if rowLimit, err = strconv.Atoi(v); err != nil || rowLimit <= 0 {
+				http.Error(w, fmt.Sprintf("Invalid limit %q", v), http.StatusBadRequest)
+				return
+			}
+		}
+		trace, err := exporter.TraceCollector(ctx, params.Get("job"), params.Get("target"), params.Get("name"), rowLimit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set(contentTypeHeader, "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(trace)
+	})
+}
+
+// ErrorsHandlerFor returns an http.Handler writing the JSON encoded most recent scrape errors of the provided Exporter,
+// most recent first.
+func ErrorsHandlerFor(exporter sql_exporter.Exporter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set(contentTypeHeader, "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(exporter.RecentErrors())
+	})
+}
+
+// contextFor returns a context for scraping exporter in response to req, with a deadline derived from the scrape
+// timeout Prometheus provides (the `timeout` URL parameter if set, e.g. `?timeout=30s` for proxies stripping the
+// X-Prometheus-Scrape-Timeout-Seconds header, else the header) minus the timeout offset (the `offset` URL parameter if
+// set, else global.scrape_timeout_offset), capped by global.scrape_timeout.
 func contextFor(req *http.Request, exporter sql_exporter.Exporter) (context.Context, context.CancelFunc) {
 	timeout := time.Duration(0)
 	configTimeout := time.Duration(exporter.Config().Globals.ScrapeTimeout)
-	// If a timeout is provided in the Prometheus header, use it.
-	if v := req.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"); v != "" {
+	params := req.URL.Query()
+	// If a timeout is provided in the URL or the Prometheus header, use it.
+	if v := params.Get("timeout"); v != "" {
+		var err error
+		if timeout, err = parseTimeoutParam(v); err != nil {
+			sql_exporter.Logf(sql_exporter.SeverityError, "Failed to parse timeout (`%s`) from URL: %s", v, err)
+		}
+	} else if v := req.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"); v != "" {
 		timeoutSeconds, err := strconv.ParseFloat(v, 64)
 		if err != nil {
-			log.Errorf("Failed to parse timeout (`%s`) from Prometheus header: %s", v, err)
+			sql_exporter.Logf(sql_exporter.SeverityError,
+				"Failed to parse timeout (`%s`) from Prometheus header: %s", v, err)
 		} else {
 			timeout = time.Duration(timeoutSeconds * float64(time.Second))
-
-			// Subtract the timeout offset, unless the result would be negative or zero.
-			timeoutOffset := time.Duration(exporter.Config().Globals.TimeoutOffset)
-			if timeoutOffset > timeout {
-				log.Errorf("global.scrape_timeout_offset (`%s`) is greater than Prometheus' scraping timeout (`%s`), ignoring",
-					timeoutOffset, timeout)
+		}
+	}
+	if timeout > 0 {
+		timeoutOffset := time.Duration(exporter.Config().Globals.TimeoutOffset)
+		if v := params.Get("offset"); v != "" {
+			if offset, err := parseTimeoutParam(v); err != nil {
+				sql_exporter.Logf(sql_exporter.SeverityError, "Failed to parse timeout offset (`%s`) from URL: %s", v, err)
 			} else {
-				timeout -= timeoutOffset
+				timeoutOffset = offset
 			}
 		}
+
+		// Subtract the timeout offset, unless the result would be negative or zero.
+		if timeoutOffset > timeout {
+			sql_exporter.Logf(sql_exporter.SeverityError,
+				"Timeout offset (`%s`) is greater than Prometheus' scraping timeout (`%s`), ignoring",
+				timeoutOffset, timeout)
+		} else {
+			timeout -= timeoutOffset
+		}
 	}
 
 	// If the configured scrape timeout is more restrictive, use that instead.
@@ -104,32 +294,86 @@ func contextFor(req *http.Request, exporter sql_exporter.Exporter) (context.Cont
 	return context.WithTimeout(context.Background(), timeout)
 }
 
+// parseTimeoutParam parses a `timeout` or `offset` URL parameter: a duration (e.g. `30s`) or a number of seconds.
+func parseTimeoutParam(v string) (time.Duration, error) {
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		seconds, ferr := strconv.ParseFloat(v, 64)
+		if ferr != nil {
+			return 0, err
+		}
+		d = time.Duration(seconds * float64(time.Second))
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("negative duration %s", d)
+	}
+	return d, nil
+}
+
+// Size of the buffer expositions are written to clients through.
+const expositionBufferSize = 32 * 1024
+
 var bufPool sync.Pool
 
-func getBuf() *bytes.Buffer {
+// getBuf returns a buffered writer writing to w, from the pool if available.
+func getBuf(w io.Writer) *bufio.Writer {
 	buf := bufPool.Get()
 	if buf == nil {
-		return &bytes.Buffer{}
+		return bufio.NewWriterSize(w, expositionBufferSize)
 	}
-	return buf.(*bytes.Buffer)
+	bw := buf.(*bufio.Writer)
+	bw.Reset(w)
+	return bw
 }
 
-func giveBuf(buf *bytes.Buffer) {
-	buf.Reset()
+// giveBuf returns a buffered writer to the pool.
+func giveBuf(buf *bufio.Writer) {
+	buf.Reset(nil)
 	bufPool.Put(buf)
 }
 
-// decorateWriter wraps a writer to handle gzip compression if requested.  It
-// returns the decorated writer and the appropriate "Content-Encoding" header
-// (which is empty if no compression is enabled).
+// compressor is a supported response content encoding.
+type compressor struct {
+	encoding  string
+	newWriter func(io.Writer) io.WriteCloser
+}
+
+// compressors lists the supported response content encodings, in order of preference. Additional encodings (e.g.
+// zstd, see compress_zstd.go) are registered by files built with the corresponding build tag.
+var compressors = []compressor{
+	{"gzip", func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }},
+}
+
+// decorateWriter wraps a writer to handle compression if requested, using the most preferred supported encoding the
+// client accepts. It returns the decorated writer and the appropriate "Content-Encoding" header (which is empty if no
+// compression is enabled).
 func decorateWriter(request *http.Request, writer io.Writer) (w io.Writer, encoding string) {
-	header := request.Header.Get(acceptEncodingHeader)
-	parts := strings.Split(header, ",")
-	for _, part := range parts {
-		part := strings.TrimSpace(part)
-		if part == "gzip" || strings.HasPrefix(part, "gzip;") {
-			return gzip.NewWriter(writer), "gzip"
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(request.Header.Get(acceptEncodingHeader), ",") {
+		params := strings.Split(strings.TrimSpace(part), ";")
+		// Skip explicitly refused encodings, e.g. "gzip;q=0".
+		if len(params) > 1 && strings.Replace(strings.TrimSpace(params[1]), " ", "", -1) == "q=0" {
+			continue
+		}
+		accepted[strings.TrimSpace(params[0])] = true
+	}
+	for _, c := range compressors {
+		if accepted[c.encoding] {
+			return c.newWriter(writer), c.encoding
 		}
 	}
 	return writer, ""
 }
+
+// countingWriter is an io.Writer counting the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int
+}
+
+// Write implements io.Writer.
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += n
+	return n, err
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/free/sql_exporter"
+	"github.com/free/sql_exporter/config"
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// staticJob is a job gatherer returning fixed metric families, one series per name.
+type staticJob struct {
+	job   string
+	names []string
+}
+
+func (j *staticJob) Job() string {
+	return j.job
+}
+
+func (j *staticJob) Gather() ([]*dto.MetricFamily, error) {
+	var mfs []*dto.MetricFamily
+	for _, name := range j.names {
+		mfs = append(mfs, &dto.MetricFamily{
+			Name: proto.String(name),
+			Help: proto.String("Help."),
+			Type: dto.MetricType_GAUGE.Enum(),
+			Metric: []*dto.Metric{{
+				Label: []*dto.LabelPair{{Name: proto.String("job"), Value: proto.String(j.job)}},
+				Gauge: &dto.Gauge{Value: proto.Float64(1)},
+			}},
+		})
+	}
+	return mfs, nil
+}
+
+// jobsExporter is an Exporter gathering static jobs. Only the methods used by the metrics handler are implemented.
+type jobsExporter struct {
+	sql_exporter.Exporter
+	config *config.Config
+	jobs   prometheus.Gatherers
+}
+
+func (e *jobsExporter) Config() *config.Config {
+	return e.config
+}
+
+func (e *jobsExporter) JobGatherers(context.Context) prometheus.Gatherers {
+	return e.jobs
+}
+
+var familyRE = regexp.MustCompile(`(?m)^# TYPE (\w+)`)
+
+func TestExporterHandlerStreaming(t *testing.T) {
+	c, err := config.Parse([]byte(fixtureConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &jobsExporter{config: c, jobs: prometheus.Gatherers{
+		&staticJob{"a", []string{"up", "a_only"}},
+		&staticJob{"b", []string{"up", "b_only"}},
+	}}
+	handler := ExporterHandlerFor(e)
+
+	tests := []struct {
+		jobs     []*staticJob // replacing the jobs' families before the scrape, if not nil
+		families string       // in order
+		err      bool
+	}{
+		// Without history, all families are merged and sorted.
+		{nil, "a_only,b_only,up", false},
+		// Families exported by a single job come first, job by job.
+		{nil, "a_only,b_only,up", false},
+		{[]*staticJob{{"a", []string{"up", "z_a_only"}}, {"b", []string{"up", "b_only"}}}, "b_only,up,z_a_only", false},
+		{nil, "z_a_only,b_only,up", false},
+		// Job b exporting a family so far exported by job a alone: it's dropped from job b for this scrape.
+		{[]*staticJob{{"a", []string{"up", "z_a_only"}}, {"b", []string{"up", "z_a_only"}}}, "z_a_only,up", true},
+		{nil, "up,z_a_only", false},
+	}
+	for i, test := range tests {
+		if test.jobs != nil {
+			e.jobs = prometheus.Gatherers{test.jobs[0], test.jobs[1]}
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("scrape #%d: unexpected status %d, body:\n%s", i+1, rec.Code, rec.Body)
+		}
+		body := rec.Body.String()
+		if _, err := new(expfmt.TextParser).TextToMetricFamilies(strings.NewReader(body)); err != nil {
+			t.Errorf("scrape #%d: invalid exposition: %s\n%s", i+1, err, body)
+		}
+		var families []string
+		for _, m := range familyRE.FindAllStringSubmatch(body, -1) {
+			families = append(families, m[1])
+		}
+		if got := strings.Join(families, ","); got != test.families {
+			t.Errorf("scrape #%d: expected families %s, got %s", i+1, test.families, got)
+		}
+		if want := `z_a_only{job="b"}`; test.err && strings.Contains(body, want) {
+			t.Errorf("scrape #%d: unexpected %s:\n%s", i+1, want, body)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/free/sql_exporter"
+	"github.com/free/sql_exporter/config"
+	"github.com/free/sql_exporter/log"
+)
+
+var configWatchInterval = kingpin.Flag("config.watch-interval",
+	"How often to check the configuration and data source name files for changes, e.g. rotated credentials, and reload "+
+		"the targets' data source names if any changed. 0 to only reload on SIGHUP.").Default("1m").Duration()
+
+// watchDataSources reloads the configuration from configFile and replaces the data source names of the exporter's
+// targets with the reloaded ones on SIGHUP and, if interval is positive, whenever the configuration file(s) or data
+// source name files change. Other configuration changes are ignored, they require a restart.
+func watchDataSources(exporter sql_exporter.Exporter, configFile string, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	var tick <-chan time.Time
+	if interval > 0 {
+		tick = time.NewTicker(interval).C
+	}
+
+	files := watchedFiles(configFile, exporter.Config())
+	stamp := filesStamp(files)
+	for {
+		select {
+		case <-hup:
+			log.Info("Received SIGHUP, reloading data source names")
+		case <-tick:
+			if filesStamp(files) == stamp {
+				continue
+			}
+			log.Info("Configuration or data source name files changed, reloading data source names")
+		}
+
+		// Don't retry until the files change again, if reloading fails.
+		stamp = filesStamp(files)
+		c, err := sql_exporter.LoadConfig(configFile)
+		if err != nil {
+			log.Errorf("Error reloading configuration, keeping the previous data source names: %s", err)
+			continue
+		}
+		if err := exporter.UpdateDataSources(c); err != nil {
+			log.Errorf("Error reloading configuration: %s", err)
+		}
+		files = watchedFiles(configFile, c)
+		stamp = filesStamp(files)
+	}
+}
+
+// watchedFiles returns the configuration file (or the files in the configuration directory) and the data source name
+// files of c.
+func watchedFiles(configFile string, c *config.Config) []string {
+	var files []string
+	if configFile != config.StdinConfigFile {
+		files = append(files, configFile)
+		if fi, err := os.Stat(configFile); err == nil && fi.IsDir() {
+			ymls, _ := filepath.Glob(filepath.Join(configFile, "*.yml"))
+			files = append(files, ymls...)
+		}
+	}
+	return append(files, c.DataSourceNameFiles()...)
+}
+
+// filesStamp returns a string that changes whenever any of files is modified, created or deleted.
+func filesStamp(files []string) string {
+	var b strings.Builder
+	for _, f := range files {
+		if fi, err := os.Stat(f); err == nil {
+			fmt.Fprintf(&b, "%s %d %d\n", f, fi.ModTime().UnixNano(), fi.Size())
+		} else {
+			fmt.Fprintf(&b, "%s missing\n", f)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/free/sql_exporter/config"
+)
+
+// serve serves handler on address, over HTTPS if wc configures TLS. Client certificates are verified if presented, but
+// only required for the paths wc.TLS.ClientCertRequired() returns true for, so that e.g. /healthz can remain open to
+// load balancer checks while /metrics requires mutual TLS.
+func serve(address string, wc *config.WebConfig, handler http.Handler) error {
+	if wc == nil || wc.TLS == nil {
+		return http.ListenAndServe(address, handler)
+	}
+	tc := wc.TLS
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if tc.ClientCAFile != "" {
+		pem, err := os.ReadFile(tc.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in client_ca_file %s", tc.ClientCAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	server := &http.Server{
+		Addr:      address,
+		Handler:   clientCertHandler(tc, handler),
+		TLSConfig: tlsConfig,
+	}
+	return server.ListenAndServeTLS(tc.CertFile, tc.KeyFile)
+}
+
+// clientCertHandler returns an http.Handler rejecting requests without a verified client certificate for the paths
+// that require one, passing all others on to h.
+func clientCertHandler(tc *config.WebTLSConfig, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if tc.ClientCertRequired(req.URL.Path) && (req.TLS == nil || len(req.TLS.VerifiedChains) == 0) {
+			http.Error(w, "Client certificate required", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
@@ -1,18 +1,45 @@
 package sql_exporter
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
 	"fmt"
+	"runtime/debug"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/free/sql_exporter/config"
 	"github.com/free/sql_exporter/errors"
-	log "github.com/golang/glog"
+	"github.com/free/sql_exporter/log"
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
 	dto "github.com/prometheus/client_model/go"
 )
 
+const (
+	collectorUpMetricName = "sql_collector_up"
+	collectorUpMetricHelp = "1 if the collector's values are fresh enough to be exported, 0 otherwise."
+
+	queryRowsMetricName = "sql_query_rows"
+	queryRowsMetricHelp = "Number of rows returned by the query."
+)
+
+var collectorLastSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "sql_exporter_collector_last_success_timestamp_seconds",
+	Help: "Time the collector last ran all its queries on the target successfully, in seconds since the epoch.",
+}, []string{"job", "instance", "collector"})
+
+var collectorCachedScrapes = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "sql_exporter_collector_cached_scrapes_total",
+	Help: "Number of scrapes served from the collector's cache (see min_interval and sample_every).",
+}, []string{"job", "instance", "collector"})
+
+func init() {
+	prometheus.MustRegister(collectorLastSuccess, collectorCachedScrapes)
+}
+
 // Collector is a self-contained group of SQL queries and metric families to collect from a specific database. It is
 // conceptually similar to a prometheus.Collector.
 type Collector interface {
@@ -25,11 +52,16 @@ type collector struct {
 	config     *config.CollectorConfig
 	queries    []*Query
 	logContext string
+	// Set to the time of each successful Collect() call.
+	lastSuccess prometheus.Gauge
 }
 
-// NewCollector returns a new Collector with the given configuration and database. The metrics it creates will all have
-// the provided const labels applied.
-func NewCollector(logContext string, cc *config.CollectorConfig, constLabels []*dto.LabelPair) (Collector, errors.WithContext) {
+// NewCollector returns a new Collector with the given configuration, database driver name, connection pooler (see
+// config.PoolerPgBouncer; empty if none) and time zone of the database's timestamps without an offset. The metrics it
+// creates will all have the provided const labels applied and their names prefixed with metricPrefix.
+func NewCollector(
+	logContext, driver, pooler string, loc *time.Location, cc *config.CollectorConfig, constLabels []*dto.LabelPair,
+	metricPrefix string, gc *config.GlobalConfig) (Collector, errors.WithContext) {
 	logContext = fmt.Sprintf("%s, collector=%q", logContext, cc.Name)
 
 	// Maps each query to the list of metric families it populates.
@@ -37,7 +69,7 @@ func NewCollector(logContext string, cc *config.CollectorConfig, constLabels []*
 
 	// Instantiate metric families.
 	for _, mc := range cc.Metrics {
-		mf, err := NewMetricFamily(logContext, mc, constLabels)
+		mf, err := NewMetricFamily(logContext, mc, constLabels, metricPrefix)
 		if err != nil {
 			return nil, err
 		}
@@ -48,35 +80,231 @@ func NewCollector(logContext string, cc *config.CollectorConfig, constLabels []*
 		queryMFs[mc.Query()] = append(mfs, mf)
 	}
 
-	// Instantiate queries.
-	queries := make([]*Query, 0, len(cc.Metrics))
-	for qc, mfs := range queryMFs {
+	// Instantiate log families, mapping each query to the list of log families it populates.
+	queryLFs := make(map[*config.QueryConfig][]*LogFamily, len(cc.Logs))
+	for _, lc := range cc.Logs {
+		queryLFs[lc.Query()] = append(queryLFs[lc.Query()], NewLogFamily(logContext, lc, constLabels, gc.LogOutput))
+		if _, found := queryMFs[lc.Query()]; !found {
+			queryMFs[lc.Query()] = nil
+		}
+	}
+
+	// Instantiate check families, mapping each query to the list of check families it evaluates.
+	queryCFs := make(map[*config.QueryConfig][]*CheckFamily, len(cc.Checks))
+	for _, chc := range cc.Checks {
+		cf := NewCheckFamily(logContext, chc, constLabels, gc.CheckAnnotations())
+		queryCFs[chc.Query()] = append(queryCFs[chc.Query()], cf)
+		if _, found := queryMFs[chc.Query()]; !found {
+			queryMFs[chc.Query()] = nil
+		}
+	}
+
+	// Instantiate queries, in the order in which they are first referenced.
+	queryOrder := make([]*config.QueryConfig, 0, len(queryMFs))
+	seen := make(map[*config.QueryConfig]bool, len(queryMFs))
+	for _, mc := range cc.Metrics {
+		queryOrder = appendQuery(queryOrder, seen, mc.Query())
+	}
+	for _, lc := range cc.Logs {
+		queryOrder = appendQuery(queryOrder, seen, lc.Query())
+	}
+	for _, chc := range cc.Checks {
+		queryOrder = appendQuery(queryOrder, seen, chc.Query())
+	}
+	// Queries exporting a result checksum or row count run even if they populate nothing else.
+	for _, qc := range cc.Queries {
+		if qc.ResultChecksum || qc.ExportRowCount {
+			queryOrder = appendQuery(queryOrder, seen, qc)
+		}
+	}
+	dialect := DialectFor(driver).ForPooler(pooler)
+	// Statement labelling the sessions queries run in, if global.session_label is set and the driver supports it.
+	var sessionSetup string
+	if tmpl := gc.ParsedSessionLabel(); tmpl != nil && dialect.SessionLabelStatement != nil {
+		job, instance := jobAndInstance(constLabels)
+		var buf bytes.Buffer
+		data := map[string]string{"job": job, "instance": instance, "collector": cc.Name}
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return nil, errors.Wrapf(logContext, err, "rendering global.session_label failed")
+		}
+		sessionSetup = dialect.SessionLabelStatement(buf.String())
+	}
+
+	// Target labels, for rendering query parameters.
+	targetLabels := make(map[string]string, len(constLabels))
+	for _, lp := range constLabels {
+		targetLabels[lp.GetName()] = lp.GetValue()
+	}
+	job, instance := jobAndInstance(constLabels)
+	queries := make([]*Query, 0, len(queryMFs))
+	for _, qc := range queryOrder {
+		mfs := queryMFs[qc]
 		q, err := NewQuery(logContext, qc, mfs...)
 		if err != nil {
 			return nil, err
 		}
+		setQueryInfo(job, instance, cc.Name, qc.Name, q.fingerprint)
+		q.logFamilies = queryLFs[qc]
+		params, perr := qc.RenderParams(targetLabels)
+		if perr != nil {
+			return nil, errors.Wrap(q.logContext, perr)
+		}
+		q.paramValues = params
+		q.location = loc
+		if err := q.setDialect(dialect); err != nil {
+			return nil, err
+		}
+		if qc.Pagination != nil && q.dialect.Page == nil {
+			return nil, errors.Errorf(q.logContext, "pagination not supported for driver %q", driver)
+		}
+		if qc.Isolation != "" && !q.dialect.SupportsIsolation {
+			return nil, errors.Errorf(q.logContext, "isolation not supported for driver %q", driver)
+		}
+		if qc.ReadOnly && !q.dialect.SupportsReadOnly {
+			return nil, errors.Errorf(q.logContext, "read_only not supported for driver %q", driver)
+		}
+		if err := q.addCheckFamilies(queryCFs[qc]...); err != nil {
+			return nil, err
+		}
+		q.explainer = newExplainer(q.logContext, driver, cc.ExplainAfterTimeouts, time.Duration(gc.ExplainTimeout))
+		q.quarantine = newQueryQuarantine(q.logContext, gc.Quarantine, constLabels, cc.Name, qc.Name)
+		q.schema = newQuerySchema(q.logContext, constLabels, cc.Name, qc.Name)
+		q.truncations = newQueryTruncations(constLabels, cc.Name, qc.Name)
+		if qc.ResultChecksum {
+			q.checksum = newQueryChecksum(constLabels, cc.Name, qc.Name)
+		}
+		if qc.ExportRowCount {
+			labelPairs := append(constLabels[:0:0], constLabels...)
+			labelPairs = append(labelPairs,
+				&dto.LabelPair{Name: proto.String("collector"), Value: proto.String(cc.Name)},
+				&dto.LabelPair{Name: proto.String("query"), Value: proto.String(qc.Name)})
+			sort.Sort(labelPairSorter(labelPairs))
+			q.rowCountDesc = NewAutomaticMetricDesc(
+				q.logContext, queryRowsMetricName, queryRowsMetricHelp, prometheus.GaugeValue, labelPairs)
+		}
+		q.sessionSetup = sessionSetup
+		if qc.RowProcessor != nil {
+			if q.rowProcessor, err = loadRowProcessor(q.logContext, qc.RowProcessor, gc.ScriptMaxSteps); err != nil {
+				return nil, err
+			}
+			q.droppedRows = rowProcessorDroppedRows.WithLabelValues(job, instance, cc.Name, qc.Name)
+			q.droppedRows.Add(0)
+		}
+		if qc.WatermarkColumn != "" {
+			store, err := openWatermarkStore(gc.WatermarkFile)
+			if err != nil {
+				return nil, errors.Wrapf(q.logContext, err, "loading watermarks failed")
+			}
+			q.watermarks = store
+			q.watermarkKey = watermarkKey(job, instance, cc.Name, qc.Name)
+		}
 		queries = append(queries, q)
 	}
 
 	c := collector{
-		config:     cc,
-		queries:    queries,
-		logContext: logContext,
+		config:      cc,
+		queries:     queries,
+		logContext:  logContext,
+		lastSuccess: collectorLastSuccess.WithLabelValues(job, instance, cc.Name),
 	}
-	if c.config.MinInterval > 0 {
-		log.V(2).Infof("[%s] Non-zero min_interval (%s), using cached collector.", logContext, c.config.MinInterval)
-		return newCachingCollector(&c), nil
+	var coll Collector = &c
+	if c.config.MinInterval > 0 || c.config.SampleEvery > 1 {
+		log.V(2).Infof("[%s] Non-zero min_interval (%s) or sample_every (%d), using cached collector.",
+			logContext, c.config.MinInterval, c.config.SampleEvery)
+		coll = newCachingCollector(&c, collectorCachedScrapes.WithLabelValues(job, instance, cc.Name))
+	}
+	if (c.config.OnError != "" && c.config.OnError != config.OnErrorOmit) || c.config.MaxStaleness > 0 {
+		log.V(2).Infof("[%s] on_error set to %s, max_staleness set to %s, using error handling collector.",
+			logContext, c.config.OnError, c.config.MaxStaleness)
+		coll = newErrorHandlingCollector(coll, cc, constLabels, logContext)
+	}
+	return coll, nil
+}
+
+// rawCollector returns the collector underlying coll, unwrapping any caching or error handling.
+func rawCollector(coll Collector) *collector {
+	switch c := coll.(type) {
+	case *errorHandlingCollector:
+		return rawCollector(c.coll)
+	case *cachingCollector:
+		return c.rawColl
+	case *collector:
+		return c
+	}
+	return nil
+}
+
+// appendQuery appends qc to queries, unless already seen.
+func appendQuery(
+	queries []*config.QueryConfig, seen map[*config.QueryConfig]bool, qc *config.QueryConfig) []*config.QueryConfig {
+	if seen[qc] {
+		return queries
 	}
-	return &c, nil
+	seen[qc] = true
+	return append(queries, qc)
 }
 
 // Collect implements Collector.
 func (c *collector) Collect(ctx context.Context, conn *sql.DB, ch chan<- Metric) {
+	start := time.Now()
+	scope := auditScopeFrom(ctx)
+	scope.collector = c.config.Name
+	ctx = withAuditScope(ctx, scope)
+	collChan := make(chan Metric, capMetricChan)
+	go func() {
+		defer close(collChan)
+		defer recoverCollect(c.logContext, collChan)
+		c.collect(ctx, conn, collChan)
+	}()
+
+	failed := false
+	for metric := range collChan {
+		failed = failed || isInvalid(metric)
+		ch <- metric
+	}
+	// Quarantined queries are skipped silently, so they don't count as successful. Nor do dry runs.
+	if !failed && ctx.Err() == nil && !isDryRun(ctx) && !c.quarantined(start) {
+		c.lastSuccess.SetToCurrentTime()
+	}
+}
+
+// recoverCollect, deferred by the goroutines running collectors and queries, recovers from a panic and pipes it into ch
+// as an invalid metric. A panic in a goroutine can only be recovered by that goroutine, so without it a panicking
+// collector (e.g. a driver bug) would crash the exporter rather than fail alone.
+func recoverCollect(logContext string, ch chan<- Metric) {
+	if r := recover(); r != nil {
+		log.Errorf("[%s] Panic collecting metrics: %v\n%s", logContext, r, debug.Stack())
+		ch <- NewInvalidMetric(errors.Errorf(logContext, "panic collecting metrics: %v", r))
+	}
+}
+
+// quarantined returns true if any of the collector's queries is quarantined at time now.
+func (c *collector) quarantined(now time.Time) bool {
+	for _, q := range c.queries {
+		if q.quarantine != nil && q.quarantine.skip(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// collect runs the collector's queries, piping their metrics into ch, and returns once all have completed.
+func (c *collector) collect(ctx context.Context, conn *sql.DB, ch chan<- Metric) {
+	if c.config.SingleConnection && !*demoMode {
+		c.collectPinned(ctx, conn, ch)
+		return
+	}
+	if c.config.MaxParallelQueries > 0 {
+		c.collectBounded(ctx, conn, ch)
+		return
+	}
+
 	var wg sync.WaitGroup
 	wg.Add(len(c.queries))
 	for _, q := range c.queries {
 		go func(q *Query) {
 			defer wg.Done()
+			defer recoverCollect(q.logContext, ch)
 			q.Collect(ctx, conn, ch)
 		}(q)
 	}
@@ -84,23 +312,80 @@ func (c *collector) Collect(ctx context.Context, conn *sql.DB, ch chan<- Metric)
 	wg.Wait()
 }
 
-// newCachingCollector returns a new Collector wrapping the provided raw Collector.
-func newCachingCollector(rawColl *collector) Collector {
+// collectPinned runs all queries sequentially, in configuration order, on a single connection (so that session state,
+// e.g. temporary tables, is shared among them).
+func (c *collector) collectPinned(ctx context.Context, conn *sql.DB, ch chan<- Metric) {
+	pinned, err := conn.Conn(ctx)
+	if err != nil {
+		ch <- NewInvalidMetric(errors.Wrapf(c.logContext, err, "acquiring connection failed"))
+		return
+	}
+	defer pinned.Close()
+
+	for _, q := range c.queries {
+		q.collect(ctx, conn, pinned, ch)
+	}
+}
+
+// collectBounded runs at most max_parallel_queries queries concurrently, started in configuration order. Metrics are
+// piped through in the same order, i.e. all metrics from one query before any metrics from the next.
+func (c *collector) collectBounded(ctx context.Context, conn *sql.DB, ch chan<- Metric) {
+	var (
+		sem   = make(chan struct{}, c.config.MaxParallelQueries)
+		chans = make([]chan Metric, len(c.queries))
+	)
+	for i := range chans {
+		chans[i] = make(chan Metric, capMetricChan)
+	}
+
+	// Acquire the semaphore in query order, so a query never waits for one that is itself blocked on its full channel.
+	go func() {
+		for i, q := range c.queries {
+			sem <- struct{}{}
+			go func(q *Query, out chan Metric) {
+				defer func() {
+					close(out)
+					<-sem
+				}()
+				defer recoverCollect(q.logContext, out)
+				q.Collect(ctx, conn, out)
+			}(q, chans[i])
+		}
+	}()
+
+	for _, out := range chans {
+		for metric := range out {
+			ch <- metric
+		}
+	}
+}
+
+// newCachingCollector returns a new Collector wrapping the provided raw Collector, counting scrapes served from the
+// cache in cachedScrapes.
+func newCachingCollector(rawColl *collector, cachedScrapes prometheus.Counter) Collector {
 	cc := &cachingCollector{
-		rawColl:     rawColl,
-		minInterval: time.Duration(rawColl.config.MinInterval),
-		cacheSem:    make(chan time.Time, 1),
+		rawColl:       rawColl,
+		cachedScrapes: cachedScrapes,
+		minInterval:   time.Duration(rawColl.config.MinInterval),
+		sampleEvery:   rawColl.config.SampleEvery,
+		cacheSem:      make(chan time.Time, 1),
 	}
 	cc.cacheSem <- time.Time{}
 	return cc
 }
 
-// Collector with a cache for collected metrics. Only used when min_interval is non-zero.
+// Collector with a cache for collected metrics. Only used when min_interval is non-zero or sample_every is above 1.
 type cachingCollector struct {
 	// Underlying collector, which is being cached.
 	rawColl *collector
 	// Convenience copy of rawColl.config.MinInterval.
 	minInterval time.Duration
+	// Convenience copy of rawColl.config.SampleEvery.
+	sampleEvery int
+	// Number of Collect() calls served from the cache since the last fresh collection. Protected by cacheSem.
+	cacheHits int
+	// Total number of Collect() calls served from the cache.
+	cachedScrapes prometheus.Counter
 
 	// Used as a non=blocking semaphore protecting the cache. The value in the channel is the time of the cached metrics.
 	cacheSem chan time.Time
@@ -114,20 +399,32 @@ func (cc *cachingCollector) Collect(ctx context.Context, conn *sql.DB, ch chan<-
 		ch <- NewInvalidMetric(errors.Wrap(cc.rawColl.logContext, ctx.Err()))
 		return
 	}
+	// Traced runs are always fresh and not cached.
+	if traceFrom(ctx) != nil {
+		cc.rawColl.Collect(ctx, conn, ch)
+		return
+	}
 
 	collTime := time.Now()
 	select {
 	case cacheTime := <-cc.cacheSem:
 		// Have the lock.
-		if age := collTime.Sub(cacheTime); age > cc.minInterval {
+		age := collTime.Sub(cacheTime)
+		fresh := age > cc.minInterval
+		if cc.sampleEvery > 0 {
+			fresh = cacheTime.IsZero() || cc.cacheHits+1 >= cc.sampleEvery
+		}
+		if fresh {
+			cc.cacheHits = 0
 			// Cache contents are older than minInterval, collect fresh metrics, cache them and pipe them through.
 			log.V(2).Infof("[%s] Collecting fresh metrics: min_interval=%.3fs cache_age=%.3fs",
 				cc.rawColl.logContext, cc.minInterval.Seconds(), age.Seconds())
 			cacheChan := make(chan Metric, capMetricChan)
 			cc.cache = make([]Metric, 0, len(cc.cache))
 			go func() {
+				defer close(cacheChan)
+				defer recoverCollect(cc.rawColl.logContext, cacheChan)
 				cc.rawColl.Collect(ctx, conn, cacheChan)
-				close(cacheChan)
 			}()
 			for metric := range cacheChan {
 				cc.cache = append(cc.cache, metric)
@@ -135,8 +432,11 @@ func (cc *cachingCollector) Collect(ctx context.Context, conn *sql.DB, ch chan<-
 			}
 			cacheTime = collTime
 		} else {
-			log.V(2).Infof("[%s] Returning cached metrics: min_interval=%.3fs cache_age=%.3fs",
-				cc.rawColl.logContext, cc.minInterval.Seconds(), age.Seconds())
+			cc.cacheHits++
+			cc.cachedScrapes.Inc()
+			log.V(2).Infof("[%s] Skipping collector %q, returning cached metrics: min_interval=%.3fs sample_every=%d "+
+				"cache_age=%.3fs", cc.rawColl.logContext, cc.rawColl.config.Name, cc.minInterval.Seconds(), cc.sampleEvery,
+				age.Seconds())
 			for _, metric := range cc.cache {
 				ch <- metric
 			}
@@ -150,3 +450,125 @@ func (cc *cachingCollector) Collect(ctx context.Context, conn *sql.DB, ch chan<-
 		ch <- NewInvalidMetric(errors.Wrap(cc.rawColl.logContext, ctx.Err()))
 	}
 }
+
+// newErrorHandlingCollector returns a new Collector wrapping the provided Collector and applying the on_error failure
+// mode and max_staleness of the given collector config.
+func newErrorHandlingCollector(
+	coll Collector, cc *config.CollectorConfig, constLabels []*dto.LabelPair, logContext string) Collector {
+	ec := &errorHandlingCollector{
+		coll:         coll,
+		onError:      cc.OnError,
+		maxStaleness: time.Duration(cc.MaxStaleness),
+		logContext:   logContext,
+	}
+	if ec.maxStaleness > 0 {
+		labelPairs := append(constLabels[:0:0], constLabels...)
+		labelPairs = append(labelPairs, &dto.LabelPair{
+			Name:  proto.String("collector"),
+			Value: proto.String(cc.Name),
+		})
+		sort.Sort(labelPairSorter(labelPairs))
+		ec.upDesc = NewAutomaticMetricDesc(
+			logContext, collectorUpMetricName, collectorUpMetricHelp, prometheus.GaugeValue, labelPairs)
+	}
+	return ec
+}
+
+// Collector applying a failure mode (zero, stale or fail) when any of the wrapped collector's metrics is invalid and
+// dropping re-exported values older than max_staleness. Only used when on_error is set to something other than omit or
+// max_staleness is set.
+type errorHandlingCollector struct {
+	coll         Collector
+	onError      string
+	maxStaleness time.Duration
+	logContext   string
+	// Descriptor of the collector's up metric, only exported if maxStaleness is set.
+	upDesc MetricDesc
+
+	// Protects last and lastTime.
+	mtx sync.Mutex
+	// Metrics from the last successful Collect() call.
+	last []Metric
+	// Time of the last successful Collect() call.
+	lastTime time.Time
+}
+
+// Collect implements Collector.
+func (ec *errorHandlingCollector) Collect(ctx context.Context, conn *sql.DB, ch chan<- Metric) {
+	collTime := time.Now()
+	collChan := make(chan Metric, capMetricChan)
+	go func() {
+		defer close(collChan)
+		defer recoverCollect(ec.logContext, collChan)
+		ec.coll.Collect(ctx, conn, collChan)
+	}()
+
+	// Buffer all metrics, as we only know what to do with them once we know whether the collector failed.
+	var (
+		metrics = make([]Metric, 0, capMetricChan)
+		errs    = make([]Metric, 0)
+	)
+	for metric := range collChan {
+		if isInvalid(metric) {
+			errs = append(errs, metric)
+		} else {
+			metrics = append(metrics, metric)
+		}
+	}
+
+	ec.mtx.Lock()
+	defer ec.mtx.Unlock()
+
+	if len(errs) == 0 {
+		// Sampled runs only return part of the metrics, don't keep them around. Nor those of dry runs.
+		if rowLimitFrom(ctx) == 0 && !isDryRun(ctx) {
+			ec.last = metrics
+			ec.lastTime = collTime
+		}
+		for _, metric := range metrics {
+			ch <- metric
+		}
+		ec.collectUp(ch, true)
+		return
+	}
+
+	log.V(1).Infof("[%s] Collector failed, on_error=%s", ec.logContext, ec.onError)
+	if ec.maxStaleness > 0 && ec.last != nil && collTime.Sub(ec.lastTime) > ec.maxStaleness {
+		log.Warningf("[%s] Dropping values older than max_staleness (%s), last collected at %s",
+			ec.logContext, ec.maxStaleness, ec.lastTime.Format(time.RFC3339))
+		ec.last = nil
+	}
+	switch ec.onError {
+	case config.OnErrorZero:
+		for _, metric := range ec.last {
+			if zm := zeroMetric(metric); zm != nil {
+				ch <- zm
+			}
+		}
+	case config.OnErrorStale:
+		for _, metric := range ec.last {
+			ch <- metric
+		}
+	case config.OnErrorFail:
+		for _, metric := range errs {
+			ch <- NewFatalMetric(metric.(invalidMetric).err)
+		}
+		return
+	}
+	for _, metric := range errs {
+		ch <- metric
+	}
+	ec.collectUp(ch, ec.last != nil && (ec.onError == config.OnErrorZero || ec.onError == config.OnErrorStale))
+}
+
+// collectUp exports the collector's up metric, if max_staleness is set.
+func (ec *errorHandlingCollector) collectUp(ch chan<- Metric, up bool) {
+	if ec.upDesc == nil {
+		return
+	}
+	value := 0.0
+	if up {
+		value = 1
+	}
+	ch <- NewMetric(ec.upDesc, value)
+}
@@ -0,0 +1,141 @@
+package sql_exporter
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var collectorBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "sql_exporter_collector_bytes",
+	Help: "Approximate size in bytes of the metric names, labels and values produced by the collector for the target " +
+		"in the last scrape.",
+}, []string{"job", "instance", "collector"})
+
+func init() {
+	prometheus.MustRegister(collectorBytes)
+}
+
+// CollectorSize is the approximate size of the metrics produced by a collector for a target in the last scrape.
+type CollectorSize struct {
+	Job       string
+	Instance  string
+	Collector string
+	Samples   int
+	Bytes     int
+}
+
+// collectorSizeSet keeps track of the size of the metrics produced by each collector for each target.
+type collectorSizeSet struct {
+	mtx   sync.Mutex
+	sizes map[[3]string]CollectorSize // keyed by job, instance and collector name
+}
+
+// collectorSizes is the one and only set of collector sizes.
+var collectorSizes = &collectorSizeSet{sizes: make(map[[3]string]CollectorSize)}
+
+// record records the size of the metrics produced by the named collector for a target in the last scrape.
+func (cs *collectorSizeSet) record(job, instance, collector string, samples, bytes int) {
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+	collectorBytes.WithLabelValues(job, instance, collector).Set(float64(bytes))
+	cs.sizes[[3]string{job, instance, collector}] = CollectorSize{
+		Job:       job,
+		Instance:  instance,
+		Collector: collector,
+		Samples:   samples,
+		Bytes:     bytes,
+	}
+}
+
+// remove deletes the sizes recorded for the collectors of a removed target.
+func (cs *collectorSizeSet) remove(job, instance string) {
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+	for key := range cs.sizes {
+		if key[0] == job && key[1] == instance {
+			collectorBytes.DeleteLabelValues(job, instance, key[2])
+			delete(cs.sizes, key)
+		}
+	}
+}
+
+// list returns the recorded sizes, largest first.
+func (cs *collectorSizeSet) list() []CollectorSize {
+	cs.mtx.Lock()
+	sizes := make([]CollectorSize, 0, len(cs.sizes))
+	for _, size := range cs.sizes {
+		sizes = append(sizes, size)
+	}
+	cs.mtx.Unlock()
+
+	sort.Slice(sizes, func(i, j int) bool {
+		if sizes[i].Bytes != sizes[j].Bytes {
+			return sizes[i].Bytes > sizes[j].Bytes
+		}
+		return sizes[i].Job+"/"+sizes[i].Instance+"/"+sizes[i].Collector <
+			sizes[j].Job+"/"+sizes[j].Instance+"/"+sizes[j].Collector
+	})
+	return sizes
+}
+
+// sizedMetric wraps a metric produced by a collector for a target, for gatherTargets to add its size to the collector's.
+type sizedMetric struct {
+	Metric
+	target    *target
+	collector string
+}
+
+// scrapeSizeKey identifies a collector of a target, see scrapeSizes.
+type scrapeSizeKey struct {
+	target    *target
+	collector string
+}
+
+// scrapeSizes accumulates the size of the metrics of each collector of each target over a scrape.
+type scrapeSizes map[scrapeSizeKey]*CollectorSize
+
+// add adds the size of m, as written to out, to the size of the collector that produced it (if a sizedMetric).
+func (ss scrapeSizes) add(m Metric, out *dto.Metric) {
+	sm, ok := m.(sizedMetric)
+	if !ok {
+		return
+	}
+	key := scrapeSizeKey{sm.target, sm.collector}
+	size := ss[key]
+	if size == nil {
+		size = &CollectorSize{}
+		ss[key] = size
+	}
+	samples, bytes := metricSize(sm.Desc().Name(), out)
+	size.Samples, size.Bytes = size.Samples+samples, size.Bytes+bytes
+}
+
+// record records the accumulated sizes, once the scrape completed.
+func (ss scrapeSizes) record() {
+	for key, size := range ss {
+		key.target.recordCollectorSize(key.collector, size.Samples, size.Bytes)
+	}
+}
+
+// metricSize returns the number of samples the named metric, as written to m, is exposed as and their approximate size
+// in text exposition format: metric name, labels and 8 bytes per value.
+func metricSize(name string, m *dto.Metric) (samples, bytes int) {
+	sampleBytes := len(name) + 8
+	for _, lp := range m.Label {
+		sampleBytes += len(lp.GetName()) + len(lp.GetValue())
+	}
+	switch {
+	case m.Histogram != nil:
+		// Buckets (including +Inf), sum and count. Buckets have an extra `le` label.
+		buckets := len(m.Histogram.Bucket) + 1
+		return buckets + 2, (buckets+2)*sampleBytes + buckets*len("le")
+	case m.Summary != nil:
+		// Quantiles, sum and count. Quantiles have an extra `quantile` label.
+		quantiles := len(m.Summary.Quantile)
+		return quantiles + 2, (quantiles+2)*sampleBytes + quantiles*len("quantile")
+	}
+	return 1, sampleBytes
+}
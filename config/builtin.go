@@ -0,0 +1,57 @@
+package config
+
+import (
+	"embed"
+	"fmt"
+
+	"github.com/free/sql_exporter/log"
+	"gopkg.in/yaml.v2"
+)
+
+// builtinCollectorFiles holds the standard collectors compiled into the exporter, one per file named
+// `<collector_name>.collector.yml`.
+//
+//go:embed builtin/*.collector.yml
+var builtinCollectorFiles embed.FS
+
+// loadBuiltinCollectors loads the built-in collectors referenced (by targets, jobs or collectors extending them) but
+// not defined by the configuration. Collectors defined by the configuration take precedence over built-in ones with
+// the same name.
+func (c *Config) loadBuiltinCollectors() error {
+	defined := make(map[string]bool, len(c.Collectors))
+	for _, coll := range c.Collectors {
+		defined[coll.Name] = true
+	}
+	var refs []string
+	if c.Target != nil {
+		refs = append(refs, c.Target.CollectorRefs...)
+	}
+	for _, j := range c.Jobs {
+		refs = append(refs, j.CollectorRefs...)
+	}
+	for _, coll := range c.Collectors {
+		if coll.Extends != "" {
+			refs = append(refs, coll.Extends)
+		}
+	}
+
+	for _, name := range refs {
+		if defined[name] {
+			continue
+		}
+		buf, err := builtinCollectorFiles.ReadFile("builtin/" + name + ".collector.yml")
+		if err != nil {
+			// Not a built-in collector either, reported when resolving references.
+			continue
+		}
+		cc := CollectorConfig{}
+		if err := yaml.Unmarshal(buf, &cc); err != nil {
+			return fmt.Errorf("error loading built-in collector %q: %s", name, err)
+		}
+		cc.setSource("builtin:" + name)
+		c.Collectors = append(c.Collectors, &cc)
+		defined[name] = true
+		log.Infof("Loaded built-in collector %q", name)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Metric name prefixes claimed by well known exporters (and client libraries) commonly running on the same hosts as
+// the exporter, mapped to the exporter claiming them. Metrics with these prefixes are likely to collide, e.g. when
+// both exporters' targets end up with the same labels.
+var wellKnownMetricPrefixes = map[string]string{
+	"node_":     "node_exporter",
+	"mysql_":    "mysqld_exporter",
+	"pg_":       "postgres_exporter",
+	"mongodb_":  "mongodb_exporter",
+	"oracledb_": "oracledb_exporter",
+	"redis_":    "redis_exporter",
+	"windows_":  "windows_exporter",
+	"go_":       "Prometheus Go client library",
+	"process_":  "Prometheus client libraries",
+	"promhttp_": "Prometheus Go client library",
+}
+
+// wellKnownCollisions returns one line per metric of the target's or jobs' collectors whose name (including the metric
+// prefix, if any) collides with the metrics of a well known exporter, empty if none.
+func (c *Config) wellKnownCollisions() []string {
+	var (
+		problems []string
+		seen     = make(map[string]bool)
+	)
+	check := func(prefix string, colls []*CollectorConfig) {
+		for _, coll := range colls {
+			for _, m := range coll.Metrics {
+				name := prefix + m.Name
+				if seen[coll.Name+"/"+name] {
+					continue
+				}
+				seen[coll.Name+"/"+name] = true
+				if exporter := wellKnownExporter(name); exporter != "" {
+					problems = append(problems, fmt.Sprintf(
+						"collector %q, metric %q: name collides with metrics exported by %s", coll.Name, name, exporter))
+				}
+			}
+		}
+	}
+	if c.Target != nil {
+		check(c.Globals.MetricPrefix, c.Target.collectors)
+	}
+	for _, j := range c.Jobs {
+		check(j.MetricPrefix, j.collectors)
+	}
+	return problems
+}
+
+// wellKnownExporter returns the well known exporter claiming the metric name, empty if none.
+func wellKnownExporter(name string) string {
+	for prefix, exporter := range wellKnownMetricPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return exporter
+		}
+	}
+	return ""
+}
@@ -0,0 +1,256 @@
+package config
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Target metadata variables that conditions may refer to.
+const (
+	// ConditionDriver is the database driver name, e.g. "postgres".
+	ConditionDriver = "driver"
+	// ConditionServerVersion is the numeric database server version, e.g. "13.4".
+	ConditionServerVersion = "server_version"
+	// ConditionEdition is the database server edition, e.g. "Enterprise Edition (64-bit)". Only available on SQL Server.
+	ConditionEdition = "edition"
+)
+
+var (
+	conditionVariables = []string{ConditionDriver, ConditionServerVersion, ConditionEdition}
+	// A single comparison: variable, operator and either a quoted string or an unquoted (e.g. numeric) value.
+	comparisonRE = regexp.MustCompile(`^\s*([a-z_]+)\s*(==|!=|>=|<=|>|<)\s*(?:'([^']*)'|"([^"]*)"|([^\s'"]+))\s*$`)
+	// Numeric, dotted versions, e.g. "13" or "5.7.30".
+	versionRE = regexp.MustCompile(`^\d+(\.\d+)*$`)
+)
+
+// Condition is a boolean expression evaluated against target metadata (see the Condition* variables), deciding
+// whether a collector or metric applies to a target. It is one or more comparisons, joined by `&&`, e.g.
+// `server_version >= 13 && edition != 'Express'`. Numeric, dotted versions are compared component-wise, anything else
+// as strings.
+type Condition struct {
+	text        string
+	comparisons []comparison
+}
+
+type comparison struct {
+	variable, operator, value string
+}
+
+// ParseCondition parses the provided condition text. It returns nil for an empty text, i.e. always true.
+func ParseCondition(text string) (*Condition, error) {
+	if strings.TrimSpace(text) == "" {
+		return nil, nil
+	}
+	c := &Condition{text: text}
+	for _, part := range strings.Split(text, "&&") {
+		m := comparisonRE.FindStringSubmatch(part)
+		if m == nil {
+			return nil, fmt.Errorf("invalid condition %q, expecting `<variable> <operator> <value>` joined by &&", text)
+		}
+		if !contains(conditionVariables, m[1]) {
+			return nil, fmt.Errorf("unknown variable %q in condition %q, expecting one of %s",
+				m[1], text, strings.Join(conditionVariables, ", "))
+		}
+		c.comparisons = append(c.comparisons, comparison{variable: m[1], operator: m[2], value: m[3] + m[4] + m[5]})
+	}
+	return c, nil
+}
+
+// String returns the condition text.
+func (c *Condition) String() string {
+	return c.text
+}
+
+// Eval evaluates the condition against the provided target metadata. A nil condition is always true.
+func (c *Condition) Eval(metadata map[string]string) bool {
+	if c == nil {
+		return true
+	}
+	for _, cmp := range c.comparisons {
+		if !cmp.eval(metadata[cmp.variable]) {
+			return false
+		}
+	}
+	return true
+}
+
+// eval applies the comparison to the provided actual value.
+func (cmp *comparison) eval(actual string) bool {
+	var order int
+	if versionRE.MatchString(actual) && versionRE.MatchString(cmp.value) {
+		order = compareVersions(actual, cmp.value)
+	} else {
+		order = strings.Compare(actual, cmp.value)
+	}
+	switch cmp.operator {
+	case "==":
+		return order == 0
+	case "!=":
+		return order != 0
+	case ">=":
+		return order >= 0
+	case "<=":
+		return order <= 0
+	case ">":
+		return order > 0
+	default:
+		return order < 0
+	}
+}
+
+// compareVersions compares two numeric, dotted versions component-wise, missing components being 0. It returns -1, 0
+// or 1 if a is less than, equal to or greater than b.
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// A single row comparison: column name, operator and either a quoted string or an unquoted (e.g. numeric) value.
+var rowComparisonRE = regexp.MustCompile(
+	`^\s*([A-Za-z_][A-Za-z0-9_]*)\s*(==|!=|>=|<=|>|<)\s*(?:'([^']*)'|"([^"]*)"|([^\s'"]+))\s*$`)
+
+// RowCondition is a boolean expression evaluated against the columns of a query result row, deciding whether a metric
+// is exported for the row (see MetricConfig.EmitIf). Same syntax as Condition, but its variables are column names.
+// Numbers are compared numerically, anything else as strings; NULL (and NaN) values only match `== null`.
+type RowCondition struct {
+	text        string
+	comparisons []rowComparison
+}
+
+type rowComparison struct {
+	column, operator, value string
+	null                    bool // the value is an unquoted `null`
+}
+
+// ParseRowCondition parses the provided row condition text. It returns nil for an empty text, i.e. always true.
+func ParseRowCondition(text string) (*RowCondition, error) {
+	if strings.TrimSpace(text) == "" {
+		return nil, nil
+	}
+	c := &RowCondition{text: text}
+	for _, part := range strings.Split(text, "&&") {
+		m := rowComparisonRE.FindStringSubmatch(part)
+		if m == nil {
+			return nil, fmt.Errorf("invalid condition %q, expecting `<column> <operator> <value>` joined by &&", text)
+		}
+		null := strings.EqualFold(m[5], "null")
+		if null && m[2] != "==" && m[2] != "!=" {
+			return nil, fmt.Errorf("invalid condition %q, null may only be compared with == or !=", text)
+		}
+		c.comparisons = append(c.comparisons,
+			rowComparison{column: m[1], operator: m[2], value: m[3] + m[4] + m[5], null: null})
+	}
+	return c, nil
+}
+
+// String returns the condition text.
+func (c *RowCondition) String() string {
+	return c.text
+}
+
+// Columns returns the names of the columns the condition refers to.
+func (c *RowCondition) Columns() []string {
+	if c == nil {
+		return nil
+	}
+	columns := make([]string, 0, len(c.comparisons))
+	for _, cmp := range c.comparisons {
+		if !contains(columns, cmp.column) {
+			columns = append(columns, cmp.column)
+		}
+	}
+	return columns
+}
+
+// Eval evaluates the condition against the provided row, with column values of type float64 (NaN for NULL), string
+// or, for columns the condition alone refers to, as returned by the driver. A nil condition is always true.
+func (c *RowCondition) Eval(row map[string]interface{}) bool {
+	if c == nil {
+		return true
+	}
+	for _, cmp := range c.comparisons {
+		if !cmp.eval(row[cmp.column]) {
+			return false
+		}
+	}
+	return true
+}
+
+// eval applies the comparison to the provided actual column value.
+func (cmp *rowComparison) eval(actual interface{}) bool {
+	var (
+		value    string
+		number   float64
+		isNumber bool
+	)
+	switch v := actual.(type) {
+	case nil:
+		return cmp.null == (cmp.operator == "==")
+	case float64:
+		if math.IsNaN(v) {
+			return cmp.null == (cmp.operator == "==")
+		}
+		number, isNumber = v, true
+	case []byte:
+		value = string(v)
+	case string:
+		value = v
+	default:
+		value = fmt.Sprint(v)
+	}
+	if cmp.null {
+		return cmp.operator == "!="
+	}
+	if !isNumber {
+		var err error
+		number, err = strconv.ParseFloat(value, 64)
+		isNumber = err == nil
+	}
+
+	var order int
+	if expected, err := strconv.ParseFloat(cmp.value, 64); err == nil && isNumber {
+		switch {
+		case number < expected:
+			order = -1
+		case number > expected:
+			order = 1
+		}
+	} else {
+		if value == "" && isNumber {
+			value = strconv.FormatFloat(number, 'g', -1, 64)
+		}
+		order = strings.Compare(value, cmp.value)
+	}
+	switch cmp.operator {
+	case "==":
+		return order == 0
+	case "!=":
+		return order != 0
+	case ">=":
+		return order >= 0
+	case "<=":
+		return order <= 0
+	case ">":
+		return order > 0
+	default:
+		return order < 0
+	}
+}
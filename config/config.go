@@ -1,32 +1,79 @@
 package config
 
 import (
+	"bytes"
 	"fmt"
-	"io/ioutil"
+	"math"
+	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"text/template"
 	"time"
+	// Embeds the IANA time zone database, for target and maintenance window timezones on hosts (e.g. scratch
+	// containers or Windows) without one.
+	_ "time/tzdata"
 
-	log "github.com/golang/glog"
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/free/sql_exporter/log"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/model"
 	"gopkg.in/yaml.v2"
 )
 
-// Load attempts to parse the given config file and return a Config object.
+// Whether unknown configuration fields are an error, see the --config.strict flag. Set to the default in advance, as
+// kingpin only does so when parsing the command line.
+var strictMode = true
+
+func init() {
+	kingpin.Flag("config.strict",
+		"Fail on unknown configuration fields. If false, unknown fields are logged and ignored (e.g. when migrating "+
+			"from other exporter forks).").Default("true").BoolVar(&strictMode)
+}
+
+// Load attempts to parse the given config file and return a Config object. configFile may also be a directory, whose
+// `*.yml` files are merged into one configuration, or StdinConfigFile to read the configuration from the standard
+// input, see readConfigFile.
 func Load(configFile string) (*Config, error) {
-	log.Infof("Loading configuration from %s", configFile)
-	buf, err := ioutil.ReadFile(configFile)
+	log.Infof("Loading configuration from %s", configSource(configFile))
+	buf, baseFile, err := readConfigFile(configFile)
 	if err != nil {
 		return nil, err
 	}
 
-	c := Config{configFile: configFile}
-	err = yaml.Unmarshal(buf, &c)
+	return parse(buf, baseFile)
+}
+
+// LoadWithCollectorFiles is the equivalent of Load, but with the configuration's collector_files replaced by
+// collectorFiles (e.g. to compare the metrics of two versions of a collector bundle). Relative collectorFiles are
+// resolved relative to the configuration file's directory, same as collector_files.
+func LoadWithCollectorFiles(configFile string, collectorFiles []string) (*Config, error) {
+	log.Infof("Loading configuration from %s, with collector files %q", configSource(configFile), collectorFiles)
+	buf, baseFile, err := readConfigFile(configFile)
 	if err != nil {
 		return nil, err
 	}
 
+	c := Config{configFile: baseFile, collectorFilesOverride: collectorFiles}
+	if err := yaml.Unmarshal(buf, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// Parse parses the provided YAML configuration and returns a Config object, for programs embedding the exporter that
+// don't keep its configuration in a file of its own. Relative paths (e.g. collector_files) are resolved relative to the
+// current working directory.
+func Parse(buf []byte) (*Config, error) {
+	return parse(buf, "")
+}
+
+// parse parses the provided YAML configuration, read from configFile (if not empty).
+func parse(buf []byte, configFile string) (*Config, error) {
+	c := Config{configFile: configFile}
+	if err := yaml.Unmarshal(buf, &c); err != nil {
+		return nil, err
+	}
 	return &c, nil
 }
 
@@ -36,13 +83,18 @@ func Load(configFile string) (*Config, error) {
 
 // Config is a collection of jobs and collectors.
 type Config struct {
-	Globals        *GlobalConfig      `yaml:"global"`
-	CollectorFiles []string           `yaml:"collector_files,omitempty"`
-	Target         *TargetConfig      `yaml:"target,omitempty"`
-	Jobs           []*JobConfig       `yaml:"jobs,omitempty"`
-	Collectors     []*CollectorConfig `yaml:"collectors,omitempty"`
+	Globals          *GlobalConfig      `yaml:"global"`
+	CollectorFiles   []string           `yaml:"collector_files,omitempty"`
+	CollectorScripts []string           `yaml:"collector_scripts,omitempty"`
+	Target           *TargetConfig      `yaml:"target,omitempty"`
+	Jobs             []*JobConfig       `yaml:"jobs,omitempty"`
+	Collectors       []*CollectorConfig `yaml:"collectors,omitempty"`
+	Web              *WebConfig         `yaml:"web,omitempty"`
 
 	configFile string
+	// Replaces CollectorFiles if not nil, see LoadWithCollectorFiles.
+	collectorFilesOverride []string
+	warnings               []string // see Warnings()
 
 	// Catches all undefined fields and must be empty after parsing.
 	XXX map[string]interface{} `yaml:",inline" json:"-"`
@@ -54,55 +106,200 @@ func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if err := unmarshal((*plain)(c)); err != nil {
 		return err
 	}
+	if c.collectorFilesOverride != nil {
+		c.CollectorFiles = c.collectorFilesOverride
+	}
+
+	// Apply global defaults if no `global` section is present.
+	if c.Globals == nil {
+		c.Globals = &GlobalConfig{}
+		if err := yaml.Unmarshal([]byte("{}"), c.Globals); err != nil {
+			return err
+		}
+	}
 
 	if (len(c.Jobs) == 0) == (c.Target == nil) {
 		return fmt.Errorf("exactly one of `jobs` and `target` must be defined")
 	}
 
-	// Load any externally defined collectors.
+	for _, coll := range c.Collectors {
+		coll.setSource(c.configFile)
+	}
+	// Load any externally defined or generated collectors.
 	if err := c.loadCollectorFiles(); err != nil {
 		return err
 	}
+	if err := c.loadCollectorScripts(); err != nil {
+		return err
+	}
+	if err := c.loadBuiltinCollectors(); err != nil {
+		return err
+	}
+	if err := c.resolveExtends(); err != nil {
+		return err
+	}
+	policy, err := loadPolicy()
+	if err != nil {
+		return err
+	}
+	denied := c.applyPolicy(policy)
 
 	// Populate collector references for the target/jobs.
 	colls := make(map[string]*CollectorConfig)
 	for _, coll := range c.Collectors {
-		// Set the min interval to the global default if not explicitly set.
-		if coll.MinInterval < 0 {
+		// Set the min interval to the global default if not explicitly set (and not sampling every N scrapes instead).
+		if coll.MinInterval < 0 && coll.SampleEvery > 0 {
+			coll.MinInterval = 0
+		} else if coll.MinInterval < 0 {
 			coll.MinInterval = c.Globals.MinInterval
 		}
+		if coll.ExplainAfterTimeouts < 0 {
+			coll.ExplainAfterTimeouts = c.Globals.ExplainAfterTimeouts
+		}
+		if coll.MaxStaleness > 0 && coll.MaxStaleness < coll.MinInterval {
+			return fmt.Errorf("max_staleness (%s) shorter than min_interval (%s) for collector %q",
+				coll.MaxStaleness, coll.MinInterval, coll.Name)
+		}
 		if _, found := colls[coll.Name]; found {
 			return fmt.Errorf("duplicate collector name: %s", coll.Name)
 		}
 		colls[coll.Name] = coll
 	}
+	// Disabled collectors are kept (and shown as such by /config) but skipped, same as denied ones, wherever referenced.
+	skipped := make(map[string]bool, len(denied))
+	for _, coll := range c.Collectors {
+		if denied[coll.Name] || !coll.IsEnabled() {
+			skipped[coll.Name] = true
+		}
+	}
+	// Drop denied collectors, but let them be referenced.
+	if len(denied) > 0 {
+		allowed := c.Collectors[:0]
+		for _, coll := range c.Collectors {
+			if !denied[coll.Name] {
+				allowed = append(allowed, coll)
+			}
+		}
+		c.Collectors = allowed
+	}
+	// Watermarks can only be used if there is somewhere to persist them.
+	if c.Globals.WatermarkFile == "" {
+		for _, coll := range c.Collectors {
+			for _, q := range coll.Queries {
+				if q.WatermarkColumn != "" {
+					return fmt.Errorf("watermark_column defined for query %q of collector %q but no global.watermark_file",
+						q.Name, coll.Name)
+				}
+			}
+		}
+	} else if !filepath.IsAbs(c.Globals.WatermarkFile) {
+		c.Globals.WatermarkFile = filepath.Join(filepath.Dir(c.configFile), c.Globals.WatermarkFile)
+	}
+	if al := c.Globals.AuditLog; al != nil && al.Type == AuditLogFile && !filepath.IsAbs(al.Path) {
+		al.Path = filepath.Join(filepath.Dir(c.configFile), al.Path)
+	}
+	if c.Web != nil && c.Web.TLS != nil {
+		for _, f := range []*string{&c.Web.TLS.CertFile, &c.Web.TLS.KeyFile, &c.Web.TLS.ClientCAFile} {
+			if *f != "" && !filepath.IsAbs(*f) {
+				*f = filepath.Join(filepath.Dir(c.configFile), *f)
+			}
+		}
+	}
+	if err := c.loadDataSourceNameFiles(); err != nil {
+		return err
+	}
 	if c.Target != nil {
-		cs, err := resolveCollectorRefs(c.Target.CollectorRefs, colls, "target")
+		cs, err := resolveCollectorRefs(c.Target.CollectorRefs, colls, skipped, "target")
 		if err != nil {
 			return err
 		}
 		c.Target.collectors = cs
 	}
 	for _, j := range c.Jobs {
-		cs, err := resolveCollectorRefs(j.CollectorRefs, colls, fmt.Sprintf("job %q", j.Name))
+		cs, err := resolveCollectorRefs(j.CollectorRefs, colls, skipped, fmt.Sprintf("job %q", j.Name))
 		if err != nil {
 			return err
 		}
 		j.collectors = cs
+		// Set the metric prefix to the global default if not explicitly set.
+		if j.MetricPrefix == "" {
+			j.MetricPrefix = c.Globals.MetricPrefix
+		}
+	}
+	if err := c.checkMetricConsistency(); err != nil {
+		return err
+	}
+	if err := c.checkCheckConsistency(); err != nil {
+		return err
 	}
+	for _, collision := range c.wellKnownCollisions() {
+		log.Warningf("Metric name collision: %s", collision)
+	}
+	if c.warnings = c.findWarnings(); len(c.warnings) > 0 {
+		log.Warningf("Configuration warnings (%d):\n  %s", len(c.warnings), strings.Join(c.warnings, "\n  "))
+	}
+	c.setEffectiveEnabled()
 
 	return checkOverflow(c.XXX, "config")
 }
 
+// setEffectiveEnabled sets the `enabled` field of the target, jobs, static configs and collectors to their effective
+// value, so that it's explicit in the config served by /config: static configs of disabled jobs are disabled too.
+func (c *Config) setEffectiveEnabled() {
+	setEnabled := func(enabled **bool, value bool) {
+		*enabled = &value
+	}
+	if c.Target != nil {
+		setEnabled(&c.Target.Enabled, c.Target.IsEnabled())
+	}
+	for _, j := range c.Jobs {
+		for _, sc := range j.StaticConfigs {
+			setEnabled(&sc.Enabled, j.IsEnabled() && sc.IsEnabled())
+		}
+		setEnabled(&j.Enabled, j.IsEnabled())
+	}
+	for _, coll := range c.Collectors {
+		setEnabled(&coll.Enabled, coll.IsEnabled())
+	}
+}
+
+// Collector returns the collector with the given name, nil if not defined.
+func (c *Config) Collector(name string) *CollectorConfig {
+	for _, coll := range c.Collectors {
+		if coll.Name == name {
+			return coll
+		}
+	}
+	return nil
+}
+
 // YAML marshals the config into YAML format.
 func (c *Config) YAML() ([]byte, error) {
 	return yaml.Marshal(c)
 }
 
-// loadCollectorFiles resolves all collector file globs to files and loads the collectors they define.
+// loadCollectorFiles resolves all collector file globs to files (or fetches remote collector files, see
+// fetchCollectorFiles) and loads the collectors they define.
 func (c *Config) loadCollectorFiles() error {
 	baseDir := filepath.Dir(c.configFile)
 	for _, cfglob := range c.CollectorFiles {
+		if isRemoteCollectorFile(cfglob) {
+			files, err := fetchCollectorFiles(cfglob)
+			if err != nil {
+				return err
+			}
+			for _, f := range files {
+				cc := CollectorConfig{}
+				if err := yaml.Unmarshal(f.buf, &cc); err != nil {
+					return fmt.Errorf("error loading collector file %s: %s", f.source, err)
+				}
+				cc.setSource(f.source)
+				c.Collectors = append(c.Collectors, &cc)
+				log.Infof("Loaded collector %q from %s", cc.Name, f.source)
+			}
+			continue
+		}
+
 		// Resolve relative paths by joining them to the configuration file's directory.
 		if len(cfglob) > 0 && !filepath.IsAbs(cfglob) {
 			cfglob = filepath.Join(baseDir, cfglob)
@@ -117,7 +314,7 @@ func (c *Config) loadCollectorFiles() error {
 
 		// And load the CollectorConfig defined in each file.
 		for _, cf := range cfs {
-			buf, err := ioutil.ReadFile(cf)
+			buf, err := os.ReadFile(cf)
 			if err != nil {
 				return err
 			}
@@ -127,6 +324,7 @@ func (c *Config) loadCollectorFiles() error {
 			if err != nil {
 				return err
 			}
+			cc.setSource(cf)
 			c.Collectors = append(c.Collectors, &cc)
 			log.Infof("Loaded collector %q from %s", cc.Name, cf)
 		}
@@ -143,10 +341,43 @@ type GlobalConfig struct {
 	MaxConns      int            `yaml:"max_connections"`       // maximum number of open connections to any one target
 	MaxIdleConns  int            `yaml:"max_idle_connections"`  // maximum number of idle connections to any one target
 
+	MaxQueriesPerHost int `yaml:"max_queries_per_host,omitempty"` // maximum concurrent queries on one database server
+
+	ExplainAfterTimeouts int            `yaml:"explain_after_timeouts"` // log query plan after this many timeouts in a row
+	ExplainTimeout       model.Duration `yaml:"explain_timeout"`        // timeout for capturing the query plan
+
+	StartupProbe  *StartupProbeConfig `yaml:"startup_probe,omitempty"`  // connectivity check on startup and DSN reload
+	WatermarkFile string              `yaml:"watermark_file,omitempty"` // file to persist query watermarks to
+	LogOutput     *LogOutputConfig    `yaml:"log_output,omitempty"`     // where log lines produced by collectors go
+	FlapDamping   *FlapDampingConfig  `yaml:"flap_damping,omitempty"`   // skip connecting to flapping targets
+	Quarantine    *QuarantineConfig   `yaml:"quarantine,omitempty"`     // skip queries failing repeatedly on a target
+	AuditLog      *AuditLogConfig     `yaml:"audit_log,omitempty"`      // record of every statement executed
+	Silences      *SilencesConfig     `yaml:"silences,omitempty"`       // skip targets silenced in an external system
+
+	DatabaseInfoInterval model.Duration `yaml:"database_info_interval,omitempty"` // sql_database_info refresh interval
+	ScriptMaxSteps       uint64         `yaml:"script_max_steps"`                 // execution limit of Starlark scripts
+
+	MetricPrefix string `yaml:"metric_prefix,omitempty"` // prepended to the names of all metrics from collectors
+	SessionLabel string `yaml:"session_label,omitempty"` // template identifying collectors' sessions to the database
+
+	sessionLabel     *template.Template // SessionLabel, parsed; nil if not set
+	checkAnnotations []string           // annotations of all checks, see CheckAnnotations
+
 	// Catches all undefined fields and must be empty after parsing.
 	XXX map[string]interface{} `yaml:",inline" json:"-"`
 }
 
+// ParsedSessionLabel returns the session label template, parsed. Nil if not set.
+func (g *GlobalConfig) ParsedSessionLabel() *template.Template {
+	return g.sessionLabel
+}
+
+// CheckAnnotations returns the annotations of all checks of all collectors, sorted: the labels of every
+// `sql_check_violations` series besides `check`, empty for annotations of other checks.
+func (g *GlobalConfig) CheckAnnotations() []string {
+	return g.checkAnnotations
+}
+
 // UnmarshalYAML implements the yaml.Unmarshaler interface for GlobalConfig.
 func (g *GlobalConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	// Default to running the queries on every scrape.
@@ -157,6 +388,10 @@ func (g *GlobalConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	g.TimeoutOffset = model.Duration(500 * time.Millisecond)
 	g.MaxConns = 3
 	g.MaxIdleConns = 3
+	// Default to never capturing query plans.
+	g.ExplainAfterTimeouts = 0
+	g.ExplainTimeout = model.Duration(30 * time.Second)
+	g.ScriptMaxSteps = 1000000
 
 	type plain GlobalConfig
 	if err := unmarshal((*plain)(g)); err != nil {
@@ -166,20 +401,267 @@ func (g *GlobalConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if g.TimeoutOffset <= 0 {
 		return fmt.Errorf("global.scrape_timeout_offset must be strictly positive, have %s", g.TimeoutOffset)
 	}
+	if g.DatabaseInfoInterval < 0 {
+		return fmt.Errorf("global.database_info_interval must not be negative, have %s", g.DatabaseInfoInterval)
+	}
+	if g.ExplainAfterTimeouts > 0 && g.ExplainTimeout <= 0 {
+		return fmt.Errorf("global.explain_timeout must be strictly positive, have %s", g.ExplainTimeout)
+	}
+	if g.ScriptMaxSteps == 0 {
+		return fmt.Errorf("global.script_max_steps must be strictly positive")
+	}
+	if g.MetricPrefix != "" && !model.IsValidMetricName(model.LabelValue(g.MetricPrefix)) {
+		return fmt.Errorf("invalid global.metric_prefix %q", g.MetricPrefix)
+	}
+	if g.SessionLabel != "" {
+		tmpl, err := template.New("session_label").Option("missingkey=error").Parse(g.SessionLabel)
+		if err != nil {
+			return fmt.Errorf("invalid global.session_label template: %s", err)
+		}
+		g.sessionLabel = tmpl
+	}
 
 	return checkOverflow(g.XXX, "global")
 }
 
+// Log output types, see LogOutputConfig.Type.
+const (
+	// LogOutputStdout writes log lines to standard output, as JSON.
+	LogOutputStdout = "stdout"
+	// LogOutputLoki pushes log lines to a Loki server.
+	LogOutputLoki = "loki"
+)
+
+// LogOutputConfig defines where log lines produced by collectors (see LogConfig) are written to.
+type LogOutputConfig struct {
+	Type string `yaml:"type"`          // one of stdout (default) or loki
+	URL  string `yaml:"url,omitempty"` // Loki push API URL, e.g. http://loki:3100/loki/api/v1/push
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for LogOutputConfig.
+func (o *LogOutputConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	o.Type = LogOutputStdout
+
+	type plain LogOutputConfig
+	if err := unmarshal((*plain)(o)); err != nil {
+		return err
+	}
+
+	switch o.Type {
+	case LogOutputStdout:
+	case LogOutputLoki:
+		if o.URL == "" {
+			return fmt.Errorf("missing url for global.log_output of type %s", o.Type)
+		}
+	default:
+		return fmt.Errorf("unsupported global.log_output type %q", o.Type)
+	}
+
+	return checkOverflow(o.XXX, "log_output")
+}
+
+// Audit log types, see AuditLogConfig.Type.
+const (
+	// AuditLogFile appends audit records to a file, as JSON.
+	AuditLogFile = "file"
+	// AuditLogSyslog sends audit records to the local syslog daemon, as JSON.
+	AuditLogSyslog = "syslog"
+)
+
+// AuditLogConfig defines where records of executed statements are written to.
+type AuditLogConfig struct {
+	Type string `yaml:"type"`           // one of file (default) or syslog
+	Path string `yaml:"path,omitempty"` // file to append records to, file type only
+	Tag  string `yaml:"tag,omitempty"`  // syslog tag, default sql_exporter
+
+	LogArgs bool `yaml:"log_args,omitempty"` // record statement arguments, which may hold secrets (e.g. from .env)
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for AuditLogConfig.
+func (a *AuditLogConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	a.Type = AuditLogFile
+	a.Tag = "sql_exporter"
+
+	type plain AuditLogConfig
+	if err := unmarshal((*plain)(a)); err != nil {
+		return err
+	}
+
+	switch a.Type {
+	case AuditLogFile:
+		if a.Path == "" {
+			return fmt.Errorf("missing path for global.audit_log of type %s", a.Type)
+		}
+	case AuditLogSyslog:
+	default:
+		return fmt.Errorf("unsupported global.audit_log type %q", a.Type)
+	}
+
+	return checkOverflow(a.XXX, "audit_log")
+}
+
+// FlapDampingConfig defines when a target is considered to be flapping and for how long connection attempts to it are
+// then skipped.
+type FlapDampingConfig struct {
+	Flaps   int            `yaml:"flaps"`   // number of up/down transitions within window for a target to be flapping
+	Window  model.Duration `yaml:"window"`  // time window over which transitions are counted
+	Backoff model.Duration `yaml:"backoff"` // how long to skip connection attempts to a flapping target
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for FlapDampingConfig.
+func (f *FlapDampingConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	f.Flaps = 5
+	f.Window = model.Duration(10 * time.Minute)
+	f.Backoff = model.Duration(time.Minute)
+
+	type plain FlapDampingConfig
+	if err := unmarshal((*plain)(f)); err != nil {
+		return err
+	}
+
+	if f.Flaps <= 0 {
+		return fmt.Errorf("global.flap_damping.flaps must be strictly positive, have %d", f.Flaps)
+	}
+	if f.Window <= 0 || f.Backoff <= 0 {
+		return fmt.Errorf("global.flap_damping.window and backoff must be strictly positive, have %s and %s",
+			f.Window, f.Backoff)
+	}
+
+	return checkOverflow(f.XXX, "flap_damping")
+}
+
+// QuarantineConfig defines when a query failing repeatedly on a target is quarantined, i.e. skipped, and how often it
+// is retried.
+type QuarantineConfig struct {
+	Failures      int            `yaml:"failures"`       // number of consecutive failures before quarantining a query
+	RetryInterval model.Duration `yaml:"retry_interval"` // how long to skip a quarantined query before retrying it once
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for QuarantineConfig.
+func (q *QuarantineConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	q.Failures = 5
+	q.RetryInterval = model.Duration(time.Hour)
+
+	type plain QuarantineConfig
+	if err := unmarshal((*plain)(q)); err != nil {
+		return err
+	}
+
+	if q.Failures <= 0 {
+		return fmt.Errorf("global.quarantine.failures must be strictly positive, have %d", q.Failures)
+	}
+	if q.RetryInterval <= 0 {
+		return fmt.Errorf("global.quarantine.retry_interval must be strictly positive, have %s", q.RetryInterval)
+	}
+
+	return checkOverflow(q.XXX, "quarantine")
+}
+
+// Silence source types, see SilencesConfig.Type.
+const (
+	// SilencesAlertmanager polls the active silences of an Alertmanager.
+	SilencesAlertmanager = "alertmanager"
+	// SilencesHTTP polls a JSON list of label sets.
+	SilencesHTTP = "http"
+)
+
+// SilencesConfig defines where to poll silences from. Targets whose labels match an active silence are not scraped.
+type SilencesConfig struct {
+	Type            string         `yaml:"type"`             // one of alertmanager (default) or http
+	URL             string         `yaml:"url"`              // Alertmanager base URL or label set list URL
+	RefreshInterval model.Duration `yaml:"refresh_interval"` // how often silences are polled
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for SilencesConfig.
+func (s *SilencesConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	s.Type = SilencesAlertmanager
+	s.RefreshInterval = model.Duration(time.Minute)
+
+	type plain SilencesConfig
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+
+	if s.Type != SilencesAlertmanager && s.Type != SilencesHTTP {
+		return fmt.Errorf("unsupported global.silences type %q", s.Type)
+	}
+	if s.URL == "" {
+		return fmt.Errorf("missing url for global.silences")
+	}
+	if s.RefreshInterval <= 0 {
+		return fmt.Errorf("global.silences.refresh_interval must be strictly positive, have %s", s.RefreshInterval)
+	}
+
+	return checkOverflow(s.XXX, "silences")
+}
+
+// StartupProbeConfig defines how targets are opened and pinged on startup and when their data source names change.
+type StartupProbeConfig struct {
+	Concurrency int            `yaml:"concurrency"` // maximum number of targets probed concurrently
+	Timeout     model.Duration `yaml:"timeout"`     // timeout for probing any one target
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for StartupProbeConfig.
+func (p *StartupProbeConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	p.Concurrency = 4
+	p.Timeout = model.Duration(10 * time.Second)
+
+	type plain StartupProbeConfig
+	if err := unmarshal((*plain)(p)); err != nil {
+		return err
+	}
+
+	if p.Concurrency <= 0 {
+		return fmt.Errorf("global.startup_probe.concurrency must be strictly positive, have %d", p.Concurrency)
+	}
+	if p.Timeout <= 0 {
+		return fmt.Errorf("global.startup_probe.timeout must be strictly positive, have %s", p.Timeout)
+	}
+
+	return checkOverflow(p.XXX, "startup_probe")
+}
+
 //
 // Target
 //
 
 // TargetConfig defines a DSN and a set of collectors to be executed on it.
 type TargetConfig struct {
-	DSN           Secret   `yaml:"data_source_name"` // data source name to connect to
-	CollectorRefs []string `yaml:"collectors"`       // names of collectors to execute on the target
+	DSN     Secret   `yaml:"data_source_name,omitempty"`      // data source name to connect to
+	DSNs    []Secret `yaml:"data_source_names,omitempty"`     // data source names, in order of preference
+	DSNFile string   `yaml:"data_source_name_file,omitempty"` // file to read the data source name(s) from
+
+	CollectorRefs []string               `yaml:"collectors"`               // names of collectors to execute on the target
+	DriverOptions map[string]interface{} `yaml:"driver_options,omitempty"` // driver specific connection options
+	DialTimeout   model.Duration         `yaml:"dial_timeout,omitempty"`   // connection establishment timeout
+	Pooler        string                 `yaml:"pooler,omitempty"`         // connection pooler in front of the target
+	Timezone      string                 `yaml:"timezone,omitempty"`       // IANA time zone of the target's timestamps
+
+	MaintenanceWindows []*MaintenanceWindow `yaml:"maintenance_windows,omitempty"` // planned downtime, not scraped
+	ReplicaLag         *ReplicaLagConfig    `yaml:"replica_lag,omitempty"`         // lag check, for read replicas
+
+	Enabled *bool `yaml:"enabled,omitempty"` // scrape the target, true unless explicitly disabled
 
 	collectors []*CollectorConfig // resolved collector references
+	location   *time.Location     // Timezone, loaded
 
 	// Catches all undefined fields and must be empty after parsing.
 	XXX map[string]interface{} `yaml:",inline" json:"-"`
@@ -190,6 +672,25 @@ func (t *TargetConfig) Collectors() []*CollectorConfig {
 	return t.collectors
 }
 
+// IsEnabled returns true unless the target is explicitly disabled.
+func (t *TargetConfig) IsEnabled() bool {
+	return isEnabled(t.Enabled)
+}
+
+// Location returns the time zone timestamps without an offset returned by the target are interpreted in, UTC unless
+// configured otherwise.
+func (t *TargetConfig) Location() *time.Location {
+	return locationOrUTC(t.location)
+}
+
+// DataSourceNames returns the target's data source names, in order of preference: either DSN or DSNs.
+func (t *TargetConfig) DataSourceNames() []Secret {
+	if len(t.DSNs) > 0 {
+		return t.DSNs
+	}
+	return []Secret{t.DSN}
+}
+
 // UnmarshalYAML implements the yaml.Unmarshaler interface for TargetConfig.
 func (t *TargetConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	type plain TargetConfig
@@ -198,14 +699,57 @@ func (t *TargetConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	}
 
 	// Check required fields
-	if t.DSN == "" {
-		return fmt.Errorf("missing data_source_name for target %+v", t)
+	sources := 0
+	for _, defined := range []bool{t.DSN != "", len(t.DSNs) > 0, t.DSNFile != ""} {
+		if defined {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return fmt.Errorf("exactly one of data_source_name, data_source_names and data_source_name_file must be defined "+
+			"for target %+v", t)
 	}
 	checkCollectorRefs(t.CollectorRefs, "target")
+	if t.DialTimeout < 0 {
+		return fmt.Errorf("negative dial_timeout for target: %s", t.DialTimeout)
+	}
+	var err error
+	if t.location, err = loadTimezone(t.Timezone); err != nil {
+		return fmt.Errorf("invalid timezone for target: %s", err)
+	}
+	// Data source names read from a file are only checked once loaded, see loadDataSourceNameFiles.
+	if t.DSNFile == "" {
+		if err := t.checkDataSourceNames(); err != nil {
+			return err
+		}
+	}
 
 	return checkOverflow(t.XXX, "target")
 }
 
+// checkDataSourceNames checks the target's data source names against its driver options and pooler.
+func (t *TargetConfig) checkDataSourceNames() error {
+	for _, dsn := range t.DataSourceNames() {
+		if dsn == "" {
+			return fmt.Errorf("empty data source name for target")
+		}
+		if _, err := ParseDataSourceName(string(dsn)); err != nil {
+			return fmt.Errorf("%s for target", err)
+		}
+		// Failover data sources must all be accessed via the same driver, as queries are prepared for it.
+		if driver, primary := dsnDriver(dsn), dsnDriver(t.DataSourceNames()[0]); driver != primary {
+			return fmt.Errorf("data_source_names for target use different drivers: %q and %q", primary, driver)
+		}
+		if err := checkDriverOptions(dsn, t.DriverOptions, "target"); err != nil {
+			return err
+		}
+		if err := checkPooler(t.Pooler, dsn, "target"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 //
 // Jobs
 //
@@ -216,7 +760,21 @@ type JobConfig struct {
 	CollectorRefs []string        `yaml:"collectors"`     // names of collectors to apply to all targets in this job
 	StaticConfigs []*StaticConfig `yaml:"static_configs"` // collections of statically defined targets
 
+	DriverOptions map[string]interface{} `yaml:"driver_options,omitempty"` // driver specific options for all targets
+	DialTimeout   model.Duration         `yaml:"dial_timeout,omitempty"`   // connection establishment timeout of all targets
+	Pooler        string                 `yaml:"pooler,omitempty"`         // connection pooler in front of all targets
+	Timezone      string                 `yaml:"timezone,omitempty"`       // IANA time zone of all targets' timestamps
+
+	MaintenanceWindows []*MaintenanceWindow `yaml:"maintenance_windows,omitempty"` // planned downtime of all targets
+	ReplicaLag         *ReplicaLagConfig    `yaml:"replica_lag,omitempty"`         // lag check of all targets (replicas)
+
+	MetricPrefix  string         `yaml:"metric_prefix,omitempty"`  // prepended to the names of all metrics from collectors
+	ScrapeTimeout model.Duration `yaml:"scrape_timeout,omitempty"` // per-scrape timeout of the job, if shorter
+
+	Enabled *bool `yaml:"enabled,omitempty"` // scrape the job's targets, true unless explicitly disabled
+
 	collectors []*CollectorConfig // resolved collector references
+	location   *time.Location     // Timezone, loaded
 
 	// Catches all undefined fields and must be empty after parsing.
 	XXX map[string]interface{} `yaml:",inline" json:"-"`
@@ -227,6 +785,17 @@ func (j *JobConfig) Collectors() []*CollectorConfig {
 	return j.collectors
 }
 
+// IsEnabled returns true unless the job is explicitly disabled.
+func (j *JobConfig) IsEnabled() bool {
+	return isEnabled(j.Enabled)
+}
+
+// Location returns the time zone timestamps without an offset returned by the job's targets are interpreted in, UTC
+// unless configured otherwise.
+func (j *JobConfig) Location() *time.Location {
+	return locationOrUTC(j.location)
+}
+
 // UnmarshalYAML implements the yaml.Unmarshaler interface for JobConfig.
 func (j *JobConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	type plain JobConfig
@@ -238,15 +807,50 @@ func (j *JobConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if j.Name == "" {
 		return fmt.Errorf("missing name for job %+v", j)
 	}
+	if _, found := j.XXX["data_source_names"]; found {
+		return fmt.Errorf("data_source_names is only supported by the single target, not by job %q", j.Name)
+	}
 	checkCollectorRefs(j.CollectorRefs, fmt.Sprintf("job %q", j.Name))
 
 	if len(j.StaticConfigs) == 0 {
 		return fmt.Errorf("no targets defined for job %q", j.Name)
 	}
+	if j.ScrapeTimeout < 0 {
+		return fmt.Errorf("negative scrape_timeout for job %q: %s", j.Name, j.ScrapeTimeout)
+	}
+	if j.DialTimeout < 0 {
+		return fmt.Errorf("negative dial_timeout for job %q: %s", j.Name, j.DialTimeout)
+	}
+	if j.MetricPrefix != "" && !model.IsValidMetricName(model.LabelValue(j.MetricPrefix)) {
+		return fmt.Errorf("invalid metric_prefix %q for job %q", j.MetricPrefix, j.Name)
+	}
+	var err error
+	if j.location, err = loadTimezone(j.Timezone); err != nil {
+		return fmt.Errorf("invalid timezone for job %q: %s", j.Name, err)
+	}
+	// Data source names read from target_files are only checked once loaded, see loadDataSourceNameFiles.
+	for _, sc := range j.StaticConfigs {
+		for tname, dsn := range sc.Targets {
+			if err := j.checkDataSourceName(tname, dsn); err != nil {
+				return err
+			}
+		}
+	}
 
 	return checkOverflow(j.XXX, "job")
 }
 
+// checkDataSourceName checks the data source name of the named target against the job's driver options and pooler.
+func (j *JobConfig) checkDataSourceName(tname string, dsn Secret) error {
+	if _, err := ParseDataSourceName(string(dsn)); err != nil {
+		return fmt.Errorf("%s for job %q target %q", err, j.Name, tname)
+	}
+	if err := checkDriverOptions(dsn, j.DriverOptions, fmt.Sprintf("job %q target %q", j.Name, tname)); err != nil {
+		return err
+	}
+	return checkPooler(j.Pooler, dsn, fmt.Sprintf("job %q target %q", j.Name, tname))
+}
+
 // checkLabelCollisions checks for label collisions between StaticConfig labels and Metric labels.
 func (j *JobConfig) checkLabelCollisions() error {
 	sclabels := make(map[string]interface{})
@@ -272,13 +876,23 @@ func (j *JobConfig) checkLabelCollisions() error {
 
 // StaticConfig defines a set of targets and optional labels to apply to the metrics collected from them.
 type StaticConfig struct {
-	Targets map[string]Secret `yaml:"targets"`          // map of target names to data source names
-	Labels  map[string]string `yaml:"labels,omitempty"` // labels to apply to all metrics collected from the targets
+	Targets     map[string]Secret `yaml:"targets"`                // map of target names to data source names
+	TargetFiles map[string]string `yaml:"target_files,omitempty"` // map of target names to data source name files
+	Labels      map[string]string `yaml:"labels,omitempty"`       // labels to apply to all metrics collected from the targets
+
+	MaintenanceWindows []*MaintenanceWindow `yaml:"maintenance_windows,omitempty"` // planned downtime of the targets
+
+	Enabled *bool `yaml:"enabled,omitempty"` // scrape the targets, true unless explicitly disabled
 
 	// Catches all undefined fields and must be empty after parsing.
 	XXX map[string]interface{} `yaml:",inline" json:"-"`
 }
 
+// IsEnabled returns true unless the targets are explicitly disabled.
+func (s *StaticConfig) IsEnabled() bool {
+	return isEnabled(s.Enabled)
+}
+
 // UnmarshalYAML implements the yaml.Unmarshaler interface for StaticConfig.
 func (s *StaticConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	type plain StaticConfig
@@ -286,6 +900,10 @@ func (s *StaticConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		return err
 	}
 
+	if _, found := s.XXX["data_source_names"]; found {
+		return fmt.Errorf("data_source_names is only supported by the single target, not in static_configs")
+	}
+
 	// Check for empty/duplicate target names/data source names
 	tnames := make(map[string]interface{})
 	dsns := make(map[string]interface{})
@@ -305,6 +923,14 @@ func (s *StaticConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		}
 		dsns[string(dsn)] = nil
 	}
+	for tname, file := range s.TargetFiles {
+		if tname == "" || file == "" {
+			return fmt.Errorf("empty target name or file name in target_files of static config %+v", s)
+		}
+		if _, ok := tnames[tname]; ok {
+			return fmt.Errorf("target %q defined by both targets and target_files in static_config %+v", tname, s)
+		}
+	}
 
 	return checkOverflow(s.XXX, "static_config")
 }
@@ -313,29 +939,128 @@ func (s *StaticConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 // Collectors
 //
 
+// Collector failure modes, see CollectorConfig.OnError.
+const (
+	// OnErrorOmit omits the series of failed queries (default).
+	OnErrorOmit = "omit"
+	// OnErrorZero exports the last known series of a failed collector with zero values.
+	OnErrorZero = "zero"
+	// OnErrorStale re-exports the last known values of a failed collector.
+	OnErrorStale = "stale"
+	// OnErrorFail fails the entire target scrape if the collector fails.
+	OnErrorFail = "fail"
+)
+
 // CollectorConfig defines a set of metrics and how they are collected.
 type CollectorConfig struct {
 	Name        string          `yaml:"collector_name"`         // name of this collector
+	Extends     string          `yaml:"extends,omitempty"`      // name of the collector this one inherits from
 	MinInterval model.Duration  `yaml:"min_interval,omitempty"` // minimum interval between query executions
+	SampleEvery int             `yaml:"sample_every,omitempty"` // only execute queries on every Nth scrape
 	Metrics     []*MetricConfig `yaml:"metrics"`                // metrics/queries defined by this collector
+	Logs        []*LogConfig    `yaml:"logs,omitempty"`         // logs/queries defined by this collector
+	Checks      []*CheckConfig  `yaml:"checks,omitempty"`       // checks/queries defined by this collector
 	Queries     []*QueryConfig  `yaml:"queries,omitempty"`      // named queries defined by this collector
 
+	ExplainAfterTimeouts int    `yaml:"explain_after_timeouts,omitempty"` // log query plan after N timeouts in a row
+	OnError              string `yaml:"on_error,omitempty"`               // one of omit (default), zero, stale or fail
+	MaxParallelQueries   int    `yaml:"max_parallel_queries,omitempty"`   // maximum number of queries run concurrently
+	SingleConnection     bool   `yaml:"single_connection,omitempty"`      // run all queries in order, on one connection
+
+	// Data source name parameters (e.g. session settings such as work_mem) of the connections the collector's queries
+	// run on, from a pool of their own. Collectors with the same parameters share a pool, collectors without any use
+	// the target's.
+	ConnectionParams map[string]string `yaml:"connection_params,omitempty"`
+
+	MaxStaleness model.Duration `yaml:"max_staleness,omitempty"` // maximum age of cached or stale values exported
+	LagSensitive bool           `yaml:"lag_sensitive,omitempty"` // skipped or labelled stale on lagging replicas
+
+	When string `yaml:"when,omitempty"` // condition on target metadata for the collector to apply
+
+	Enabled *bool `yaml:"enabled,omitempty"` // run the collector, true unless explicitly disabled
+
+	condition *Condition // When, parsed
+
 	// Catches all undefined fields and must be empty after parsing.
 	XXX map[string]interface{} `yaml:",inline" json:"-"`
 }
 
+// Condition returns the collector's parsed `when` condition, nil if none.
+func (c *CollectorConfig) Condition() *Condition {
+	return c.condition
+}
+
+// IsEnabled returns true unless the collector is explicitly disabled.
+func (c *CollectorConfig) IsEnabled() bool {
+	return isEnabled(c.Enabled)
+}
+
+// HasConditions returns true if the collector or any of its metrics define a `when` condition.
+func (c *CollectorConfig) HasConditions() bool {
+	if c.condition != nil {
+		return true
+	}
+	for _, m := range c.Metrics {
+		if m.condition != nil {
+			return true
+		}
+	}
+	return false
+}
+
 // UnmarshalYAML implements the yaml.Unmarshaler interface for CollectorConfig.
 func (c *CollectorConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	// Default to undefined (a negative value) so it can be overridden by the global default when not explicitly set.
 	c.MinInterval = -1
+	c.ExplainAfterTimeouts = -1
 
 	type plain CollectorConfig
 	if err := unmarshal((*plain)(c)); err != nil {
 		return err
 	}
 
-	if len(c.Metrics) == 0 {
-		return fmt.Errorf("no metrics defined for collector %q", c.Name)
+	// Collectors extending another are only validated once merged with it, see Config.resolveExtends().
+	if c.Extends != "" {
+		return checkOverflow(c.XXX, "collector")
+	}
+	return c.resolve()
+}
+
+// resolve validates the collector and resolves query references.
+func (c *CollectorConfig) resolve() error {
+	if len(c.Metrics) == 0 && len(c.Logs) == 0 && len(c.Checks) == 0 {
+		return fmt.Errorf("no metrics, logs or checks defined for collector %q", c.Name)
+	}
+
+	if c.MaxParallelQueries < 0 {
+		return fmt.Errorf("negative max_parallel_queries for collector %q: %d", c.Name, c.MaxParallelQueries)
+	}
+	if c.MaxStaleness < 0 {
+		return fmt.Errorf("negative max_staleness for collector %q: %s", c.Name, c.MaxStaleness)
+	}
+	if c.SampleEvery < 0 {
+		return fmt.Errorf("negative sample_every for collector %q: %d", c.Name, c.SampleEvery)
+	}
+	if c.SampleEvery > 0 && c.MinInterval >= 0 {
+		return fmt.Errorf("min_interval and sample_every are mutually exclusive, collector %q", c.Name)
+	}
+	var err error
+	if c.condition, err = ParseCondition(c.When); err != nil {
+		return fmt.Errorf("%s for collector %q", err, c.Name)
+	}
+	if c.SingleConnection && c.MaxParallelQueries > 0 {
+		return fmt.Errorf("max_parallel_queries and single_connection are mutually exclusive, collector %q", c.Name)
+	}
+	for name := range c.ConnectionParams {
+		if name == "" {
+			return fmt.Errorf("empty connection_params name for collector %q", c.Name)
+		}
+	}
+
+	switch c.OnError {
+	case "", OnErrorOmit, OnErrorZero, OnErrorStale, OnErrorFail:
+	default:
+		return fmt.Errorf("unsupported on_error value %q for collector %q", c.OnError, c.Name)
 	}
 
 	// Set metric.query for all metrics: resolve query references (if any) and generate QueryConfigs for literal queries.
@@ -349,6 +1074,17 @@ func (c *CollectorConfig) UnmarshalYAML(unmarshal func(interface{}) error) error
 			if !found {
 				return fmt.Errorf("unresolved query_ref %q in metric %q of collector %q", metric.QueryRef, metric.Name, c.Name)
 			}
+			for label := range query.ConstKeyLabels {
+				if _, found := metric.StaticLabels[label]; found {
+					return fmt.Errorf("label %q defined in both const_key_labels of query %q and static_labels of metric %q",
+						label, query.Name, metric.Name)
+				}
+				_, templated := metric.LabelTemplates[label]
+				if templated || label == metric.ValueLabel || contains(metric.KeyLabels, label) {
+					return fmt.Errorf("label %q defined in both const_key_labels of query %q and labels of metric %q",
+						label, query.Name, metric.Name)
+				}
+			}
 			metric.query = query
 			query.metrics = append(query.metrics, metric)
 		} else {
@@ -359,6 +1095,34 @@ func (c *CollectorConfig) UnmarshalYAML(unmarshal func(interface{}) error) error
 			}
 		}
 	}
+	for _, check := range c.Checks {
+		if check.QueryRef != "" {
+			query, found := queries[check.QueryRef]
+			if !found {
+				return fmt.Errorf("unresolved query_ref %q in check %q of collector %q", check.QueryRef, check.Name, c.Name)
+			}
+			check.query = query
+		} else {
+			check.query = &QueryConfig{
+				Name:  check.Name,
+				Query: check.QueryLiteral,
+			}
+		}
+	}
+	for _, l := range c.Logs {
+		if l.QueryRef != "" {
+			query, found := queries[l.QueryRef]
+			if !found {
+				return fmt.Errorf("unresolved query_ref %q in log %q of collector %q", l.QueryRef, l.Name, c.Name)
+			}
+			l.query = query
+		} else {
+			l.query = &QueryConfig{
+				Name:  l.Name,
+				Query: l.QueryLiteral,
+			}
+		}
+	}
 
 	return checkOverflow(c.XXX, "collector")
 }
@@ -366,33 +1130,118 @@ func (c *CollectorConfig) UnmarshalYAML(unmarshal func(interface{}) error) error
 // MetricConfig defines a Prometheus metric, the SQL query to populate it and the mapping of columns to metric
 // keys/values.
 type MetricConfig struct {
-	Name         string            `yaml:"metric_name"`             // the Prometheus metric name
-	TypeString   string            `yaml:"type"`                    // the Prometheus metric type
-	Help         string            `yaml:"help"`                    // the Prometheus metric help text
-	KeyLabels    []string          `yaml:"key_labels,omitempty"`    // expose these columns as labels from SQL
-	StaticLabels map[string]string `yaml:"static_labels,omitempty"` // fixed key/value pairs as static labels
-	ValueLabel   string            `yaml:"value_label,omitempty"`   // with multiple value columns, map their names under this label
-	Values       []string          `yaml:"values"`                  // expose each of these columns as a value, keyed by column name
-	QueryLiteral string            `yaml:"query,omitempty"`         // a literal query
-	QueryRef     string            `yaml:"query_ref,omitempty"`     // references a query in the query map
-
-	valueType prometheus.ValueType // TypeString converted to prometheus.ValueType
-	query     *QueryConfig         // QueryConfig resolved from QueryRef or generated from Query
+	Name           string            `yaml:"metric_name"`               // the Prometheus metric name
+	TypeString     string            `yaml:"type"`                      // the Prometheus metric type
+	Help           string            `yaml:"help"`                      // the Prometheus metric help text
+	KeyLabels      []string          `yaml:"key_labels,omitempty"`      // expose these columns as labels from SQL
+	StaticLabels   map[string]string `yaml:"static_labels,omitempty"`   // fixed key/value pairs as static labels
+	LabelTemplates map[string]string `yaml:"label_templates,omitempty"` // labels computed from columns via Go templates
+	ValueLabel     string            `yaml:"value_label,omitempty"`     // with multiple value columns, map their names under this label
+	Values         []string          `yaml:"values"`                    // expose each of these columns as a value, keyed by column name
+	HistogramSum   string            `yaml:"histogram_sum,omitempty"`   // histograms only, column holding the sum of observations
+	ResetDetection bool              `yaml:"reset_detection,omitempty"` // counters only, keep exported values monotonic
+	Scale          float64           `yaml:"scale,omitempty"`           // multiply values by this factor (e.g. 0.001)
+	Round          *int              `yaml:"round,omitempty"`           // round values to this many decimal places
+	ValueFormat    string            `yaml:"value_format,omitempty"`    // how values are read, e.g. `age` of timestamps
+	QueryLiteral   string            `yaml:"query,omitempty"`           // a literal query
+	QueryRef       string            `yaml:"query_ref,omitempty"`       // references a query in the query map
+
+	AllowLabelValues map[string][]string `yaml:"allow_label_values,omitempty"` // only export series with these values
+	DenyLabelValues  map[string][]string `yaml:"deny_label_values,omitempty"`  // drop series with these values
+
+	When   string `yaml:"when,omitempty"`    // condition on target metadata for the metric to apply
+	EmitIf string `yaml:"emit_if,omitempty"` // condition on the columns of a row for the metric to be exported from it
+
+	valueType      prometheus.ValueType          // TypeString converted to prometheus.ValueType
+	query          *QueryConfig                  // QueryConfig resolved from QueryRef or generated from Query
+	labelTemplates map[string]*template.Template // LabelTemplates, parsed
+	allowValues    map[string]*regexp.Regexp     // AllowLabelValues, compiled into one anchored regexp per label
+	denyValues     map[string]*regexp.Regexp     // DenyLabelValues, compiled into one anchored regexp per label
+	condition      *Condition                    // When, parsed
+	emitIf         *RowCondition                 // EmitIf, parsed
+	source         string                        // file the metric is defined in, empty if unknown
+	buckets        []HistogramBucket             // histograms only, Values parsed into buckets, sorted by upper bound
+	exposition     bool                          // Values holds Prometheus text exposition format, passed through
 
 	// Catches all undefined fields and must be empty after parsing.
 	XXX map[string]interface{} `yaml:",inline" json:"-"`
 }
 
-// ValueType returns the metric type, converted to a prometheus.ValueType.
+// ValueType returns the metric type, converted to a prometheus.ValueType. Histograms and expositions, which have no
+// ValueType, are reported as prometheus.UntypedValue, see IsHistogram() and IsExposition().
 func (m *MetricConfig) ValueType() prometheus.ValueType {
 	return m.valueType
 }
 
+// IsHistogram returns true if the metric is a histogram, assembled from `bucket_<le>` value columns.
+func (m *MetricConfig) IsHistogram() bool {
+	return m.buckets != nil
+}
+
+// IsExposition returns true if the metric's single value column holds Prometheus text exposition format, passed through
+// with names prefixed by the metric name and labels added.
+func (m *MetricConfig) IsExposition() bool {
+	return m.exposition
+}
+
+// Buckets returns the histogram buckets populated from the metric's value columns, sorted by upper bound (+Inf last,
+// if defined). Nil unless the metric is a histogram.
+func (m *MetricConfig) Buckets() []HistogramBucket {
+	return m.buckets
+}
+
+// ValueFormatAge is the value_format of metrics exporting the age (at scrape time, in seconds) of timestamp columns.
+const ValueFormatAge = "age"
+
+// ScaleValue applies the metric's scale factor and rounding (if any) to a value read from the database.
+func (m *MetricConfig) ScaleValue(v float64) float64 {
+	if m.Scale != 0 {
+		v *= m.Scale
+	}
+	if m.Round != nil {
+		pow := math.Pow(10, float64(*m.Round))
+		v = math.Round(v*pow) / pow
+	}
+	return v
+}
+
 // Query returns the query defined (as a literal) or referenced by the metric.
 func (m *MetricConfig) Query() *QueryConfig {
 	return m.query
 }
 
+// Condition returns the metric's parsed `when` condition, nil if none.
+func (m *MetricConfig) Condition() *Condition {
+	return m.condition
+}
+
+// EmitCondition returns the metric's parsed `emit_if` row condition, nil if none.
+func (m *MetricConfig) EmitCondition() *RowCondition {
+	return m.emitIf
+}
+
+// ParsedLabelTemplates returns the metric's label templates, parsed, keyed by label name.
+func (m *MetricConfig) ParsedLabelTemplates() map[string]*template.Template {
+	return m.labelTemplates
+}
+
+// AllowsLabelValue returns true if the metric's allow_label_values and deny_label_values let through series with the
+// given label value.
+func (m *MetricConfig) AllowsLabelValue(label, value string) bool {
+	if re, found := m.allowValues[label]; found && !re.MatchString(value) {
+		return false
+	}
+	if re, found := m.denyValues[label]; found && re.MatchString(value) {
+		return false
+	}
+	return true
+}
+
+// HasLabelValueFilters returns true if the metric defines any allow_label_values or deny_label_values.
+func (m *MetricConfig) HasLabelValueFilters() bool {
+	return len(m.allowValues) > 0 || len(m.denyValues) > 0
+}
+
 // UnmarshalYAML implements the yaml.Unmarshaler interface for MetricConfig.
 func (m *MetricConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	type plain MetricConfig
@@ -407,7 +1256,7 @@ func (m *MetricConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if m.TypeString == "" {
 		return fmt.Errorf("missing type for metric %q", m.Name)
 	}
-	if m.Help == "" {
+	if m.Help == "" && !strings.EqualFold(m.TypeString, "exposition") {
 		return fmt.Errorf("missing help for metric %q", m.Name)
 	}
 	if (m.QueryLiteral == "") == (m.QueryRef == "") {
@@ -419,6 +1268,11 @@ func (m *MetricConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		m.valueType = prometheus.CounterValue
 	case "gauge":
 		m.valueType = prometheus.GaugeValue
+	case "histogram":
+		m.valueType = prometheus.UntypedValue
+	case "exposition":
+		m.valueType = prometheus.UntypedValue
+		m.exposition = true
 	default:
 		return fmt.Errorf("unsupported metric type: %s", m.TypeString)
 	}
@@ -436,11 +1290,46 @@ func (m *MetricConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		}
 	}
 
+	// Parse label templates, checking for collisions with key labels and value label
+	m.labelTemplates = make(map[string]*template.Template, len(m.LabelTemplates))
+	for label, text := range m.LabelTemplates {
+		if err := checkLabel(label, "label_templates for metric", m.Name); err != nil {
+			return err
+		}
+		if contains(m.KeyLabels, label) {
+			return fmt.Errorf("duplicate label %q (defined in both key_labels and label_templates) for metric %q", label, m.Name)
+		}
+		if label == m.ValueLabel {
+			return fmt.Errorf(
+				"duplicate label %q (defined in both label_templates and value_label) for metric %q", label, m.Name)
+		}
+		if _, found := m.StaticLabels[label]; found {
+			return fmt.Errorf(
+				"duplicate label %q (defined in both static_labels and label_templates) for metric %q", label, m.Name)
+		}
+		tmpl, err := template.New(label).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return fmt.Errorf("invalid template for label %q of metric %q: %s", label, m.Name, err)
+		}
+		m.labelTemplates[label] = tmpl
+	}
+
 	if len(m.Values) == 0 {
 		return fmt.Errorf("no values defined for metric %q", m.Name)
 	}
 
-	if len(m.Values) > 1 {
+	if m.HistogramSum != "" && !strings.EqualFold(m.TypeString, "histogram") {
+		return fmt.Errorf("histogram_sum defined for metric %q of type %s", m.Name, m.TypeString)
+	}
+	if m.exposition {
+		if len(m.Values) != 1 || m.ValueLabel != "" {
+			return fmt.Errorf("exposition metric %q must define exactly one value column and no value_label", m.Name)
+		}
+	} else if m.valueType == prometheus.UntypedValue {
+		if err := m.parseBuckets(); err != nil {
+			return err
+		}
+	} else if len(m.Values) > 1 {
 		// Multiple value columns but no value label to identify them
 		if m.ValueLabel == "" {
 			return fmt.Errorf("value_label must be defined for metric with multiple values %q", m.Name)
@@ -448,15 +1337,193 @@ func (m *MetricConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		checkLabel(m.ValueLabel, "value_label for metric", m.Name)
 	}
 
+	if m.exposition && (m.Scale != 0 || m.Round != nil) {
+		return fmt.Errorf("scale and round not supported for exposition metric %q", m.Name)
+	}
+	if m.Round != nil && *m.Round < 0 {
+		return fmt.Errorf("negative round for metric %q: %d", m.Name, *m.Round)
+	}
+
+	if m.ResetDetection && m.valueType != prometheus.CounterValue {
+		return fmt.Errorf("reset_detection defined for metric %q of type %s", m.Name, m.TypeString)
+	}
+	switch m.ValueFormat {
+	case "":
+	case ValueFormatAge:
+		if m.valueType != prometheus.GaugeValue || m.buckets != nil || m.exposition {
+			return fmt.Errorf("value_format %s defined for metric %q of type %s, only gauges supported", m.ValueFormat,
+				m.Name, m.TypeString)
+		}
+	default:
+		return fmt.Errorf("invalid value_format %q for metric %q, expecting %q", m.ValueFormat, m.Name, ValueFormatAge)
+	}
+
+	var err error
+	if m.allowValues, err = m.compileLabelValues(m.AllowLabelValues, "allow_label_values"); err != nil {
+		return err
+	}
+	if m.denyValues, err = m.compileLabelValues(m.DenyLabelValues, "deny_label_values"); err != nil {
+		return err
+	}
+	if m.condition, err = ParseCondition(m.When); err != nil {
+		return fmt.Errorf("%s for metric %q", err, m.Name)
+	}
+	if m.emitIf, err = ParseRowCondition(m.EmitIf); err != nil {
+		return fmt.Errorf("%s for metric %q emit_if", err, m.Name)
+	}
+
 	return checkOverflow(m.XXX, "metric")
 }
 
+// compileLabelValues compiles the values listed for each label (exact values or regular expressions) into a single
+// anchored regexp per label. Labels must be key labels, label templates or the value label.
+func (m *MetricConfig) compileLabelValues(values map[string][]string, field string) (map[string]*regexp.Regexp, error) {
+	compiled := make(map[string]*regexp.Regexp, len(values))
+	for label, vs := range values {
+		_, templated := m.LabelTemplates[label]
+		if !templated && label != m.ValueLabel && !contains(m.KeyLabels, label) {
+			return nil, fmt.Errorf("%s label %q is not a key label, label template or value label of metric %q",
+				field, label, m.Name)
+		}
+		if len(vs) == 0 {
+			return nil, fmt.Errorf("no values in %s for label %q of metric %q", field, label, m.Name)
+		}
+		re, err := regexp.Compile("^(?:" + strings.Join(vs, "|") + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s for label %q of metric %q: %s", field, label, m.Name, err)
+		}
+		compiled[label] = re
+	}
+	return compiled, nil
+}
+
+// LogConfig defines a log stream and the SQL query to populate it: every result row is output as one log line, with
+// all columns as fields.
+type LogConfig struct {
+	Name         string            `yaml:"log_name"`            // the log stream name
+	Labels       map[string]string `yaml:"labels,omitempty"`    // fixed key/value pairs identifying the log stream
+	QueryLiteral string            `yaml:"query,omitempty"`     // a literal query
+	QueryRef     string            `yaml:"query_ref,omitempty"` // references a query in the query map
+
+	query *QueryConfig // QueryConfig resolved from QueryRef or generated from Query
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// Query returns the query defined (as a literal) or referenced by the log.
+func (l *LogConfig) Query() *QueryConfig {
+	return l.query
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for LogConfig.
+func (l *LogConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain LogConfig
+	if err := unmarshal((*plain)(l)); err != nil {
+		return err
+	}
+
+	// Check required fields
+	if l.Name == "" {
+		return fmt.Errorf("missing name for log %+v", l)
+	}
+	if (l.QueryLiteral == "") == (l.QueryRef == "") {
+		return fmt.Errorf("exactly one of query and query_ref must be specified for log %q", l.Name)
+	}
+	for label := range l.Labels {
+		if err := checkLabel(label, "labels for log", l.Name); err != nil {
+			return err
+		}
+	}
+
+	return checkOverflow(l.XXX, "log")
+}
+
+// MaxCheckAnnotations is the maximum number of annotation columns a check may define, to keep cardinality in check.
+const MaxCheckAnnotations = 3
+
+// CheckConfig defines a check and the SQL query to evaluate it: every row returned by the query is a violation. Checks
+// are exported as `sql_check_violations{check="<name>"}`, optionally with labels populated from annotation columns.
+type CheckConfig struct {
+	Name         string   `yaml:"check_name"`            // the check name, exported as the `check` label
+	Help         string   `yaml:"help,omitempty"`        // optional description of the check, not exported
+	Annotations  []string `yaml:"annotations,omitempty"` // expose these columns as labels, at most MaxCheckAnnotations
+	QueryLiteral string   `yaml:"query,omitempty"`       // a literal query
+	QueryRef     string   `yaml:"query_ref,omitempty"`   // references a query in the query map
+
+	query *QueryConfig // QueryConfig resolved from QueryRef or generated from Query
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// Query returns the query defined (as a literal) or referenced by the check.
+func (c *CheckConfig) Query() *QueryConfig {
+	return c.query
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for CheckConfig.
+func (c *CheckConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain CheckConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+
+	// Check required fields
+	if c.Name == "" {
+		return fmt.Errorf("missing name for check %+v", c)
+	}
+	if (c.QueryLiteral == "") == (c.QueryRef == "") {
+		return fmt.Errorf("exactly one of query and query_ref must be specified for check %q", c.Name)
+	}
+
+	if len(c.Annotations) > MaxCheckAnnotations {
+		return fmt.Errorf("too many annotations for check %q: %d, at most %d allowed",
+			c.Name, len(c.Annotations), MaxCheckAnnotations)
+	}
+	for i, a := range c.Annotations {
+		if err := checkLabel(a, "annotations for check", c.Name); err != nil {
+			return err
+		}
+		if a == "check" || contains(c.Annotations[i+1:], a) {
+			return fmt.Errorf("duplicate annotation %q for check %q", a, c.Name)
+		}
+	}
+
+	return checkOverflow(c.XXX, "check")
+}
+
+// Transaction isolation levels of queries, see QueryConfig.Isolation.
+const (
+	IsolationReadCommitted  = "read_committed"
+	IsolationRepeatableRead = "repeatable_read"
+)
+
 // QueryConfig defines a named query, to be referenced by one or multiple metrics.
 type QueryConfig struct {
-	Name  string `yaml:"query_name"` // the query name, to be referenced via `query_ref`
-	Query string `yaml:"query"`      // the named query
+	Name             string            `yaml:"query_name"`                  // the query name, referenced via `query_ref`
+	Query            string            `yaml:"query"`                       // the named query
+	Template         bool              `yaml:"template,omitempty"`          // the query is a Go template, see Render
+	ConstKeyLabels   map[string]string `yaml:"const_key_labels,omitempty"`  // fixed labels for all metrics of the query
+	WatermarkColumn  string            `yaml:"watermark_column,omitempty"`  // column whose max value is the watermark
+	WatermarkInitial string            `yaml:"watermark_initial,omitempty"` // watermark before the first collection
+
+	Pagination   *PaginationConfig   `yaml:"pagination,omitempty"`    // fetch results in pages, using keyset pagination
+	RowProcessor *RowProcessorConfig `yaml:"row_processor,omitempty"` // post-process result rows with a Go plugin
+
+	Isolation string `yaml:"isolation,omitempty"` // run in a transaction with this isolation level
+	ReadOnly  bool   `yaml:"read_only,omitempty"` // run in a read only transaction
+
+	Params  map[string]string `yaml:"params,omitempty"`   // named parameters (`:name`) bound by the driver, Go templates
+	LogRows bool              `yaml:"log_rows,omitempty"` // log every result row, for collector development
 
-	metrics []*MetricConfig // metrics referencing this query
+	ResultChecksum bool `yaml:"result_checksum,omitempty"`  // export a checksum of the full result set
+	ExportRowCount bool `yaml:"export_row_count,omitempty"` // export the number of result rows
+
+	params map[string]*template.Template // Params, parsed
+
+	metrics  []*MetricConfig    // metrics referencing this query
+	template *template.Template // Query, parsed; nil unless it is a template
 
 	// Catches all undefined fields and must be empty after parsing.
 	XXX map[string]interface{} `yaml:",inline" json:"-"`
@@ -477,11 +1544,194 @@ func (q *QueryConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		return fmt.Errorf("missing query literal for query %q", q.Name)
 	}
 
+	for label := range q.ConstKeyLabels {
+		if err := checkLabel(label, "const_key_labels for query", q.Name); err != nil {
+			return err
+		}
+	}
+	if q.WatermarkColumn != "" && q.WatermarkInitial == "" {
+		q.WatermarkInitial = "0"
+	}
+	if q.ResultChecksum && q.WatermarkColumn != "" {
+		// Incremental queries only return rows added since the previous execution, not the full result set.
+		return fmt.Errorf("result_checksum not supported together with watermark_column, query %q", q.Name)
+	}
+	if err := q.parseTemplate(); err != nil {
+		return err
+	}
+	// Templates may contain the placeholder once per dialect, see Render.
+	if n := strings.Count(q.Query, PageKeyPlaceholder); q.Pagination != nil && (n == 0 || n > 1 && q.template == nil) {
+		return fmt.Errorf("paginated query %q must contain the %s placeholder exactly once", q.Name, PageKeyPlaceholder)
+	}
+
+	q.params = make(map[string]*template.Template, len(q.Params))
+	for name, text := range q.Params {
+		if !paramNameRE.MatchString(name) || strings.HasPrefix(name, "__") {
+			return fmt.Errorf("invalid parameter name %q for query %q", name, q.Name)
+		}
+		tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return fmt.Errorf("invalid template for parameter %q of query %q: %s", name, q.Name, err)
+		}
+		q.params[name] = tmpl
+	}
+
+	switch q.Isolation {
+	case "", IsolationReadCommitted, IsolationRepeatableRead:
+	default:
+		return fmt.Errorf("invalid isolation %q for query %q, expecting one of %q or %q", q.Isolation, q.Name,
+			IsolationReadCommitted, IsolationRepeatableRead)
+	}
+
 	q.metrics = make([]*MetricConfig, 0, 2)
 
 	return checkOverflow(q.XXX, "metric")
 }
 
+// paramNameRE matches valid query parameter names. Names starting with `__` are reserved for built-in placeholders.
+var paramNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// RenderParams returns the values of the query's named parameters for a target with the given labels. Parameter
+// templates are executed with `.target.labels` set to the target labels and `.env` to the environment variables.
+func (q *QueryConfig) RenderParams(labels map[string]string) (map[string]string, error) {
+	if len(q.params) == 0 {
+		return nil, nil
+	}
+	env := make(map[string]string)
+	for _, kv := range os.Environ() {
+		if i := strings.IndexByte(kv, '='); i > 0 {
+			env[kv[:i]] = kv[i+1:]
+		}
+	}
+	data := map[string]interface{}{
+		"target": map[string]interface{}{"labels": labels},
+		"env":    env,
+	}
+	values := make(map[string]string, len(q.params))
+	for name, tmpl := range q.params {
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return nil, fmt.Errorf("rendering parameter %q of query %q failed: %s", name, q.Name, err)
+		}
+		values[name] = buf.String()
+	}
+	return values, nil
+}
+
+// parseTemplate parses the query text as a Go template, if the query is one.
+func (q *QueryConfig) parseTemplate() error {
+	if !q.Template {
+		return nil
+	}
+	var err error
+	if q.template, err = template.New(q.Name).Option("missingkey=error").Parse(q.Query); err != nil {
+		return fmt.Errorf("invalid template for query %q: %s", q.Name, err)
+	}
+	return nil
+}
+
+// Render returns the query text for the given SQL dialect (e.g. "postgres" or "sqlserver"). Template queries are
+// executed with `.dialect` set to the dialect name, so one query may support multiple databases.
+func (q *QueryConfig) Render(dialect string) (string, error) {
+	if q.template == nil {
+		return q.Query, nil
+	}
+	var buf bytes.Buffer
+	if err := q.template.Execute(&buf, map[string]string{"dialect": dialect}); err != nil {
+		return "", fmt.Errorf("rendering query %q for dialect %q failed: %s", q.Name, dialect, err)
+	}
+	if q.Pagination != nil && strings.Count(buf.String(), PageKeyPlaceholder) != 1 {
+		return "", fmt.Errorf("paginated query %q must contain the %s placeholder exactly once for dialect %q",
+			q.Name, PageKeyPlaceholder, dialect)
+	}
+	return buf.String(), nil
+}
+
+// PageKeyPlaceholder is replaced with a bind parameter holding the last key of the previous page, see PaginationConfig.
+const PageKeyPlaceholder = ":__page_key"
+
+// PaginationConfig configures keyset pagination for a query: the query is run repeatedly, ordered by key_column and
+// limited to page_size rows (both appended to the query in the target's dialect), with PageKeyPlaceholder bound to the
+// key_column value of the last row of the previous page (initial_key for the first page). The query must thus filter on
+// the key column, e.g. `WHERE table_name > :__page_key`, but neither be ordered nor limited itself.
+type PaginationConfig struct {
+	KeyColumn  string `yaml:"key_column"`         // unique column the results are ordered by
+	PageSize   int    `yaml:"page_size"`          // maximum number of rows fetched per page
+	MaxRows    int    `yaml:"max_rows,omitempty"` // stop after this many rows in total, 0 means no limit
+	InitialKey string `yaml:"initial_key"`        // page key of the first page
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for PaginationConfig.
+func (p *PaginationConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain PaginationConfig
+	if err := unmarshal((*plain)(p)); err != nil {
+		return err
+	}
+
+	if p.KeyColumn == "" {
+		return fmt.Errorf("missing key_column for pagination %+v", p)
+	}
+	if p.PageSize <= 0 {
+		return fmt.Errorf("page_size must be positive for pagination %+v", p)
+	}
+	if p.MaxRows < 0 {
+		return fmt.Errorf("negative max_rows for pagination %+v", p)
+	}
+	// An empty initial_key is valid (e.g. for string keys), but must be explicit.
+	var fields map[string]interface{}
+	if err := unmarshal(&fields); err != nil {
+		return err
+	}
+	if _, found := fields["initial_key"]; !found {
+		return fmt.Errorf("missing initial_key for pagination %+v", p)
+	}
+	return checkOverflow(p.XXX, "pagination")
+}
+
+// Names of the functions looked up in row processor plugins and scripts if none is configured.
+const (
+	DefaultRowProcessorFunction = "ProcessRow"
+	DefaultRowScriptFunction    = "process_row"
+)
+
+// RowProcessorConfig configures a function, loaded from a Go plugin or a Starlark script, that every result row of a
+// query is passed to before metrics are populated from it. Plugin functions must have the signature
+// `func(query string, row map[string]interface{}) error`, script functions `def process_row(query, row)`. Either may
+// modify the row in place: change values, add derived columns (listed under columns) or remove columns. Key columns
+// are strings, value columns float64s (numbers in scripts) and any other columns returned by the query are passed as
+// scanned. Returning an error (calling fail() in scripts) drops the row.
+type RowProcessorConfig struct {
+	Plugin   string   `yaml:"plugin,omitempty"`   // path to the Go plugin (.so) file
+	Script   string   `yaml:"script,omitempty"`   // path to the Starlark script, requires a build with the starlark tag
+	Function string   `yaml:"function,omitempty"` // name of the function, default ProcessRow or process_row
+	Columns  []string `yaml:"columns,omitempty"`  // columns added by the function, not expected from the query
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for RowProcessorConfig.
+func (r *RowProcessorConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain RowProcessorConfig
+	if err := unmarshal((*plain)(r)); err != nil {
+		return err
+	}
+
+	if (r.Plugin == "") == (r.Script == "") {
+		return fmt.Errorf("exactly one of plugin and script must be defined for row_processor %+v", r)
+	}
+	if r.Function == "" {
+		r.Function = DefaultRowProcessorFunction
+		if r.Script != "" {
+			r.Function = DefaultRowScriptFunction
+		}
+	}
+	return checkOverflow(r.XXX, "row_processor")
+}
+
 // Secret special type for storing secrets.
 type Secret string
 
@@ -513,19 +1763,43 @@ func checkCollectorRefs(collectorRefs []string, ctx string) error {
 	return nil
 }
 
-func resolveCollectorRefs(
-	collectorRefs []string, collectors map[string]*CollectorConfig, ctx string) ([]*CollectorConfig, error) {
+func resolveCollectorRefs(collectorRefs []string, collectors map[string]*CollectorConfig, skipped map[string]bool,
+	ctx string) ([]*CollectorConfig, error) {
 	resolved := make([]*CollectorConfig, 0, len(collectorRefs))
 	for _, cref := range collectorRefs {
 		c, found := collectors[cref]
 		if !found {
 			return nil, fmt.Errorf("unknown collector %q referenced in %s", cref, ctx)
 		}
+		if skipped[cref] {
+			continue
+		}
 		resolved = append(resolved, c)
 	}
 	return resolved, nil
 }
 
+// isEnabled returns the value of an `enabled` field: true unless explicitly set to false.
+func isEnabled(enabled *bool) bool {
+	return enabled == nil || *enabled
+}
+
+// loadTimezone loads the named IANA time zone, nil if name is empty.
+func loadTimezone(name string) (*time.Location, error) {
+	if name == "" {
+		return nil, nil
+	}
+	return time.LoadLocation(name)
+}
+
+// locationOrUTC returns loc, UTC if nil.
+func locationOrUTC(loc *time.Location) *time.Location {
+	if loc == nil {
+		return time.UTC
+	}
+	return loc
+}
+
 func checkLabel(label string, ctx ...string) error {
 	if label == "" {
 		return fmt.Errorf("empty label defined in %s", strings.Join(ctx, " "))
@@ -536,12 +1810,28 @@ func checkLabel(label string, ctx ...string) error {
 	return nil
 }
 
+// contains returns true if s is an element of values.
+func contains(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// checkOverflow returns an error if any unknown fields were caught in m. If --config.strict=false, it only logs a
+// warning instead.
 func checkOverflow(m map[string]interface{}, ctx string) error {
 	if len(m) > 0 {
 		var keys []string
 		for k := range m {
 			keys = append(keys, k)
 		}
+		if !strictMode {
+			log.Warningf("Ignoring unknown fields in %s: %s", ctx, strings.Join(keys, ", "))
+			return nil
+		}
 		return fmt.Errorf("unknown fields in %s: %s", ctx, strings.Join(keys, ", "))
 	}
 	return nil
@@ -0,0 +1,128 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// setSource records the file the collector's metrics are defined in, for error messages.
+func (c *CollectorConfig) setSource(file string) {
+	for _, m := range c.Metrics {
+		m.source = file
+	}
+}
+
+// checkMetricConsistency checks that metrics with the same name (metric_prefix included) defined by the collectors of
+// the target or of any job agree on help text and type. The metrics of all jobs are exported together and Prometheus
+// rejects a scrape with inconsistent metric families, so fail fast rather than intermittently, depending on which
+// collectors' cached values are exported.
+func (c *Config) checkMetricConsistency() error {
+	type definition struct {
+		metric    *MetricConfig
+		collector string
+		what      string
+	}
+	defs := make(map[string]definition)
+	check := func(colls []*CollectorConfig, prefix, what string) error {
+		for _, coll := range colls {
+			for _, m := range coll.Metrics {
+				name := prefix + m.Name
+				def, found := defs[name]
+				if !found {
+					defs[name] = definition{m, coll.Name, what}
+					continue
+				}
+				if def.metric.Help != m.Help || def.metric.ValueType() != m.ValueType() {
+					return fmt.Errorf("metric %q defined with different help or type: %s of %s (%s %q) and %s of %s (%s %q)",
+						name, metricLocation(def.metric, def.collector), def.what, def.metric.TypeString, def.metric.Help,
+						metricLocation(m, coll.Name), what, m.TypeString, m.Help)
+				}
+			}
+		}
+		return nil
+	}
+
+	if c.Target != nil {
+		if err := check(c.Target.collectors, c.Globals.MetricPrefix, "target"); err != nil {
+			return err
+		}
+	}
+	for _, j := range c.Jobs {
+		if err := check(j.collectors, j.MetricPrefix, fmt.Sprintf("job %q", j.Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkCheckConsistency checks that the checks of every collector, and those of the collectors of the target or of
+// any job, have distinct names, as they are exported as the same `sql_check_violations` family, told apart by their
+// `check` label only. It also records the annotations of all checks (see GlobalConfig.CheckAnnotations), as all series
+// of the family must have the same labels.
+func (c *Config) checkCheckConsistency() error {
+	annotations := make(map[string]bool)
+	for _, coll := range c.Collectors {
+		for i, ch := range coll.Checks {
+			if indexOf(i, func(j int) bool { return coll.Checks[j].Name == ch.Name }) >= 0 {
+				return fmt.Errorf("duplicate check name %q in collector %q", ch.Name, coll.Name)
+			}
+			for _, a := range ch.Annotations {
+				annotations[a] = true
+			}
+		}
+	}
+	c.Globals.checkAnnotations = make([]string, 0, len(annotations))
+	for a := range annotations {
+		c.Globals.checkAnnotations = append(c.Globals.checkAnnotations, a)
+	}
+	sort.Strings(c.Globals.checkAnnotations)
+
+	check := func(colls []*CollectorConfig, what string) error {
+		collectors := make(map[string]string)
+		for _, coll := range colls {
+			for _, ch := range coll.Checks {
+				if other, found := collectors[ch.Name]; found {
+					return fmt.Errorf("check %q defined by both collector %q and collector %q of %s",
+						ch.Name, other, coll.Name, what)
+				}
+				collectors[ch.Name] = coll.Name
+			}
+		}
+		return nil
+	}
+	if c.Target != nil {
+		if err := check(c.Target.collectors, "target"); err != nil {
+			return err
+		}
+	}
+	for _, j := range c.Jobs {
+		if err := check(j.collectors, fmt.Sprintf("job %q", j.Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// metricLocation describes where a metric is defined: collector name, file and line, as far as known. The line is
+// that of the first `metric_name` definition with the metric's name in the file.
+func metricLocation(m *MetricConfig, collector string) string {
+	location := fmt.Sprintf("collector %q", collector)
+	if m.source == "" {
+		return location
+	}
+	buf, err := os.ReadFile(m.source)
+	if err != nil {
+		return fmt.Sprintf("%s in %s", location, m.source)
+	}
+	// Matches both YAML (`metric_name: foo`) and Starlark collector scripts (`"metric_name": "foo"`).
+	re := regexp.MustCompile(`metric_name["']?\s*[:=]\s*["']?` + regexp.QuoteMeta(m.Name) + `["']?\s*(?:[,#}].*)?$`)
+	for i, line := range strings.Split(string(buf), "\n") {
+		if re.MatchString(strings.TrimSpace(line)) {
+			return fmt.Sprintf("%s at %s:%d", location, m.source, i+1)
+		}
+	}
+	return fmt.Sprintf("%s in %s", location, m.source)
+}
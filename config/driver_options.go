@@ -0,0 +1,129 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// knownDriverOptions lists the connection options accepted as `driver_options` for each driver. They are passed to the
+// driver as DSN query parameters.
+var knownDriverOptions = map[string][]string{
+	"mysql": {
+		"allowNativePasswords", "charset", "clientFoundRows", "collation", "interpolateParams", "loc",
+		"maxAllowedPacket", "multiStatements", "parseTime", "readTimeout", "timeout", "tls", "writeTimeout",
+	},
+	"postgres": {
+		"application_name", "binary_parameters", "connect_timeout", "sslcert", "sslkey", "sslmode", "sslrootcert",
+	},
+	"sqlserver": {
+		"app name", "connection timeout", "database", "dial timeout", "encrypt", "keepAlive", "log", "packet size",
+		"ServerSPN", "TrustServerCertificate", "workstation id",
+	},
+	"clickhouse": {
+		"block_size", "compress", "database", "debug", "read_timeout", "write_timeout",
+	},
+}
+
+func init() {
+	knownDriverOptions["mssql"] = knownDriverOptions["sqlserver"]
+}
+
+// dsnDriver returns the driver name of dsn (its URI scheme), empty if missing.
+func dsnDriver(dsn Secret) string {
+	return DSNDriver(string(dsn))
+}
+
+// checkDriverOptions checks that all options are known for the driver of dsn, suggesting the closest known option
+// for unknown ones.
+func checkDriverOptions(dsn Secret, options map[string]interface{}, ctx string) error {
+	if len(options) == 0 {
+		return nil
+	}
+	driver := dsnDriver(dsn)
+	if driver == "" {
+		return fmt.Errorf("missing driver in data source name for %s", ctx)
+	}
+	known, found := knownDriverOptions[driver]
+	if !found {
+		return fmt.Errorf("driver_options not supported for driver %q in %s", driver, ctx)
+	}
+
+	for name := range options {
+		if contains(known, name) {
+			continue
+		}
+		if suggestion := closestOption(name, known); suggestion != "" {
+			return fmt.Errorf("unknown %s driver option %q in %s, did you mean %q?", driver, name, ctx, suggestion)
+		}
+		return fmt.Errorf("unknown %s driver option %q in %s, known options: %s",
+			driver, name, ctx, strings.Join(known, ", "))
+	}
+	return nil
+}
+
+// closestOption returns the option in known closest to name (case insensitive edit distance of at most 3), or an empty
+// string if none is close enough.
+func closestOption(name string, known []string) string {
+	best, bestDist := "", 4
+	for _, k := range known {
+		if d := editDistance(strings.ToLower(name), strings.ToLower(k)); d < bestDist {
+			best, bestDist = k, d
+		}
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min3(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// DSNWithOptions returns dsn with the provided driver options appended as query parameters, in a stable order.
+func DSNWithOptions(dsn Secret, options map[string]interface{}) Secret {
+	if len(options) == 0 {
+		return dsn
+	}
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	params := make([]string, 0, len(names))
+	for _, name := range names {
+		params = append(params, url.QueryEscape(name)+"="+url.QueryEscape(fmt.Sprint(options[name])))
+	}
+	sep := "?"
+	if strings.Contains(string(dsn), "?") {
+		sep = "&"
+	}
+	return dsn + Secret(sep+strings.Join(params, "&"))
+}
@@ -0,0 +1,267 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+var (
+	// Matches the URI scheme naming the driver at the start of a data source name, e.g. `postgres://`.
+	dsnSchemeRE = regexp.MustCompile(`^([a-zA-Z][a-zA-Z0-9+.-]*)://`)
+	// Matches password-like parameters in a data source name query, up to the value.
+	dsnSecretParamRE = regexp.MustCompile(`(?i)((?:^|[&;])(?:password|passwd|pwd|secret|token)=)[^&;]*`)
+
+	// Drivers expecting URL data source names. The DSNs of other drivers (other than MySQL) are passed through as is.
+	urlDrivers = map[string]bool{
+		"clickhouse": true,
+		"postgres":   true,
+		"prometheus": true,
+		"sqlserver":  true,
+	}
+)
+
+// DataSourceName is a data source name parsed into its components.
+type DataSourceName struct {
+	Driver string        // the driver name, i.e. the URI scheme
+	User   *url.Userinfo // username and password, nil if none
+	Host   string        // the server address (host:port, host or, for MySQL, e.g. a socket path), empty if unknown
+
+	path      string // the URL path, decoded (e.g. the database name)
+	rawPath   string // the URL path, as provided
+	rawQuery  string // the URL query (MySQL: the parameters), as provided
+	driverDSN string // the data source name as expected by the driver
+	redacted  string // the data source name with passwords replaced by "xxxxx"
+}
+
+// DSNDriver returns the driver name of dsn (its URI scheme), empty if missing.
+func DSNDriver(dsn string) string {
+	if m := dsnSchemeRE.FindStringSubmatch(dsn); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// ParseDataSourceName parses a data source name of the form `<driver>://<dsn>`. MySQL DSNs are validated by the
+// driver. URL DSNs (PostgreSQL, SQL Server, ClickHouse, Prometheus) are parsed leniently: passwords may contain
+// unescaped `@`, `/` and `:` characters (only `?` needs percent-encoding) and IPv6 literal hosts must be enclosed in
+// brackets. DSNs of other drivers are not parsed.
+//
+// Errors point to the offending component, but never include the password.
+func ParseDataSourceName(dsn string) (*DataSourceName, error) {
+	driver := DSNDriver(dsn)
+	if driver == "" {
+		return nil, fmt.Errorf("missing driver in data source name, expected format `<driver>://<dsn>`")
+	}
+	rest := dsn[len(driver)+len("://"):]
+
+	if driver == "mysql" {
+		cfg, err := mysql.ParseDSN(rest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mysql data source name: %s", err)
+		}
+		d := &DataSourceName{Driver: driver, Host: cfg.Addr, path: cfg.DBName, rawPath: cfg.DBName, driverDSN: rest}
+		// Passwords may contain an unescaped `?` or `/`, the parameters follow the last `/`.
+		slash := strings.LastIndexByte(rest, '/')
+		params := rest[slash+1:]
+		if i := strings.IndexByte(params, '?'); i >= 0 {
+			d.rawQuery = params[i+1:]
+		}
+		if cfg.User != "" {
+			d.User = url.UserPassword(cfg.User, cfg.Passwd)
+		}
+		// The credentials end at the last `@` before the database name.
+		d.redacted = dsn
+		if at := strings.LastIndexByte(rest[:slash], '@'); at >= 0 && strings.IndexByte(rest[:at], ':') >= 0 {
+			d.redacted = driver + "://" + cfg.User + ":xxxxx" + rest[at:]
+		}
+		d.redacted = redactParams(d.redacted, d.rawQuery)
+		return d, nil
+	}
+
+	d := &DataSourceName{Driver: driver}
+	if !urlDrivers[driver] {
+		d.driverDSN = dsn
+		d.redacted = redactOpaque(dsn, driver)
+		return d, nil
+	}
+	if i := strings.IndexByte(rest, '?'); i >= 0 {
+		rest, d.rawQuery = rest[:i], rest[i+1:]
+	}
+	// The credentials end at the last `@`, so the password may contain `@` or `/`.
+	if i := strings.LastIndexByte(rest, '@'); i >= 0 {
+		var userinfo string
+		userinfo, rest = rest[:i], rest[i+1:]
+		if j := strings.IndexByte(userinfo, ':'); j >= 0 {
+			d.User = url.UserPassword(unescapeUserinfo(userinfo[:j]), unescapeUserinfo(userinfo[j+1:]))
+		} else {
+			d.User = url.User(unescapeUserinfo(userinfo))
+		}
+	}
+	hostport := rest
+	if i := strings.IndexByte(rest, '/'); i >= 0 {
+		hostport, d.rawPath = rest[:i], rest[i:]
+	}
+	var err error
+	if d.Host, err = normalizeHost(hostport); err != nil {
+		return nil, fmt.Errorf("invalid host %q in %s data source name: %s", hostport, driver, err)
+	}
+	if d.path, err = url.PathUnescape(d.rawPath); err != nil {
+		return nil, fmt.Errorf("invalid path %q in %s data source name: %s", d.rawPath, driver, err)
+	}
+	query, err := url.ParseQuery(d.rawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("invalid query in %s data source name: %s", driver, err)
+	}
+	if driver == "sqlserver" && d.User == nil && query.Get("user id") == "" && runtime.GOOS != "windows" {
+		// Without credentials, the driver uses integrated authentication (SSPI), only available on Windows.
+		return nil, fmt.Errorf("missing credentials in sqlserver data source name: integrated authentication is " +
+			`only supported on Windows, elsewhere use SQL Server or NTLM (DOMAIN\user) credentials`)
+	}
+
+	scheme := driver
+	if driver == "clickhouse" {
+		// The ClickHouse driver expects a `tcp://` scheme.
+		scheme = "tcp"
+	}
+	u := url.URL{Scheme: scheme, User: d.User, Host: d.Host, Path: d.path, RawPath: d.rawPath, RawQuery: d.rawQuery}
+	d.driverDSN = u.String()
+
+	u.Scheme, u.RawQuery = driver, ""
+	if _, hasPassword := d.User.Password(); hasPassword {
+		u.User = url.UserPassword(d.User.Username(), "xxxxx")
+	}
+	d.redacted = u.String()
+	if d.rawQuery != "" {
+		d.redacted = redactParams(d.redacted+"?"+d.rawQuery, d.rawQuery)
+	}
+	return d, nil
+}
+
+// DriverDSN returns the data source name to pass to the driver: with the scheme stripped (MySQL) or replaced
+// (ClickHouse) as the driver expects and the credentials percent-encoded (all other drivers).
+func (d *DataSourceName) DriverDSN() string {
+	return d.driverDSN
+}
+
+// Redacted returns the data source name with the password and password-like parameters (e.g. `password` or `token`)
+// replaced by "xxxxx", fit for logging.
+func (d *DataSourceName) Redacted() string {
+	return d.redacted
+}
+
+// Param returns the value of the named data source name parameter, empty if not set. Only MySQL and URL data source
+// names (PostgreSQL, SQL Server, ClickHouse, Prometheus) have parameters.
+func (d *DataSourceName) Param(name string) string {
+	query, _ := url.ParseQuery(d.rawQuery)
+	return query.Get(name)
+}
+
+// WithDSNParams returns dsn with the given parameters added to its query, replacing any already present. Only MySQL
+// and URL data source names (PostgreSQL, SQL Server, ClickHouse, Prometheus) have parameters. PostgreSQL and MySQL
+// apply the ones they don't recognize as session settings (e.g. `work_mem`, `search_path` or `sql_mode`).
+func WithDSNParams(dsn string, params map[string]string) (string, error) {
+	if len(params) == 0 {
+		return dsn, nil
+	}
+	driver := DSNDriver(dsn)
+	if driver != "mysql" && !urlDrivers[driver] {
+		return "", fmt.Errorf("data source name parameters not supported by driver %q", driver)
+	}
+	// MySQL passwords may contain an unescaped `?`, the parameters follow the last `/`.
+	start := len(driver) + len("://")
+	if i := strings.LastIndexByte(dsn, '/'); driver == "mysql" && i >= start {
+		start = i
+	}
+	base, rawQuery := dsn, ""
+	if i := strings.IndexByte(dsn[start:], '?'); i >= 0 {
+		base, rawQuery = dsn[:start+i], dsn[start+i+1:]
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return "", fmt.Errorf("invalid query in %s data source name: %s", driver, err)
+	}
+	for name, value := range params {
+		query.Set(name, value)
+	}
+	return base + "?" + query.Encode(), nil
+}
+
+// redactParams returns dsn, which ends with the rawQuery parameters, with the values of password-like parameters
+// replaced by "xxxxx".
+func redactParams(dsn, rawQuery string) string {
+	return dsn[:len(dsn)-len(rawQuery)] + dsnSecretParamRE.ReplaceAllString(rawQuery, "${1}xxxxx")
+}
+
+// redactOpaque redacts the data source name of a driver whose format is unknown: the password, if it starts with a
+// `user:password@` authority (up to the first `/` or `?`) and password-like parameters following the first `?`.
+func redactOpaque(dsn, driver string) string {
+	rest := dsn[len(driver)+len("://"):]
+	authority := rest
+	if i := strings.IndexAny(rest, "/?"); i >= 0 {
+		authority = rest[:i]
+	}
+	if at := strings.LastIndexByte(authority, '@'); at >= 0 {
+		if colon := strings.IndexByte(authority[:at], ':'); colon >= 0 {
+			rest = rest[:colon] + ":xxxxx" + rest[at:]
+		}
+	}
+	dsn = driver + "://" + rest
+	if i := strings.IndexByte(dsn, '?'); i >= 0 {
+		return redactParams(dsn, dsn[i+1:])
+	}
+	return dsn
+}
+
+// unescapeUserinfo decodes a percent-encoded username or password, returning it unchanged if not validly encoded.
+func unescapeUserinfo(s string) string {
+	if unescaped, err := url.PathUnescape(s); err == nil {
+		return unescaped
+	}
+	return s
+}
+
+// normalizeHost validates a `host`, `host:port`, `[ipv6]` or `[ipv6]:port` URL host and returns it, with IPv6 literals
+// enclosed in brackets.
+func normalizeHost(hostport string) (string, error) {
+	host, port := hostport, ""
+	if strings.HasPrefix(hostport, "[") {
+		end := strings.IndexByte(hostport, ']')
+		if end < 0 {
+			return "", fmt.Errorf("missing ']' after IPv6 address")
+		}
+		host, port = hostport[1:end], hostport[end+1:]
+		if port != "" && !strings.HasPrefix(port, ":") {
+			return "", fmt.Errorf("unexpected %q after IPv6 address", port)
+		}
+		port = strings.TrimPrefix(port, ":")
+		// Zone identifiers (e.g. `fe80::1%25eth0`) are percent-encoded in URLs, url.URL encodes them again.
+		host = strings.Replace(host, "%25", "%", 1)
+		if ip := net.ParseIP(strings.SplitN(host, "%", 2)[0]); ip == nil {
+			return "", fmt.Errorf("invalid IPv6 address %q", host)
+		}
+	} else if strings.Count(hostport, ":") > 1 {
+		return "", fmt.Errorf("IPv6 addresses must be enclosed in brackets, e.g. [::1]:5432")
+	} else if i := strings.IndexByte(hostport, ':'); i >= 0 {
+		host, port = hostport[:i], hostport[i+1:]
+	}
+
+	if port != "" {
+		if n, err := strconv.ParseUint(port, 10, 16); err != nil || n == 0 {
+			return "", fmt.Errorf("invalid port %q", port)
+		}
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if port != "" {
+		return host + ":" + port, nil
+	}
+	return host, nil
+}
@@ -0,0 +1,99 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// loadDataSourceNameFiles reads the data source names of the target's data_source_name_file and of the static_configs'
+// target_files (relative paths are resolved relative to the configuration file's directory) and checks them, same as
+// data source names defined inline.
+func (c *Config) loadDataSourceNameFiles() error {
+	baseDir := filepath.Dir(c.configFile)
+	resolve := func(file string) string {
+		if filepath.IsAbs(file) {
+			return file
+		}
+		return filepath.Join(baseDir, file)
+	}
+
+	if t := c.Target; t != nil && t.DSNFile != "" {
+		t.DSNFile = resolve(t.DSNFile)
+		dsns, err := readDataSourceNameFile(t.DSNFile)
+		if err != nil {
+			return fmt.Errorf("%s for target", err)
+		}
+		if len(dsns) == 1 {
+			t.DSN = dsns[0]
+		} else {
+			t.DSNs = dsns
+		}
+		if err := t.checkDataSourceNames(); err != nil {
+			return err
+		}
+	}
+	for _, j := range c.Jobs {
+		for _, sc := range j.StaticConfigs {
+			for tname, file := range sc.TargetFiles {
+				file = resolve(file)
+				sc.TargetFiles[tname] = file
+				dsns, err := readDataSourceNameFile(file)
+				if err != nil {
+					return fmt.Errorf("%s for job %q target %q", err, j.Name, tname)
+				}
+				if len(dsns) > 1 {
+					return fmt.Errorf("multiple data source names in %s for job %q target %q, only supported by the "+
+						"single target", file, j.Name, tname)
+				}
+				if err := j.checkDataSourceName(tname, dsns[0]); err != nil {
+					return err
+				}
+				if sc.Targets == nil {
+					sc.Targets = make(map[string]Secret, len(sc.TargetFiles))
+				}
+				sc.Targets[tname] = dsns[0]
+			}
+		}
+	}
+	return nil
+}
+
+// readDataSourceNameFile reads the data source names in file, one per line, ignoring empty lines.
+func readDataSourceNameFile(file string) ([]Secret, error) {
+	buf, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading data source name file: %s", err)
+	}
+	var dsns []Secret
+	for _, line := range strings.Split(string(buf), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			dsns = append(dsns, Secret(line))
+		}
+	}
+	if len(dsns) == 0 {
+		return nil, fmt.Errorf("no data source name in %s", file)
+	}
+	return dsns, nil
+}
+
+// DataSourceNameFiles returns the data_source_name_file of the target and the target_files of all static_configs, with
+// relative paths resolved. Their contents (e.g. rotated credentials) may be reloaded at runtime, see
+// sql_exporter.Exporter.UpdateDataSources.
+func (c *Config) DataSourceNameFiles() []string {
+	var files []string
+	if c.Target != nil && c.Target.DSNFile != "" {
+		files = append(files, c.Target.DSNFile)
+	}
+	for _, j := range c.Jobs {
+		for _, sc := range j.StaticConfigs {
+			for _, file := range sc.TargetFiles {
+				files = append(files, file)
+			}
+		}
+	}
+	sort.Strings(files)
+	return files
+}
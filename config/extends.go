@@ -0,0 +1,151 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// resolveExtends merges every collector that extends another with its base collector, recursively, then validates the
+// result. Collectors with no `extends` were already validated when unmarshalled.
+func (c *Config) resolveExtends() error {
+	byName := make(map[string]*CollectorConfig, len(c.Collectors))
+	for _, coll := range c.Collectors {
+		byName[coll.Name] = coll
+	}
+
+	// Collectors already merged with their bases (or not extending anything).
+	resolved := make(map[*CollectorConfig]bool, len(c.Collectors))
+	var resolve func(coll *CollectorConfig, seen []string) error
+	resolve = func(coll *CollectorConfig, seen []string) error {
+		if coll.Extends == "" || resolved[coll] {
+			return nil
+		}
+		if contains(seen, coll.Name) {
+			return fmt.Errorf("circular extends: %s", strings.Join(append(seen, coll.Name), " -> "))
+		}
+		base, found := byName[coll.Extends]
+		if !found {
+			return fmt.Errorf("collector %q extends unknown collector %q", coll.Name, coll.Extends)
+		}
+		if err := resolve(base, append(seen, coll.Name)); err != nil {
+			return err
+		}
+
+		coll.inherit(base)
+		if err := coll.resolve(); err != nil {
+			return err
+		}
+		resolved[coll] = true
+		return nil
+	}
+
+	for _, coll := range c.Collectors {
+		if err := resolve(coll, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inherit merges the metrics, logs, checks, queries and settings of base into c. Items defined by c replace the base
+// items with the same name (in the base item's position); settings explicitly set by c take precedence.
+//
+// Inherited items are copies, so c may be resolved without affecting base.
+func (c *CollectorConfig) inherit(base *CollectorConfig) {
+	metrics := make([]*MetricConfig, 0, len(base.Metrics)+len(c.Metrics))
+	for _, m := range base.Metrics {
+		mc := *m
+		mc.query = nil
+		metrics = append(metrics, &mc)
+	}
+	for _, m := range c.Metrics {
+		if i := indexOf(len(metrics), func(i int) bool { return metrics[i].Name == m.Name }); i >= 0 {
+			metrics[i] = m
+		} else {
+			metrics = append(metrics, m)
+		}
+	}
+	c.Metrics = metrics
+
+	logs := make([]*LogConfig, 0, len(base.Logs)+len(c.Logs))
+	for _, l := range base.Logs {
+		lc := *l
+		lc.query = nil
+		logs = append(logs, &lc)
+	}
+	for _, l := range c.Logs {
+		if i := indexOf(len(logs), func(i int) bool { return logs[i].Name == l.Name }); i >= 0 {
+			logs[i] = l
+		} else {
+			logs = append(logs, l)
+		}
+	}
+	c.Logs = logs
+
+	checks := make([]*CheckConfig, 0, len(base.Checks)+len(c.Checks))
+	for _, ch := range base.Checks {
+		cc := *ch
+		cc.query = nil
+		checks = append(checks, &cc)
+	}
+	for _, ch := range c.Checks {
+		if i := indexOf(len(checks), func(i int) bool { return checks[i].Name == ch.Name }); i >= 0 {
+			checks[i] = ch
+		} else {
+			checks = append(checks, ch)
+		}
+	}
+	c.Checks = checks
+
+	queries := make([]*QueryConfig, 0, len(base.Queries)+len(c.Queries))
+	for _, q := range base.Queries {
+		qc := *q
+		qc.metrics = nil
+		queries = append(queries, &qc)
+	}
+	for _, q := range c.Queries {
+		if i := indexOf(len(queries), func(i int) bool { return queries[i].Name == q.Name }); i >= 0 {
+			queries[i] = q
+		} else {
+			queries = append(queries, q)
+		}
+	}
+	c.Queries = queries
+
+	// Negative values stand for "not set", see CollectorConfig.UnmarshalYAML().
+	// min_interval and sample_every are mutually exclusive, only inherit them if c sets neither.
+	if c.MinInterval < 0 && c.SampleEvery == 0 {
+		c.MinInterval = base.MinInterval
+		c.SampleEvery = base.SampleEvery
+	}
+	if c.ExplainAfterTimeouts < 0 {
+		c.ExplainAfterTimeouts = base.ExplainAfterTimeouts
+	}
+	if c.OnError == "" {
+		c.OnError = base.OnError
+	}
+	if c.MaxParallelQueries == 0 && !c.SingleConnection {
+		c.MaxParallelQueries = base.MaxParallelQueries
+		c.SingleConnection = base.SingleConnection
+	}
+	if c.MaxStaleness == 0 {
+		c.MaxStaleness = base.MaxStaleness
+	}
+	if c.When == "" {
+		c.When = base.When
+	}
+	c.LagSensitive = c.LagSensitive || base.LagSensitive
+	if c.ConnectionParams == nil {
+		c.ConnectionParams = base.ConnectionParams
+	}
+}
+
+// indexOf returns the smallest index i in [0, n) for which f(i) is true, or -1 if there is none.
+func indexOf(n int, f func(i int) bool) int {
+	for i := 0; i < n; i++ {
+		if f(i) {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,49 @@
+package config
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Matches histogram bucket column names: `bucket_<le>`, where le is `inf` or a non-negative number with an optional
+// fractional part following an underscore (e.g. `bucket_0_5` for le="0.5").
+var bucketColumnRE = regexp.MustCompile(`^bucket_(inf|[0-9]+(?:_[0-9]+)?)$`)
+
+// HistogramBucket is a histogram bucket populated from a value column, holding the cumulative count of observations
+// less than or equal to UpperBound.
+type HistogramBucket struct {
+	Column     string
+	UpperBound float64
+}
+
+// parseBuckets parses the value columns of a histogram metric into buckets, sorted by upper bound.
+func (m *MetricConfig) parseBuckets() error {
+	if m.ValueLabel != "" {
+		return fmt.Errorf("value_label not supported for histogram metric %q", m.Name)
+	}
+	m.buckets = make([]HistogramBucket, 0, len(m.Values))
+	for _, column := range m.Values {
+		match := bucketColumnRE.FindStringSubmatch(column)
+		if match == nil {
+			return fmt.Errorf("value %q of histogram metric %q is not named bucket_<le>, e.g. bucket_100 or bucket_inf",
+				column, m.Name)
+		}
+		le := math.Inf(+1)
+		if match[1] != "inf" {
+			le, _ = strconv.ParseFloat(strings.Replace(match[1], "_", ".", 1), 64)
+		}
+		for _, b := range m.buckets {
+			if b.UpperBound == le {
+				return fmt.Errorf("values %q and %q of histogram metric %q have the same upper bound",
+					b.Column, column, m.Name)
+			}
+		}
+		m.buckets = append(m.buckets, HistogramBucket{Column: column, UpperBound: le})
+	}
+	sort.Slice(m.buckets, func(i, j int) bool { return m.buckets[i].UpperBound < m.buckets[j].UpperBound })
+	return nil
+}
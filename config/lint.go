@@ -0,0 +1,93 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// Lowercase letters, digits and underscores, not starting with a digit.
+	snakeCaseRE = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+	// Non-base unit suffixes (as the last or next to last name component, before `_total`) and the base unit to use
+	// instead. See https://prometheus.io/docs/practices/naming/#base-units.
+	nonBaseUnits = map[string]string{
+		"ms":           "seconds",
+		"msec":         "seconds",
+		"millis":       "seconds",
+		"milliseconds": "seconds",
+		"us":           "seconds",
+		"microseconds": "seconds",
+		"minutes":      "seconds",
+		"hours":        "seconds",
+		"days":         "seconds",
+		"kb":           "bytes",
+		"kilobytes":    "bytes",
+		"mb":           "bytes",
+		"megabytes":    "bytes",
+		"gb":           "bytes",
+		"gigabytes":    "bytes",
+		"pages":        "bytes",
+		"percent":      "ratio",
+		"pct":          "ratio",
+	}
+)
+
+// LintMetricNames checks the names of the metrics defined by all loaded collectors and the metric prefixes
+// against the Prometheus naming conventions: snake_case, no leading digits, base unit suffixes and `_total` suffixes
+// for counters (only); and for collisions with the metrics of well known exporters. It returns one line per problem
+// found, empty if none.
+func (c *Config) LintMetricNames() []string {
+	var problems []string
+	if c.Globals.MetricPrefix != "" && !snakeCaseRE.MatchString(c.Globals.MetricPrefix) {
+		problems = append(problems, fmt.Sprintf("global: metric_prefix %q is not snake_case", c.Globals.MetricPrefix))
+	}
+	for _, j := range c.Jobs {
+		if j.MetricPrefix != "" && !snakeCaseRE.MatchString(j.MetricPrefix) {
+			problems = append(problems,
+				fmt.Sprintf("job %q: metric_prefix %q is not snake_case", j.Name, j.MetricPrefix))
+		}
+	}
+	for _, coll := range c.Collectors {
+		for _, m := range coll.Metrics {
+			for _, problem := range lintMetricName(m.Name, m.ValueType() == prometheus.CounterValue) {
+				problems = append(problems, fmt.Sprintf("collector %q, metric %q: %s", coll.Name, m.Name, problem))
+			}
+		}
+	}
+	return append(problems, c.wellKnownCollisions()...)
+}
+
+// lintMetricName returns the naming convention violations of a metric with the given name, counter or not.
+func lintMetricName(name string, counter bool) []string {
+	var problems []string
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		problems = append(problems, "name starts with a digit")
+	} else if !snakeCaseRE.MatchString(name) {
+		problems = append(problems, "name is not snake_case")
+	}
+
+	components := strings.Split(strings.ToLower(name), "_")
+	last := components[len(components)-1]
+	if counter {
+		if last != "total" {
+			problems = append(problems, "counter name should end in _total")
+		} else {
+			components = components[:len(components)-1]
+		}
+	} else if last == "total" {
+		problems = append(problems, "_total suffix is reserved for counters")
+		components = components[:len(components)-1]
+	}
+
+	if len(components) > 0 {
+		unit := components[len(components)-1]
+		if base, found := nonBaseUnits[unit]; found {
+			problems = append(problems, fmt.Sprintf("unit %q should be converted to %s", unit, base))
+		}
+	}
+	return problems
+}
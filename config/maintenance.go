@@ -0,0 +1,124 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// weekdays maps (lowercase, 3 letter) day of the week names to time.Weekday values.
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// MaintenanceWindow defines a period of planned downtime, during which targets are not scraped. It is either a one-off
+// window (RFC 3339 start and end timestamps) or a recurring one (time of day, duration and, optionally, days of the
+// week).
+type MaintenanceWindow struct {
+	Start    string         `yaml:"start"`              // RFC 3339 timestamp or, for recurring windows, HH:MM
+	End      string         `yaml:"end,omitempty"`      // RFC 3339 timestamp, one-off windows only
+	Duration model.Duration `yaml:"duration,omitempty"` // length of recurring windows
+	Weekdays []string       `yaml:"weekdays,omitempty"` // days of the week of recurring windows, every day if empty
+	Timezone string         `yaml:"timezone,omitempty"` // IANA time zone of recurring windows, default UTC
+
+	start, end time.Time             // one-off windows
+	timeOfDay  time.Duration         // recurring windows, offset from midnight
+	days       map[time.Weekday]bool // recurring windows, nil means every day
+	location   *time.Location        // recurring windows
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for MaintenanceWindow.
+func (w *MaintenanceWindow) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain MaintenanceWindow
+	if err := unmarshal((*plain)(w)); err != nil {
+		return err
+	}
+
+	if w.Start == "" {
+		return fmt.Errorf("missing start for maintenance window %+v", w)
+	}
+
+	if w.End != "" {
+		// One-off window.
+		if w.Duration != 0 || len(w.Weekdays) > 0 || w.Timezone != "" {
+			return fmt.Errorf("maintenance window with an end may not define duration, weekdays or timezone: %+v", w)
+		}
+		var err error
+		if w.start, err = time.Parse(time.RFC3339, w.Start); err != nil {
+			return fmt.Errorf("invalid start for maintenance window: %s", err)
+		}
+		if w.end, err = time.Parse(time.RFC3339, w.End); err != nil {
+			return fmt.Errorf("invalid end for maintenance window: %s", err)
+		}
+		if !w.start.Before(w.end) {
+			return fmt.Errorf("maintenance window end %s not after start %s", w.End, w.Start)
+		}
+		return checkOverflow(w.XXX, "maintenance_window")
+	}
+
+	// Recurring window.
+	if w.Duration <= 0 {
+		return fmt.Errorf("missing end or duration for maintenance window %+v", w)
+	}
+	tod, err := time.Parse("15:04", w.Start)
+	if err != nil {
+		return fmt.Errorf("invalid start for recurring maintenance window, expecting HH:MM: %q", w.Start)
+	}
+	w.timeOfDay = time.Duration(tod.Hour())*time.Hour + time.Duration(tod.Minute())*time.Minute
+	if len(w.Weekdays) > 0 {
+		w.days = make(map[time.Weekday]bool, len(w.Weekdays))
+		for _, day := range w.Weekdays {
+			wd, found := weekdays[strings.ToLower(day)]
+			if !found {
+				return fmt.Errorf("invalid weekday %q for maintenance window, expecting one of sun, mon, ..., sat", day)
+			}
+			w.days[wd] = true
+		}
+	}
+	w.location = time.UTC
+	if w.Timezone != "" {
+		if w.location, err = time.LoadLocation(w.Timezone); err != nil {
+			return fmt.Errorf("invalid timezone for maintenance window: %s", err)
+		}
+	}
+	return checkOverflow(w.XXX, "maintenance_window")
+}
+
+// Contains returns true if t falls within the maintenance window.
+func (w *MaintenanceWindow) Contains(t time.Time) bool {
+	if w.location == nil {
+		return !t.Before(w.start) && t.Before(w.end)
+	}
+
+	// A recurring window may have started on any of the days overlapping its duration, check them all.
+	t = t.In(w.location)
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, w.location)
+	for d := day; !d.Add(w.timeOfDay + time.Duration(w.Duration)).Before(t); d = d.AddDate(0, 0, -1) {
+		start := d.Add(w.timeOfDay)
+		if (w.days == nil || w.days[d.Weekday()]) && !t.Before(start) && t.Before(start.Add(time.Duration(w.Duration))) {
+			return true
+		}
+	}
+	return false
+}
+
+// InMaintenance returns true if t falls within any of the provided maintenance windows.
+func InMaintenance(windows []*MaintenanceWindow, t time.Time) bool {
+	for _, w := range windows {
+		if w.Contains(t) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,171 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/free/sql_exporter/log"
+	"gopkg.in/yaml.v2"
+)
+
+var policyFile = kingpin.Flag("config.policy-file",
+	"Operator managed policy file denying collectors or queries by name (regular expression) across all jobs.").String()
+
+// Policy is an operator managed list of collectors and queries that must not run, regardless of the configuration and
+// collector files (e.g. an expensive collector from a community bundle), loaded from --config.policy-file.
+type Policy struct {
+	Deny []*DenyRule `yaml:"deny"`
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for Policy.
+func (p *Policy) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Policy
+	if err := unmarshal((*plain)(p)); err != nil {
+		return err
+	}
+	return checkOverflow(p.XXX, "policy")
+}
+
+// DenyRule denies the collectors matching Collector or, if Query is set, the queries matching Query (of the collectors
+// matching Collector, if also set). Both are regular expressions matching whole names.
+type DenyRule struct {
+	Collector string `yaml:"collector,omitempty"`
+	Query     string `yaml:"query,omitempty"`
+	Reason    string `yaml:"reason,omitempty"` // logged when denying a collector or query
+
+	collectorRE *regexp.Regexp
+	queryRE     *regexp.Regexp
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for DenyRule.
+func (r *DenyRule) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	r.Reason = "no reason given"
+
+	type plain DenyRule
+	if err := unmarshal((*plain)(r)); err != nil {
+		return err
+	}
+
+	if r.Collector == "" && r.Query == "" {
+		return fmt.Errorf("deny rule must define at least one of collector and query")
+	}
+	var err error
+	if r.Collector != "" {
+		if r.collectorRE, err = regexp.Compile("^(?:" + r.Collector + ")$"); err != nil {
+			return fmt.Errorf("invalid collector regular expression %q in deny rule: %s", r.Collector, err)
+		}
+	}
+	if r.Query != "" {
+		if r.queryRE, err = regexp.Compile("^(?:" + r.Query + ")$"); err != nil {
+			return fmt.Errorf("invalid query regular expression %q in deny rule: %s", r.Query, err)
+		}
+	}
+	return checkOverflow(r.XXX, "deny rule")
+}
+
+// deniesCollector returns true if the rule denies the named collector as a whole.
+func (r *DenyRule) deniesCollector(collector string) bool {
+	return r.queryRE == nil && r.collectorRE.MatchString(collector)
+}
+
+// deniesQuery returns true if the rule denies the named query of the named collector.
+func (r *DenyRule) deniesQuery(collector, query string) bool {
+	return r.queryRE != nil && r.queryRE.MatchString(query) &&
+		(r.collectorRE == nil || r.collectorRE.MatchString(collector))
+}
+
+// loadPolicy loads the policy file provided via --config.policy-file, nil if not set.
+func loadPolicy() (*Policy, error) {
+	if *policyFile == "" {
+		return nil, nil
+	}
+	buf, err := os.ReadFile(*policyFile)
+	if err != nil {
+		return nil, err
+	}
+	var p Policy
+	if err := yaml.Unmarshal(buf, &p); err != nil {
+		return nil, fmt.Errorf("loading policy file %s: %s", *policyFile, err)
+	}
+	return &p, nil
+}
+
+// applyPolicy removes the metrics, logs and checks of denied queries from all collectors and returns the names of
+// denied collectors: denied as a whole, or left with nothing to collect.
+func (c *Config) applyPolicy(p *Policy) map[string]bool {
+	denied := make(map[string]bool)
+	if p == nil {
+		return denied
+	}
+
+	for _, coll := range c.Collectors {
+		if rule := p.collectorRule(coll.Name); rule != nil {
+			log.Warningf("Collector %q denied by policy: %s", coll.Name, rule.Reason)
+			denied[coll.Name] = true
+			continue
+		}
+
+		deniedQuery := func(q *QueryConfig) bool {
+			rule := p.queryRule(coll.Name, q.Name)
+			if rule != nil {
+				log.Warningf("Query %q of collector %q denied by policy: %s", q.Name, coll.Name, rule.Reason)
+			}
+			return rule != nil
+		}
+		metrics := coll.Metrics[:0]
+		for _, m := range coll.Metrics {
+			if !deniedQuery(m.query) {
+				metrics = append(metrics, m)
+			}
+		}
+		coll.Metrics = metrics
+		logs := coll.Logs[:0]
+		for _, l := range coll.Logs {
+			if !deniedQuery(l.query) {
+				logs = append(logs, l)
+			}
+		}
+		coll.Logs = logs
+		checks := coll.Checks[:0]
+		for _, ch := range coll.Checks {
+			if !deniedQuery(ch.query) {
+				checks = append(checks, ch)
+			}
+		}
+		coll.Checks = checks
+
+		if len(coll.Metrics) == 0 && len(coll.Logs) == 0 && len(coll.Checks) == 0 {
+			log.Warningf("Collector %q denied by policy: all its queries are denied", coll.Name)
+			denied[coll.Name] = true
+		}
+	}
+	return denied
+}
+
+// collectorRule returns the first rule denying the named collector as a whole, nil if none.
+func (p *Policy) collectorRule(collector string) *DenyRule {
+	for _, r := range p.Deny {
+		if r.deniesCollector(collector) {
+			return r
+		}
+	}
+	return nil
+}
+
+// queryRule returns the first rule denying the named query of the named collector, nil if none.
+func (p *Policy) queryRule(collector, query string) *DenyRule {
+	for _, r := range p.Deny {
+		if r.deniesQuery(collector, query) {
+			return r
+		}
+	}
+	return nil
+}
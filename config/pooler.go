@@ -0,0 +1,59 @@
+package config
+
+import "fmt"
+
+// Connection poolers, see TargetConfig.Pooler and JobConfig.Pooler.
+const (
+	// PoolerNone means targets are connected to directly (or via a pooler transparent to clients).
+	PoolerNone = "none"
+	// PoolerPgBouncer means PostgreSQL targets are connected to via PgBouncer, possibly in transaction pooling mode.
+	PoolerPgBouncer = "pgbouncer"
+	// PoolerProxySQL means MySQL targets are connected to via ProxySQL, possibly multiplexing connections.
+	PoolerProxySQL = "proxysql"
+)
+
+// poolerDrivers maps poolers to the driver of the databases they front.
+var poolerDrivers = map[string]string{
+	PoolerPgBouncer: "postgres",
+	PoolerProxySQL:  "mysql",
+}
+
+// poolerDriverOptions are the driver options implied by each pooler, unless explicitly set otherwise: PgBouncer does
+// not keep the unnamed prepared statement the PostgreSQL driver parses queries with arguments into across
+// transactions, unless they are sent in a single round trip; and ProxySQL stops multiplexing connections with prepared
+// statements, so arguments are interpolated client side.
+var poolerDriverOptions = map[string]map[string]interface{}{
+	PoolerPgBouncer: {"binary_parameters": "yes"},
+	PoolerProxySQL:  {"interpolateParams": true},
+}
+
+// checkPooler checks that pooler is supported for the driver of dsn.
+func checkPooler(pooler string, dsn Secret, ctx string) error {
+	if pooler == "" || pooler == PoolerNone {
+		return nil
+	}
+	driver, found := poolerDrivers[pooler]
+	if !found {
+		return fmt.Errorf("unsupported pooler %q in %s", pooler, ctx)
+	}
+	if d := dsnDriver(dsn); d != driver {
+		return fmt.Errorf("pooler %s not supported for driver %q in %s", pooler, d, ctx)
+	}
+	return nil
+}
+
+// PoolerDriverOptions returns options with the driver options implied by pooler added, unless already set.
+func PoolerDriverOptions(options map[string]interface{}, pooler string) map[string]interface{} {
+	implied := poolerDriverOptions[pooler]
+	if len(implied) == 0 {
+		return options
+	}
+	merged := make(map[string]interface{}, len(options)+len(implied))
+	for name, value := range implied {
+		merged[name] = value
+	}
+	for name, value := range options {
+		merged[name] = value
+	}
+	return merged
+}
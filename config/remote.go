@@ -0,0 +1,286 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	// Timeout of every request fetching remote collector files.
+	remoteFetchTimeout = 30 * time.Second
+	// Upper bound on the size of remote collector files and OCI manifests.
+	remoteMaxSize = 16 << 20
+
+	// Media types of the OCI (and equivalent Docker) image manifests accepted for collector bundles.
+	ociManifestMediaType    = "application/vnd.oci.image.manifest.v1+json"
+	dockerManifestMediaType = "application/vnd.docker.distribution.manifest.v2+json"
+	// Annotation holding the file name of an OCI artifact layer, as set by e.g. `oras push`.
+	ociTitleAnnotation = "org.opencontainers.image.title"
+)
+
+var remoteClient = &http.Client{Timeout: remoteFetchTimeout}
+
+// remoteFile is a collector file fetched from a URL or an OCI artifact.
+type remoteFile struct {
+	source string // where the file was fetched from, for logging and error messages
+	buf    []byte
+}
+
+// isRemoteCollectorFile returns true if the collector_files entry refers to an HTTP(S) URL or an OCI artifact rather
+// than a local glob.
+func isRemoteCollectorFile(entry string) bool {
+	return strings.HasPrefix(entry, "https://") || strings.HasPrefix(entry, "http://") ||
+		strings.HasPrefix(entry, "oci://")
+}
+
+// fetchCollectorFiles fetches the collector files referenced by a remote collector_files entry: a single file from an
+// HTTPS URL, optionally pinned by a `#sha256=<hex digest>` fragment, or a plain HTTP URL, which must be pinned (the
+// file's queries run with the exporter's database credentials, anyone on the network path could change them); or
+// every YAML layer of an OCI artifact
+// (`oci://registry/repository:tag` or `oci://registry/repository@sha256:<hex digest>`).
+func fetchCollectorFiles(entry string) ([]remoteFile, error) {
+	if strings.HasPrefix(entry, "oci://") {
+		return fetchOCICollectorFiles(strings.TrimPrefix(entry, "oci://"))
+	}
+
+	u, err := url.Parse(entry)
+	if err != nil {
+		return nil, fmt.Errorf("invalid collector file URL %q: %s", entry, err)
+	}
+	var digest string
+	if u.Fragment != "" {
+		if !strings.HasPrefix(u.Fragment, "sha256=") {
+			return nil, fmt.Errorf("invalid checksum %q for collector file %s, expecting sha256=<hex digest>",
+				u.Fragment, u.Redacted())
+		}
+		digest = "sha256:" + strings.TrimPrefix(u.Fragment, "sha256=")
+		u.Fragment = ""
+	}
+	if u.Scheme == "http" && digest == "" {
+		return nil, fmt.Errorf("collector file %s fetched over plain HTTP must be pinned by a #sha256=<hex digest> "+
+			"fragment, or use https://", u.Redacted())
+	}
+	buf, err := fetch(u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("fetching collector file %s failed: %s", u.Redacted(), err)
+	}
+	if digest != "" {
+		if err := verifyDigest(buf, digest); err != nil {
+			return nil, fmt.Errorf("collector file %s: %s", u.Redacted(), err)
+		}
+	}
+	return []remoteFile{{source: u.Redacted(), buf: buf}}, nil
+}
+
+// ociReference is a parsed OCI artifact reference.
+type ociReference struct {
+	registry   string // host[:port]
+	repository string
+	reference  string // tag or digest
+}
+
+// parseOCIReference parses a `registry/repository[:tag|@digest]` reference. The tag defaults to `latest`.
+func parseOCIReference(ref string) (*ociReference, error) {
+	i := strings.IndexByte(ref, '/')
+	if i <= 0 || i == len(ref)-1 {
+		return nil, fmt.Errorf("invalid OCI reference %q, expecting oci://registry/repository[:tag|@digest]", ref)
+	}
+	r := &ociReference{registry: ref[:i], repository: ref[i+1:], reference: "latest"}
+	if j := strings.IndexByte(r.repository, '@'); j >= 0 {
+		r.repository, r.reference = r.repository[:j], r.repository[j+1:]
+	} else if j := strings.LastIndexByte(r.repository, ':'); j > strings.LastIndexByte(r.repository, '/') {
+		r.repository, r.reference = r.repository[:j], r.repository[j+1:]
+	}
+	if r.repository == "" || r.reference == "" {
+		return nil, fmt.Errorf("invalid OCI reference %q, expecting oci://registry/repository[:tag|@digest]", ref)
+	}
+	return r, nil
+}
+
+// url returns the registry API URL of the provided kind (`manifests` or `blobs`) of object. Registries on the loopback
+// interface are accessed over plain HTTP, all others over HTTPS.
+func (r *ociReference) url(kind, object string) string {
+	scheme := "https"
+	if host := strings.Split(r.registry, ":")[0]; host == "localhost" || host == "127.0.0.1" {
+		scheme = "http"
+	}
+	return fmt.Sprintf("%s://%s/v2/%s/%s/%s", scheme, r.registry, r.repository, kind, object)
+}
+
+// fetchOCICollectorFiles pulls the OCI artifact referenced by ref (anonymously, as registries hosting shared bundles
+// typically allow) and returns its layers, verified against their digests. Layers with a file name (title annotation)
+// not ending in .yml or .yaml are ignored.
+func fetchOCICollectorFiles(ref string) ([]remoteFile, error) {
+	r, err := parseOCIReference(ref)
+	if err != nil {
+		return nil, err
+	}
+	auth := &registryAuth{}
+	buf, err := auth.fetch(r.url("manifests", r.reference), ociManifestMediaType+", "+dockerManifestMediaType)
+	if err != nil {
+		return nil, fmt.Errorf("fetching manifest of oci://%s failed: %s", ref, err)
+	}
+	if strings.HasPrefix(r.reference, "sha256:") {
+		if err := verifyDigest(buf, r.reference); err != nil {
+			return nil, fmt.Errorf("manifest of oci://%s: %s", ref, err)
+		}
+	}
+	var manifest struct {
+		Layers []struct {
+			Digest      string            `json:"digest"`
+			Annotations map[string]string `json:"annotations"`
+		} `json:"layers"`
+	}
+	if err := json.Unmarshal(buf, &manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest of oci://%s: %s", ref, err)
+	}
+
+	var files []remoteFile
+	for _, layer := range manifest.Layers {
+		title := layer.Annotations[ociTitleAnnotation]
+		if ext := path.Ext(title); title != "" && ext != ".yml" && ext != ".yaml" {
+			continue
+		}
+		buf, err := auth.fetch(r.url("blobs", layer.Digest), "")
+		if err != nil {
+			return nil, fmt.Errorf("fetching layer %s of oci://%s failed: %s", layer.Digest, ref, err)
+		}
+		if err := verifyDigest(buf, layer.Digest); err != nil {
+			return nil, fmt.Errorf("layer %s of oci://%s: %s", layer.Digest, ref, err)
+		}
+		source := fmt.Sprintf("oci://%s (%s)", ref, layer.Digest)
+		if title != "" {
+			source = fmt.Sprintf("oci://%s (%s)", ref, title)
+		}
+		files = append(files, remoteFile{source: source, buf: buf})
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no collector files in oci://%s", ref)
+	}
+	return files, nil
+}
+
+// registryAuth fetches objects from an OCI registry, obtaining an anonymous bearer token when challenged to.
+type registryAuth struct {
+	token string
+}
+
+// fetch fetches rawURL, accepting the provided media types (if not empty), authenticating if challenged to.
+func (a *registryAuth) fetch(rawURL, accept string) ([]byte, error) {
+	header := http.Header{}
+	if accept != "" {
+		header.Set("Accept", accept)
+	}
+	if a.token != "" {
+		header.Set("Authorization", "Bearer "+a.token)
+	}
+	buf, err := fetch(rawURL, header)
+	challenge, ok := err.(*unauthorizedError)
+	if !ok || a.token != "" {
+		return buf, err
+	}
+	if a.token, err = fetchRegistryToken(challenge.authenticate); err != nil {
+		return nil, err
+	}
+	header.Set("Authorization", "Bearer "+a.token)
+	return fetch(rawURL, header)
+}
+
+// fetchRegistryToken requests an anonymous token from the authorization service named by a `Bearer realm="...",
+// service="...",scope="..."` challenge.
+func fetchRegistryToken(authenticate string) (string, error) {
+	if !strings.HasPrefix(authenticate, "Bearer ") {
+		return "", fmt.Errorf("unsupported authentication challenge %q", authenticate)
+	}
+	params := make(map[string]string)
+	for _, param := range strings.Split(strings.TrimPrefix(authenticate, "Bearer "), ",") {
+		param = strings.TrimSpace(param)
+		if i := strings.IndexByte(param, '='); i >= 0 {
+			params[param[:i]] = strings.Trim(param[i+1:], `"`)
+		}
+	}
+	if params["realm"] == "" {
+		return "", fmt.Errorf("missing realm in authentication challenge %q", authenticate)
+	}
+	query := url.Values{}
+	for _, name := range []string{"service", "scope"} {
+		if params[name] != "" {
+			query.Set(name, params[name])
+		}
+	}
+	buf, err := fetch(params["realm"]+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", fmt.Errorf("fetching registry token failed: %s", err)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(buf, &token); err != nil {
+		return "", fmt.Errorf("invalid registry token response: %s", err)
+	}
+	if token.Token != "" {
+		return token.Token, nil
+	}
+	return token.AccessToken, nil
+}
+
+// unauthorizedError is returned by fetch for 401 responses, with the authentication challenge.
+type unauthorizedError struct {
+	authenticate string
+}
+
+// Error implements error.
+func (e *unauthorizedError) Error() string {
+	return "unauthorized"
+}
+
+// fetch GETs rawURL with the provided headers and returns the response body, at most remoteMaxSize bytes.
+func fetch(rawURL string, header http.Header) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := remoteClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return nil, &unauthorizedError{authenticate: resp.Header.Get("WWW-Authenticate")}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	buf, err := io.ReadAll(io.LimitReader(resp.Body, remoteMaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) > remoteMaxSize {
+		return nil, fmt.Errorf("response larger than %d bytes", remoteMaxSize)
+	}
+	return buf, nil
+}
+
+// verifyDigest checks that buf matches digest, of the form `sha256:<hex digest>`.
+func verifyDigest(buf []byte, digest string) error {
+	if !strings.HasPrefix(digest, "sha256:") {
+		return fmt.Errorf("unsupported digest %q, only sha256 is supported", digest)
+	}
+	sum := sha256.Sum256(buf)
+	if actual := hex.EncodeToString(sum[:]); !strings.EqualFold(actual, strings.TrimPrefix(digest, "sha256:")) {
+		return fmt.Errorf("checksum mismatch: expected %s, got sha256:%s", digest, actual)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFetchCollectorFilesHTTP(t *testing.T) {
+	const body = "collector_name: test\n"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+	sum := sha256.Sum256([]byte(body))
+	digest := hex.EncodeToString(sum[:])
+
+	// Plain HTTP URLs must be pinned.
+	if _, err := fetchCollectorFiles(srv.URL + "/test.collector.yml"); err == nil ||
+		!strings.Contains(err.Error(), "must be pinned") {
+		t.Errorf("expected an unpinned plain HTTP URL to be rejected, got %v", err)
+	}
+
+	files, err := fetchCollectorFiles(srv.URL + "/test.collector.yml#sha256=" + digest)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(files) != 1 || string(files[0].buf) != body {
+		t.Errorf("unexpected collector files %+v", files)
+	}
+
+	if _, err := fetchCollectorFiles(srv.URL + "/test.collector.yml#sha256=" + strings.Repeat("0", 64)); err == nil ||
+		!strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("expected a checksum mismatch, got %v", err)
+	}
+}
+
+func TestFetchRegistryTokenChallenge(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.URL.Query().Get("scope"); got != "repository:example/collectors:pull" {
+			t.Errorf("unexpected scope %q", got)
+		}
+		w.Write([]byte(`{"token": "t0ken"}`))
+	}))
+	defer srv.Close()
+
+	token, err := fetchRegistryToken(
+		`Bearer realm="` + srv.URL + `/token", service="registry", scope="repository:example/collectors:pull"`)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if token != "t0ken" {
+		t.Errorf("unexpected token %q", token)
+	}
+}
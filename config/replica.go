@@ -0,0 +1,49 @@
+package config
+
+import (
+	"fmt"
+
+	"github.com/prometheus/common/model"
+)
+
+// Actions taken on lag sensitive collectors when a replica lags too far behind, see ReplicaLagConfig.
+const (
+	ReplicaLagSkip  = "skip"
+	ReplicaLagLabel = "label"
+)
+
+// ReplicaLagConfig makes scrapes of a read replica lag aware: before running the collectors, the lag query is run and,
+// if the replica's lag exceeds max_lag, collectors marked `lag_sensitive` are either skipped or their metrics labelled
+// `stale_data="true"`, so metrics aren't silently computed from outdated data.
+type ReplicaLagConfig struct {
+	Query  string         `yaml:"query"`            // returns the replica's lag in seconds, as a single value
+	MaxLag model.Duration `yaml:"max_lag"`          // lag beyond which the replica's data is considered stale
+	Action string         `yaml:"action,omitempty"` // skip (default) or label lag sensitive collectors when stale
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for ReplicaLagConfig.
+func (r *ReplicaLagConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain ReplicaLagConfig
+	if err := unmarshal((*plain)(r)); err != nil {
+		return err
+	}
+
+	if r.Query == "" {
+		return fmt.Errorf("missing query for replica_lag")
+	}
+	if r.MaxLag <= 0 {
+		return fmt.Errorf("max_lag for replica_lag must be positive, have %s", r.MaxLag)
+	}
+	switch r.Action {
+	case "":
+		r.Action = ReplicaLagSkip
+	case ReplicaLagSkip, ReplicaLagLabel:
+	default:
+		return fmt.Errorf("invalid action %q for replica_lag, must be one of %q or %q",
+			r.Action, ReplicaLagSkip, ReplicaLagLabel)
+	}
+	return checkOverflow(r.XXX, "replica_lag")
+}
@@ -0,0 +1,65 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/free/sql_exporter/log"
+	"gopkg.in/yaml.v2"
+)
+
+// evalCollectorScript executes a Starlark collector script and returns the value of its global `collectors` variable,
+// converted to Go maps, slices and scalars. Set by script_starlark.go, nil unless built with the starlark tag.
+var evalCollectorScript func(filename string, src []byte, maxSteps uint64) (interface{}, error)
+
+// loadCollectorScripts resolves all collector script globs to files, executes them and loads the collectors they
+// generate. Every script must define a global `collectors` variable: a list of collector definitions, with the same
+// structure as collector files.
+func (c *Config) loadCollectorScripts() error {
+	if len(c.CollectorScripts) > 0 && evalCollectorScript == nil {
+		return fmt.Errorf("collector_scripts require sql_exporter to be built with the starlark tag")
+	}
+
+	baseDir := filepath.Dir(c.configFile)
+	for _, csglob := range c.CollectorScripts {
+		// Resolve relative paths by joining them to the configuration file's directory.
+		if len(csglob) > 0 && !filepath.IsAbs(csglob) {
+			csglob = filepath.Join(baseDir, csglob)
+		}
+
+		scripts, err := filepath.Glob(csglob)
+		if err != nil {
+			// The only error can be a bad pattern.
+			return fmt.Errorf("error resolving collector scripts for %s: %s", csglob, err)
+		}
+
+		for _, script := range scripts {
+			src, err := os.ReadFile(script)
+			if err != nil {
+				return err
+			}
+			value, err := evalCollectorScript(script, src, c.Globals.ScriptMaxSteps)
+			if err != nil {
+				return fmt.Errorf("error executing collector script %s: %s", script, err)
+			}
+
+			// Round-trip the generated collectors through YAML, to validate them exactly like collector files.
+			buf, err := yaml.Marshal(value)
+			if err != nil {
+				return fmt.Errorf("error converting collectors generated by %s: %s", script, err)
+			}
+			var ccs []*CollectorConfig
+			if err := yaml.Unmarshal(buf, &ccs); err != nil {
+				return fmt.Errorf("invalid collectors generated by %s: %s", script, err)
+			}
+			for _, cc := range ccs {
+				cc.setSource(script)
+				c.Collectors = append(c.Collectors, cc)
+				log.Infof("Generated collector %q from %s", cc.Name, script)
+			}
+		}
+	}
+
+	return nil
+}
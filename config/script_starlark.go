@@ -0,0 +1,87 @@
+//go:build starlark
+// +build starlark
+
+package config
+
+import (
+	"fmt"
+
+	"go.starlark.net/starlark"
+)
+
+// Builds with the starlark tag (such as release builds, see .promu.yml) support collector_scripts.
+func init() {
+	evalCollectorScript = evalStarlarkCollectorScript
+}
+
+// evalStarlarkCollectorScript implements evalCollectorScript, executing at most maxSteps Starlark instructions.
+func evalStarlarkCollectorScript(filename string, src []byte, maxSteps uint64) (interface{}, error) {
+	thread := &starlark.Thread{Name: filename}
+	thread.SetMaxExecutionSteps(maxSteps)
+	globals, err := starlark.ExecFile(thread, filename, src, nil)
+	if err != nil {
+		return nil, err
+	}
+	collectors, found := globals["collectors"]
+	if !found {
+		return nil, fmt.Errorf("no global `collectors` variable defined")
+	}
+	return fromStarlark(collectors)
+}
+
+// fromStarlark converts a Starlark value to the equivalent Go value: dicts to maps with string keys, lists and tuples
+// to slices, scalars to strings, int64s, float64s, bools and nil.
+func fromStarlark(v starlark.Value) (interface{}, error) {
+	switch v := v.(type) {
+	case starlark.NoneType:
+		return nil, nil
+	case starlark.Bool:
+		return bool(v), nil
+	case starlark.String:
+		return string(v), nil
+	case starlark.Float:
+		return float64(v), nil
+	case starlark.Int:
+		i, ok := v.Int64()
+		if !ok {
+			return nil, fmt.Errorf("integer %s out of range", v)
+		}
+		return i, nil
+	case *starlark.List:
+		values := make([]interface{}, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			value, err := fromStarlark(v.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+		return values, nil
+	case starlark.Tuple:
+		values := make([]interface{}, 0, len(v))
+		for _, elem := range v {
+			value, err := fromStarlark(elem)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+		return values, nil
+	case *starlark.Dict:
+		values := make(map[string]interface{}, v.Len())
+		for _, item := range v.Items() {
+			key, ok := starlark.AsString(item[0])
+			if !ok {
+				return nil, fmt.Errorf("dict key %s is not a string", item[0])
+			}
+			value, err := fromStarlark(item[1])
+			if err != nil {
+				return nil, err
+			}
+			values[key] = value
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("unsupported value %s of type %s", v, v.Type())
+	}
+}
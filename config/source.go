@@ -0,0 +1,144 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/free/sql_exporter/log"
+	"gopkg.in/yaml.v2"
+)
+
+// StdinConfigFile is the configuration file name standing for the standard input.
+const StdinConfigFile = "-"
+
+// The configuration read from the standard input, which can only be read once, see readStdin().
+var (
+	stdinOnce sync.Once
+	stdinBuf  []byte
+	stdinErr  error
+)
+
+// readConfigFile reads the configuration from configFile: a file, a directory of files merged into one configuration
+// (see readConfigDir) or, if StdinConfigFile, the standard input. Along with the configuration, it returns the file
+// name to resolve relative paths (e.g. collector_files) against the directory of: empty for the standard input, i.e.
+// relative to the current working directory.
+func readConfigFile(configFile string) ([]byte, string, error) {
+	if configFile == StdinConfigFile {
+		buf, err := readStdin()
+		return buf, "", err
+	}
+	fi, err := os.Stat(configFile)
+	if err != nil {
+		return nil, "", err
+	}
+	if fi.IsDir() {
+		buf, err := readConfigDir(configFile)
+		return buf, filepath.Join(configFile, "*.yml"), err
+	}
+	buf, err := os.ReadFile(configFile)
+	return buf, configFile, err
+}
+
+// readStdin reads the standard input once and returns the same contents on every call, so that the configuration can
+// be loaded more than once (e.g. by the diff subcommand).
+func readStdin() ([]byte, error) {
+	stdinOnce.Do(func() {
+		stdinBuf, stdinErr = io.ReadAll(os.Stdin)
+	})
+	return stdinBuf, stdinErr
+}
+
+// readConfigDir merges all `*.yml` files in dir, in lexical order, into one configuration, as e.g. when the files of a
+// Kubernetes ConfigMap are mounted into a directory. Mappings are merged, sequences (e.g. jobs or collectors) are
+// concatenated and scalars defined by more than one file take the value of the last one. Collector files
+// (`*.collector.yml`) are skipped, so they may be kept in the same directory and referenced via collector_files.
+func readConfigDir(dir string) ([]byte, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.yml"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	var merged interface{}
+	for _, f := range files {
+		if strings.HasSuffix(f, ".collector.yml") {
+			continue
+		}
+		buf, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		var doc interface{}
+		if err := yaml.Unmarshal(buf, &doc); err != nil {
+			return nil, fmt.Errorf("error loading configuration file %s: %s", f, err)
+		}
+		if merged, err = mergeYAML(merged, doc); err != nil {
+			return nil, fmt.Errorf("error merging configuration file %s: %s", f, err)
+		}
+		log.V(1).Infof("Merged configuration file %s", f)
+	}
+	if merged == nil {
+		return nil, fmt.Errorf("no configuration files (*.yml) in directory %s", dir)
+	}
+	return yaml.Marshal(merged)
+}
+
+// mergeYAML merges src into dst, both unmarshaled YAML documents, and returns the result: mappings are merged key by
+// key, sequences concatenated and any other value replaced by src (unless nil, e.g. an empty file).
+func mergeYAML(dst, src interface{}) (interface{}, error) {
+	if dst == nil {
+		return src, nil
+	}
+	if src == nil {
+		return dst, nil
+	}
+	switch s := src.(type) {
+	case map[interface{}]interface{}:
+		d, ok := dst.(map[interface{}]interface{})
+		if !ok {
+			return nil, fmt.Errorf("cannot merge a mapping into a %s", yamlKind(dst))
+		}
+		for k, v := range s {
+			merged, err := mergeYAML(d[k], v)
+			if err != nil {
+				return nil, fmt.Errorf("%v: %s", k, err)
+			}
+			d[k] = merged
+		}
+		return d, nil
+	case []interface{}:
+		d, ok := dst.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("cannot merge a sequence into a %s", yamlKind(dst))
+		}
+		return append(d, s...), nil
+	}
+	if kind := yamlKind(dst); kind != "scalar" {
+		return nil, fmt.Errorf("cannot merge a scalar into a %s", kind)
+	}
+	return src, nil
+}
+
+// yamlKind returns the kind of an unmarshaled YAML value: mapping, sequence or scalar.
+func yamlKind(v interface{}) string {
+	switch v.(type) {
+	case map[interface{}]interface{}:
+		return "mapping"
+	case []interface{}:
+		return "sequence"
+	}
+	return "scalar"
+}
+
+// configSource describes where the configuration is loaded from, for logging.
+func configSource(configFile string) string {
+	if configFile == StdinConfigFile {
+		return "standard input"
+	}
+	return configFile
+}
@@ -0,0 +1,42 @@
+package config
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestQueryTemplate(t *testing.T) {
+	tests := []struct {
+		yaml string
+		want string
+	}{
+		{
+			// Queries are only templates if explicitly enabled.
+			yaml: `
+query_name: settings
+query: SELECT '{{ not a template }}' AS doc`,
+			want: `SELECT '{{ not a template }}' AS doc`,
+		},
+		{
+			yaml: `
+query_name: now
+template: true
+query: SELECT {{ if eq .dialect "sqlserver" }}GETDATE(){{ else }}CURRENT_TIMESTAMP{{ end }} AS now`,
+			want: `SELECT GETDATE() AS now`,
+		},
+	}
+	for _, test := range tests {
+		var q QueryConfig
+		if err := yaml.Unmarshal([]byte(test.yaml), &q); err != nil {
+			t.Errorf("unexpected error: %s", err)
+			continue
+		}
+		got, err := q.Render("sqlserver")
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", q.Name, err)
+		} else if got != test.want {
+			t.Errorf("%s: Render() = %q, want %q", q.Name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Warnings returns the problems found with the configuration when loading it, which don't prevent it from being used
+// but likely are leftovers or mistakes: named queries no metric, log or check references (and exporting neither a
+// result checksum nor a row count); value columns read more than once by the same metric or by several metrics of the
+// same query (exporting duplicate data); and collectors no target or job references. One line per problem, empty if
+// none.
+func (c *Config) Warnings() []string {
+	return c.warnings
+}
+
+// findWarnings returns the configuration's warnings, see Warnings(). Must be called once collector references and
+// extends are resolved.
+func (c *Config) findWarnings() []string {
+	var warnings []string
+	for _, coll := range c.Collectors {
+		warnings = append(warnings, coll.unusedQueries()...)
+		warnings = append(warnings, coll.ambiguousColumns()...)
+	}
+	return append(warnings, c.unreferencedCollectors()...)
+}
+
+// unusedQueries returns a warning for each of the collector's named queries not referenced by any of its metrics, logs
+// or checks. Queries exporting a result checksum or row count are used regardless.
+func (c *CollectorConfig) unusedQueries() []string {
+	used := make(map[string]bool, len(c.Queries))
+	for _, m := range c.Metrics {
+		used[m.QueryRef] = true
+	}
+	for _, l := range c.Logs {
+		used[l.QueryRef] = true
+	}
+	for _, check := range c.Checks {
+		used[check.QueryRef] = true
+	}
+	var warnings []string
+	for _, q := range c.Queries {
+		if !used[q.Name] && !q.ResultChecksum && !q.ExportRowCount {
+			warnings = append(warnings, fmt.Sprintf("collector %q: query %q is never referenced", c.Name, q.Name))
+		}
+	}
+	return warnings
+}
+
+// ambiguousColumns returns a warning for each column read as value more than once, either by the same metric or by
+// several metrics of the same query. Columns used as both key label and value, by any metric of the same query, are
+// rejected when the collector is created.
+func (c *CollectorConfig) ambiguousColumns() []string {
+	var warnings []string
+	// The first metric reading each value column, by query.
+	readBy := make(map[*QueryConfig]map[string]string)
+	for _, m := range c.Metrics {
+		columns := readBy[m.query]
+		if columns == nil {
+			columns = make(map[string]string, len(m.Values))
+			readBy[m.query] = columns
+		}
+		for i, v := range m.Values {
+			if contains(m.Values[:i], v) {
+				warnings = append(warnings, fmt.Sprintf("collector %q, metric %q: column %q used as value more than once",
+					c.Name, m.Name, v))
+			} else if other, found := columns[v]; found {
+				warnings = append(warnings, fmt.Sprintf(
+					"collector %q, metric %q: column %q of query %q already used as value by metric %q",
+					c.Name, m.Name, v, m.query.Name, other))
+			} else {
+				columns[v] = m.Name
+			}
+		}
+	}
+	return warnings
+}
+
+// unreferencedCollectors returns a warning for each collector neither referenced by the target or any job nor
+// extended by another collector, in name order.
+func (c *Config) unreferencedCollectors() []string {
+	referenced := make(map[string]bool, len(c.Collectors))
+	if c.Target != nil {
+		for _, name := range c.Target.CollectorRefs {
+			referenced[name] = true
+		}
+	}
+	for _, j := range c.Jobs {
+		for _, name := range j.CollectorRefs {
+			referenced[name] = true
+		}
+	}
+	for _, coll := range c.Collectors {
+		referenced[coll.Extends] = true
+	}
+
+	var warnings []string
+	for _, coll := range c.Collectors {
+		if !referenced[coll.Name] {
+			warnings = append(warnings, fmt.Sprintf("collector %q is not referenced by the target or any job", coll.Name))
+		}
+	}
+	sort.Strings(warnings)
+	return warnings
+}
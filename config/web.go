@@ -0,0 +1,150 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/prometheus/common/model"
+)
+
+// ScrapeLabelParamPrefix prefixes the URL parameters of scrapes setting the labels listed in WebConfig.ScrapeLabels,
+// e.g. `/metrics?label_env=prod`.
+const ScrapeLabelParamPrefix = "label_"
+
+// WebConfig defines how the exporter's web endpoints are served (HTTPS, client certificates) and the authentication
+// required by all of them other than /healthz and the admin API, which has its own token.
+type WebConfig struct {
+	BearerToken    Secret           `yaml:"bearer_token,omitempty"`     // token required in the Authorization header
+	BearerTokenEnv string           `yaml:"bearer_token_env,omitempty"` // environment variable holding the token
+	BasicAuth      *BasicAuthConfig `yaml:"basic_auth,omitempty"`       // basic auth credentials
+	TLS            *WebTLSConfig    `yaml:"tls,omitempty"`              // serve over HTTPS
+	ScrapeLabels   []string         `yaml:"scrape_labels,omitempty"`    // labels scrapes may add via URL parameters
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for WebConfig.
+func (w *WebConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain WebConfig
+	if err := unmarshal((*plain)(w)); err != nil {
+		return err
+	}
+
+	if w.BearerTokenEnv != "" {
+		if w.BearerToken != "" {
+			return fmt.Errorf("bearer_token and bearer_token_env are mutually exclusive")
+		}
+		if w.BearerToken = Secret(os.Getenv(w.BearerTokenEnv)); w.BearerToken == "" {
+			return fmt.Errorf("environment variable %s (bearer_token_env) is empty or not set", w.BearerTokenEnv)
+		}
+	}
+	if w.BearerToken != "" && w.BasicAuth != nil {
+		return fmt.Errorf("bearer_token and basic_auth are mutually exclusive")
+	}
+	for _, name := range w.ScrapeLabels {
+		if !model.LabelName(name).IsValid() || strings.HasPrefix(name, model.ReservedLabelPrefix) {
+			return fmt.Errorf("invalid label name %q in web.scrape_labels", name)
+		}
+	}
+	return checkOverflow(w.XXX, "web")
+}
+
+// AllowsScrapeLabel returns true if scrapes may add the named label via URL parameters, see ScrapeLabelParamPrefix.
+func (w *WebConfig) AllowsScrapeLabel(name string) bool {
+	if w == nil {
+		return false
+	}
+	for _, allowed := range w.ScrapeLabels {
+		if allowed == name {
+			return true
+		}
+	}
+	return false
+}
+
+// BasicAuthConfig defines basic auth credentials.
+type BasicAuthConfig struct {
+	Username    string `yaml:"username"`
+	Password    Secret `yaml:"password,omitempty"`
+	PasswordEnv string `yaml:"password_env,omitempty"` // environment variable holding the password
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for BasicAuthConfig.
+func (b *BasicAuthConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain BasicAuthConfig
+	if err := unmarshal((*plain)(b)); err != nil {
+		return err
+	}
+
+	if b.Username == "" {
+		return fmt.Errorf("missing username for basic_auth")
+	}
+	if b.PasswordEnv != "" {
+		if b.Password != "" {
+			return fmt.Errorf("password and password_env are mutually exclusive for basic_auth")
+		}
+		if b.Password = Secret(os.Getenv(b.PasswordEnv)); b.Password == "" {
+			return fmt.Errorf("environment variable %s (basic_auth password_env) is empty or not set", b.PasswordEnv)
+		}
+	}
+	if b.Password == "" {
+		return fmt.Errorf("missing password for basic_auth")
+	}
+	return checkOverflow(b.XXX, "basic_auth")
+}
+
+// WebTLSConfig defines the server certificate to serve HTTPS with and, optionally, the CA to verify client certificates
+// against and the paths requiring one.
+type WebTLSConfig struct {
+	CertFile        string   `yaml:"cert_file"`                   // server certificate
+	KeyFile         string   `yaml:"key_file"`                    // server certificate key
+	ClientCAFile    string   `yaml:"client_ca_file,omitempty"`    // CA to verify client certificates against
+	ClientCertPaths []string `yaml:"client_cert_paths,omitempty"` // paths requiring a verified client certificate
+
+	// Catches all undefined fields and must be empty after parsing.
+	XXX map[string]interface{} `yaml:",inline" json:"-"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for WebTLSConfig.
+func (t *WebTLSConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain WebTLSConfig
+	if err := unmarshal((*plain)(t)); err != nil {
+		return err
+	}
+
+	if t.CertFile == "" || t.KeyFile == "" {
+		return fmt.Errorf("both cert_file and key_file must be defined for web tls")
+	}
+	if len(t.ClientCertPaths) > 0 && t.ClientCAFile == "" {
+		return fmt.Errorf("client_cert_paths defined for web tls but no client_ca_file")
+	}
+	for _, p := range t.ClientCertPaths {
+		if !strings.HasPrefix(p, "/") {
+			return fmt.Errorf("invalid client_cert_paths entry %q for web tls, must start with /", p)
+		}
+	}
+	return checkOverflow(t.XXX, "tls")
+}
+
+// ClientCertRequired returns true if requests for path must present a client certificate verified against the client
+// CA. Like http.ServeMux patterns, client_cert_paths ending in a slash match all paths under them, others only match
+// themselves. If client_ca_file is set but client_cert_paths isn't, all paths except /healthz require one.
+func (t *WebTLSConfig) ClientCertRequired(path string) bool {
+	if t == nil || t.ClientCAFile == "" {
+		return false
+	}
+	if len(t.ClientCertPaths) == 0 {
+		return path != "/healthz"
+	}
+	for _, p := range t.ClientCertPaths {
+		if path == p || (strings.HasSuffix(p, "/") && strings.HasPrefix(path, p)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,175 @@
+package sql_exporter
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	mssql "github.com/denisenkom/go-mssqldb"
+	"github.com/free/sql_exporter/promql"
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+)
+
+// Names of the networks registered with the MySQL driver, keyed by dial timeout, see mysqlNetwork().
+var (
+	mysqlNetworksMtx sync.Mutex
+	mysqlNetworks    = make(map[time.Duration]string)
+)
+
+// openDB opens a DB handle for the provided driver and (adjusted) data source name, see openConnector. If auditor is
+// not nil, everything sent over the handle's connections is audited.
+func openDB(driverName, dsn string, dialTimeout time.Duration, auditor *connAuditor) (*sql.DB, error) {
+	c, err := openConnector(driverName, dsn, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if auditor != nil {
+		c = &auditConnector{Connector: c, auditor: auditor}
+	}
+	return sql.OpenDB(c), nil
+}
+
+// openConnector returns a connector for the provided driver and (adjusted) data source name. Drivers supporting custom
+// dialers (PostgreSQL, SQL Server, Prometheus and, if --dns.cache-ttl is set, MySQL) connect via dialContext.
+//
+// If dialTimeout is positive, establishing a network connection times out after dialTimeout, independently of the
+// context (i.e. scrape) deadline. ClickHouse does not support custom dialers, use its `timeout` DSN parameter instead.
+func openConnector(driverName, dsn string, dialTimeout time.Duration) (driver.Connector, error) {
+	dial := dialWithTimeout(dialTimeout)
+	switch driverName {
+	case "postgres":
+		return &pqConnector{dsn: dsn, dialer: pqDialer{dial: dial}}, nil
+	case "sqlserver":
+		c, err := mssql.NewConnector(dsn)
+		if err != nil {
+			return nil, err
+		}
+		c.Dialer = dialerFunc(dial)
+		return c, nil
+	case promql.DriverName:
+		return promql.NewConnector(dsn, dial)
+	case "mysql":
+		cfg, err := mysql.ParseDSN(dsn)
+		if err != nil {
+			return nil, err
+		}
+		// dial_timeout takes precedence over the `timeout` DSN parameter, which only applies to dialing anyway.
+		if dialTimeout > 0 {
+			cfg.Timeout = dialTimeout
+		}
+		// A custom dialer replaces the driver's own, so only use it if the DNS cache is enabled.
+		if cfg.Net == "tcp" && *dnsCacheTTL > 0 {
+			cfg.Net = mysqlNetwork(cfg.Timeout)
+		}
+		return mysql.NewConnector(cfg)
+	}
+
+	// Look up the driver registered under driverName via a throwaway handle, database/sql doesn't export the registry.
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	d := db.Driver()
+	db.Close()
+	if dc, ok := d.(driver.DriverContext); ok {
+		return dc.OpenConnector(dsn)
+	}
+	return dsnConnector{dsn: dsn, driver: d}, nil
+}
+
+// dialWithTimeout returns a dial function connecting via dialContext, giving up after timeout (if positive).
+func dialWithTimeout(timeout time.Duration) func(ctx context.Context, network, address string) (net.Conn, error) {
+	if timeout <= 0 {
+		return dialContext
+	}
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return dialContext(ctx, network, address)
+	}
+}
+
+// mysqlNetwork returns the name of a network registered with the MySQL driver, dialing TCP connections via dialContext
+// with the given timeout. The driver only supports custom dialers per network name, so there is one per timeout.
+func mysqlNetwork(timeout time.Duration) string {
+	mysqlNetworksMtx.Lock()
+	defer mysqlNetworksMtx.Unlock()
+
+	name, found := mysqlNetworks[timeout]
+	if !found {
+		name = fmt.Sprintf("sql_exporter_tcp_%d", timeout)
+		dial := dialWithTimeout(timeout)
+		mysql.RegisterDialContext(name, func(ctx context.Context, addr string) (net.Conn, error) {
+			return dial(ctx, "tcp", addr)
+		})
+		mysqlNetworks[timeout] = name
+	}
+	return name
+}
+
+// dialerFunc adapts a dial function to the go-mssqldb Dialer interface.
+type dialerFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// DialContext implements mssql.Dialer.
+func (f dialerFunc) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return f(ctx, network, address)
+}
+
+// dsnConnector implements driver.Connector for drivers not implementing driver.DriverContext.
+type dsnConnector struct {
+	dsn    string
+	driver driver.Driver
+}
+
+// Connect implements driver.Connector.
+func (c dsnConnector) Connect(context.Context) (driver.Conn, error) {
+	return c.driver.Open(c.dsn)
+}
+
+// Driver implements driver.Connector.
+func (c dsnConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// pqConnector implements driver.Connector for the PostgreSQL driver, connecting via pqDialer.
+type pqConnector struct {
+	dsn    string
+	dialer pqDialer
+}
+
+// Connect implements driver.Connector.
+func (c *pqConnector) Connect(context.Context) (driver.Conn, error) {
+	return pq.DialOpen(c.dialer, c.dsn)
+}
+
+// Driver implements driver.Connector.
+func (c *pqConnector) Driver() driver.Driver {
+	return &pq.Driver{}
+}
+
+// pqDialer implements pq.Dialer and pq.DialerContext via a dial function.
+type pqDialer struct {
+	dial func(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Dial implements pq.Dialer.
+func (d pqDialer) Dial(network, address string) (net.Conn, error) {
+	return d.dial(context.Background(), network, address)
+}
+
+// DialTimeout implements pq.Dialer.
+func (d pqDialer) DialTimeout(network, address string, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return d.dial(ctx, network, address)
+}
+
+// DialContext implements pq.DialerContext.
+func (d pqDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return d.dial(ctx, network, address)
+}
@@ -0,0 +1,68 @@
+package sql_exporter
+
+import (
+	"context"
+	"database/sql"
+	"net/url"
+
+	"github.com/free/sql_exporter/config"
+	"github.com/free/sql_exporter/errors"
+	"github.com/free/sql_exporter/log"
+)
+
+// paramsConn is a DB handle opened with a collector's connection_params added to the target's data source name.
+type paramsConn struct {
+	dsn  string // the data source name the handle was opened with
+	conn *sql.DB
+}
+
+// connParamsKey returns the key of the DB handle used by collectors with the given connection_params: the parameters,
+// URL encoded in name order. Empty if there are none, i.e. the collector uses the target's DB handle.
+func connParamsKey(params map[string]string) string {
+	values := make(url.Values, len(params))
+	for name, value := range params {
+		values.Set(name, value)
+	}
+	return values.Encode()
+}
+
+// connectWithParams pings the target's DB handle with the given connection_params and returns it, opening it first if
+// necessary. Like connect, the handle remains open until released via releaseConn. If the target's data source name
+// changed (e.g. failed over or rotated credentials) since the handle was opened, it is replaced with one for the active
+// data source name. As in connect, the database is pinged without holding connMtx.
+func (t *target) connectWithParams(ctx context.Context, params map[string]string) (*sql.DB, errors.WithContext) {
+	t.connMtx.Lock()
+	conn, err := t.acquireParamsLocked(ctx, params)
+	t.connMtx.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return t.pingAcquired(ctx, conn)
+}
+
+// acquireParamsLocked returns the DB handle with the given connection_params, replacing it first if the data source
+// name changed, and takes a reference to it. Must be called with connMtx held.
+func (t *target) acquireParamsLocked(ctx context.Context, params map[string]string) (*sql.DB, errors.WithContext) {
+	if t.closed {
+		return nil, errors.New(t.logContext, "target closed")
+	}
+	key := connParamsKey(params)
+	dsn, err := config.WithDSNParams(t.dataSourceName(), params)
+	if err != nil {
+		return nil, errors.Wrap(t.logContext, err)
+	}
+
+	pc := t.paramsConns[key]
+	if pc != nil && pc.dsn != dsn {
+		log.V(1).Infof("[%s] Data source name changed, replacing DB handle with connection_params %s", t.logContext, key)
+		if pc.conn != nil {
+			t.retireLocked(pc.conn)
+		}
+		pc = nil
+	}
+	if pc == nil {
+		pc = &paramsConn{dsn: dsn}
+		t.paramsConns[key] = pc
+	}
+	return t.acquireLocked(ctx, dsn, &pc.conn)
+}
@@ -0,0 +1,45 @@
+package sql_exporter
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/free/sql_exporter/log"
+)
+
+// counterResets keeps the state of the series of a counter metric with reset_detection, so that values read from the
+// database going backwards (e.g. statistics reset by a failover or restart) don't show up as huge negative rates.
+//
+// Each series is exported as the sum of the values read before every detected reset plus the current value: i.e. it
+// keeps increasing across resets, exactly the way Prometheus' rate() would have interpreted a reset to zero.
+type counterResets struct {
+	mtx    sync.Mutex
+	series map[string]*counterSeries
+}
+
+// counterSeries is the state of a single series: the last value read from the database and the offset to add to it.
+type counterSeries struct {
+	last   float64
+	offset float64
+}
+
+// adjust records value as read from the database for the series with the given label values and returns the value to
+// export for it.
+func (cr *counterResets) adjust(logContext string, labelValues []string, value float64) float64 {
+	key := strings.Join(labelValues, "\xff")
+
+	cr.mtx.Lock()
+	defer cr.mtx.Unlock()
+
+	s, found := cr.series[key]
+	if !found {
+		cr.series[key] = &counterSeries{last: value}
+		return value
+	}
+	if value < s.last {
+		log.V(1).Infof("[%s] Counter reset detected for series %q: %g after %g", logContext, labelValues, value, s.last)
+		s.offset += s.last
+	}
+	s.last = value
+	return s.offset + value
+}
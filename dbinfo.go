@@ -0,0 +1,54 @@
+package sql_exporter
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/free/sql_exporter/errors"
+)
+
+const (
+	databaseInfoName = "sql_database_info"
+	databaseInfoHelp = "Database server metadata, always 1"
+)
+
+// databaseInfo caches a target's database server version, refreshing it at most once per interval.
+type databaseInfo struct {
+	driver     string
+	interval   time.Duration
+	logContext string
+
+	mtx       sync.Mutex
+	version   string
+	refreshed time.Time
+}
+
+// get returns the database server version, querying it if not yet known or older than the refresh interval. If the
+// query fails, the last known version (if any) is returned along with the error.
+func (i *databaseInfo) get(ctx context.Context, conn *sql.DB) (string, errors.WithContext) {
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+
+	if i.version != "" && time.Since(i.refreshed) < i.interval {
+		return i.version, nil
+	}
+	query := DialectFor(i.driver).VersionQuery
+	if query == "" {
+		return "", errors.Errorf(i.logContext, "no version query known for driver %q", i.driver)
+	}
+
+	var version string
+	if err := conn.QueryRowContext(ctx, query).Scan(&version); err != nil {
+		return i.version, errors.Wrapf(i.logContext, err, "querying database version failed")
+	}
+	// Multi-line versions (e.g. SQL Server's) are reduced to their first line.
+	if idx := strings.IndexByte(version, '\n'); idx >= 0 {
+		version = version[:idx]
+	}
+	i.version = strings.TrimSpace(version)
+	i.refreshed = time.Now()
+	return i.version, nil
+}
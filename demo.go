@@ -0,0 +1,103 @@
+package sql_exporter
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	demoMode = kingpin.Flag("demo",
+		"Serve synthetic metrics generated from the collector definitions, without connecting to any database.").Bool()
+	demoRows = flagValue(3, kingpin.Flag("demo.rows",
+		"Number of synthetic rows generated per query in demo mode.").Default("3").IntVar)
+	demoMinValue = kingpin.Flag("demo.min-value",
+		"Lower bound of the synthetic values generated in demo mode.").Default("0").Float64()
+	demoMaxValue = flagValue(100.0, kingpin.Flag("demo.max-value",
+		"Upper bound of the synthetic values generated in demo mode.").Default("100").Float64Var)
+)
+
+// demoRand is the random source for demo values, shared across goroutines (rand.Rand is not safe for concurrent use).
+var (
+	demoRandMtx sync.Mutex
+	demoRand    = rand.New(rand.NewSource(1))
+)
+
+// demoValue returns a random value in the [demo.min-value, demo.max-value) range.
+func demoValue() float64 {
+	demoRandMtx.Lock()
+	defer demoRandMtx.Unlock()
+	return *demoMinValue + demoRand.Float64()*(*demoMaxValue-*demoMinValue)
+}
+
+// demoQuery generates synthetic result rows for a Query, with key columns populated as `<column>_<n>` and value
+// columns populated with random values. Counter values are accumulated across calls so they stay monotonic.
+type demoQuery struct {
+	mtx      sync.Mutex
+	counters map[string]float64
+}
+
+// rows returns demo.rows synthetic rows for the provided query.
+func (d *demoQuery) rows(q *Query) []map[string]interface{} {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.counters == nil {
+		d.counters = make(map[string]float64)
+	}
+
+	// Columns used as values by at least one counter metric.
+	counterColumns := make(map[string]bool)
+	for _, mf := range q.metricFamilies {
+		if mf.config.ValueType() == prometheus.CounterValue {
+			for _, v := range mf.config.Values {
+				counterColumns[v] = true
+			}
+		}
+	}
+
+	rows := make([]map[string]interface{}, 0, *demoRows)
+	for i := 1; i <= *demoRows; i++ {
+		row := make(map[string]interface{}, len(q.columnTypes))
+		for column, ctype := range q.columnTypes {
+			switch ctype {
+			case columnTypeKey:
+				row[column] = fmt.Sprintf("%s_%d", column, i)
+			case columnTypeCondition:
+				row[column] = demoValue()
+			case columnTypeValue, columnTypeNullableValue:
+				value := demoValue()
+				if counterColumns[column] {
+					id := fmt.Sprintf("%s_%d", column, i)
+					d.counters[id] += value
+					value = d.counters[id]
+				}
+				row[column] = value
+			}
+		}
+		// Exposition columns hold one demo gauge per row.
+		for _, mf := range q.metricFamilies {
+			if mf.config.IsExposition() {
+				row[mf.config.Values[0]] = fmt.Sprintf("# HELP demo Demo gauge.\n# TYPE demo gauge\ndemo{row=\"%d\"} %g\n",
+					i, demoValue())
+			}
+		}
+		// Histogram bucket counts are cumulative. Columns shared by multiple histograms are only accumulated once.
+		accumulated := make(map[string]bool)
+		for _, mf := range q.metricFamilies {
+			cumulative := 0.0
+			for _, b := range mf.config.Buckets() {
+				if !accumulated[b.Column] {
+					cumulative += row[b.Column].(float64)
+					row[b.Column] = cumulative
+					accumulated[b.Column] = true
+				}
+				cumulative = row[b.Column].(float64)
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
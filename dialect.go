@@ -0,0 +1,250 @@
+package sql_exporter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/free/sql_exporter/config"
+)
+
+// Dialect describes the SQL dialect and capabilities of a database driver, so that features depending on them (bind
+// parameters, execution plans, row limits, session settings) are implemented once for all supported databases.
+type Dialect struct {
+	// Name of the dialect, usually the same as the driver name.
+	Name string
+	// Placeholder returns the bind parameter placeholder for the i-th (1-based) query argument. Nil if bind parameters
+	// are not supported, time window placeholders are then expanded into the query text.
+	Placeholder func(i int) string
+	// Limit wraps query so that it returns at most n rows, or returns it unchanged if it can't be wrapped (rows are then
+	// only limited while reading them). Nil if not supported.
+	Limit func(query string, n int) string
+	// Page appends to query an ORDER BY clause on column and a limit of n rows, for keyset pagination. Unlike Limit, it
+	// doesn't wrap the query in a derived table, which SQL Server won't order. Nil if not supported.
+	Page func(query, column string, n int) string
+	// VersionQuery returns the database server version as a single row and column. Empty if not supported.
+	VersionQuery string
+	// EditionQuery returns the database server edition as a single row and column. Empty if not supported.
+	EditionQuery string
+	// ExplainPrefix is prepended to a query to return its execution plan instead of running it. Ignored if
+	// ExplainSetup is set.
+	ExplainPrefix string
+	// ExplainSetup and ExplainTeardown, if set, are executed before and after a query on the same connection to return
+	// its execution plan instead of running it.
+	ExplainSetup, ExplainTeardown string
+	// SessionLabelStatement returns a statement identifying the session to database tooling by the provided label (e.g.
+	// as application name). Nil if not supported.
+	SessionLabelStatement func(label string) string
+	// Whether queries may run in transactions with a given isolation level and, separately, read only transactions.
+	SupportsIsolation, SupportsReadOnly bool
+	// Whether backslashes escape the following character in string literals (as well as doubled quotes), respectively
+	// square brackets quote identifiers (as well as double quotes and backticks), for finding named parameters.
+	BackslashEscapes, BracketIdentifiers bool
+	// Whether the columns of a result depend on its rows (e.g. one column per label of the returned PromQL samples), so
+	// that an empty result may lack the key columns of the query's metrics.
+	ColumnsFromRows bool
+
+	// Whether connections go through a pooler, see ForPooler. Queries are then executed directly rather than prepared
+	// (and the prepared statements reused).
+	pooled bool
+}
+
+// CanExplain returns true if the dialect supports returning execution plans.
+func (d *Dialect) CanExplain() bool {
+	return d.ExplainPrefix != "" || d.ExplainSetup != ""
+}
+
+func questionMarkPlaceholder(int) string { return "?" }
+
+func dollarPlaceholder(i int) string { return "$" + strconv.Itoa(i) }
+
+func limitClause(query string, n int) string {
+	return fmt.Sprintf("SELECT * FROM (%s) AS limited LIMIT %d", trimStatement(query), n)
+}
+
+// topClause implements Limit for SQL Server, which doesn't allow common table expressions in derived tables.
+func topClause(query string, n int) string {
+	if isCommonTableExpression(query) {
+		return query
+	}
+	return fmt.Sprintf("SELECT TOP %d * FROM (%s) AS limited", n, trimStatement(query))
+}
+
+func rownumClause(query string, n int) string {
+	return fmt.Sprintf("SELECT * FROM (%s) WHERE ROWNUM <= %d", trimStatement(query), n)
+}
+
+func limitPage(query, column string, n int) string {
+	return fmt.Sprintf("%s ORDER BY %s LIMIT %d", trimStatement(query), column, n)
+}
+
+func fetchPage(query, column string, n int) string {
+	return fmt.Sprintf("%s ORDER BY %s OFFSET 0 ROWS FETCH NEXT %d ROWS ONLY", trimStatement(query), column, n)
+}
+
+// trimStatement strips trailing whitespace and semicolons from query, so clauses can be appended to it.
+func trimStatement(query string) string {
+	return strings.TrimRight(query, " \t\r\n;")
+}
+
+// isCommonTableExpression returns true if query starts with a WITH clause, ignoring leading whitespace, comments and
+// semicolons (as in SQL Server's `;WITH` idiom).
+func isCommonTableExpression(query string) bool {
+	for {
+		query = strings.TrimLeft(query, " \t\r\n;")
+		switch {
+		case strings.HasPrefix(query, "--"):
+			i := strings.IndexByte(query, '\n')
+			if i < 0 {
+				return false
+			}
+			query = query[i+1:]
+		case strings.HasPrefix(query, "/*"):
+			i := strings.Index(query, "*/")
+			if i < 0 {
+				return false
+			}
+			query = query[i+2:]
+		default:
+			return len(query) > 4 && strings.EqualFold(query[:4], "WITH") &&
+				strings.ContainsRune(" \t\r\n", rune(query[4]))
+		}
+	}
+}
+
+// dialectsMtx protects dialects.
+var dialectsMtx sync.RWMutex
+
+// dialects is the registry of known dialects, keyed by driver name.
+var dialects = map[string]*Dialect{
+	"mysql": {
+		Name:              "mysql",
+		Placeholder:       questionMarkPlaceholder,
+		Limit:             limitClause,
+		Page:              limitPage,
+		VersionQuery:      "SELECT version()",
+		ExplainPrefix:     "EXPLAIN ",
+		SupportsIsolation: true,
+		SupportsReadOnly:  true,
+		BackslashEscapes:  true,
+	},
+	"postgres": {
+		Name:          "postgres",
+		Placeholder:   dollarPlaceholder,
+		Limit:         limitClause,
+		Page:          limitPage,
+		VersionQuery:  "SELECT version()",
+		ExplainPrefix: "EXPLAIN ",
+		SessionLabelStatement: func(label string) string {
+			return "SET application_name = '" + strings.Replace(label, "'", "''", -1) + "'"
+		},
+		SupportsIsolation: true,
+		SupportsReadOnly:  true,
+	},
+	"sqlserver": {
+		Name:            "sqlserver",
+		Placeholder:     func(i int) string { return "@p" + strconv.Itoa(i) },
+		Limit:           topClause,
+		Page:            fetchPage,
+		VersionQuery:    "SELECT @@version",
+		EditionQuery:    "SELECT CAST(SERVERPROPERTY('Edition') AS nvarchar(128))",
+		ExplainSetup:    "SET SHOWPLAN_TEXT ON",
+		ExplainTeardown: "SET SHOWPLAN_TEXT OFF",
+		// The driver rejects read only transactions.
+		SupportsIsolation:  true,
+		BracketIdentifiers: true,
+	},
+	"clickhouse": {
+		Name:             "clickhouse",
+		Placeholder:      questionMarkPlaceholder,
+		Limit:            limitClause,
+		Page:             limitPage,
+		VersionQuery:     "SELECT version()",
+		ExplainPrefix:    "EXPLAIN ",
+		BackslashEscapes: true,
+	},
+	"oracle": {
+		Name:         "oracle",
+		Placeholder:  func(i int) string { return ":" + strconv.Itoa(i) },
+		Limit:        rownumClause,
+		Page:         fetchPage,
+		VersionQuery: "SELECT banner FROM v$version WHERE rownum = 1",
+	},
+	// PromQL queries, see the promql package.
+	"prometheus": {
+		Name:            "prometheus",
+		ColumnsFromRows: true,
+	},
+}
+
+func init() {
+	// The MS SQL driver registers itself under two names.
+	dialects["mssql"] = dialects["sqlserver"]
+}
+
+// genericDialect is used for drivers without a registered dialect: prepared statements, but no optional features.
+var genericDialect = &Dialect{
+	Name:        "generic",
+	Placeholder: questionMarkPlaceholder,
+}
+
+// RegisterDialect registers (or replaces) the dialect for a driver, for builds including additional drivers. Targets
+// already created keep using the dialect they were created with, so it should be called early, typically from an init
+// function.
+func RegisterDialect(driver string, d *Dialect) {
+	dialectsMtx.Lock()
+	defer dialectsMtx.Unlock()
+	dialects[driver] = d
+}
+
+// DialectFor returns the dialect registered for the driver, or a generic dialect if none is.
+func DialectFor(driver string) *Dialect {
+	dialectsMtx.RLock()
+	defer dialectsMtx.RUnlock()
+	if d, found := dialects[driver]; found {
+		return d
+	}
+	return genericDialect
+}
+
+// ForPooler returns the dialect adjusted for connecting via the given pooler (see config.PoolerPgBouncer): without
+// prepared statements, which poolers multiplexing server connections lose track of; nor session settings, which would
+// leak to other clients of the pooler.
+func (d *Dialect) ForPooler(pooler string) *Dialect {
+	if pooler == "" || pooler == config.PoolerNone {
+		return d
+	}
+	pd := *d
+	pd.pooled = true
+	pd.SessionLabelStatement = nil
+	return &pd
+}
+
+// skipQuoted returns the index following the string literal, quoted identifier or comment starting at index i of
+// query, or i if none starts there. Unterminated ones extend to the end of query.
+func (d *Dialect) skipQuoted(query string, i int) int {
+	var end string
+	switch {
+	case query[i] == '\'' || query[i] == '"' || query[i] == '`':
+		end = query[i : i+1]
+	case query[i] == '[' && d.BracketIdentifiers:
+		end = "]"
+	case strings.HasPrefix(query[i:], "--"):
+		end = "\n"
+	case strings.HasPrefix(query[i:], "/*"):
+		end = "*/"
+	default:
+		return i
+	}
+	for j := i + 1; j < len(query); j++ {
+		if query[j] == '\\' && query[i] == '\'' && d.BackslashEscapes {
+			j++
+			continue
+		}
+		if strings.HasPrefix(query[j:], end) && (end != "*/" || j > i+1) {
+			return j + len(end)
+		}
+	}
+	return len(query)
+}
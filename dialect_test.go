@@ -0,0 +1,25 @@
+package sql_exporter
+
+import "testing"
+
+func TestDialectLimit(t *testing.T) {
+	tests := []struct {
+		driver, query, want string
+	}{
+		{"postgres", "SELECT a FROM t;\n", "SELECT * FROM (SELECT a FROM t) AS limited LIMIT 5"},
+		{"sqlserver", "SELECT a FROM t; ", "SELECT TOP 5 * FROM (SELECT a FROM t) AS limited"},
+		{"oracle", "SELECT a FROM t;", "SELECT * FROM (SELECT a FROM t) WHERE ROWNUM <= 5"},
+		// SQL Server doesn't allow common table expressions in derived tables, rows are limited while reading.
+		{"sqlserver", "WITH c AS (SELECT a FROM t) SELECT a FROM c", "WITH c AS (SELECT a FROM t) SELECT a FROM c"},
+		{"sqlserver", "-- Comment\n;with c AS (SELECT 1 AS a) SELECT a FROM c",
+			"-- Comment\n;with c AS (SELECT 1 AS a) SELECT a FROM c"},
+		{"sqlserver", "SELECT withdrawn FROM t", "SELECT TOP 5 * FROM (SELECT withdrawn FROM t) AS limited"},
+		{"postgres", "WITH c AS (SELECT a FROM t) SELECT a FROM c",
+			"SELECT * FROM (WITH c AS (SELECT a FROM t) SELECT a FROM c) AS limited LIMIT 5"},
+	}
+	for _, test := range tests {
+		if got := DialectFor(test.driver).Limit(test.query, 5); got != test.want {
+			t.Errorf("%s: Limit(%q) = %q, want %q", test.driver, test.query, got, test.want)
+		}
+	}
+}
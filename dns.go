@@ -0,0 +1,107 @@
+package sql_exporter
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/free/sql_exporter/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	dnsCacheTTL = kingpin.Flag("dns.cache-ttl",
+		"How long to cache the addresses of target hosts. If a lookup fails, expired addresses are used instead. "+
+			"Zero disables caching.").Default("0s").Duration()
+
+	// Protects dnsCache.
+	dnsCacheMtx sync.Mutex
+	// Resolved addresses, by host name.
+	dnsCache = make(map[string]*dnsEntry)
+
+	dnsLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sql_exporter_dns_lookups_total",
+		Help: "Number of DNS lookups of target hosts, excluding those answered from the cache.",
+	}, []string{"host"})
+	dnsLookupFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sql_exporter_dns_lookup_failures_total",
+		Help: "Number of failed DNS lookups of target hosts.",
+	}, []string{"host"})
+	dnsLookupDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "sql_exporter_dns_lookup_duration_seconds",
+		Help:    "Duration of DNS lookups of target hosts, excluding those answered from the cache.",
+		Buckets: []float64{.001, .005, .01, .05, .1, .5, 1, 5, 10},
+	})
+)
+
+func init() {
+	prometheus.MustRegister(dnsLookups, dnsLookupFailures, dnsLookupDuration)
+}
+
+// dnsEntry is a cached DNS lookup result.
+type dnsEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+// lookupHost returns the addresses of host: from the cache, if caching is enabled and the cached addresses have not
+// expired; or looked up, falling back to the expired cached addresses (if any) if the lookup fails.
+func lookupHost(ctx context.Context, host string) ([]string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+
+	now := time.Now()
+	dnsCacheMtx.Lock()
+	entry := dnsCache[host]
+	dnsCacheMtx.Unlock()
+	if entry != nil && now.Before(entry.expires) {
+		return entry.addrs, nil
+	}
+
+	start := time.Now()
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	dnsLookupDuration.Observe(time.Since(start).Seconds())
+	dnsLookups.WithLabelValues(host).Inc()
+	if err != nil {
+		dnsLookupFailures.WithLabelValues(host).Inc()
+		if entry != nil {
+			Logf(SeverityWarning, "DNS lookup of %s failed, using expired addresses %v: %s", host, entry.addrs, err)
+			return entry.addrs, nil
+		}
+		return nil, err
+	}
+
+	if *dnsCacheTTL > 0 {
+		dnsCacheMtx.Lock()
+		dnsCache[host] = &dnsEntry{addrs: addrs, expires: now.Add(*dnsCacheTTL)}
+		dnsCacheMtx.Unlock()
+	}
+	return addrs, nil
+}
+
+// dialContext connects to address on the named network, like net.Dialer.DialContext, but looks up host names via
+// lookupHost. All addresses of the host are tried in order, until one accepts the connection.
+func dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	var d net.Dialer
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || (network != "tcp" && network != "tcp4" && network != "tcp6") {
+		// Not a host:port address (e.g. a Unix socket), nothing to look up.
+		return d.DialContext(ctx, network, address)
+	}
+
+	addrs, err := lookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		var conn net.Conn
+		if conn, err = d.DialContext(ctx, network, net.JoinHostPort(addr, port)); err == nil {
+			return conn, nil
+		}
+		log.V(1).Infof("Connecting to %s (%s) failed: %s", address, addr, err)
+	}
+	return nil, err
+}
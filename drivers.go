@@ -0,0 +1,105 @@
+package sql_exporter
+
+import (
+	"database/sql"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/version"
+)
+
+// exporterPackage is the import path of this package.
+const exporterPackage = "github.com/free/sql_exporter"
+
+var (
+	// Protects driverPackages.
+	driverPackagesMtx sync.Mutex
+	// Go package implementing each known database/sql driver, by driver name.
+	driverPackages = map[string]string{
+		"mssql":      "github.com/denisenkom/go-mssqldb",
+		"sqlserver":  "github.com/denisenkom/go-mssqldb",
+		"mysql":      "github.com/go-sql-driver/mysql",
+		"postgres":   "github.com/lib/pq",
+		"prometheus": exporterPackage + "/promql",
+	}
+
+	driverInfoDesc = prometheus.NewDesc("sql_exporter_driver_info",
+		"Database drivers compiled into the exporter, with the Go package and version implementing them.",
+		[]string{"driver", "package", "version"}, nil)
+)
+
+func init() {
+	prometheus.MustRegister(driverInfoCollector{})
+}
+
+// driverInfoCollector exports sql_exporter_driver_info, evaluated on collection rather than on initialization, so it
+// includes drivers registered by the init() functions of any file.
+type driverInfoCollector struct{}
+
+// Describe implements prometheus.Collector.
+func (driverInfoCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- driverInfoDesc
+}
+
+// Collect implements prometheus.Collector.
+func (driverInfoCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, d := range Drivers() {
+		ch <- prometheus.MustNewConstMetric(driverInfoDesc, prometheus.GaugeValue, 1, d.Name, d.Package, d.Version)
+	}
+}
+
+// DriverInfo describes a database driver compiled into the exporter.
+type DriverInfo struct {
+	Name    string // driver name, i.e. the DSN scheme
+	Package string // Go package implementing the driver, empty if not known
+	Version string // version of the package's module, "unknown" if not known
+}
+
+// RegisterDriverPackage records the Go package implementing a database/sql driver, for Drivers() to report its version.
+// Meant to be called from the init() function of packages adding drivers to the build, e.g. the driver modules under
+// drivers/.
+func RegisterDriverPackage(driver, pkg string) {
+	driverPackagesMtx.Lock()
+	defer driverPackagesMtx.Unlock()
+	driverPackages[driver] = pkg
+}
+
+// Drivers returns the database drivers compiled into the exporter (as registered with database/sql), sorted by name.
+func Drivers() []DriverInfo {
+	driverPackagesMtx.Lock()
+	defer driverPackagesMtx.Unlock()
+
+	// Module versions, unless the binary was built without module support.
+	var deps []*debug.Module
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		deps = bi.Deps
+	}
+
+	names := sql.Drivers()
+	sort.Strings(names)
+	drivers := make([]DriverInfo, 0, len(names))
+	for _, name := range names {
+		d := DriverInfo{Name: name, Package: driverPackages[name], Version: "unknown"}
+		if strings.HasPrefix(d.Package, exporterPackage+"/") && version.Version != "" {
+			// Drivers implemented by the exporter itself share its version (its module is a replaced dependency of the
+			// binary's, when built from a checkout).
+			d.Version = version.Version
+			drivers = append(drivers, d)
+			continue
+		}
+		for _, dep := range deps {
+			if d.Package != "" && strings.HasPrefix(d.Package+"/", dep.Path+"/") {
+				if dep.Replace != nil {
+					dep = dep.Replace
+				}
+				d.Version = dep.Version
+				break
+			}
+		}
+		drivers = append(drivers, d)
+	}
+	return drivers
+}
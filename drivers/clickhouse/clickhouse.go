@@ -0,0 +1,17 @@
+// Package clickhouse adds the ClickHouse driver to programs embedding the exporter, by importing it for its side
+// effects:
+//
+//	import _ "github.com/free/sql_exporter/drivers/clickhouse"
+//
+// It is a separate module, so that the exporter library doesn't pull in the driver and its dependencies unless needed.
+package clickhouse
+
+import (
+	_ "github.com/ClickHouse/clickhouse-go" // register the ClickHouse driver
+
+	"github.com/free/sql_exporter"
+)
+
+func init() {
+	sql_exporter.RegisterDriverPackage("clickhouse", "github.com/ClickHouse/clickhouse-go")
+}
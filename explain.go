@@ -0,0 +1,129 @@
+package sql_exporter
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/free/sql_exporter/log"
+)
+
+// explainer keeps track of consecutive query timeouts and, once a threshold is reached, runs the query's execution plan
+// (using the dialect specific syntax for the driver) with its own timeout and logs it. The plan is only captured once
+// per streak of timeouts.
+type explainer struct {
+	driver     string
+	threshold  int
+	timeout    time.Duration
+	logContext string
+
+	mtx       sync.Mutex
+	timeouts  int
+	explained bool
+}
+
+// newExplainer returns an explainer for queries running on the given driver, or nil if threshold is not positive.
+func newExplainer(logContext, driver string, threshold int, timeout time.Duration) *explainer {
+	if threshold <= 0 {
+		return nil
+	}
+	return &explainer{
+		driver:     driver,
+		threshold:  threshold,
+		timeout:    timeout,
+		logContext: logContext,
+	}
+}
+
+// observe records the outcome of a query execution: a timeout if ctx has exceeded its deadline, success otherwise. When
+// the threshold of consecutive timeouts is reached, it asynchronously captures and logs the execution plan of query,
+// bound to args (the arguments of the timed out execution).
+func (e *explainer) observe(ctx context.Context, conn *sql.DB, query string, args []interface{}) {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	if ctx.Err() != context.DeadlineExceeded {
+		e.timeouts = 0
+		e.explained = false
+		return
+	}
+	e.timeouts++
+	if e.timeouts < e.threshold || e.explained {
+		return
+	}
+	e.explained = true
+
+	log.Warningf("[%s] Query timed out %d times in a row, capturing its execution plan", e.logContext, e.timeouts)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
+		defer cancel()
+		plan, err := explainQuery(ctx, conn, e.driver, query, args)
+		if err != nil {
+			log.Errorf("[%s] Failed to capture execution plan: %s", e.logContext, err)
+			return
+		}
+		log.Infof("[%s] Execution plan:\n%s", e.logContext, plan)
+	}()
+}
+
+// explainQuery returns the execution plan of query bound to args, as text, using the appropriate syntax for the driver.
+// The arguments are needed for queries with placeholders, which can't be planned without them.
+func explainQuery(ctx context.Context, db *sql.DB, driver, query string, args []interface{}) (string, error) {
+	dialect := DialectFor(driver)
+	if !dialect.CanExplain() {
+		return "", fmt.Errorf("EXPLAIN not supported for driver %q", driver)
+	}
+
+	// Use a dedicated connection, as some dialects require a session setting to return the plan instead of running it.
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	if dialect.ExplainSetup != "" {
+		if _, err := conn.ExecContext(ctx, dialect.ExplainSetup); err != nil {
+			return "", err
+		}
+		defer conn.ExecContext(context.Background(), dialect.ExplainTeardown)
+	} else {
+		query = dialect.ExplainPrefix + query
+	}
+
+	rows, err := conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	var plan strings.Builder
+	for {
+		columns, err := rows.Columns()
+		if err != nil {
+			return "", err
+		}
+		values := make([]sql.NullString, len(columns))
+		dest := make([]interface{}, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		for rows.Next() {
+			if err := rows.Scan(dest...); err != nil {
+				return "", err
+			}
+			fields := make([]string, len(values))
+			for i, v := range values {
+				fields[i] = v.String
+			}
+			plan.WriteString(strings.Join(fields, "\t"))
+			plan.WriteString("\n")
+		}
+		if !rows.NextResultSet() {
+			break
+		}
+	}
+	return plan.String(), rows.Err()
+}
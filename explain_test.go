@@ -0,0 +1,106 @@
+package sql_exporter
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"sync"
+	"testing"
+)
+
+func init() {
+	sql.Register("explaintest", &explainDriver{})
+}
+
+// explainDriver is a database/sql driver recording the statements it runs and, like PostgreSQL, failing those whose
+// `$n` placeholders don't match the number of arguments. Every query returns a single row plan.
+type explainDriver struct {
+	mtx   sync.Mutex
+	query string
+	args  []driver.NamedValue
+}
+
+var placeholderRE = regexp.MustCompile(`\$\d+`)
+
+func (d *explainDriver) Open(string) (driver.Conn, error) { return explainConn{d}, nil }
+
+type explainConn struct{ d *explainDriver }
+
+func (c explainConn) Prepare(string) (driver.Stmt, error) { return nil, driver.ErrSkip }
+func (c explainConn) Close() error                        { return nil }
+func (c explainConn) Begin() (driver.Tx, error)           { return nil, driver.ErrSkip }
+
+func (c explainConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.d.mtx.Lock()
+	c.d.query, c.d.args = query, args
+	c.d.mtx.Unlock()
+	if placeholders := len(placeholderRE.FindAllString(query, -1)); placeholders != len(args) {
+		return nil, fmt.Errorf("bind message supplies %d parameters, but prepared statement requires %d",
+			len(args), placeholders)
+	}
+	return &explainRows{}, nil
+}
+
+type explainRows struct{ done bool }
+
+func (r *explainRows) Columns() []string { return []string{"QUERY PLAN"} }
+func (r *explainRows) Close() error      { return nil }
+func (r *explainRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	dest[0] = "Seq Scan on t"
+	return nil
+}
+
+func TestExplainQueryArgs(t *testing.T) {
+	db, err := sql.Open("explaintest", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	d := db.Driver().(*explainDriver)
+
+	tests := []struct {
+		name  string
+		query string
+		args  []interface{}
+	}{
+		{"no placeholders", "SELECT a FROM t", nil},
+		{"bound placeholders", "SELECT a FROM t WHERE db = $1 AND ts > $2", []interface{}{"app", int64(42)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan, err := explainQuery(context.Background(), db, "postgres", tt.query, tt.args)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if plan != "Seq Scan on t\n" {
+				t.Errorf("expected the plan returned by the database, got %q", plan)
+			}
+
+			d.mtx.Lock()
+			defer d.mtx.Unlock()
+			if want := DialectFor("postgres").ExplainPrefix + tt.query; d.query != want {
+				t.Errorf("expected %q to be run, got %q", want, d.query)
+			}
+			var args []interface{}
+			for _, arg := range d.args {
+				args = append(args, arg.Value)
+			}
+			if !reflect.DeepEqual(args, tt.args) {
+				t.Errorf("expected %q to be bound to %v, got %v", d.query, tt.args, args)
+			}
+		})
+	}
+
+	// Without its arguments, a query with placeholders can't be explained.
+	if _, err := explainQuery(context.Background(), db, "postgres", tests[1].query, nil); err == nil {
+		t.Errorf("expected an error explaining %q without arguments", tests[1].query)
+	}
+}
@@ -2,37 +2,93 @@ package sql_exporter
 
 import (
 	"context"
-	"flag"
 	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/alecthomas/kingpin/v2"
 	"github.com/free/sql_exporter/config"
+	"github.com/free/sql_exporter/errors"
+	"github.com/free/sql_exporter/log"
 	"github.com/golang/protobuf/proto"
 	"github.com/prometheus/client_golang/prometheus"
 	dto "github.com/prometheus/client_model/go"
 )
 
-var dsnOverride = flag.String("config.data-source-name", "", "Data source name to override the value in the configuration file with.")
+var dsnOverride = kingpin.Flag("config.data-source-name",
+	"Data source name to override the value in the configuration file with.").String()
 
 // Exporter is a prometheus.Gatherer that gathers SQL metrics from targets and merges them with the default registry.
+//
+// Exporter, New, NewExporter and the config package make up the API for embedding the exporter in other programs and
+// are kept backwards compatible. Configuration is always parsed and validated YAML, either loaded from a file (see
+// config.Load) or from memory (see config.Parse). Command line flags defined by this package (e.g. --shard.index)
+// apply to all exporters in the process.
 type Exporter interface {
 	prometheus.Gatherer
 
 	// WithContext returns a (single use) copy of the Exporter, which will use the provided context for Gather() calls.
 	WithContext(context.Context) Exporter
+	// GatherContext is the equivalent of Gather(), but takes a context to run in, e.g. to limit the scrape duration.
+	GatherContext(context.Context) ([]*dto.MetricFamily, error)
+	// JobGatherers returns one Gatherer per job (a single one in single target mode), gathering the metrics of the job's
+	// targets in the provided context, limited by the job's scrape_timeout, if any. A panic, deadlock or huge result in
+	// one job only affects that job's metrics. Gather() is equivalent to JobGatherers(ctx).Gather(). The Gatherers are
+	// in job configuration order and have a `Job() string` method returning the job name.
+	JobGatherers(context.Context) prometheus.Gatherers
 	// Config returns the Exporter's underlying Config object.
 	Config() *config.Config
+	// AdminHandler returns the handler serving the admin API under /api/v1/, or nil if disabled.
+	AdminHandler() http.Handler
+	// TargetStatus returns the runtime state of all targets.
+	TargetStatus() []TargetStatus
+	// CollectorStatus returns the runtime state of all collectors.
+	CollectorStatus() []CollectorStatus
+	// RecentErrors returns the most recent distinct scrape errors, most recent first.
+	RecentErrors() []ScrapeError
+	// CollectorSizes returns the approximate size of the metrics produced by each collector for each target in the
+	// last scrape, largest first.
+	CollectorSizes() []CollectorSize
+	// UpdateDataSources replaces the data source names of the targets defined by both the Exporter's configuration and
+	// c, e.g. the configuration reloaded after credentials were rotated, without interrupting scrapes in progress. All
+	// other differences between the two configurations are ignored, applying them requires a new Exporter.
+	UpdateDataSources(c *config.Config) error
+	// TraceCollector runs the named collector once on the target identified by job and instance name (the job may be
+	// omitted if the instance name is unique, both are empty in single target mode) and returns its timing breakdown.
+	// If rowLimit is positive, a row limit is injected into every query (using the dialect's LIMIT, TOP or ROWNUM
+	// syntax, if any) and reading stops after that many rows, to cheaply sample queries on huge tables.
+	TraceCollector(ctx context.Context, job, instance, collector string, rowLimit int) (*CollectorTrace, error)
+	// Close gives up leadership (see --leader-election.lock-file), if held, stops polling silences, if configured, and
+	// closes the DB handles of all targets. The Exporter must not be used afterwards.
+	Close() error
 }
 
 type exporter struct {
 	config  *config.Config
-	targets []Target
+	targets *targetSet
+	leader  *leaderElector
+	admin   *adminHandler
+	// Stops polling silences, nil if not configured.
+	stopSilences context.CancelFunc
 
 	ctx context.Context
 }
 
-// NewExporter returns a new Exporter with the provided config.
+// NewExporter returns a new Exporter with the configuration loaded from the provided file, see LoadConfig.
 func NewExporter(configFile string) (Exporter, error) {
+	c, err := LoadConfig(configFile)
+	if err != nil {
+		return nil, err
+	}
+	return New(c)
+}
+
+// LoadConfig loads the configuration from the provided file (see config.Load), with the data source name overridden by
+// the --config.data-source-name flag, if set.
+func LoadConfig(configFile string) (*config.Config, error) {
 	c, err := config.Load(configFile)
 	if err != nil {
 		return nil, err
@@ -41,15 +97,49 @@ func NewExporter(configFile string) (Exporter, error) {
 	// Override the DSN if requested (and in single target mode).
 	if *dsnOverride != "" {
 		if len(c.Jobs) > 0 {
-			return nil, fmt.Errorf("The config.data-source-name flag (value %q) only applies in single target mode", *dsnOverride)
+			return nil, flagErrorf("The config.data-source-name flag (value %q) only applies in single target mode",
+				*dsnOverride)
 		} else {
 			c.Target.DSN = config.Secret(*dsnOverride)
+			c.Target.DSNs = nil
 		}
 	}
+	return c, nil
+}
+
+// FlagError is returned by NewExporter and New for invalid command line flags (or flags not applicable to the
+// configuration), as opposed to configuration errors.
+type FlagError struct {
+	msg string
+}
+
+// flagErrorf formats according to a format specifier and returns a new FlagError.
+func flagErrorf(format string, a ...interface{}) *FlagError {
+	return &FlagError{fmt.Sprintf(format, a...)}
+}
+
+// Error implements error.
+func (e *FlagError) Error() string {
+	return e.msg
+}
+
+// New returns a new Exporter with the provided config, as returned by config.Load or config.Parse.
+func New(c *config.Config) (Exporter, error) {
+	// Sharding only applies to jobs.
+	if err := checkShardFlags(); err != nil {
+		return nil, err
+	}
+	if *shardTotal > 1 && len(c.Jobs) == 0 {
+		return nil, flagErrorf("The shard.total flag (value %d) only applies in jobs mode", *shardTotal)
+	}
 
 	var targets []Target
-	if c.Target != nil {
-		target, err := NewTarget("", "", string(c.Target.DSN), c.Target.Collectors(), nil, c.Globals)
+	if c.Target != nil && !c.Target.IsEnabled() {
+		log.Warning("Target is disabled, not scraping anything")
+	} else if c.Target != nil {
+		target, err := NewTarget("", "", targetDataSourceNames(c.Target), time.Duration(c.Target.DialTimeout), c.Target.Pooler,
+			c.Target.Location(), c.Target.Collectors(), nil,
+			c.Globals.MetricPrefix, c.Globals, c.Target.MaintenanceWindows, c.Target.ReplicaLag)
 		if err != nil {
 			return nil, err
 		}
@@ -57,6 +147,10 @@ func NewExporter(configFile string) (Exporter, error) {
 	} else {
 		targets = make([]Target, 0, len(c.Jobs)*3)
 		for _, jc := range c.Jobs {
+			if !jc.IsEnabled() {
+				log.Infof("Job %q is disabled, not scraping its targets", jc.Name)
+				continue
+			}
 			job, err := NewJob(jc, c.Globals)
 			if err != nil {
 				return nil, err
@@ -65,34 +159,132 @@ func NewExporter(configFile string) (Exporter, error) {
 		}
 	}
 
+	// Asynchronously check connectivity to all targets, if requested.
+	if c.Globals.StartupProbe != nil && !*demoMode {
+		go probeTargets(targets, c.Globals.StartupProbe, "Startup probe")
+	}
+
+	// Skip targets silenced in an external system, if configured. Polling stops when the exporter is closed.
+	var stopSilences context.CancelFunc
+	if c.Globals.Silences != nil {
+		var silencesCtx context.Context
+		silencesCtx, stopSilences = context.WithCancel(context.Background())
+		go pollSilences(silencesCtx, c.Globals.Silences)
+	}
+
+	// Only collect metrics while holding the leader election lock, if requested.
+	var leader *leaderElector
+	if *leaderLockFile != "" {
+		leader = newLeaderElector(*leaderLockFile, *leaderRetryInterval)
+	}
+
+	ts := newTargetSet(targets)
+	admin, err := newAdminHandler(c, ts, *adminTokenFile, *adminStateFile)
+	if err != nil {
+		if stopSilences != nil {
+			stopSilences()
+		}
+		return nil, err
+	}
+
 	return &exporter{
-		config:  c,
-		targets: targets,
-		ctx:     context.Background(),
+		config:       c,
+		targets:      ts,
+		leader:       leader,
+		admin:        admin,
+		stopSilences: stopSilences,
+		ctx:          context.Background(),
 	}, nil
 }
 
+// targetDataSourceNames returns the data source names the single target connects with, i.e. with its driver options
+// applied.
+func targetDataSourceNames(tc *config.TargetConfig) []string {
+	var dsns []string
+	for _, dsn := range tc.DataSourceNames() {
+		options := config.PoolerDriverOptions(tc.DriverOptions, tc.Pooler)
+		dsns = append(dsns, string(config.DSNWithOptions(dsn, options)))
+	}
+	return dsns
+}
+
 func (e *exporter) WithContext(ctx context.Context) Exporter {
 	return &exporter{
-		config:  e.config,
-		targets: e.targets,
-		ctx:     ctx,
+		config:       e.config,
+		targets:      e.targets,
+		leader:       e.leader,
+		admin:        e.admin,
+		stopSilences: e.stopSilences,
+		ctx:          ctx,
 	}
 }
 
+// GatherContext implements Exporter.
+func (e *exporter) GatherContext(ctx context.Context) ([]*dto.MetricFamily, error) {
+	return e.WithContext(ctx).Gather()
+}
+
 // Gather implements prometheus.Gatherer.
 func (e *exporter) Gather() ([]*dto.MetricFamily, error) {
+	return e.JobGatherers(e.ctx).Gather()
+}
+
+// JobGatherers implements Exporter.
+func (e *exporter) JobGatherers(ctx context.Context) prometheus.Gatherers {
+	// Standby replicas don't query the databases.
+	if e.leader != nil && !e.leader.isLeader() {
+		return nil
+	}
+
+	// Identify all statements executed by this scrape in the audit log (if enabled).
+	ctx = withAuditScope(ctx, auditScope{scrapeID: newScrapeID()})
+	jobs, targets := e.targets.activeByJob()
+	gatherers := make(prometheus.Gatherers, 0, len(jobs))
+	for _, job := range jobs {
+		var timeout time.Duration
+		if jc := e.jobConfig(job); jc != nil {
+			timeout = time.Duration(jc.ScrapeTimeout)
+		}
+		gatherers = append(gatherers, &jobGatherer{
+			ctx:     ctx,
+			job:     job,
+			timeout: timeout,
+			targets: targets[job],
+		})
+	}
+	return gatherers
+}
+
+// jobConfig returns the configuration of the named job, nil if not found (e.g. in single target mode).
+func (e *exporter) jobConfig(name string) *config.JobConfig {
+	for _, jc := range e.config.Jobs {
+		if jc.Name == name {
+			return jc
+		}
+	}
+	return nil
+}
+
+// gatherTargets collects metrics from the provided targets, concurrently, and converts them to metric families.
+func gatherTargets(ctx context.Context, targets []Target) ([]*dto.MetricFamily, error) {
 	var (
 		metricChan = make(chan Metric, capMetricChan)
 		errs       prometheus.MultiError
 	)
 
 	var wg sync.WaitGroup
-	wg.Add(len(e.targets))
-	for _, t := range e.targets {
+	wg.Add(len(targets))
+	for _, t := range targets {
 		go func(target Target) {
 			defer wg.Done()
-			target.Collect(e.ctx, metricChan)
+			// Don't let a panicking target bring down the exporter, report it as a scrape error instead.
+			defer func() {
+				if r := recover(); r != nil {
+					log.Errorf("Panic collecting target %v: %v\n%s", target.Labels(), r, debug.Stack())
+					metricChan <- NewInvalidMetric(errors.Errorf("", "panic collecting target %v: %v", target.Labels(), r))
+				}
+			}()
+			target.Collect(ctx, metricChan)
 		}(t)
 	}
 
@@ -110,31 +302,45 @@ func (e *exporter) Gather() ([]*dto.MetricFamily, error) {
 
 	// Gather.
 	dtoMetricFamilies := make(map[string]*dto.MetricFamily, 10)
+	sizes := make(scrapeSizes)
+	// Allocate dto.Metrics in chunks rather than one by one, there are usually lots of them.
+	var chunk []dto.Metric
 	for metric := range metricChan {
-		dtoMetric := &dto.Metric{}
+		if len(chunk) == 0 {
+			chunk = make([]dto.Metric, dtoMetricChunkSize)
+		}
+		dtoMetric := &chunk[0]
+		chunk = chunk[1:]
 		if err := metric.Write(dtoMetric); err != nil {
+			recentErrors.record(err, time.Now())
 			errs = append(errs, err)
 			continue
 		}
+		metricType, ok := dtoMetricType(dtoMetric)
+		if !ok {
+			errs = append(errs, fmt.Errorf("don't know how to handle metric %v", dtoMetric))
+			continue
+		}
 		metricDesc := metric.Desc()
 		dtoMetricFamily, ok := dtoMetricFamilies[metricDesc.Name()]
 		if !ok {
 			dtoMetricFamily = &dto.MetricFamily{}
 			dtoMetricFamily.Name = proto.String(metricDesc.Name())
 			dtoMetricFamily.Help = proto.String(metricDesc.Help())
-			switch {
-			case dtoMetric.Gauge != nil:
-				dtoMetricFamily.Type = dto.MetricType_GAUGE.Enum()
-			case dtoMetric.Counter != nil:
-				dtoMetricFamily.Type = dto.MetricType_COUNTER.Enum()
-			default:
-				errs = append(errs, fmt.Errorf("don't know how to handle metric %v", dtoMetric))
-				continue
-			}
+			dtoMetricFamily.Type = metricType.Enum()
 			dtoMetricFamilies[metricDesc.Name()] = dtoMetricFamily
+		} else if dtoMetricFamily.GetType() != metricType {
+			// Possible with passed through exposition format, which may use the same name with different types.
+			err := errors.Errorf(metricDesc.LogContext(), "metric %q exported as both %s and %s",
+				metricDesc.Name(), dtoMetricFamily.GetType(), metricType)
+			recentErrors.record(err, time.Now())
+			errs = append(errs, err)
+			continue
 		}
 		dtoMetricFamily.Metric = append(dtoMetricFamily.Metric, dtoMetric)
+		sizes.add(metric, dtoMetric)
 	}
+	sizes.record()
 
 	// No need to sort metric families, prometheus.Gatherers will do that for us when merging.
 	result := make([]*dto.MetricFamily, 0, len(dtoMetricFamilies))
@@ -144,7 +350,135 @@ func (e *exporter) Gather() ([]*dto.MetricFamily, error) {
 	return result, errs
 }
 
+// dtoMetricType returns the type of m, as determined by which of its values is set. It returns false if none is.
+func dtoMetricType(m *dto.Metric) (dto.MetricType, bool) {
+	switch {
+	case m.Gauge != nil:
+		return dto.MetricType_GAUGE, true
+	case m.Counter != nil:
+		return dto.MetricType_COUNTER, true
+	case m.Histogram != nil:
+		return dto.MetricType_HISTOGRAM, true
+	case m.Summary != nil:
+		return dto.MetricType_SUMMARY, true
+	case m.Untyped != nil:
+		return dto.MetricType_UNTYPED, true
+	}
+	return 0, false
+}
+
+// Close implements Exporter.
+func (e *exporter) Close() error {
+	if e.stopSilences != nil {
+		e.stopSilences()
+	}
+	if e.leader != nil {
+		e.leader.resign()
+	}
+	var firstErr error
+	for _, t := range e.targets.all() {
+		if err := t.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
 // Config implements Exporter.
 func (e *exporter) Config() *config.Config {
 	return e.config
 }
+
+// AdminHandler implements Exporter.
+func (e *exporter) AdminHandler() http.Handler {
+	if e.admin == nil {
+		return nil
+	}
+	return e.admin
+}
+
+// TargetStatus implements Exporter.
+func (e *exporter) TargetStatus() []TargetStatus {
+	return e.targets.status(time.Now())
+}
+
+// CollectorStatus implements Exporter.
+func (e *exporter) CollectorStatus() []CollectorStatus {
+	names := make([]string, 0, len(e.config.Collectors))
+	for _, cc := range e.config.Collectors {
+		names = append(names, cc.Name)
+	}
+	return collectorPauses.status(names, time.Now())
+}
+
+// RecentErrors implements Exporter.
+func (e *exporter) RecentErrors() []ScrapeError {
+	return recentErrors.list()
+}
+
+// CollectorSizes implements Exporter.
+func (e *exporter) CollectorSizes() []CollectorSize {
+	return collectorSizes.list()
+}
+
+// UpdateDataSources implements Exporter.
+func (e *exporter) UpdateDataSources(c *config.Config) error {
+	// The data source names of the targets defined by c, by job and instance name (both empty for the single target).
+	dsns := make(map[[2]string][]string)
+	if c.Target != nil {
+		dsns[[2]string{"", ""}] = targetDataSourceNames(c.Target)
+	}
+	for _, jc := range c.Jobs {
+		for _, sc := range jc.StaticConfigs {
+			for tname, dsn := range sc.Targets {
+				dsns[[2]string{jc.Name, tname}] = []string{jobTargetDataSourceName(jc, dsn)}
+			}
+		}
+	}
+
+	e.targets.mtx.RLock()
+	defer e.targets.mtx.RUnlock()
+
+	var (
+		errs    []string
+		changed []Target
+	)
+	for _, mt := range e.targets.targets {
+		// Targets added at runtime have their data source names replaced via the admin API.
+		if mt.dynamic {
+			continue
+		}
+		d, found := dsns[[2]string{mt.job, mt.instance}]
+		if !found {
+			continue
+		}
+		t, ok := mt.target.(*target)
+		if !ok {
+			continue
+		}
+		if replaced, err := t.setDataSources(d); err != nil {
+			errs = append(errs, fmt.Sprintf("target %q of job %q: %s", mt.instance, mt.job, err))
+		} else if replaced {
+			changed = append(changed, t)
+		}
+	}
+
+	// Asynchronously check connectivity to the targets whose data source names changed, same as all targets on startup.
+	if len(changed) > 0 && e.config.Globals.StartupProbe != nil && !*demoMode {
+		go probeTargets(changed, e.config.Globals.StartupProbe, "Data source name reload probe")
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("error updating data source names: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// TraceCollector implements Exporter.
+func (e *exporter) TraceCollector(
+	ctx context.Context, job, instance, collector string, rowLimit int) (*CollectorTrace, error) {
+	t, err := e.targets.lookup(job, instance)
+	if err != nil {
+		return nil, err
+	}
+	return traceCollector(ctx, t, collector, rowLimit)
+}
@@ -0,0 +1,375 @@
+package sql_exporter
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/free/sql_exporter/config"
+	_ "github.com/free/sql_exporter/internal/testdriver" // register the canned results driver
+	"github.com/prometheus/common/expfmt"
+)
+
+// newTestExporter writes results to a canned results file, replaces `RESULTS` in the YAML configuration with its data
+// source name and returns an Exporter for the configuration, closed when the test completes.
+func newTestExporter(t testing.TB, results, configYAML string) Exporter {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "results.yml")
+	if err := os.WriteFile(path, []byte(results), 0644); err != nil {
+		t.Fatal(err)
+	}
+	configYAML = strings.Replace(configYAML, "RESULTS", "testdriver://"+filepath.ToSlash(path), -1)
+
+	c, err := config.Parse([]byte(configYAML))
+	if err != nil {
+		t.Fatalf("parsing configuration: %s", err)
+	}
+	e, err := New(c)
+	if err != nil {
+		t.Fatalf("creating exporter: %s", err)
+	}
+	t.Cleanup(func() { e.Close() })
+	return e
+}
+
+// gatherText scrapes e and returns the metrics in the text exposition format, along with the scrape error, if any.
+func gatherText(t testing.TB, e Exporter) (string, error) {
+	t.Helper()
+	mfs, gatherErr := e.GatherContext(context.Background())
+	var buf bytes.Buffer
+	for _, mf := range mfs {
+		if _, err := expfmt.MetricFamilyToText(&buf, mf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.String(), gatherErr
+}
+
+const testResults = `
+results:
+  - query: 'FROM pg_stat_database'
+    columns: [datname, xact_commit, xact_rollback]
+    rows:
+      - [postgres, 1234, 5]
+      - [template1, 0, 0]
+  - query: 'FROM pg_stat_replication'
+    error: permission denied for table pg_stat_replication
+`
+
+func TestExporterSingleTarget(t *testing.T) {
+	e := newTestExporter(t, testResults, `
+target:
+  data_source_name: 'RESULTS'
+  collectors: [pg_database]
+collectors:
+  - collector_name: pg_database
+    metrics:
+      - metric_name: pg_xact_commit_total
+        type: counter
+        help: 'Committed transactions.'
+        key_labels: [datname]
+        values: [xact_commit]
+        query: SELECT datname, xact_commit FROM pg_stat_database
+      - metric_name: pg_xact_total
+        type: counter
+        help: 'Transactions, by outcome.'
+        key_labels: [datname]
+        value_label: outcome
+        values: [xact_commit, xact_rollback]
+        query: SELECT datname, xact_commit, xact_rollback FROM pg_stat_database
+`)
+
+	got, err := gatherText(t, e)
+	if err != nil {
+		t.Fatalf("unexpected scrape error: %s", err)
+	}
+	want := `# HELP pg_xact_commit_total Committed transactions.
+# TYPE pg_xact_commit_total counter
+pg_xact_commit_total{datname="postgres"} 1234
+pg_xact_commit_total{datname="template1"} 0
+# HELP pg_xact_total Transactions, by outcome.
+# TYPE pg_xact_total counter
+pg_xact_total{datname="postgres",outcome="xact_commit"} 1234
+pg_xact_total{datname="postgres",outcome="xact_rollback"} 5
+pg_xact_total{datname="template1",outcome="xact_commit"} 0
+pg_xact_total{datname="template1",outcome="xact_rollback"} 0
+`
+	if got != want {
+		t.Errorf("unexpected metrics, got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestExporterJobs(t *testing.T) {
+	e := newTestExporter(t, testResults, `
+jobs:
+  - job_name: pg
+    collectors: [pg_database, pg_replication]
+    static_configs:
+      - targets:
+          db1: 'RESULTS'
+collectors:
+  - collector_name: pg_database
+    metrics:
+      - metric_name: pg_xact_commit_total
+        type: counter
+        help: 'Committed transactions.'
+        key_labels: [datname]
+        values: [xact_commit]
+        query: SELECT datname, xact_commit FROM pg_stat_database
+  - collector_name: pg_replication
+    metrics:
+      - metric_name: pg_replication_lag_seconds
+        type: gauge
+        help: 'Replication lag.'
+        values: [lag]
+        query: SELECT lag FROM pg_stat_replication
+`)
+
+	got, err := gatherText(t, e)
+	if err == nil || !strings.Contains(err.Error(), "permission denied for table pg_stat_replication") {
+		t.Errorf("expected the failing query's error, got %v", err)
+	}
+	// The failing collector doesn't affect the other one, nor the target's `up`.
+	for _, want := range []string{
+		`pg_xact_commit_total{datname="postgres",instance="db1",job="pg"} 1234`,
+		`pg_xact_commit_total{datname="template1",instance="db1",job="pg"} 0`,
+		`up{instance="db1",job="pg"} 1`,
+	} {
+		if !strings.Contains(got, want+"\n") {
+			t.Errorf("missing %q in metrics:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "pg_replication_lag_seconds") {
+		t.Errorf("unexpected metric of the failing query:\n%s", got)
+	}
+}
+
+// TestExporterCollectorPanic checks that a panic in one job's collector (here, in the driver) fails that collector alone,
+// with the other job's metrics still served.
+func TestExporterCollectorPanic(t *testing.T) {
+	e := newTestExporter(t, `
+results:
+  - query: 'FROM pg_stat_database'
+    columns: [datname, xact_commit]
+    rows:
+      - [postgres, 1234]
+  - query: 'FROM pg_stat_replication'
+    panic: driver bug
+`, `
+jobs:
+  - job_name: pg
+    collectors: [pg_database]
+    static_configs:
+      - targets:
+          db1: 'RESULTS'
+  - job_name: replica
+    collectors: [pg_replication]
+    static_configs:
+      - targets:
+          db2: 'RESULTS'
+collectors:
+  - collector_name: pg_database
+    metrics:
+      - metric_name: pg_xact_commit_total
+        type: counter
+        help: 'Committed transactions.'
+        key_labels: [datname]
+        values: [xact_commit]
+        query: SELECT datname, xact_commit FROM pg_stat_database
+  - collector_name: pg_replication
+    metrics:
+      - metric_name: pg_replication_lag_seconds
+        type: gauge
+        help: 'Replication lag.'
+        values: [lag]
+        query: SELECT lag FROM pg_stat_replication
+`)
+
+	got, err := gatherText(t, e)
+	if err == nil || !strings.Contains(err.Error(), "panic collecting metrics: driver bug") {
+		t.Errorf("expected the panic as a scrape error, got %v", err)
+	}
+	for _, want := range []string{
+		`pg_xact_commit_total{datname="postgres",instance="db1",job="pg"} 1234`,
+		`up{instance="db1",job="pg"} 1`,
+		`up{instance="db2",job="replica"} 1`,
+	} {
+		if !strings.Contains(got, want+"\n") {
+			t.Errorf("missing %q in metrics:\n%s", want, got)
+		}
+	}
+}
+
+func TestExporterTargetDown(t *testing.T) {
+	e := newTestExporter(t, testResults, `
+jobs:
+  - job_name: pg
+    collectors: [pg_database]
+    static_configs:
+      - targets:
+          db1: 'testdriver://does/not/exist.yml'
+collectors:
+  - collector_name: pg_database
+    metrics:
+      - metric_name: pg_xact_commit_total
+        type: counter
+        help: 'Committed transactions.'
+        key_labels: [datname]
+        values: [xact_commit]
+        query: SELECT datname, xact_commit FROM pg_stat_database
+`)
+
+	got, err := gatherText(t, e)
+	if err == nil {
+		t.Errorf("expected a scrape error for the unreachable target")
+	}
+	if want := `up{instance="db1",job="pg"} 0`; !strings.Contains(got, want+"\n") {
+		t.Errorf("missing %q in metrics:\n%s", want, got)
+	}
+	if strings.Contains(got, "pg_xact_commit_total") {
+		t.Errorf("unexpected metrics of an unreachable target:\n%s", got)
+	}
+}
+
+func TestExporterChecks(t *testing.T) {
+	e := newTestExporter(t, `
+results:
+  - query: 'FROM long_tx'
+    columns: [db]
+    rows:
+      - [postgres]
+  - query: 'FROM blocked'
+    columns: [session, db]
+    rows: []
+`, `
+jobs:
+  - job_name: pg
+    collectors: [pg_tx, pg_locks]
+    static_configs:
+      - targets:
+          db1: 'RESULTS'
+collectors:
+  - collector_name: pg_tx
+    checks:
+      - check_name: long_tx
+        help: 'Transactions running for more than 10 minutes.'
+        annotations: [db]
+        query: SELECT db FROM long_tx
+  - collector_name: pg_locks
+    checks:
+      - check_name: blocked
+        help: 'Sessions blocked for more than a minute.'
+        annotations: [session, db]
+        query: SELECT session, db FROM blocked
+`)
+
+	// Checks with different help texts and annotations are exported as one consistent metric family.
+	got, err := gatherText(t, e)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for _, want := range []string{
+		`# HELP sql_check_violations ` + checkViolationsHelp,
+		`sql_check_violations{check="blocked",db="",instance="db1",job="pg",session=""} 0`,
+		`sql_check_violations{check="long_tx",db="postgres",instance="db1",job="pg",session=""} 1`,
+	} {
+		if !strings.Contains(got, want+"\n") {
+			t.Errorf("missing %q in metrics:\n%s", want, got)
+		}
+	}
+}
+
+// TestExporterCloseStopsSilences checks that closing the exporter stops polling silences.
+func TestExporterCloseStopsSilences(t *testing.T) {
+	var fetches int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&fetches, 1)
+		w.Write([]byte("[]"))
+	}))
+	defer srv.Close()
+
+	e := newTestExporter(t, testResults, `
+global:
+  silences:
+    type: http
+    url: '`+srv.URL+`'
+    refresh_interval: 10ms
+target:
+  data_source_name: 'RESULTS'
+  collectors: [pg_database]
+collectors:
+  - collector_name: pg_database
+    metrics:
+      - metric_name: pg_xact_commit_total
+        type: counter
+        help: 'Committed transactions.'
+        key_labels: [datname]
+        values: [xact_commit]
+        query: SELECT datname, xact_commit FROM pg_stat_database
+`)
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt32(&fetches) < 2; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("silences not polled")
+		}
+	}
+	e.Close()
+	// Allow a fetch already in progress to complete.
+	time.Sleep(50 * time.Millisecond)
+	closed := atomic.LoadInt32(&fetches)
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt32(&fetches); n != closed {
+		t.Errorf("silences polled %d times after the exporter was closed", n-closed)
+	}
+}
+
+// TestCollectorSizes checks the size of the metrics produced by a collector, as recorded by a scrape and deleted once
+// the target is removed.
+func TestCollectorSizes(t *testing.T) {
+	e := newTestExporter(t, testResults, `
+jobs:
+  - job_name: sizes
+    collectors: [pg_database]
+    static_configs:
+      - targets:
+          db1: 'RESULTS'
+collectors:
+  - collector_name: pg_database
+    metrics:
+      - metric_name: pg_xact_commit_total
+        type: counter
+        help: 'Committed transactions.'
+        key_labels: [datname]
+        values: [xact_commit]
+        query: SELECT datname, xact_commit FROM pg_stat_database
+`)
+	find := func() *CollectorSize {
+		for _, size := range e.CollectorSizes() {
+			if size.Job == "sizes" && size.Instance == "db1" && size.Collector == "pg_database" {
+				return &size
+			}
+		}
+		return nil
+	}
+
+	if _, err := gatherText(t, e); err != nil {
+		t.Fatalf("unexpected scrape error: %s", err)
+	}
+	// Name and value (28 bytes), labels datname, instance and job (26 bytes plus the datname value), for 2 samples.
+	want := CollectorSize{Job: "sizes", Instance: "db1", Collector: "pg_database", Samples: 2,
+		Bytes: 2*(28+26) + len("postgres") + len("template1")}
+	if got := find(); got == nil || *got != want {
+		t.Errorf("expected collector size %+v, got %+v", want, got)
+	}
+
+	e.Close()
+	if got := find(); got != nil {
+		t.Errorf("expected no collector size once the target is closed, got %+v", got)
+	}
+}
@@ -0,0 +1,78 @@
+package sql_exporter
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/free/sql_exporter/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// collectExposition parses the exposition metric's value column of row as Prometheus text exposition format and
+// passes the samples through, with names prefixed by the metric name and the metric's labels (const, key and template
+// labels) added.
+func (mf *MetricFamily) collectExposition(row map[string]interface{}, labelValues []string, ch chan<- Metric) {
+	column := mf.config.Values[0]
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(strings.NewReader(row[column].(string)))
+	if err != nil {
+		ch <- NewInvalidMetric(errors.Wrapf(mf.logContext, err, "parsing exposition column %q failed", column))
+		return
+	}
+
+	labelPairs := makeLabelPairs(mf, labelValues)
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		family := families[name]
+		help := family.GetHelp()
+		if help == "" {
+			help = mf.Help()
+		}
+		desc := NewAutomaticMetricDesc(mf.logContext, mf.name+"_"+name, help, prometheus.UntypedValue, nil)
+		for _, m := range family.Metric {
+			ch <- &expositionMetric{desc: desc, metric: m, labelPairs: labelPairs}
+		}
+	}
+}
+
+// expositionMetric is a sample parsed from text exposition format, with additional labels.
+type expositionMetric struct {
+	desc       MetricDesc
+	metric     *dto.Metric
+	labelPairs []*dto.LabelPair // added to the sample's own labels, which they may not collide with
+}
+
+// Desc implements Metric.
+func (m *expositionMetric) Desc() MetricDesc {
+	return m.desc
+}
+
+// Write implements Metric. Timestamps are dropped, the sample is exported as current.
+func (m *expositionMetric) Write(out *dto.Metric) errors.WithContext {
+	labels := make([]*dto.LabelPair, 0, len(m.metric.Label)+len(m.labelPairs))
+	labels = append(labels, m.labelPairs...)
+	for _, lp := range m.metric.Label {
+		for _, added := range m.labelPairs {
+			if lp.GetName() == added.GetName() {
+				return errors.Errorf(m.desc.LogContext(), "label %q of exposed metric %q collides with a metric label",
+					lp.GetName(), m.desc.Name())
+			}
+		}
+		labels = append(labels, lp)
+	}
+	sort.Sort(labelPairSorter(labels))
+
+	out.Label = labels
+	out.Counter = m.metric.Counter
+	out.Gauge = m.metric.Gauge
+	out.Untyped = m.metric.Untyped
+	out.Histogram = m.metric.Histogram
+	out.Summary = m.metric.Summary
+	return nil
+}
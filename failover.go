@@ -0,0 +1,215 @@
+package sql_exporter
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/free/sql_exporter/errors"
+	"github.com/free/sql_exporter/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var dataSourceActive = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "sql_exporter_data_source_active",
+	Help: "Whether the target is currently connected to the data source (1) or not (0). Only exported for targets with " +
+		"multiple data_source_names.",
+}, []string{"job", "instance", "data_source"})
+
+func init() {
+	prometheus.MustRegister(dataSourceActive)
+}
+
+const (
+	// Initial and maximum interval between attempts to fail back to a preferred data source.
+	failbackMinInterval = 5 * time.Second
+	failbackMaxInterval = 5 * time.Minute
+	// Timeout of a failback attempt.
+	failbackTimeout = 10 * time.Second
+)
+
+// dataSourceFailover keeps track of the data sources of a target with multiple data source names (e.g. a primary and
+// a standby without a virtual IP), in order of preference, and of which one is active. All fields but stop are
+// protected by the target's connMtx.
+type dataSourceFailover struct {
+	dsns    []string
+	conns   []*sql.DB // DB handle of each data source, nil unless opened
+	active  int       // index of the active data source
+	gauges  []prometheus.Gauge
+	failing bool          // whether failBack is running
+	stop    chan struct{} // closed when the target is closed, to stop failBack
+}
+
+// newDataSourceFailover returns a dataSourceFailover for the provided data source names, the first one active.
+func newDataSourceFailover(dsns []string, constLabels prometheus.Labels) *dataSourceFailover {
+	f := &dataSourceFailover{
+		dsns:   dsns,
+		conns:  make([]*sql.DB, len(dsns)),
+		gauges: make([]prometheus.Gauge, len(dsns)),
+		stop:   make(chan struct{}),
+	}
+	for i, dsn := range dsns {
+		f.gauges[i] = dataSourceActive.WithLabelValues(constLabels["job"], constLabels["instance"], redactDSN(dsn))
+	}
+	f.gauges[0].Set(1)
+	return f
+}
+
+// connectFailover implements connect for targets with multiple data source names. It pings the last reachable (i.e.
+// active) data source and, only if that fails, the others in order of preference, making the first reachable one
+// active. Failing back to a preferred data source is left to failBack, so that scrapes don't wait for an unreachable
+// primary to time out every time. It returns the error of the last data source tried if none is reachable.
+func (t *target) connectFailover(ctx context.Context) (*sql.DB, errors.WithContext) {
+	f := t.failover
+	t.connMtx.Lock()
+	active := f.active
+	conn, err := t.acquireLocked(ctx, f.dsns[active], &f.conns[active])
+	t.connMtx.Unlock()
+	if err == nil {
+		if conn, err = t.pingAcquired(ctx, conn); err == nil {
+			return conn, nil
+		}
+	}
+
+	for i := range f.dsns {
+		if i == active {
+			continue
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		var ierr errors.WithContext
+		t.connMtx.Lock()
+		conn, ierr = t.acquireLocked(ctx, f.dsns[i], &f.conns[i])
+		t.connMtx.Unlock()
+		if ierr == nil {
+			conn, ierr = t.pingAcquired(ctx, conn)
+		}
+		if ierr != nil {
+			err = ierr
+			continue
+		}
+
+		t.connMtx.Lock()
+		// Unless the target was closed or another scrape failed over in the meantime.
+		if !t.closed && f.active == active && f.conns[i] == conn {
+			t.activate(i)
+		}
+		t.connMtx.Unlock()
+		return conn, nil
+	}
+	return nil, err
+}
+
+// failBack runs in the background for as long as a data source other than the most preferred one is active. It
+// pings the preferred data sources, backing off exponentially between attempts, and makes the first reachable one
+// active.
+func (t *target) failBack() {
+	f := t.failover
+	interval := failbackMinInterval
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-time.After(interval):
+		}
+
+		t.connMtx.Lock()
+		active := f.active
+		if active == 0 || t.closed {
+			f.failing = false
+			t.connMtx.Unlock()
+			return
+		}
+		t.connMtx.Unlock()
+
+		for i := 0; i < active; i++ {
+			if t.tryFailBack(i) {
+				break
+			}
+		}
+		if interval *= 2; interval > failbackMaxInterval {
+			interval = failbackMaxInterval
+		}
+	}
+}
+
+// tryFailBack pings the i-th data source and, if reachable, makes it active. It returns true if it did.
+func (t *target) tryFailBack(i int) bool {
+	f := t.failover
+	ctx, cancel := context.WithTimeout(context.Background(), failbackTimeout)
+	defer cancel()
+
+	t.connMtx.Lock()
+	dsn := f.dsns[i]
+	conn, err := t.acquireLocked(ctx, dsn, &f.conns[i])
+	t.connMtx.Unlock()
+	if err != nil {
+		return false
+	}
+	if conn, err = t.pingAcquired(ctx, conn); err != nil {
+		log.V(1).Infof("[%s] Data source %s still unreachable: %s", t.logContext, redactDSN(dsn), err)
+		return false
+	}
+
+	t.connMtx.Lock()
+	ok := !t.closed && i < f.active && f.conns[i] == conn
+	if ok {
+		t.activate(i)
+	}
+	t.connMtx.Unlock()
+	t.releaseConn(conn)
+	return ok
+}
+
+// activate makes the i-th data source active, retiring the DB handle of the previously active one. Must be called with
+// connMtx held.
+func (t *target) activate(i int) {
+	f := t.failover
+	if i != f.active {
+		log.Warningf("[%s] Switching from data source %s to %s", t.logContext,
+			redactDSN(f.dsns[f.active]), redactDSN(f.dsns[i]))
+		if conn := f.conns[f.active]; conn != nil {
+			t.retireLocked(conn)
+			f.conns[f.active] = nil
+		}
+		f.gauges[f.active].Set(0)
+		f.gauges[i].Set(1)
+		f.active = i
+	}
+	t.dsn.Store(f.dsns[i])
+	t.conn = f.conns[i]
+	if i > 0 && !f.failing {
+		f.failing = true
+		go t.failBack()
+	}
+}
+
+// replace replaces the data source names, retiring the DB handles of those that changed. Must be called with the
+// target's connMtx held.
+func (f *dataSourceFailover) replace(t *target, dsns []string) bool {
+	replaced := false
+	for i, dsn := range dsns {
+		if dsn == f.dsns[i] {
+			continue
+		}
+		replaced = true
+		log.Infof("[%s] Data source name %s replaced, draining the previous DB handle", t.logContext, redactDSN(dsn))
+		// The data source label only changes if more than the credentials did.
+		if label, previous := redactDSN(dsn), redactDSN(f.dsns[i]); label != previous {
+			dataSourceActive.DeleteLabelValues(t.constLabels["job"], t.constLabels["instance"], previous)
+			f.gauges[i] = dataSourceActive.WithLabelValues(t.constLabels["job"], t.constLabels["instance"], label)
+			f.gauges[i].Set(boolToFloat64(i == f.active))
+		}
+		f.dsns[i] = dsn
+		if f.conns[i] != nil {
+			t.retireLocked(f.conns[i])
+			f.conns[i] = nil
+		}
+		if i == f.active {
+			t.dsn.Store(dsn)
+			t.conn = nil
+		}
+	}
+	return replaced
+}
@@ -0,0 +1,70 @@
+package sql_exporter
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTargetFailover(t *testing.T) {
+	primary := filepath.Join(t.TempDir(), "primary.yml")
+	e := newTestExporter(t, testResults, `
+target:
+  data_source_names:
+    - 'testdriver://`+filepath.ToSlash(primary)+`'
+    - 'RESULTS'
+  collectors: [pg_database]
+collectors:
+  - collector_name: pg_database
+    metrics:
+      - metric_name: pg_xact_commit_total
+        type: counter
+        help: 'Committed transactions.'
+        key_labels: [datname]
+        values: [xact_commit]
+        query: SELECT datname, xact_commit FROM pg_stat_database
+`)
+	tgt, err := e.(*exporter).targets.lookup("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	active := func() int {
+		tgt.connMtx.Lock()
+		defer tgt.connMtx.Unlock()
+		return tgt.failover.active
+	}
+
+	// The primary is down, so the first scrape fails over to the standby and subsequent ones stick to it.
+	for i := 0; i < 2; i++ {
+		got, err := gatherText(t, e)
+		if err != nil {
+			t.Fatalf("unexpected scrape error: %s", err)
+		}
+		if !strings.Contains(got, `pg_xact_commit_total{datname="postgres"} 1234`) {
+			t.Errorf("unexpected metrics, got:\n%s", got)
+		}
+		if a := active(); a != 1 {
+			t.Fatalf("expected the standby to be active, got data source %d", a)
+		}
+	}
+	if tgt.tryFailBack(0) {
+		t.Errorf("failed back to an unreachable primary")
+	}
+
+	// Once the primary is back, the target fails back to it.
+	results := strings.Replace(testResults, "1234", "4321", 1)
+	if err := os.WriteFile(primary, []byte(results), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if !tgt.tryFailBack(0) {
+		t.Fatalf("did not fail back to the primary")
+	}
+	got, err := gatherText(t, e)
+	if err != nil {
+		t.Fatalf("unexpected scrape error: %s", err)
+	}
+	if !strings.Contains(got, `pg_xact_commit_total{datname="postgres"} 4321`) {
+		t.Errorf("unexpected metrics, got:\n%s", got)
+	}
+}
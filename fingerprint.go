@@ -0,0 +1,99 @@
+package sql_exporter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/free/sql_exporter/config"
+	"github.com/free/sql_exporter/errors"
+	"github.com/free/sql_exporter/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxQueryErrorLength is the maximum length of the database error messages of a query, see Query.queryError.
+const maxQueryErrorLength = 512
+
+var queryInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "sql_exporter_query_info",
+	Help: "Always 1, labelled with the fingerprint (name and short hash of the query text) identifying the query in " +
+		"logs and errors.",
+}, []string{"job", "instance", "collector", "query", "fingerprint"})
+
+func init() {
+	prometheus.MustRegister(queryInfo)
+}
+
+var (
+	// Protects queryInfoFingerprints.
+	queryInfoMtx sync.Mutex
+	// Fingerprint exported by queryInfo, keyed by job, instance, collector and query; so the series of a query whose
+	// text changed (on configuration reload) can be deleted.
+	queryInfoFingerprints = make(map[[4]string]string)
+)
+
+// queryFingerprint returns a short identifier of the query, used instead of the query text in logs and errors: the
+// query name and the first 8 hex digits of the SHA-256 hash of the query text, e.g. "pg_locks@3f2a9c1b".
+func queryFingerprint(qc *config.QueryConfig) string {
+	sum := sha256.Sum256([]byte(qc.Query))
+	return qc.Name + "@" + hex.EncodeToString(sum[:4])
+}
+
+// setQueryInfo exports the fingerprint of the named query of the named collector, running on the target identified by
+// job and instance, replacing any previously exported fingerprint.
+func setQueryInfo(job, instance, collector, query, fingerprint string) {
+	queryInfoMtx.Lock()
+	defer queryInfoMtx.Unlock()
+
+	key := [4]string{job, instance, collector, query}
+	if previous, found := queryInfoFingerprints[key]; found && previous != fingerprint {
+		queryInfo.DeleteLabelValues(job, instance, collector, query, previous)
+	}
+	queryInfoFingerprints[key] = fingerprint
+	queryInfo.WithLabelValues(job, instance, collector, query, fingerprint).Set(1)
+}
+
+// deleteQueryInfo deletes the fingerprint of the named query exported by setQueryInfo.
+func deleteQueryInfo(job, instance, collector, query string) {
+	queryInfoMtx.Lock()
+	defer queryInfoMtx.Unlock()
+
+	key := [4]string{job, instance, collector, query}
+	if fingerprint, found := queryInfoFingerprints[key]; found {
+		queryInfo.DeleteLabelValues(job, instance, collector, query, fingerprint)
+		delete(queryInfoFingerprints, key)
+	}
+}
+
+// queryError wraps err, returned by the database for the query text sent to it, prepending msg (if not empty). Drivers
+// may quote the query text in their errors, so it is replaced with the query fingerprint and the message is truncated
+// to maxQueryErrorLength, to keep logs short and literals out of them. The full text is logged at verbosity 2.
+func (q *Query) queryError(err error, text, msg string) errors.WithContext {
+	if err == nil {
+		return nil
+	}
+	if w, ok := err.(errors.WithContext); ok {
+		return w
+	}
+	message := err.Error()
+	if text != "" {
+		message = strings.Replace(message, text, "<query "+q.fingerprint+">", -1)
+	}
+	if len(message) > maxQueryErrorLength {
+		cut := maxQueryErrorLength
+		// Don't split a UTF-8 sequence.
+		for cut > 0 && message[cut]&0xc0 == 0x80 {
+			cut--
+		}
+		message = fmt.Sprintf("%s... (%d bytes truncated)", message[:cut], len(message)-cut)
+	}
+	if msg != "" {
+		message = msg + ": " + message
+	}
+	if log.V(2) {
+		log.Infof("[%s] Query text:\n%s", q.logContext, text)
+	}
+	return errors.New(q.logContext, message)
+}
@@ -0,0 +1,10 @@
+package sql_exporter
+
+// flagValue returns a pointer to value, after registering it as the target of a flag (e.g.
+// kingpin.Flag(...).Default("1").IntVar). Unlike the pointers returned by kingpin, which are zero until the command
+// line is parsed, it holds the default even if the command line is never parsed, e.g. in tests or when the exporter is
+// embedded in another program.
+func flagValue[T any](value T, register func(*T)) *T {
+	register(&value)
+	return &value
+}
@@ -0,0 +1,101 @@
+package sql_exporter
+
+import (
+	"sync"
+	"time"
+
+	"github.com/free/sql_exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	targetFlaps = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sql_exporter_target_flaps_total",
+		Help: "Number of times the target went from up to down or from down to up.",
+	}, []string{"job", "instance"})
+	targetLastStateChange = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sql_exporter_target_last_state_change_timestamp_seconds",
+		Help: "Time of the target's last transition from up to down or from down to up, in seconds since the epoch.",
+	}, []string{"job", "instance"})
+)
+
+func init() {
+	prometheus.MustRegister(targetFlaps, targetLastStateChange)
+}
+
+// healthHistorySize is the maximum number of state transitions remembered per target.
+const healthHistorySize = 16
+
+// targetHealth keeps track of a target's up/down transitions and, if flap damping is configured, decides when
+// connection attempts to it should be skipped.
+type targetHealth struct {
+	damping    *config.FlapDampingConfig
+	flaps      prometheus.Counter
+	lastChange prometheus.Gauge
+
+	mtx sync.Mutex
+	// Whether up holds the target's last known state.
+	known bool
+	up    bool
+	// Times of the most recent state transitions, oldest first.
+	transitions []time.Time
+	// Connection attempts are skipped until this time.
+	dampedUntil time.Time
+}
+
+// newTargetHealth returns a targetHealth for the target with the given labels. damping may be nil.
+func newTargetHealth(labels prometheus.Labels, damping *config.FlapDampingConfig) *targetHealth {
+	return &targetHealth{
+		damping:     damping,
+		flaps:       targetFlaps.WithLabelValues(labels["job"], labels["instance"]),
+		lastChange:  targetLastStateChange.WithLabelValues(labels["job"], labels["instance"]),
+		transitions: make([]time.Time, 0, healthHistorySize),
+	}
+}
+
+// damped returns true if the target is flapping and connection attempts to it should be skipped.
+func (h *targetHealth) damped(now time.Time) bool {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	return now.Before(h.dampedUntil)
+}
+
+// record records the target's state as of now, counting a flap if it differs from the previous state. If flap damping
+// is configured and the target flapped too many times within the window, connection attempts are damped for a while.
+func (h *targetHealth) record(up bool, now time.Time) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if !h.known {
+		h.known, h.up = true, up
+		h.lastChange.Set(float64(now.UnixNano()) / 1e9)
+		return
+	}
+	if up == h.up {
+		return
+	}
+
+	h.up = up
+	h.flaps.Inc()
+	h.lastChange.Set(float64(now.UnixNano()) / 1e9)
+	if len(h.transitions) == healthHistorySize {
+		h.transitions = append(h.transitions[:0], h.transitions[1:]...)
+	}
+	h.transitions = append(h.transitions, now)
+
+	if h.damping == nil {
+		return
+	}
+	since := now.Add(-time.Duration(h.damping.Window))
+	recent := 0
+	for _, t := range h.transitions {
+		if t.After(since) {
+			recent++
+		}
+	}
+	if recent >= h.damping.Flaps {
+		h.dampedUntil = now.Add(time.Duration(h.damping.Backoff))
+		// Start counting afresh once the backoff is over.
+		h.transitions = h.transitions[:0]
+	}
+}
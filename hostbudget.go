@@ -0,0 +1,118 @@
+package sql_exporter
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/free/sql_exporter/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// Protects hostBudgets.
+	hostBudgetsMtx sync.Mutex
+	// Concurrency budgets, keyed by database server host:port, shared by all targets on the same server.
+	hostBudgets = make(map[string]*hostBudget)
+
+	// Default port of each driver, so that `host` and `host:port` DSNs are grouped together.
+	defaultPorts = map[string]string{
+		"clickhouse": "9000",
+		"mysql":      "3306",
+		"postgres":   "5432",
+		"prometheus": "9090",
+		"sqlserver":  "1433",
+	}
+
+	hostQueriesWaiting = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sql_exporter_host_queries_waiting",
+		Help: "Number of queries waiting for global.max_queries_per_host to allow them to run on the database server.",
+	}, []string{"host"})
+)
+
+func init() {
+	prometheus.MustRegister(hostQueriesWaiting)
+}
+
+// hostBudget limits the number of queries running concurrently on one database server, across all targets. Queries
+// are let through in the order in which they started waiting.
+type hostBudget struct {
+	sem     chan struct{}
+	waiting prometheus.Gauge
+}
+
+// hostBudgetFor returns the concurrency budget of the database server the provided DSN connects to, creating it with
+// the given limit on first use. It returns nil if limit <= 0 (no limit) or the server address cannot be determined.
+func hostBudgetFor(dsn string, limit int) *hostBudget {
+	if limit <= 0 {
+		return nil
+	}
+	host := dsnHost(dsn)
+	if host == "" {
+		return nil
+	}
+
+	hostBudgetsMtx.Lock()
+	defer hostBudgetsMtx.Unlock()
+
+	if hb, found := hostBudgets[host]; found {
+		return hb
+	}
+	hb := &hostBudget{
+		sem:     make(chan struct{}, limit),
+		waiting: hostQueriesWaiting.WithLabelValues(host),
+	}
+	hostBudgets[host] = hb
+	return hb
+}
+
+// acquire waits for the budget to allow one more query to run, or for ctx to be done.
+func (hb *hostBudget) acquire(ctx context.Context) error {
+	// Fast path, no waiting.
+	select {
+	case hb.sem <- struct{}{}:
+		return nil
+	default:
+	}
+
+	hb.waiting.Inc()
+	defer hb.waiting.Dec()
+	select {
+	case hb.sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release returns the budget taken by acquire.
+func (hb *hostBudget) release() {
+	<-hb.sem
+}
+
+// dsnHost returns the host:port of the database server the provided DSN connects to, empty if unknown.
+func dsnHost(dsn string) string {
+	parsed, err := config.ParseDataSourceName(dsn)
+	if err != nil || parsed.Host == "" {
+		return ""
+	}
+	driver, host := parsed.Driver, parsed.Host
+	if _, _, err := net.SplitHostPort(host); err != nil && defaultPorts[driver] != "" {
+		host = net.JoinHostPort(host, defaultPorts[driver])
+	}
+	return host
+}
+
+// hostBudgetKey is the context key under which the hostBudget is stored.
+type hostBudgetKey struct{}
+
+// withHostBudget returns a copy of ctx carrying the provided host concurrency budget.
+func withHostBudget(ctx context.Context, hb *hostBudget) context.Context {
+	return context.WithValue(ctx, hostBudgetKey{}, hb)
+}
+
+// hostBudgetFrom returns the host concurrency budget carried by ctx, nil if none.
+func hostBudgetFrom(ctx context.Context) *hostBudget {
+	hb, _ := ctx.Value(hostBudgetKey{}).(*hostBudget)
+	return hb
+}
@@ -0,0 +1,264 @@
+// Package testdriver implements a database/sql driver serving canned result sets defined in a YAML file, so that
+// configurations can be exercised end to end (configuration, collectors, exposition) without a real database, e.g. in
+// integration tests or by contributors running the exporter locally.
+//
+// Data source names have the form
+//
+//	testdriver://path/to/results.yml
+//
+// with relative paths resolved against the working directory (use `testdriver:///path` for absolute paths). The file
+// lists result sets, each applying to queries matching a regular expression; the first matching one is returned:
+//
+//	results:
+//	  - query: 'FROM pg_stat_database'
+//	    columns: [datname, xact_commit]
+//	    rows:
+//	      - [postgres, 1234]
+//	      - [template1, 0]
+//	  - query: '^SELECT 1$'
+//	    error: connection reset by peer
+//
+// Queries (and statements) not matching any result set fail, except for statements with no rows (e.g. session setup),
+// which succeed. The file is read anew by every connection. Bind parameters are accepted and ignored; transactions
+// are accepted and have no effect.
+package testdriver
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// DriverName is the name the driver is registered under, also the URI scheme of its data source names.
+const DriverName = "testdriver"
+
+func init() {
+	sql.Register(DriverName, &testDriver{})
+}
+
+// ResultSet is a canned result set, returned for queries matching Query.
+type ResultSet struct {
+	// Regular expression matched against query text (unanchored).
+	Query string `yaml:"query"`
+	// Column names, in order.
+	Columns []string `yaml:"columns,omitempty"`
+	// Rows, each with one value per column: strings, numbers, booleans or null.
+	Rows [][]interface{} `yaml:"rows,omitempty"`
+	// If set, matching queries fail with this error instead.
+	Error string `yaml:"error,omitempty"`
+	// If set, matching queries panic with this value instead (as a buggy driver might), to test recovery.
+	Panic string `yaml:"panic,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// Results is the contents of a results file.
+type Results struct {
+	Results []*ResultSet `yaml:"results"`
+}
+
+// LoadResults reads and validates the results file at path.
+func LoadResults(path string) (*Results, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &Results{}
+	if err := yaml.UnmarshalStrict(buf, r); err != nil {
+		return nil, fmt.Errorf("invalid results file %s: %s", path, err)
+	}
+	for i, rs := range r.Results {
+		if rs.Query == "" {
+			return nil, fmt.Errorf("missing query in result set #%d of %s", i+1, path)
+		}
+		if rs.re, err = regexp.Compile(rs.Query); err != nil {
+			return nil, fmt.Errorf("invalid query in result set #%d of %s: %s", i+1, path, err)
+		}
+		for j, row := range rs.Rows {
+			if len(row) != len(rs.Columns) {
+				return nil, fmt.Errorf("row #%d of result set #%d of %s has %d values, expected %d (one per column)",
+					j+1, i+1, path, len(row), len(rs.Columns))
+			}
+			for k, v := range row {
+				if row[k], err = driverValue(v); err != nil {
+					return nil, fmt.Errorf("row #%d of result set #%d of %s: %s", j+1, i+1, path, err)
+				}
+			}
+		}
+	}
+	return r, nil
+}
+
+// driverValue converts a value parsed from YAML to a driver.Value.
+func driverValue(v interface{}) (driver.Value, error) {
+	switch v := v.(type) {
+	case nil, string, bool, float64, int64:
+		return v, nil
+	case int:
+		return int64(v), nil
+	case uint64:
+		return float64(v), nil
+	default:
+		return nil, fmt.Errorf("unsupported value %v of type %T", v, v)
+	}
+}
+
+// match returns the first result set applying to query, nil if none does.
+func (r *Results) match(query string) *ResultSet {
+	for _, rs := range r.Results {
+		if rs.re.MatchString(query) {
+			return rs
+		}
+	}
+	return nil
+}
+
+// testDriver implements driver.Driver.
+type testDriver struct{}
+
+// Open implements driver.Driver.
+func (d *testDriver) Open(dsn string) (driver.Conn, error) {
+	path := strings.TrimPrefix(dsn, DriverName+"://")
+	if path == dsn || path == "" {
+		return nil, fmt.Errorf("invalid data source name, expected format `%s://path/to/results.yml`", DriverName)
+	}
+	results, err := LoadResults(path)
+	if err != nil {
+		return nil, err
+	}
+	return &conn{results: results}, nil
+}
+
+// conn is a connection serving the result sets of a results file. It implements driver.Conn, driver.ConnBeginTx,
+// driver.QueryerContext and driver.ExecerContext.
+type conn struct {
+	results *Results
+}
+
+// Prepare implements driver.Conn.
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+	return &stmt{conn: c, query: query}, nil
+}
+
+// Close implements driver.Conn.
+func (c *conn) Close() error {
+	return nil
+}
+
+// Begin implements driver.Conn.
+func (c *conn) Begin() (driver.Tx, error) {
+	return tx{}, nil
+}
+
+// BeginTx implements driver.ConnBeginTx.
+func (c *conn) BeginTx(context.Context, driver.TxOptions) (driver.Tx, error) {
+	return tx{}, nil
+}
+
+// QueryContext implements driver.QueryerContext.
+func (c *conn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return c.query(query)
+}
+
+// ExecContext implements driver.ExecerContext.
+func (c *conn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	return c.exec(query)
+}
+
+// query returns the rows of the result set matching query.
+func (c *conn) query(query string) (driver.Rows, error) {
+	rs := c.results.match(query)
+	if rs == nil {
+		return nil, fmt.Errorf("no result set matches query %q", query)
+	}
+	if rs.Panic != "" {
+		panic(rs.Panic)
+	}
+	if rs.Error != "" {
+		return nil, errors.New(rs.Error)
+	}
+	return &rows{columns: rs.Columns, rows: rs.Rows}, nil
+}
+
+// exec runs a statement: it fails if the matching result set (if any) is an error.
+func (c *conn) exec(query string) (driver.Result, error) {
+	if rs := c.results.match(query); rs != nil && rs.Error != "" {
+		return nil, errors.New(rs.Error)
+	}
+	return driver.RowsAffected(0), nil
+}
+
+// tx implements driver.Tx, with no effect.
+type tx struct{}
+
+// Commit implements driver.Tx.
+func (tx) Commit() error {
+	return nil
+}
+
+// Rollback implements driver.Tx.
+func (tx) Rollback() error {
+	return nil
+}
+
+// stmt implements driver.Stmt.
+type stmt struct {
+	conn  *conn
+	query string
+}
+
+// Close implements driver.Stmt.
+func (s *stmt) Close() error {
+	return nil
+}
+
+// NumInput implements driver.Stmt. Any number of bind parameters is accepted.
+func (s *stmt) NumInput() int {
+	return -1
+}
+
+// Exec implements driver.Stmt.
+func (s *stmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.conn.exec(s.query)
+}
+
+// Query implements driver.Stmt.
+func (s *stmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.conn.query(s.query)
+}
+
+// rows implements driver.Rows over a canned result set.
+type rows struct {
+	columns []string
+	rows    [][]interface{}
+}
+
+// Columns implements driver.Rows.
+func (r *rows) Columns() []string {
+	return r.columns
+}
+
+// Close implements driver.Rows.
+func (r *rows) Close() error {
+	return nil
+}
+
+// Next implements driver.Rows.
+func (r *rows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	for i, v := range r.rows[0] {
+		dest[i] = v
+	}
+	r.rows = r.rows[1:]
+	return nil
+}
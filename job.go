@@ -2,6 +2,7 @@ package sql_exporter
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/free/sql_exporter/config"
 	"github.com/free/sql_exporter/errors"
@@ -29,19 +30,15 @@ func NewJob(jc *config.JobConfig, gc *config.GlobalConfig) (Job, errors.WithCont
 	}
 
 	for _, sc := range jc.StaticConfigs {
+		if !sc.IsEnabled() {
+			continue
+		}
 		for tname, dsn := range sc.Targets {
-			constLabels := prometheus.Labels{
-				"job":      jc.Name,
-				"instance": tname,
-			}
-			for name, value := range sc.Labels {
-				// Shouldn't happen as there are sanity checks in config, but check nonetheless.
-				if _, found := constLabels[name]; found {
-					return nil, errors.Errorf(j.logContext, "duplicate label %q", name)
-				}
-				constLabels[name] = value
+			// Skip targets scraped by other exporter replicas.
+			if !inShard(jc.Name, tname) {
+				continue
 			}
-			t, err := NewTarget(j.logContext, tname, string(dsn), jc.Collectors(), constLabels, gc)
+			t, err := newJobTarget(jc, gc, j.logContext, tname, dsn, sc.Labels, sc.MaintenanceWindows)
 			if err != nil {
 				return nil, err
 			}
@@ -55,3 +52,30 @@ func NewJob(jc *config.JobConfig, gc *config.GlobalConfig) (Job, errors.WithCont
 func (j *job) Targets() []Target {
 	return j.targets
 }
+
+// newJobTarget returns a new Target belonging to the job, with the given instance name, data source name, additional
+// labels and maintenance windows (on top of the job's).
+func newJobTarget(jc *config.JobConfig, gc *config.GlobalConfig, logContext, tname string, dsn config.Secret,
+	labels map[string]string, maintenance []*config.MaintenanceWindow) (Target, errors.WithContext) {
+	constLabels := prometheus.Labels{
+		"job":      jc.Name,
+		"instance": tname,
+	}
+	for name, value := range labels {
+		// Shouldn't happen as there are sanity checks in config, but check nonetheless.
+		if _, found := constLabels[name]; found {
+			return nil, errors.Errorf(logContext, "duplicate label %q", name)
+		}
+		constLabels[name] = value
+	}
+	windows := append(jc.MaintenanceWindows[:0:0], jc.MaintenanceWindows...)
+	windows = append(windows, maintenance...)
+	return NewTarget(logContext, tname, []string{jobTargetDataSourceName(jc, dsn)}, time.Duration(jc.DialTimeout),
+		jc.Pooler, jc.Location(), jc.Collectors(), constLabels, jc.MetricPrefix, gc, windows, jc.ReplicaLag)
+}
+
+// jobTargetDataSourceName returns the data source name the job's target with the given data source name connects
+// with, i.e. with the job's driver options applied.
+func jobTargetDataSourceName(jc *config.JobConfig, dsn config.Secret) string {
+	return string(config.DSNWithOptions(dsn, config.PoolerDriverOptions(jc.DriverOptions, jc.Pooler)))
+}
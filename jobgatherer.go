@@ -0,0 +1,112 @@
+package sql_exporter
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"time"
+
+	"github.com/free/sql_exporter/log"
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// jobGatherGrace is how long a job's targets are given to wrap up (e.g. export their `up` metrics) after the job's
+// context is done, before its metrics are given up on.
+const jobGatherGrace = 250 * time.Millisecond
+
+// jobGatherer is a prometheus.Gatherer collecting the metrics of one job's targets, isolated from other jobs: it returns
+// (with an error) at most jobGatherGrace after its context is done, even if some targets are deadlocked. Panics in
+// collectors and queries are recovered by the goroutines running them (see recoverCollect) and fail only the collector
+// in question; a panic gathering the job otherwise is recovered here and reported as an error.
+type jobGatherer struct {
+	ctx     context.Context
+	job     string
+	timeout time.Duration // the job's scrape_timeout, zero if not set
+	targets []Target
+}
+
+// gatherResult is the outcome of jobGatherer's gathering goroutine.
+type gatherResult struct {
+	mfs []*dto.MetricFamily
+	err error
+}
+
+// Job returns the name of the job gathered, empty in single target mode.
+func (jg *jobGatherer) Job() string {
+	return jg.job
+}
+
+// Gather implements prometheus.Gatherer.
+func (jg *jobGatherer) Gather() ([]*dto.MetricFamily, error) {
+	ctx, cancel := jg.ctx, context.CancelFunc(func() {})
+	if jg.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, jg.timeout)
+	}
+	defer cancel()
+	start := time.Now()
+
+	// Buffered, so the goroutine doesn't leak if we give up on it.
+	resultChan := make(chan gatherResult, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Errorf("[job=%q] Panic gathering metrics: %v\n%s", jg.job, r, debug.Stack())
+				resultChan <- gatherResult{
+					mfs: fallbackMetricFamilies(jg.targets, time.Since(start)),
+					err: fmt.Errorf("job %q: panic gathering metrics: %v", jg.job, r),
+				}
+			}
+		}()
+		mfs, err := gatherTargets(ctx, jg.targets)
+		resultChan <- gatherResult{mfs, err}
+	}()
+
+	select {
+	case result := <-resultChan:
+		return result.mfs, result.err
+	case <-ctx.Done():
+	}
+	select {
+	case result := <-resultChan:
+		return result.mfs, result.err
+	case <-time.After(jobGatherGrace):
+		return fallbackMetricFamilies(jg.targets, time.Since(start)),
+			fmt.Errorf("job %q: gave up gathering metrics %s after %s", jg.job, jobGatherGrace, ctx.Err())
+	}
+}
+
+// fallbackMetricFamilies returns `up` (set to 0) and `scrape_duration_seconds` series for the provided targets, for
+// when gathering their metrics failed altogether, so that alerts on `up` still fire. Targets without labels (single
+// target mode) get neither, same as when scraped successfully.
+func fallbackMetricFamilies(targets []Target, duration time.Duration) []*dto.MetricFamily {
+	up := &dto.MetricFamily{
+		Name: proto.String(upMetricName),
+		Help: proto.String(upMetricHelp),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	scrapeDuration := &dto.MetricFamily{
+		Name: proto.String(scrapeDurationName),
+		Help: proto.String(scrapeDurationHelp),
+		Type: dto.MetricType_GAUGE.Enum(),
+	}
+	for _, t := range targets {
+		labels := t.Labels()
+		if len(labels) == 0 {
+			continue
+		}
+		labelPairs := make([]*dto.LabelPair, 0, len(labels))
+		for name, value := range labels {
+			labelPairs = append(labelPairs, &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)})
+		}
+		sort.Sort(labelPairSorter(labelPairs))
+		up.Metric = append(up.Metric, &dto.Metric{Label: labelPairs, Gauge: &dto.Gauge{Value: proto.Float64(0)}})
+		scrapeDuration.Metric = append(scrapeDuration.Metric,
+			&dto.Metric{Label: labelPairs, Gauge: &dto.Gauge{Value: proto.Float64(duration.Seconds())}})
+	}
+	if len(up.Metric) == 0 {
+		return nil
+	}
+	return []*dto.MetricFamily{up, scrapeDuration}
+}
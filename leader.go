@@ -0,0 +1,116 @@
+package sql_exporter
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/free/sql_exporter/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	leaderLockFile = kingpin.Flag("leader-election.lock-file",
+		"If set, only the replica holding an exclusive lock on this file (e.g. on a shared volume) queries the "+
+			"databases.").String()
+	leaderRetryInterval = flagValue(5*time.Second, kingpin.Flag("leader-election.retry-interval",
+		"How often a standby replica attempts to acquire the leader election lock.").Default("5s").DurationVar)
+)
+
+var leaderGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "sql_exporter_leader",
+	Help: "1 if this replica is the leader and queries the databases, 0 if it is standing by.",
+})
+
+func init() {
+	prometheus.MustRegister(leaderGauge)
+}
+
+// leaderElector elects one of several exporter replicas as leader by means of an exclusive lock on a shared file. The
+// lock is held (and the replica remains leader) until it resigns or the process exits.
+type leaderElector struct {
+	path   string
+	leader int32
+	stop   chan struct{} // closed by resign, stops attempting to acquire the lock
+
+	// Protects file and resigned.
+	mtx      sync.Mutex
+	file     *os.File // the locked file while leader, nil otherwise
+	resigned bool
+}
+
+// newLeaderElector returns a leaderElector for the lock file at path, which immediately starts attempting to acquire
+// the lock in the background.
+func newLeaderElector(path string, retryInterval time.Duration) *leaderElector {
+	le := &leaderElector{path: path, stop: make(chan struct{})}
+	go le.run(retryInterval)
+	return le
+}
+
+// run attempts to acquire the lock every retryInterval until successful or resigned.
+func (le *leaderElector) run(retryInterval time.Duration) {
+	for {
+		err := le.tryAcquire()
+		if err == nil {
+			log.Infof("Acquired leader election lock %s, collecting metrics", le.path)
+			atomic.StoreInt32(&le.leader, 1)
+			leaderGauge.Set(1)
+			return
+		}
+		log.V(1).Infof("Failed to acquire leader election lock %s, standing by: %s", le.path, err)
+		select {
+		case <-le.stop:
+			return
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+// tryAcquire opens the lock file and attempts to lock it without blocking. On success, the locked file is kept open
+// (and locked) until resign is called.
+func (le *leaderElector) tryAcquire() error {
+	le.mtx.Lock()
+	defer le.mtx.Unlock()
+
+	if le.resigned {
+		return fmt.Errorf("resigned")
+	}
+	f, err := os.OpenFile(le.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return err
+	}
+	le.file = f
+	return nil
+}
+
+// resign gives up leadership, if held, by closing the locked file (which releases the lock, so that a standby replica
+// takes over) and stops attempting to acquire the lock otherwise.
+func (le *leaderElector) resign() {
+	le.mtx.Lock()
+	defer le.mtx.Unlock()
+
+	if le.resigned {
+		return
+	}
+	le.resigned = true
+	close(le.stop)
+	if le.file != nil {
+		log.Infof("Releasing leader election lock %s", le.path)
+		atomic.StoreInt32(&le.leader, 0)
+		leaderGauge.Set(0)
+		le.file.Close()
+		le.file = nil
+	}
+}
+
+// isLeader returns true if this replica holds the lock.
+func (le *leaderElector) isLeader() bool {
+	return atomic.LoadInt32(&le.leader) == 1
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+// +build !windows
+
+package sql_exporter
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile acquires an exclusive advisory lock on f, failing immediately if another process holds it.
+func lockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+}
@@ -0,0 +1,14 @@
+//go:build windows
+// +build windows
+
+package sql_exporter
+
+import (
+	"errors"
+	"os"
+)
+
+// lockFile is not supported on Windows.
+func lockFile(f *os.File) error {
+	return errors.New("leader election is not supported on Windows")
+}
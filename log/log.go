@@ -0,0 +1,136 @@
+// Package log is the logging facade used by the exporter and its library packages. It provides the glog style leveled
+// functions they were written against (Infof, Warningf, V(1).Infof etc.), writing through a log/slog Handler, so that
+// programs embedding the exporter may route its logs wherever their own go (see SetHandler).
+package log
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// Protects handler.
+	handlerMtx sync.RWMutex
+	// The handler all messages are written to.
+	handler = NewHandler(os.Stderr, false)
+	// Maximum level of V() messages logged.
+	verbosity atomic.Int32
+)
+
+// NewHandler returns the handler used by default, writing logfmt (or JSON, if json is set) records to w, with the
+// source file and line of every message.
+func NewHandler(w io.Writer, json bool) slog.Handler {
+	opts := &slog.HandlerOptions{
+		AddSource: true,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			// Strip the source file directory and function name, as glog does.
+			if source, ok := a.Value.Any().(*slog.Source); ok && a.Key == slog.SourceKey && len(groups) == 0 {
+				return slog.String(slog.SourceKey, fmt.Sprintf("%s:%d", filepath.Base(source.File), source.Line))
+			}
+			return a
+		},
+	}
+	if json {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+// SetHandler sets the handler all messages are written to.
+func SetHandler(h slog.Handler) {
+	handlerMtx.Lock()
+	defer handlerMtx.Unlock()
+	handler = h
+}
+
+// SetVerbosity sets the maximum level of V() messages logged, 0 (the default) logging none of them.
+func SetVerbosity(level int) {
+	verbosity.Store(int32(level))
+}
+
+// Verbose is returned by V(), true if messages of that level are logged.
+type Verbose bool
+
+// V reports whether messages of the provided verbosity level are logged, see SetVerbosity. E.g.
+//
+//	log.V(2).Infof("Query text: %s", text)
+func V(level int) Verbose {
+	return Verbose(int32(level) <= verbosity.Load())
+}
+
+// Infof is equivalent to the global Infof if v is true, a no-op otherwise.
+func (v Verbose) Infof(format string, args ...interface{}) {
+	if v {
+		output(slog.LevelInfo, 1, fmt.Sprintf(format, args...))
+	}
+}
+
+// Info logs a message at info level, with its arguments formatted as by fmt.Sprint.
+func Info(args ...interface{}) {
+	output(slog.LevelInfo, 1, fmt.Sprint(args...))
+}
+
+// Infof logs a message at info level, formatted as by fmt.Sprintf.
+func Infof(format string, args ...interface{}) {
+	output(slog.LevelInfo, 1, fmt.Sprintf(format, args...))
+}
+
+// InfoDepth is like Info, but attributes the message to the depth-th caller (0 being the caller of InfoDepth).
+func InfoDepth(depth int, args ...interface{}) {
+	output(slog.LevelInfo, depth+1, fmt.Sprint(args...))
+}
+
+// Warning logs a message at warning level, with its arguments formatted as by fmt.Sprint.
+func Warning(args ...interface{}) {
+	output(slog.LevelWarn, 1, fmt.Sprint(args...))
+}
+
+// Warningf logs a message at warning level, formatted as by fmt.Sprintf.
+func Warningf(format string, args ...interface{}) {
+	output(slog.LevelWarn, 1, fmt.Sprintf(format, args...))
+}
+
+// WarningDepth is like Warning, but attributes the message to the depth-th caller (0 being the caller of WarningDepth).
+func WarningDepth(depth int, args ...interface{}) {
+	output(slog.LevelWarn, depth+1, fmt.Sprint(args...))
+}
+
+// Error logs a message at error level, with its arguments formatted as by fmt.Sprint.
+func Error(args ...interface{}) {
+	output(slog.LevelError, 1, fmt.Sprint(args...))
+}
+
+// Errorf logs a message at error level, formatted as by fmt.Sprintf.
+func Errorf(format string, args ...interface{}) {
+	output(slog.LevelError, 1, fmt.Sprintf(format, args...))
+}
+
+// ErrorDepth is like Error, but attributes the message to the depth-th caller (0 being the caller of ErrorDepth).
+func ErrorDepth(depth int, args ...interface{}) {
+	output(slog.LevelError, depth+1, fmt.Sprint(args...))
+}
+
+// output writes message to the handler at the provided level, attributing it to the depth-th caller (0 being output
+// itself).
+func output(level slog.Level, depth int, message string) {
+	handlerMtx.RLock()
+	h := handler
+	handlerMtx.RUnlock()
+
+	ctx := context.Background()
+	if !h.Enabled(ctx, level) {
+		return
+	}
+	var pcs [1]uintptr
+	// Skip runtime.Callers and output itself.
+	runtime.Callers(depth+2, pcs[:])
+	h.Handle(ctx, slog.NewRecord(time.Now(), level, message, pcs[0]))
+}
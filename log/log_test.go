@@ -0,0 +1,42 @@
+package log
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestOutput(t *testing.T) {
+	var buf bytes.Buffer
+	SetHandler(NewHandler(&buf, false))
+	defer SetHandler(NewHandler(&buf, false))
+	defer SetVerbosity(0)
+
+	SetVerbosity(1)
+	Infof("info %d", 1)
+	Warning("warning ", 2)
+	V(1).Infof("verbose 1")
+	V(2).Infof("verbose 2")
+	logDepth()
+
+	got := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	want := []string{
+		`level=INFO source=log_test.go:16 msg="info 1"`,
+		`level=WARN source=log_test.go:17 msg="warning 2"`,
+		`level=INFO source=log_test.go:18 msg="verbose 1"`,
+		`level=ERROR source=log_test.go:20 msg="error 3"`,
+	}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d messages, got %q", len(want), got)
+	}
+	for i := range want {
+		if !strings.HasSuffix(got[i], want[i]) {
+			t.Errorf("expected message %d to end with %q, got %q", i, want[i], got[i])
+		}
+	}
+}
+
+// logDepth logs an error attributed to its caller.
+func logDepth() {
+	ErrorDepth(1, "error ", 3)
+}
@@ -0,0 +1,123 @@
+package sql_exporter
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/free/sql_exporter/log"
+)
+
+// Severity is the level a message is logged at, see Logf.
+type Severity int
+
+// Supported severities.
+const (
+	SeverityInfo Severity = iota
+	SeverityWarning
+	SeverityError
+)
+
+var (
+	dedupIntervals = [...]*time.Duration{
+		SeverityInfo: kingpin.Flag("log.dedup-interval.info",
+			"Log identical info messages (e.g. scrape errors) at most once per interval, followed by a summary of "+
+				"repetitions. 0 disables deduplication.").Default("0s").Duration(),
+		SeverityWarning: kingpin.Flag("log.dedup-interval.warning",
+			"Log identical warning messages at most once per interval. 0 disables deduplication.").Default("0s").Duration(),
+		SeverityError: kingpin.Flag("log.dedup-interval.error",
+			"Log identical error messages at most once per interval. 0 disables deduplication.").Default("0s").Duration(),
+	}
+)
+
+// dedupKey identifies a repeated message.
+type dedupKey struct {
+	severity Severity
+	message  string
+}
+
+// dedupEntry keeps track of the repetitions of a message suppressed since it was last logged.
+type dedupEntry struct {
+	logged     time.Time
+	suppressed int
+}
+
+// logDeduper logs messages, suppressing repetitions of identical messages (e.g. the same scrape error for a target
+// that's down) for the configured per severity interval. Repetitions are summarized once the interval has elapsed.
+type logDeduper struct {
+	mtx     sync.Mutex
+	entries map[dedupKey]*dedupEntry
+	flusher sync.Once
+}
+
+// dedupLog is the one and only logDeduper.
+var dedupLog = &logDeduper{entries: make(map[dedupKey]*dedupEntry)}
+
+// Logf formats and logs a message at the provided severity, unless an identical message was logged less than the
+// severity's deduplication interval (see the --log.dedup-interval.* flags) ago. Meant for messages likely to repeat on
+// every scrape, such as scrape errors.
+func Logf(sev Severity, format string, args ...interface{}) {
+	dedupLog.logf(sev, format, args...)
+}
+
+// logf implements Logf.
+func (d *logDeduper) logf(sev Severity, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	interval := *dedupIntervals[sev]
+	if interval <= 0 {
+		output(sev, message, 3)
+		return
+	}
+	d.flusher.Do(func() { go d.flushLoop() })
+
+	now := time.Now()
+	key := dedupKey{sev, message}
+
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if e, found := d.entries[key]; found && now.Sub(e.logged) < interval {
+		e.suppressed++
+		return
+	}
+	d.summarize(key, d.entries[key], now, 3)
+	d.entries[key] = &dedupEntry{logged: now}
+	output(sev, message, 3)
+}
+
+// flushLoop periodically summarizes and forgets messages not logged for longer than their deduplication interval, so
+// that repetitions are reported even if the message stops occurring altogether.
+func (d *logDeduper) flushLoop() {
+	for now := range time.Tick(time.Second) {
+		d.mtx.Lock()
+		for key, e := range d.entries {
+			if now.Sub(e.logged) >= *dedupIntervals[key.severity] {
+				d.summarize(key, e, now, 1)
+				delete(d.entries, key)
+			}
+		}
+		d.mtx.Unlock()
+	}
+}
+
+// summarize logs the number of suppressed repetitions of a message, if any, attributing it to the depth-th caller (0
+// being summarize itself). Must be called with d.mtx held.
+func (d *logDeduper) summarize(key dedupKey, e *dedupEntry, now time.Time, depth int) {
+	if e == nil || e.suppressed == 0 {
+		return
+	}
+	output(key.severity, fmt.Sprintf("%s (repeated %d times in the last %s)",
+		key.message, e.suppressed, now.Sub(e.logged).Round(time.Second)), depth+1)
+}
+
+// output logs message at the provided severity, attributing it to the depth-th caller (0 being output itself).
+func output(sev Severity, message string, depth int) {
+	switch sev {
+	case SeverityInfo:
+		log.InfoDepth(depth, message)
+	case SeverityWarning:
+		log.WarningDepth(depth, message)
+	default:
+		log.ErrorDepth(depth, message)
+	}
+}
@@ -0,0 +1,165 @@
+package sql_exporter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/free/sql_exporter/config"
+	"github.com/free/sql_exporter/errors"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// LogFamily is a log stream populated from SQL query result rows, each row producing one log line.
+type LogFamily struct {
+	config     *config.LogConfig
+	labels     map[string]string
+	sink       logSink
+	logContext string
+}
+
+// NewLogFamily creates a new LogFamily with the given log config, const labels (e.g. job and instance) and output.
+func NewLogFamily(
+	logContext string, lc *config.LogConfig, constLabels []*dto.LabelPair, oc *config.LogOutputConfig) *LogFamily {
+	logContext = fmt.Sprintf("%s, log=%q", logContext, lc.Name)
+
+	labels := make(map[string]string, len(constLabels)+len(lc.Labels)+1)
+	for _, lp := range constLabels {
+		labels[lp.GetName()] = lp.GetValue()
+	}
+	for k, v := range lc.Labels {
+		labels[k] = v
+	}
+	labels["log"] = lc.Name
+
+	return &LogFamily{
+		config:     lc,
+		labels:     labels,
+		sink:       newLogSink(oc),
+		logContext: logContext,
+	}
+}
+
+// logEntry is a single log line: a timestamp and a set of fields, one per result column.
+type logEntry struct {
+	ts     time.Time
+	fields map[string]interface{}
+}
+
+// newLogEntry returns a log entry for the given result row, with []byte values (as returned by some drivers for text
+// columns) converted to strings.
+func newLogEntry(ts time.Time, row map[string]interface{}) logEntry {
+	fields := make(map[string]interface{}, len(row))
+	for k, v := range row {
+		if b, ok := v.([]byte); ok {
+			v = string(b)
+		}
+		fields[k] = v
+	}
+	return logEntry{ts: ts, fields: fields}
+}
+
+// Write outputs the provided entries.
+func (lf *LogFamily) Write(ctx context.Context, entries []logEntry) errors.WithContext {
+	if len(entries) == 0 {
+		return nil
+	}
+	return errors.Wrap(lf.logContext, lf.sink.write(ctx, lf.labels, entries))
+}
+
+// logSink is an output for log entries.
+type logSink interface {
+	// write outputs the provided entries, all belonging to the log stream identified by labels.
+	write(ctx context.Context, labels map[string]string, entries []logEntry) error
+}
+
+// newLogSink returns the logSink for the provided output config. A nil config means stdout.
+func newLogSink(oc *config.LogOutputConfig) logSink {
+	if oc != nil && oc.Type == config.LogOutputLoki {
+		return &lokiSink{url: oc.URL}
+	}
+	return stdoutSink
+}
+
+// stdoutSink is the one and only logSink writing to standard output.
+var stdoutSink = &writerSink{w: os.Stdout}
+
+// writerSink writes log entries to an io.Writer, one JSON object per line, with labels and fields merged.
+type writerSink struct {
+	mtx sync.Mutex
+	w   io.Writer
+}
+
+// write implements logSink.
+func (s *writerSink) write(ctx context.Context, labels map[string]string, entries []logEntry) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range entries {
+		line := make(map[string]interface{}, len(labels)+len(e.fields)+1)
+		for k, v := range e.fields {
+			line[k] = v
+		}
+		for k, v := range labels {
+			line[k] = v
+		}
+		line["ts"] = e.ts.Format(time.RFC3339Nano)
+		if err := enc.Encode(line); err != nil {
+			return err
+		}
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	_, err := s.w.Write(buf.Bytes())
+	return err
+}
+
+// lokiSink pushes log entries to a Loki server, as JSON encoded log lines.
+type lokiSink struct {
+	url string
+}
+
+// write implements logSink.
+func (s *lokiSink) write(ctx context.Context, labels map[string]string, entries []logEntry) error {
+	values := make([][2]string, 0, len(entries))
+	for _, e := range entries {
+		line, err := json.Marshal(e.fields)
+		if err != nil {
+			return err
+		}
+		values = append(values, [2]string{strconv.FormatInt(e.ts.UnixNano(), 10), string(line)})
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"streams": []interface{}{
+			map[string]interface{}{
+				"stream": labels,
+				"values": values,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Loki push to %s failed with status %s", s.url, resp.Status)
+	}
+	return nil
+}
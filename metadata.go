@@ -0,0 +1,97 @@
+package sql_exporter
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/free/sql_exporter/config"
+	"github.com/free/sql_exporter/errors"
+)
+
+var (
+	// Dotted version numbers (e.g. "13.4" in "PostgreSQL 13.4 on x86_64-pc-linux-gnu") are preferred to plain numbers,
+	// which are frequently release years or word sizes (e.g. "2019" in "Microsoft SQL Server 2019 ... 15.0.2000.5").
+	dottedVersionRE = regexp.MustCompile(`\d+(\.\d+)+`)
+	plainVersionRE  = regexp.MustCompile(`\d+`)
+)
+
+// targetMetadata detects and caches the target metadata that collector and metric `when` conditions are evaluated
+// against (see config.Condition). Detection is retried on every scrape until it succeeds, then never repeated.
+type targetMetadata struct {
+	driver     string
+	logContext string
+
+	mtx      sync.Mutex
+	metadata map[string]string // nil until successfully detected
+}
+
+// get returns the target metadata, detecting it if not yet known.
+func (tm *targetMetadata) get(ctx context.Context, conn *sql.DB) (map[string]string, errors.WithContext) {
+	tm.mtx.Lock()
+	defer tm.mtx.Unlock()
+
+	if tm.metadata != nil {
+		return tm.metadata, nil
+	}
+	metadata := map[string]string{config.ConditionDriver: tm.driver}
+	// No database to query in demo mode, only the driver is known.
+	if *demoMode {
+		tm.metadata = metadata
+		return tm.metadata, nil
+	}
+
+	dialect := DialectFor(tm.driver)
+	if dialect.VersionQuery != "" {
+		var version string
+		if err := conn.QueryRowContext(ctx, dialect.VersionQuery).Scan(&version); err != nil {
+			return nil, errors.Wrapf(tm.logContext, err, "detecting server version failed")
+		}
+		metadata[config.ConditionServerVersion] = parseServerVersion(version)
+	}
+	if dialect.EditionQuery != "" {
+		var edition string
+		if err := conn.QueryRowContext(ctx, dialect.EditionQuery).Scan(&edition); err != nil {
+			return nil, errors.Wrapf(tm.logContext, err, "detecting server edition failed")
+		}
+		metadata[config.ConditionEdition] = strings.TrimSpace(edition)
+	}
+	tm.metadata = metadata
+	return tm.metadata, nil
+}
+
+// parseServerVersion extracts the numeric version from the free form version string returned by a dialect's
+// VersionQuery. Returns an empty string if none is found.
+func parseServerVersion(version string) string {
+	if v := dottedVersionRE.FindString(version); v != "" {
+		return v
+	}
+	return plainVersionRE.FindString(version)
+}
+
+// metadataKey is the context key under which the target metadata is stored.
+type metadataKey struct{}
+
+// withMetadata returns a copy of ctx carrying the provided target metadata.
+func withMetadata(ctx context.Context, metadata map[string]string) context.Context {
+	return context.WithValue(ctx, metadataKey{}, metadata)
+}
+
+// metadataFrom returns the target metadata carried by ctx, nil if none, i.e. if no conditions are defined or metadata
+// detection failed.
+func metadataFrom(ctx context.Context) map[string]string {
+	metadata, _ := ctx.Value(metadataKey{}).(map[string]string)
+	return metadata
+}
+
+// applies returns true if the condition holds for the target metadata carried by ctx. Conditional collectors and
+// metrics do not apply to targets with unknown metadata.
+func applies(ctx context.Context, condition *config.Condition) bool {
+	if condition == nil {
+		return true
+	}
+	metadata := metadataFrom(ctx)
+	return metadata != nil && condition.Eval(metadata)
+}
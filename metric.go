@@ -1,8 +1,13 @@
 package sql_exporter
 
 import (
+	"bytes"
 	"fmt"
+	"math"
 	"sort"
+	"sync"
+	"text/template/parse"
+	"time"
 
 	"github.com/free/sql_exporter/config"
 	"github.com/free/sql_exporter/errors"
@@ -28,24 +33,41 @@ type MetricDesc interface {
 // MetricFamily implements MetricDesc for SQL metrics, with logic for populating its labels and values from sql.Rows.
 type MetricFamily struct {
 	config      *config.MetricConfig
+	name        string // config.Name, prefixed
 	constLabels []*dto.LabelPair
 	labels      []string
-	logContext  string
+	// Names of the labels computed from templates, sorted. They follow the key labels in labels.
+	templateLabels []string
+	logContext     string
+	// Per series state of counters with reset_detection, nil otherwise. A pointer, as MetricFamily is passed by value.
+	resets *counterResets
+	layout *labelLayout
 }
 
-// NewMetricFamily creates a new MetricFamily with the given metric config and const labels (e.g. job and instance).
-func NewMetricFamily(logContext string, mc *config.MetricConfig, constLabels []*dto.LabelPair) (*MetricFamily, errors.WithContext) {
+// NewMetricFamily creates a new MetricFamily with the given metric config and const labels (e.g. job and instance). Its
+// name is the configured metric name, prefixed with metricPrefix.
+func NewMetricFamily(
+	logContext string, mc *config.MetricConfig, constLabels []*dto.LabelPair, metricPrefix string) (
+	*MetricFamily, errors.WithContext) {
 	logContext = fmt.Sprintf("%s, metric=%q", logContext, mc.Name)
 
 	if len(mc.Values) == 0 {
 		return nil, errors.New(logContext, "no value column defined")
 	}
-	if len(mc.Values) > 1 && mc.ValueLabel == "" {
+	if len(mc.Values) > 1 && mc.ValueLabel == "" && !mc.IsHistogram() {
 		return nil, errors.New(logContext, "multiple values but no value label")
 	}
 
-	labels := make([]string, 0, len(mc.KeyLabels)+1)
+	// Computed labels, in a stable order.
+	templateLabels := make([]string, 0, len(mc.ParsedLabelTemplates()))
+	for label := range mc.ParsedLabelTemplates() {
+		templateLabels = append(templateLabels, label)
+	}
+	sort.Strings(templateLabels)
+
+	labels := make([]string, 0, len(mc.KeyLabels)+len(templateLabels)+1)
 	labels = append(labels, mc.KeyLabels...)
+	labels = append(labels, templateLabels...)
 	if mc.ValueLabel != "" {
 		labels = append(labels, mc.ValueLabel)
 	}
@@ -59,34 +81,168 @@ func NewMetricFamily(logContext string, mc *config.MetricConfig, constLabels []*
 			Value: proto.String(v),
 		})
 	}
+	if mc.Query() != nil {
+		for k, v := range mc.Query().ConstKeyLabels {
+			sortedLabels = append(sortedLabels, &dto.LabelPair{
+				Name:  proto.String(k),
+				Value: proto.String(v),
+			})
+		}
+	}
 	sort.Sort(labelPairSorter(sortedLabels))
 
+	var resets *counterResets
+	if mc.ResetDetection {
+		resets = &counterResets{series: make(map[string]*counterSeries)}
+	}
+
 	return &MetricFamily{
-		config:      mc,
-		constLabels: sortedLabels,
-		labels:      labels,
-		logContext:  logContext,
+		config:         mc,
+		name:           metricPrefix + mc.Name,
+		constLabels:    sortedLabels,
+		labels:         labels,
+		templateLabels: templateLabels,
+		logContext:     logContext,
+		resets:         resets,
+		layout:         newLabelLayout(labels, sortedLabels),
 	}, nil
 }
 
+// templateColumns returns the names of the columns referenced by the metric's label templates (as `{{.column}}`).
+func (mf MetricFamily) templateColumns() []string {
+	var columns []string
+	for _, tmpl := range mf.config.ParsedLabelTemplates() {
+		columns = appendFieldNames(columns, tmpl.Tree.Root)
+	}
+	return columns
+}
+
+// appendFieldNames walks a template parse tree, appending the names of all top level fields (e.g. `host` for
+// `{{.host}}`) to names.
+func appendFieldNames(names []string, node parse.Node) []string {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n != nil {
+			for _, c := range n.Nodes {
+				names = appendFieldNames(names, c)
+			}
+		}
+	case *parse.ActionNode:
+		names = appendFieldNames(names, n.Pipe)
+	case *parse.PipeNode:
+		if n != nil {
+			for _, c := range n.Cmds {
+				names = appendFieldNames(names, c)
+			}
+		}
+	case *parse.CommandNode:
+		for _, a := range n.Args {
+			names = appendFieldNames(names, a)
+		}
+	case *parse.FieldNode:
+		names = append(names, n.Ident[0])
+	case *parse.IfNode:
+		names = appendFieldNames(appendFieldNames(appendFieldNames(names, n.Pipe), n.List), n.ElseList)
+	case *parse.RangeNode:
+		names = appendFieldNames(appendFieldNames(appendFieldNames(names, n.Pipe), n.List), n.ElseList)
+	case *parse.WithNode:
+		names = appendFieldNames(appendFieldNames(appendFieldNames(names, n.Pipe), n.List), n.ElseList)
+	}
+	return names
+}
+
 // Collect is the equivalent of prometheus.Collector.Collect() but takes a Query output map to populate values from.
-func (mf MetricFamily) Collect(row map[string]interface{}, ch chan<- Metric) {
-	labelValues := make([]string, len(mf.labels))
+func (mf *MetricFamily) Collect(row map[string]interface{}, ch chan<- Metric) {
+	if !mf.config.EmitCondition().Eval(row) {
+		return
+	}
+	// Label values are copied by the metrics, so the slice may be reused for the next row.
+	pooled := labelValuesPool.Get().(*[]string)
+	defer putLabelValues(pooled)
+	if cap(*pooled) < len(mf.labels) {
+		*pooled = make([]string, len(mf.labels))
+	}
+	*pooled = (*pooled)[:len(mf.labels)]
+	labelValues := *pooled
 	for i, label := range mf.config.KeyLabels {
 		labelValues[i] = row[label].(string)
 	}
+	if len(mf.templateLabels) > 0 {
+		var buf bytes.Buffer
+		templates := mf.config.ParsedLabelTemplates()
+		for i, label := range mf.templateLabels {
+			buf.Reset()
+			if err := templates[label].Execute(&buf, row); err != nil {
+				ch <- NewInvalidMetric(errors.Wrapf(mf.logContext, err, "executing template for label %q failed", label))
+				return
+			}
+			labelValues[len(mf.config.KeyLabels)+i] = buf.String()
+		}
+	}
+	if mf.config.HasLabelValueFilters() {
+		// The value label (if any) is filtered below, once per value.
+		for i, label := range mf.labels[:len(mf.config.KeyLabels)+len(mf.templateLabels)] {
+			if !mf.config.AllowsLabelValue(label, labelValues[i]) {
+				return
+			}
+		}
+	}
+	if mf.config.IsHistogram() {
+		mf.collectHistogram(row, labelValues, ch)
+		return
+	}
+	if mf.config.IsExposition() {
+		mf.collectExposition(row, labelValues, ch)
+		return
+	}
+	var now float64
+	if mf.config.ValueFormat == config.ValueFormatAge {
+		now = float64(time.Now().UnixNano()) / 1e9
+	}
 	for _, v := range mf.config.Values {
 		if mf.config.ValueLabel != "" {
 			labelValues[len(labelValues)-1] = v
+			if !mf.config.AllowsLabelValue(mf.config.ValueLabel, v) {
+				continue
+			}
 		}
 		value := row[v].(float64)
-		ch <- NewMetric(&mf, value, labelValues...)
+		if mf.config.ValueFormat == config.ValueFormatAge {
+			// Timestamps are read as seconds since the epoch, see valueScanner.
+			value = now - value
+		}
+		value = mf.config.ScaleValue(value)
+		if mf.resets != nil {
+			value = mf.resets.adjust(mf.logContext, labelValues, value)
+		}
+		ch <- NewMetric(mf, value, labelValues...)
 	}
 }
 
+// collectHistogram assembles the bucket columns of row into a single histogram sample. Its count is that of the +Inf
+// bucket or, if there is none, that of the largest bucket. Its sum is NaN unless histogram_sum is configured, and the
+// only value scale and round apply to: bucket upper bounds are configured in the final unit.
+func (mf *MetricFamily) collectHistogram(row map[string]interface{}, labelValues []string, ch chan<- Metric) {
+	var (
+		count   uint64
+		sum     = math.NaN()
+		buckets = make(map[float64]uint64, len(mf.config.Buckets()))
+	)
+	for _, b := range mf.config.Buckets() {
+		count = uint64(row[b.Column].(float64))
+		if !math.IsInf(b.UpperBound, +1) {
+			buckets[b.UpperBound] = count
+		}
+	}
+	if mf.config.HistogramSum != "" {
+		sum = mf.config.ScaleValue(row[mf.config.HistogramSum].(float64))
+	}
+	ch <- NewHistogramMetric(mf, count, sum, buckets, labelValues...)
+}
+
 // Name implements MetricDesc.
 func (mf MetricFamily) Name() string {
-	return mf.config.Name
+	return mf.name
 }
 
 // Help implements MetricDesc.
@@ -114,6 +270,11 @@ func (mf MetricFamily) LogContext() string {
 	return mf.logContext
 }
 
+// labelLayout implements layoutDesc.
+func (mf MetricFamily) labelLayout() *labelLayout {
+	return mf.layout
+}
+
 //
 // automaticMetricDesc
 //
@@ -126,6 +287,7 @@ type automaticMetricDesc struct {
 	labels      []string
 	constLabels []*dto.LabelPair
 	logContext  string
+	layout      *labelLayout
 }
 
 // NewAutomaticMetricDesc creates a MetricDesc for automatically generated metrics.
@@ -138,6 +300,7 @@ func NewAutomaticMetricDesc(
 		constLabels: constLabels,
 		labels:      labels,
 		logContext:  logContext,
+		layout:      newLabelLayout(labels, constLabels),
 	}
 }
 
@@ -171,6 +334,11 @@ func (a automaticMetricDesc) LogContext() string {
 	return a.logContext
 }
 
+// labelLayout implements layoutDesc.
+func (a automaticMetricDesc) labelLayout() *labelLayout {
+	return a.layout
+}
+
 //
 // Metric
 //
@@ -210,18 +378,151 @@ func (m *constMetric) Desc() MetricDesc {
 // Write implements Metric.
 func (m *constMetric) Write(out *dto.Metric) errors.WithContext {
 	out.Label = m.labelPairs
+	// The value never changes, so it may be referenced rather than copied.
 	switch t := m.desc.ValueType(); t {
 	case prometheus.CounterValue:
-		out.Counter = &dto.Counter{Value: proto.Float64(m.val)}
+		out.Counter = &dto.Counter{Value: &m.val}
 	case prometheus.GaugeValue:
-		out.Gauge = &dto.Gauge{Value: proto.Float64(m.val)}
+		out.Gauge = &dto.Gauge{Value: &m.val}
 	default:
 		return errors.Errorf(m.desc.LogContext(), "encountered unknown type %v", t)
 	}
 	return nil
 }
 
+// NewHistogramMetric returns a histogram metric with fixed count, sum and cumulative bucket counts (keyed by upper
+// bound, +Inf excluded) that cannot be changed.
+//
+// NewHistogramMetric panics if the length of labelValues is not consistent with desc.labels().
+func NewHistogramMetric(
+	desc MetricDesc, count uint64, sum float64, buckets map[float64]uint64, labelValues ...string) Metric {
+	if len(desc.Labels()) != len(labelValues) {
+		panic(fmt.Sprintf("[%s] expected %d labels, got %d", desc.LogContext(), len(desc.Labels()), len(labelValues)))
+	}
+	return &histogramMetric{
+		desc:       desc,
+		count:      count,
+		sum:        sum,
+		buckets:    buckets,
+		labelPairs: makeLabelPairs(desc, labelValues),
+	}
+}
+
+// histogramMetric is a histogram metric with fixed values that cannot be changed.
+type histogramMetric struct {
+	desc       MetricDesc
+	count      uint64
+	sum        float64
+	buckets    map[float64]uint64
+	labelPairs []*dto.LabelPair
+}
+
+// Desc implements Metric.
+func (m *histogramMetric) Desc() MetricDesc {
+	return m.desc
+}
+
+// Write implements Metric.
+func (m *histogramMetric) Write(out *dto.Metric) errors.WithContext {
+	out.Label = m.labelPairs
+	h := &dto.Histogram{
+		SampleCount: proto.Uint64(m.count),
+		SampleSum:   proto.Float64(m.sum),
+		Bucket:      make([]*dto.Bucket, 0, len(m.buckets)),
+	}
+	for upperBound, count := range m.buckets {
+		h.Bucket = append(h.Bucket, &dto.Bucket{
+			CumulativeCount: proto.Uint64(count),
+			UpperBound:      proto.Float64(upperBound),
+		})
+	}
+	sort.Slice(h.Bucket, func(i, j int) bool { return h.Bucket[i].GetUpperBound() < h.Bucket[j].GetUpperBound() })
+	out.Histogram = h
+	return nil
+}
+
+// Scratch label value slices, see MetricFamily.Collect.
+var labelValuesPool = sync.Pool{New: func() interface{} { return new([]string) }}
+
+// putLabelValues clears a label value slice (so it doesn't keep the values alive) and returns it to the pool.
+func putLabelValues(labelValues *[]string) {
+	for i := range *labelValues {
+		(*labelValues)[i] = ""
+	}
+	labelValuesPool.Put(labelValues)
+}
+
+// layoutDesc is a MetricDesc with a precomputed label layout.
+type layoutDesc interface {
+	labelLayout() *labelLayout
+}
+
+// labelLayout is the sorted arrangement of a MetricDesc's const and variable labels, computed once so that the label
+// pairs of its metrics are assembled without sorting and with a single allocation for all variable labels.
+type labelLayout struct {
+	slots []labelSlot
+	vars  int // number of variable labels
+}
+
+// labelSlot is the label at one position of a labelLayout: either a const label pair or a variable label.
+type labelSlot struct {
+	constPair *dto.LabelPair // nil for variable labels
+	name      *string        // name of the variable label, shared by all metrics
+	index     int            // index of the variable label's value in labelValues
+}
+
+// labelPairValue is a label pair along with its value, allocated together.
+type labelPairValue struct {
+	pair  dto.LabelPair
+	value string
+}
+
+// newLabelLayout returns the layout of the provided variable labels and (sorted) const labels.
+func newLabelLayout(labels []string, constLabels []*dto.LabelPair) *labelLayout {
+	l := &labelLayout{slots: make([]labelSlot, 0, len(labels)+len(constLabels)), vars: len(labels)}
+	for _, lp := range constLabels {
+		l.slots = append(l.slots, labelSlot{constPair: lp})
+	}
+	for i, label := range labels {
+		l.slots = append(l.slots, labelSlot{name: proto.String(label), index: i})
+	}
+	sort.SliceStable(l.slots, func(i, j int) bool { return l.slots[i].labelName() < l.slots[j].labelName() })
+	return l
+}
+
+// labelName returns the name of the slot's label.
+func (s *labelSlot) labelName() string {
+	if s.constPair != nil {
+		return s.constPair.GetName()
+	}
+	return *s.name
+}
+
+// labelPairs returns the sorted label pairs for the provided variable label values.
+func (l *labelLayout) labelPairs(labelValues []string) []*dto.LabelPair {
+	labelPairs := make([]*dto.LabelPair, len(l.slots))
+	vars := make([]labelPairValue, l.vars)
+	for i := range l.slots {
+		s := &l.slots[i]
+		if s.constPair != nil {
+			labelPairs[i] = s.constPair
+			continue
+		}
+		v := &vars[s.index]
+		v.value = labelValues[s.index]
+		v.pair.Name, v.pair.Value = s.name, &v.value
+		labelPairs[i] = &v.pair
+	}
+	return labelPairs
+}
+
 func makeLabelPairs(desc MetricDesc, labelValues []string) []*dto.LabelPair {
+	if ld, ok := desc.(layoutDesc); ok && len(desc.Labels()) > 0 {
+		if l := ld.labelLayout(); l != nil {
+			return l.labelPairs(labelValues)
+		}
+	}
+
 	labels := desc.Labels()
 	constLabels := desc.ConstLabels()
 
@@ -263,13 +564,54 @@ func (s labelPairSorter) Less(i, j int) bool {
 	return s[i].GetName() < s[j].GetName()
 }
 
+// zeroMetric returns a copy of m with a zero value (zero count, sum and bucket counts for histograms), or nil if m is
+// neither a const nor a histogram metric.
+func zeroMetric(m Metric) Metric {
+	switch cm := m.(type) {
+	case *constMetric:
+		return &constMetric{
+			desc:       cm.desc,
+			labelPairs: cm.labelPairs,
+		}
+	case *histogramMetric:
+		buckets := make(map[float64]uint64, len(cm.buckets))
+		for upperBound := range cm.buckets {
+			buckets[upperBound] = 0
+		}
+		return &histogramMetric{
+			desc:       cm.desc,
+			buckets:    buckets,
+			labelPairs: cm.labelPairs,
+		}
+	}
+	return nil
+}
+
 type invalidMetric struct {
-	err errors.WithContext
+	err   errors.WithContext
+	fatal bool
 }
 
 // NewInvalidMetric returns a metric whose Write method always returns the provided error.
 func NewInvalidMetric(err errors.WithContext) Metric {
-	return invalidMetric{err}
+	return invalidMetric{err: err}
+}
+
+// NewFatalMetric returns an invalid metric (see NewInvalidMetric) which additionally fails the whole target scrape.
+func NewFatalMetric(err errors.WithContext) Metric {
+	return invalidMetric{err: err, fatal: true}
+}
+
+// isInvalid returns true if m is an invalid metric, as created by NewInvalidMetric or NewFatalMetric.
+func isInvalid(m Metric) bool {
+	_, ok := m.(invalidMetric)
+	return ok
+}
+
+// isFatal returns true if m was created by NewFatalMetric.
+func isFatal(m Metric) bool {
+	im, ok := m.(invalidMetric)
+	return ok && im.fatal
 }
 
 func (m invalidMetric) Desc() MetricDesc { return nil }
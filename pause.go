@@ -0,0 +1,116 @@
+package sql_exporter
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TargetStatus is the runtime state of a target, as managed via the admin API.
+type TargetStatus struct {
+	Job      string
+	Instance string
+	// Dynamic is true if the target was added at runtime rather than defined in the configuration file.
+	Dynamic bool
+	Paused  bool
+	// PausedUntil is the time the target is automatically resumed at. Zero if paused indefinitely.
+	PausedUntil time.Time
+}
+
+// CollectorStatus is the runtime state of a collector, as managed via the admin API.
+type CollectorStatus struct {
+	Name   string
+	Paused bool
+	// PausedUntil is the time the collector is automatically resumed at. Zero if paused indefinitely.
+	PausedUntil time.Time
+}
+
+// pausedAt returns true if a pause (paused indefinitely if until is zero) is in effect at time now.
+func pausedAt(until, now time.Time) bool {
+	return until.IsZero() || now.Before(until)
+}
+
+// pauseSet keeps track of paused collectors, by name. Pausing a collector pauses it on all targets.
+type pauseSet struct {
+	mtx sync.RWMutex
+	// Paused collectors, mapped to the time they are automatically resumed at (zero if paused indefinitely).
+	paused map[string]time.Time
+}
+
+// collectorPauses is the one and only set of paused collectors.
+var collectorPauses = &pauseSet{paused: make(map[string]time.Time)}
+
+// pause pauses the named collector until the given time, or indefinitely if until is zero.
+func (ps *pauseSet) pause(name string, until time.Time) {
+	ps.mtx.Lock()
+	defer ps.mtx.Unlock()
+	ps.paused[name] = until
+}
+
+// resume resumes the named collector.
+func (ps *pauseSet) resume(name string) {
+	ps.mtx.Lock()
+	defer ps.mtx.Unlock()
+	delete(ps.paused, name)
+}
+
+// isPaused returns true if the named collector is paused at time now.
+func (ps *pauseSet) isPaused(name string, now time.Time) bool {
+	ps.mtx.RLock()
+	defer ps.mtx.RUnlock()
+	until, found := ps.paused[name]
+	return found && pausedAt(until, now)
+}
+
+// status returns the state of the named collectors, in the order provided.
+func (ps *pauseSet) status(names []string, now time.Time) []CollectorStatus {
+	ps.mtx.RLock()
+	defer ps.mtx.RUnlock()
+
+	status := make([]CollectorStatus, 0, len(names))
+	for _, name := range names {
+		until, found := ps.paused[name]
+		paused := found && pausedAt(until, now)
+		if !paused {
+			until = time.Time{}
+		}
+		status = append(status, CollectorStatus{Name: name, Paused: paused, PausedUntil: until})
+	}
+	return status
+}
+
+var (
+	targetPausedDesc = prometheus.NewDesc(
+		"sql_exporter_target_paused",
+		"1 if scraping the target is paused via the admin API, 0 otherwise.",
+		[]string{"job", "instance"}, nil)
+	collectorPausedDesc = prometheus.NewDesc(
+		"sql_exporter_collector_paused",
+		"1 if the collector is paused via the admin API, 0 otherwise.",
+		[]string{"collector"}, nil)
+)
+
+// pauseMetrics is a prometheus.Collector exporting the paused state of all targets and collectors.
+type pauseMetrics struct {
+	targets    *targetSet
+	collectors []string
+}
+
+// Describe implements prometheus.Collector.
+func (pm *pauseMetrics) Describe(ch chan<- *prometheus.Desc) {
+	ch <- targetPausedDesc
+	ch <- collectorPausedDesc
+}
+
+// Collect implements prometheus.Collector.
+func (pm *pauseMetrics) Collect(ch chan<- prometheus.Metric) {
+	now := time.Now()
+	for _, ts := range pm.targets.status(now) {
+		ch <- prometheus.MustNewConstMetric(
+			targetPausedDesc, prometheus.GaugeValue, boolToFloat64(ts.Paused), ts.Job, ts.Instance)
+	}
+	for _, cs := range collectorPauses.status(pm.collectors, now) {
+		ch <- prometheus.MustNewConstMetric(collectorPausedDesc, prometheus.GaugeValue, boolToFloat64(cs.Paused), cs.Name)
+	}
+}
@@ -0,0 +1,93 @@
+package sql_exporter
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestPingTLS pings a fake PostgreSQL server, accepting the SSLRequest (or not) and completing the TLS handshake, but
+// not the startup that follows.
+func TestPingTLS(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "db.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+
+	tests := []struct {
+		sslEnabled bool
+		params     string
+		want       []string // steps, the last one failed
+		detail     string   // of the tls step if it succeeded, else its error
+	}{
+		{true, "", []string{"parse", "dns", "dial", "tls", "auth"}, "not verified"},
+		{true, "?sslmode=verify-full", []string{"parse", "dns", "dial", "tls"}, "x509"},
+		{false, "", []string{"parse", "dns", "dial", "tls"}, "SSL is not enabled"},
+		{true, "?sslmode=disable", []string{"parse", "dns", "dial", "auth"}, ""},
+	}
+	for _, test := range tests {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func(sslEnabled bool) {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				request := make([]byte, 8)
+				if _, err := io.ReadFull(conn, request); err == nil && request[7] == 0x2f {
+					if !sslEnabled {
+						conn.Write([]byte("N"))
+					} else if _, err := conn.Write([]byte("S")); err == nil {
+						tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{cert}}).Handshake()
+					}
+				}
+				conn.Close()
+			}
+		}(test.sslEnabled)
+
+		dsn := "postgres://user:passw@" + l.Addr().String() + "/db" + test.params
+		r := PingDataSource(context.Background(), dsn, 5*time.Second)
+		l.Close()
+
+		var steps []string
+		detail := ""
+		for _, s := range r.Steps {
+			steps = append(steps, s.Name)
+			if s.Name == "tls" {
+				if detail = s.Detail; s.Err != nil {
+					detail = s.Err.Error()
+				}
+			}
+		}
+		if strings.Join(steps, ",") != strings.Join(test.want, ",") || r.Err() == nil {
+			t.Errorf("%s: expected steps %v, the last one failed, got %v (error %v)", dsn, test.want, steps, r.Err())
+		}
+		if !strings.Contains(detail, test.detail) {
+			t.Errorf("%s: expected tls step %q, got %q", dsn, test.detail, detail)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package sql_exporter
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+
+	"github.com/free/sql_exporter/config"
+)
+
+// pingTLS describes how a driver secures its connections to the server, as configured by a data source name, for
+// PingDataSource to test the TLS handshake on its own.
+type pingTLS struct {
+	// negotiate requests an upgrade of a plain connection to TLS, the way the driver's protocol does (e.g. PostgreSQL's
+	// SSLRequest), returning false if the server declined and the driver continues without TLS. Nil if the connection
+	// uses TLS from the first byte.
+	negotiate func(conn net.Conn) (bool, error)
+	// Whether the driver verifies the server's certificate, respectively the server's host name against it.
+	verify, verifyHost bool
+	// File of CA certificates to verify the server's certificate against, the system's if empty.
+	rootCAFile string
+}
+
+// pingTLSFor returns the TLS settings of dsn, nil if the driver doesn't use TLS or establishes it as part of its own
+// protocol (SQL Server), so it can't be tested on its own.
+func pingTLSFor(dsn *config.DataSourceName) *pingTLS {
+	switch dsn.Driver {
+	case "postgres":
+		switch mode := dsn.Param("sslmode"); mode {
+		case "disable":
+			return nil
+		case "verify-ca", "verify-full":
+			return &pingTLS{negotiate: postgresSSLRequest, verify: true, verifyHost: mode == "verify-full",
+				rootCAFile: dsn.Param("sslrootcert")}
+		default:
+			// Like libpq, sslmode=require (the default) only verifies the certificate against a provided CA.
+			rootCAFile := dsn.Param("sslrootcert")
+			return &pingTLS{negotiate: postgresSSLRequest, verify: rootCAFile != "", rootCAFile: rootCAFile}
+		}
+	case "mysql":
+		switch mode := dsn.Param("tls"); mode {
+		case "", "false":
+			return nil
+		case "true":
+			return &pingTLS{negotiate: mysqlSSLRequest(false), verify: true, verifyHost: true}
+		default:
+			// skip-verify, preferred or the name of a TLS config registered with the driver, whose settings we don't know.
+			return &pingTLS{negotiate: mysqlSSLRequest(mode == "preferred")}
+		}
+	case "clickhouse":
+		if secure, _ := strconv.ParseBool(dsn.Param("secure")); secure {
+			skipVerify, _ := strconv.ParseBool(dsn.Param("skip_verify"))
+			return &pingTLS{verify: !skipVerify, verifyHost: !skipVerify}
+		}
+	case "prometheus":
+		if enabled, _ := strconv.ParseBool(dsn.Param("tls")); enabled {
+			return &pingTLS{verify: true, verifyHost: true}
+		}
+	}
+	return nil
+}
+
+// handshake performs the TLS handshake over conn, a plain connection to host, and verifies the server's certificate as
+// the driver would. It returns a description of the resulting connection.
+func (p *pingTLS) handshake(ctx context.Context, conn net.Conn, host string) (string, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if p.negotiate != nil {
+		ok, err := p.negotiate(conn)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return "not supported by the server, the driver continues without TLS", nil
+		}
+	}
+
+	// Verified separately, as the driver would.
+	cfg := &tls.Config{InsecureSkipVerify: true}
+	if net.ParseIP(host) == nil {
+		cfg.ServerName = host
+	}
+	tc := tls.Client(conn, cfg)
+	if err := tc.Handshake(); err != nil {
+		return "", fmt.Errorf("tls handshake failed: %s", err)
+	}
+	state := tc.ConnectionState()
+	cert := state.PeerCertificates[0]
+	detail := fmt.Sprintf("%s, %s, certificate for %q issued by %q", tlsVersions[state.Version],
+		tls.CipherSuiteName(state.CipherSuite), cert.Subject.CommonName, cert.Issuer.CommonName)
+	if !p.verify {
+		return detail + ", not verified (as configured)", nil
+	}
+
+	opts := x509.VerifyOptions{Intermediates: x509.NewCertPool()}
+	for _, c := range state.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	if p.verifyHost {
+		opts.DNSName = host
+	}
+	if p.rootCAFile != "" {
+		buf, err := os.ReadFile(p.rootCAFile)
+		if err != nil {
+			return "", err
+		}
+		opts.Roots = x509.NewCertPool()
+		if !opts.Roots.AppendCertsFromPEM(buf) {
+			return "", fmt.Errorf("no CA certificates found in %s", p.rootCAFile)
+		}
+	}
+	if _, err := cert.Verify(opts); err != nil {
+		return "", err
+	}
+	return detail + ", verified", nil
+}
+
+// tlsVersions maps TLS versions to their names.
+var tlsVersions = map[uint16]string{
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+// postgresSSLRequest asks a PostgreSQL server to upgrade the connection to TLS, failing if it declines (as the driver
+// does).
+func postgresSSLRequest(conn net.Conn) (bool, error) {
+	// Message length and the SSLRequest code, 1234 << 16 | 5679.
+	if _, err := conn.Write([]byte{0, 0, 0, 8, 0x04, 0xd2, 0x16, 0x2f}); err != nil {
+		return false, err
+	}
+	response := make([]byte, 1)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return false, err
+	}
+	if response[0] != 'S' {
+		return false, errors.New("pq: SSL is not enabled on the server")
+	}
+	return true, nil
+}
+
+// MySQL client and server capability flags.
+const (
+	mysqlClientLongPassword     = 0x1
+	mysqlClientProtocol41       = 0x200
+	mysqlClientSSL              = 0x800
+	mysqlClientSecureConnection = 0x8000
+)
+
+// mysqlSSLRequest returns a function reading a MySQL server's initial handshake and asking it to upgrade the connection
+// to TLS. Servers not supporting TLS are an error, unless optional is true.
+func mysqlSSLRequest(optional bool) func(conn net.Conn) (bool, error) {
+	return func(conn net.Conn) (bool, error) {
+		// Packets are made of the payload length (3 bytes), a sequence number and the payload.
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return false, err
+		}
+		payload := make([]byte, int(header[0])|int(header[1])<<8|int(header[2])<<16)
+		if _, err := io.ReadFull(conn, payload); err != nil {
+			return false, err
+		}
+		if len(payload) > 3 && payload[0] == 0xff {
+			// Error packet: marker, error code (2 bytes), message.
+			return false, fmt.Errorf("server error %d: %s", binary.LittleEndian.Uint16(payload[1:]), payload[3:])
+		}
+		// Protocol version, server version (NUL terminated), connection ID (4 bytes), first part of the auth plugin data
+		// (8 bytes), filler and the lower 2 bytes of the capability flags.
+		end := bytes.IndexByte(payload, 0)
+		if end < 0 || len(payload) < end+16 {
+			return false, errors.New("invalid initial handshake packet")
+		}
+		if binary.LittleEndian.Uint16(payload[end+14:])&mysqlClientSSL == 0 {
+			if optional {
+				return false, nil
+			}
+			return false, errors.New("TLS requested but server does not allow it")
+		}
+
+		// SSLRequest packet, sequence number 1: client capability flags, maximum packet size, character set
+		// (utf8_general_ci) and 23 reserved bytes.
+		request := make([]byte, 4+32)
+		request[0], request[3] = 32, 1
+		binary.LittleEndian.PutUint32(request[4:], mysqlClientLongPassword|mysqlClientProtocol41|mysqlClientSSL|
+			mysqlClientSecureConnection)
+		binary.LittleEndian.PutUint32(request[8:], 1<<24-1)
+		request[12] = 33
+		if _, err := conn.Write(request); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+}
@@ -0,0 +1,206 @@
+package sql_exporter
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/free/sql_exporter/config"
+	"github.com/free/sql_exporter/errors"
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// previewCollectorName is the name collectors run via the admin API preview are given, regardless of their own.
+	previewCollectorName = "preview"
+	// Timeout of preview runs, unless shorter one is requested.
+	previewDefaultTimeout = 10 * time.Second
+	// Upper bound on the timeout of preview runs.
+	previewMaxTimeout = time.Minute
+)
+
+// CollectorPreview is the outcome of running a collector definition (not part of the configuration) once on a target:
+// the samples it produced, in text exposition format, along with its timing breakdown and errors.
+type CollectorPreview struct {
+	*CollectorTrace
+	Samples string `json:"samples"`
+	// Execution plans of the collector's queries, by query name. Only set if requested.
+	Plans map[string]string `json:"plans,omitempty"`
+}
+
+// parsePreviewCollector parses a collector definition to preview: either a collector (the name is optional) or a
+// single metric. Collectors extending others are not supported.
+func parsePreviewCollector(buf []byte) (*config.CollectorConfig, error) {
+	var fields map[string]interface{}
+	if err := yaml.Unmarshal(buf, &fields); err != nil {
+		return nil, err
+	}
+	if _, ok := fields["metric_name"]; ok {
+		// A single metric, wrap it into a collector.
+		var err error
+		if buf, err = yaml.Marshal(map[string]interface{}{"metrics": []interface{}{fields}}); err != nil {
+			return nil, err
+		}
+	}
+
+	cc := &config.CollectorConfig{Name: previewCollectorName}
+	if err := yaml.Unmarshal(buf, cc); err != nil {
+		return nil, err
+	}
+	if cc.Extends != "" {
+		return nil, fmt.Errorf("extends not supported in preview, collector %q", cc.Name)
+	}
+	return cc, nil
+}
+
+// previewCollector runs the collector defined by cc once on t, with the given timeout, and returns the resulting
+// samples. Metric names are prefixed with metricPrefix. If rowLimit is positive, queries are limited to that many result
+// rows. If explain is true, the execution plans of the collector's queries are also captured.
+//
+// The collector is never cached nor registered with the target: any caching or error handling options are ignored, it
+// runs without lasting effects (see withDryRun) and the process metrics it creates are removed once it completes.
+func previewCollector(
+	ctx context.Context, t *target, cc *config.CollectorConfig, metricPrefix string, timeout time.Duration,
+	rowLimit int, explain bool) (*CollectorPreview, error) {
+	for _, qc := range cc.Queries {
+		if qc.WatermarkColumn != "" {
+			return nil, fmt.Errorf("watermark_column not supported in preview, query %q", qc.Name)
+		}
+	}
+	for _, mc := range cc.Metrics {
+		if qc := mc.Query(); qc != nil && qc.WatermarkColumn != "" {
+			return nil, fmt.Errorf("watermark_column not supported in preview, metric %q", mc.Name)
+		}
+	}
+	cc.Name = previewCollectorName
+	cc.MinInterval, cc.SampleEvery, cc.OnError, cc.MaxStaleness = 0, 0, "", 0
+
+	constLabels := make([]*dto.LabelPair, 0, len(t.constLabels))
+	for n, v := range t.constLabels {
+		constLabels = append(constLabels, &dto.LabelPair{Name: proto.String(n), Value: proto.String(v)})
+	}
+	sort.Sort(labelPairSorter(constLabels))
+
+	driver := DriverName(t.dataSourceName())
+	coll, err := NewCollector(t.logContext, driver, t.pooler, t.location, cc, constLabels, metricPrefix, t.globalConfig)
+	if err != nil {
+		return nil, err
+	}
+	c := coll.(*collector)
+	defer c.release(constLabels)
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	trace := &CollectorTrace{Job: t.constLabels["job"], Target: t.name, Collector: cc.Name, Queries: []*QueryTrace{}}
+	preview := &CollectorPreview{CollectorTrace: trace}
+	start := time.Now()
+	// Identify all statements executed by the preview in the audit log (if enabled), including the ping.
+	ctx = withAuditScope(ctx, auditScope{scrapeID: "preview-" + newScrapeID()})
+	var conn *sql.DB
+	if !*demoMode {
+		var err errors.WithContext
+		if conn, err = t.connect(ctx); err != nil {
+			return nil, err
+		}
+		defer t.releaseConn(conn)
+	}
+
+	ch := make(chan Metric, capMetricChan)
+	go func() {
+		ctx := t.metadataContext(ctx, conn, ch)
+		if rowLimit > 0 {
+			ctx = withRowLimit(ctx, rowLimit)
+		}
+		c.Collect(withTrace(withDryRun(ctx), trace), conn, ch)
+		close(ch)
+	}()
+	families := make(map[string]*dto.MetricFamily)
+	for metric := range ch {
+		if isInvalid(metric) {
+			trace.Errors = append(trace.Errors, metric.(invalidMetric).err.Error())
+			continue
+		}
+		dtoMetric := &dto.Metric{}
+		if err := metric.Write(dtoMetric); err != nil {
+			trace.Errors = append(trace.Errors, err.Error())
+			continue
+		}
+		metricType, ok := dtoMetricType(dtoMetric)
+		if !ok {
+			trace.Errors = append(trace.Errors, fmt.Sprintf("don't know how to handle metric %v", dtoMetric))
+			continue
+		}
+		desc := metric.Desc()
+		mf, found := families[desc.Name()]
+		if !found {
+			mf = &dto.MetricFamily{Name: proto.String(desc.Name()), Help: proto.String(desc.Help()), Type: metricType.Enum()}
+			families[desc.Name()] = mf
+		} else if mf.GetType() != metricType {
+			trace.Errors = append(trace.Errors, errors.Errorf(desc.LogContext(), "metric %q exported as both %s and %s",
+				desc.Name(), mf.GetType(), metricType).Error())
+			continue
+		}
+		mf.Metric = append(mf.Metric, dtoMetric)
+		trace.Metrics++
+	}
+	trace.Seconds = time.Since(start).Seconds()
+
+	mfs := make([]*dto.MetricFamily, 0, len(families))
+	for _, mf := range families {
+		mfs = append(mfs, mf)
+	}
+	SortMetricFamilies(mfs)
+	var buf bytes.Buffer
+	for _, mf := range mfs {
+		if _, err := expfmt.MetricFamilyToText(&buf, mf); err != nil {
+			trace.Errors = append(trace.Errors, err.Error())
+		}
+	}
+	preview.Samples = buf.String()
+
+	if explain && !*demoMode {
+		preview.Plans = make(map[string]string, len(c.queries))
+		for _, q := range c.queries {
+			var pageKey string
+			if pc := q.config.Pagination; pc != nil {
+				pageKey = pc.InitialKey
+			}
+			query, args := q.bind(start, pageKey)
+			plan, err := explainQuery(ctx, conn, driver, query, args)
+			if err != nil {
+				plan = "error: " + err.Error()
+			}
+			preview.Plans[q.config.Name] = plan
+		}
+	}
+	return preview, nil
+}
+
+// release closes the prepared statements of the collector's queries and deletes the process metrics created for it.
+// Only meant for short lived collectors, such as previews, and for the collectors of removed targets.
+func (c *collector) release(constLabels []*dto.LabelPair) {
+	job, instance := jobAndInstance(constLabels)
+	collectorLastSuccess.DeleteLabelValues(job, instance, c.config.Name)
+	collectorCachedScrapes.DeleteLabelValues(job, instance, c.config.Name)
+	for _, q := range c.queries {
+		q.stmtMtx.Lock()
+		if q.stmt != nil {
+			q.stmt.Close()
+			q.stmt = nil
+		}
+		q.stmtMtx.Unlock()
+		queryQuarantined.DeleteLabelValues(job, instance, c.config.Name, q.config.Name)
+		deleteQueryInfo(job, instance, c.config.Name, q.config.Name)
+		querySchemaChanged.DeleteLabelValues(job, instance, c.config.Name, q.config.Name)
+		queryTruncated.DeleteLabelValues(job, instance, c.config.Name, q.config.Name, truncatedMaxRows)
+		queryTruncated.DeleteLabelValues(job, instance, c.config.Name, q.config.Name, truncatedDeadline)
+		queryResultChecksum.DeleteLabelValues(job, instance, c.config.Name, q.config.Name)
+		rowProcessorDroppedRows.DeleteLabelValues(job, instance, c.config.Name, q.config.Name)
+	}
+}
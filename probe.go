@@ -0,0 +1,58 @@
+package sql_exporter
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/free/sql_exporter/config"
+	"github.com/free/sql_exporter/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var startupProbeSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "sql_exporter_startup_probe_success",
+	Help: "1 if the target was reachable when last probed, on startup or after its data source names changed, else 0.",
+}, []string{"job", "instance"})
+
+func init() {
+	prometheus.MustRegister(startupProbeSuccess)
+}
+
+// probeTargets opens and pings all targets, at most pc.Concurrency at a time, logging any failures and a one-line
+// summary (prefixed with what, e.g. "Startup probe") once done. Results are exported as
+// sql_exporter_startup_probe_success.
+func probeTargets(targets []Target, pc *config.StartupProbeConfig, what string) {
+	var (
+		wg     sync.WaitGroup
+		mtx    sync.Mutex
+		failed int
+		sem    = make(chan struct{}, pc.Concurrency)
+		start  = time.Now()
+	)
+	wg.Add(len(targets))
+	for _, t := range targets {
+		sem <- struct{}{}
+		go func(t Target) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Duration(pc.Timeout))
+			defer cancel()
+			err := t.Ping(ctx)
+			if err != nil {
+				log.Errorf("%s failed: %s", what, err)
+				mtx.Lock()
+				failed++
+				mtx.Unlock()
+			}
+			labels := t.Labels()
+			startupProbeSuccess.WithLabelValues(labels["job"], labels["instance"]).Set(boolToFloat64(err == nil))
+		}(t)
+	}
+	wg.Wait()
+
+	log.Infof("%s done in %s: %d of %d targets reachable", what, time.Since(start), len(targets)-failed, len(targets))
+}
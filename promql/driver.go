@@ -0,0 +1,297 @@
+// Package promql implements a database/sql driver running PromQL queries against the HTTP API of Prometheus (or any
+// compatible server, e.g. Thanos or Cortex), so that Prometheus can be used as a "virtual" SQL Exporter target: query
+// results are exposed as rows, with one column per label and a `value` column.
+//
+// Data source names have the form
+//
+//	prometheus://[username:password@]host:port[/path][?tls=true]
+//
+// Only instant queries returning vectors or scalars are supported, evaluated at the current time. Bind parameters and
+// transactions are not supported.
+package promql
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DriverName is the name the driver is registered under, also the URI scheme of its data source names.
+const DriverName = "prometheus"
+
+// ValueColumn is the name of the column holding sample values.
+const ValueColumn = "value"
+
+func init() {
+	sql.Register(DriverName, &promDriver{})
+}
+
+// promDriver implements driver.Driver.
+type promDriver struct{}
+
+// Open implements driver.Driver.
+func (d *promDriver) Open(dsn string) (driver.Conn, error) {
+	queryURL, err := parseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &conn{queryURL: queryURL, client: http.DefaultClient}, nil
+}
+
+// parseDSN returns the query API URL of the provided data source name.
+func parseDSN(dsn string) (string, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != DriverName {
+		return "", fmt.Errorf("invalid data source name %q, expecting %s://host:port", u.Redacted(), DriverName)
+	}
+	params := u.Query()
+	u.Scheme = "http"
+	if tls, _ := strconv.ParseBool(params.Get("tls")); tls {
+		u.Scheme = "https"
+	}
+	u.RawQuery = ""
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v1/query"
+	return u.String(), nil
+}
+
+// DialFunc connects to an address on the named network, see net.Dialer.DialContext.
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+// connector implements driver.Connector.
+type connector struct {
+	queryURL string
+	client   *http.Client
+}
+
+// NewConnector returns a driver.Connector (for use with sql.OpenDB) for the provided data source name, establishing
+// network connections to the server with dial.
+func NewConnector(dsn string, dial DialFunc) (driver.Connector, error) {
+	queryURL, err := parseDSN(dsn)
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dial
+	return &connector{queryURL: queryURL, client: &http.Client{Transport: transport}}, nil
+}
+
+// Connect implements driver.Connector.
+func (c *connector) Connect(context.Context) (driver.Conn, error) {
+	return &conn{queryURL: c.queryURL, client: c.client}, nil
+}
+
+// Driver implements driver.Connector.
+func (c *connector) Driver() driver.Driver {
+	return &promDriver{}
+}
+
+// conn is a (stateless) connection to a Prometheus server. It implements driver.Conn, driver.QueryerContext and
+// driver.Pinger.
+type conn struct {
+	queryURL string
+	client   *http.Client
+}
+
+// Prepare implements driver.Conn.
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+	return &stmt{conn: c, query: query}, nil
+}
+
+// Close implements driver.Conn.
+func (c *conn) Close() error {
+	return nil
+}
+
+// Begin implements driver.Conn.
+func (c *conn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions not supported by the prometheus driver")
+}
+
+// QueryContext implements driver.QueryerContext.
+func (c *conn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if len(args) > 0 {
+		return nil, errors.New("bind parameters not supported by the prometheus driver")
+	}
+	return c.query(ctx, query)
+}
+
+// Ping implements driver.Pinger.
+func (c *conn) Ping(ctx context.Context) error {
+	rows, err := c.query(ctx, "1")
+	if err != nil {
+		return err
+	}
+	return rows.Close()
+}
+
+// apiResponse is the response of the Prometheus instant query API.
+type apiResponse struct {
+	Status    string `json:"status"`
+	ErrorType string `json:"errorType"`
+	Error     string `json:"error"`
+	Data      struct {
+		ResultType string          `json:"resultType"`
+		Result     json.RawMessage `json:"result"`
+	} `json:"data"`
+}
+
+// sample is an element of a vector result.
+type sample struct {
+	Metric map[string]string `json:"metric"`
+	Value  [2]interface{}    `json:"value"`
+}
+
+// query runs the provided PromQL expression as an instant query.
+func (c *conn) query(ctx context.Context, query string) (driver.Rows, error) {
+	params := url.Values{}
+	params.Set("query", query)
+	params.Set("time", strconv.FormatFloat(float64(time.Now().UnixNano())/1e9, 'f', 3, 64))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.queryURL, strings.NewReader(params.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var r apiResponse
+	if err := json.Unmarshal(body, &r); err != nil {
+		return nil, fmt.Errorf("invalid response from Prometheus (HTTP status %s): %s", resp.Status, err)
+	}
+	if r.Status != "success" {
+		return nil, fmt.Errorf("query failed: %s: %s", r.ErrorType, r.Error)
+	}
+
+	switch r.Data.ResultType {
+	case "vector":
+		var samples []sample
+		if err := json.Unmarshal(r.Data.Result, &samples); err != nil {
+			return nil, err
+		}
+		return newRows(samples)
+	case "scalar":
+		var value [2]interface{}
+		if err := json.Unmarshal(r.Data.Result, &value); err != nil {
+			return nil, err
+		}
+		return newRows([]sample{{Value: value}})
+	default:
+		return nil, fmt.Errorf("unsupported result type %q, only instant vectors and scalars are supported",
+			r.Data.ResultType)
+	}
+}
+
+// stmt implements driver.Stmt and driver.StmtQueryContext.
+type stmt struct {
+	conn  *conn
+	query string
+}
+
+// Close implements driver.Stmt.
+func (s *stmt) Close() error {
+	return nil
+}
+
+// NumInput implements driver.Stmt.
+func (s *stmt) NumInput() int {
+	return 0
+}
+
+// Exec implements driver.Stmt.
+func (s *stmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, errors.New("statements not supported by the prometheus driver, only queries")
+}
+
+// Query implements driver.Stmt.
+func (s *stmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.conn.query(context.Background(), s.query)
+}
+
+// QueryContext implements driver.StmtQueryContext.
+func (s *stmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	return s.conn.query(ctx, s.query)
+}
+
+// rows implements driver.Rows, with one column per label name present in any sample (sorted) plus the value column.
+// Labels missing from a sample are returned as empty strings. An empty vector only has the value column.
+type rows struct {
+	columns []string
+	samples []sample
+	values  []float64
+}
+
+// newRows returns rows for the provided samples, parsing their values.
+func newRows(samples []sample) (*rows, error) {
+	seen := make(map[string]bool)
+	columns := make([]string, 0, 8)
+	values := make([]float64, 0, len(samples))
+	for _, s := range samples {
+		for name := range s.Metric {
+			if !seen[name] {
+				seen[name] = true
+				columns = append(columns, name)
+			}
+		}
+		str, ok := s.Value[1].(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid sample value %v", s.Value[1])
+		}
+		// Handles "NaN", "+Inf" and "-Inf" too.
+		v, err := strconv.ParseFloat(str, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid sample value %q: %s", str, err)
+		}
+		values = append(values, v)
+	}
+	if seen[ValueColumn] {
+		return nil, fmt.Errorf("label %q conflicts with the value column, rename it using label_replace()", ValueColumn)
+	}
+	sort.Strings(columns)
+	return &rows{columns: append(columns, ValueColumn), samples: samples, values: values}, nil
+}
+
+// Columns implements driver.Rows.
+func (r *rows) Columns() []string {
+	return r.columns
+}
+
+// Close implements driver.Rows.
+func (r *rows) Close() error {
+	return nil
+}
+
+// Next implements driver.Rows.
+func (r *rows) Next(dest []driver.Value) error {
+	if len(r.samples) == 0 {
+		return io.EOF
+	}
+	s := r.samples[0]
+	for i, name := range r.columns[:len(r.columns)-1] {
+		dest[i] = s.Metric[name]
+	}
+	dest[len(r.columns)-1] = r.values[0]
+	r.samples, r.values = r.samples[1:], r.values[1:]
+	return nil
+}
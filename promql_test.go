@@ -0,0 +1,70 @@
+package sql_exporter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newPrometheusServer returns a fake Prometheus HTTP API answering every instant query with result, a vector.
+func newPrometheusServer(t *testing.T, result string) string {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status": "success", "data": {"resultType": "vector", "result": ` + result + `}}`))
+	}))
+	t.Cleanup(srv.Close)
+	return "prometheus://" + strings.TrimPrefix(srv.URL, "http://")
+}
+
+const promqlConfig = `
+target:
+  data_source_name: 'DSN'
+  collectors: [requests]
+collectors:
+  - collector_name: requests
+    metrics:
+      - metric_name: job_requests_rate
+        type: gauge
+        help: 'Request rate, by job.'
+        key_labels: [job]
+        values: [value]
+        query: sum by (job) (rate(http_requests_total[5m]))
+`
+
+func TestPrometheusTarget(t *testing.T) {
+	dsn := newPrometheusServer(t, `[
+		{"metric": {"job": "api"}, "value": [1700000000, "2.5"]},
+		{"metric": {"job": "web"}, "value": [1700000000, "NaN"]}
+	]`)
+	e := newTestExporter(t, "", strings.Replace(promqlConfig, "DSN", dsn, 1))
+
+	got, err := gatherText(t, e)
+	if err != nil {
+		t.Fatalf("unexpected scrape error: %s", err)
+	}
+	want := `# HELP job_requests_rate Request rate, by job.
+# TYPE job_requests_rate gauge
+job_requests_rate{job="api"} 2.5
+job_requests_rate{job="web"} NaN
+`
+	if got != want {
+		t.Errorf("unexpected metrics, got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestPrometheusTargetEmptyVector(t *testing.T) {
+	// An empty vector has no label columns, it's not an error for metrics with key labels.
+	dsn := newPrometheusServer(t, `[]`)
+	e := newTestExporter(t, "", strings.Replace(promqlConfig, "DSN", dsn, 1))
+
+	for i := 0; i < 2; i++ {
+		got, err := gatherText(t, e)
+		if err != nil {
+			t.Fatalf("unexpected scrape error: %s", err)
+		}
+		if got != "" {
+			t.Errorf("unexpected metrics:\n%s", got)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package sql_exporter
+
+import (
+	"sync"
+	"time"
+
+	"github.com/free/sql_exporter/config"
+	"github.com/free/sql_exporter/log"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var queryQuarantined = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "sql_exporter_query_quarantined",
+	Help: "1 if the query is quarantined (skipped) on the target after failing repeatedly, 0 otherwise.",
+}, []string{"job", "instance", "collector", "query"})
+
+func init() {
+	prometheus.MustRegister(queryQuarantined)
+}
+
+// queryQuarantine keeps track of a query's consecutive failures on one target and, once the configured number of
+// failures is reached, has the query skipped until the retry interval has elapsed. A quarantined query that fails its
+// retry is quarantined again right away.
+type queryQuarantine struct {
+	config     *config.QuarantineConfig
+	gauge      prometheus.Gauge
+	logContext string
+
+	mtx      sync.Mutex
+	failures int
+	// The query is skipped until this time.
+	until time.Time
+}
+
+// newQueryQuarantine returns a queryQuarantine for the named query of the named collector, running on the target
+// identified by constLabels (job and instance). It returns nil if qc is nil, i.e. quarantine is disabled.
+func newQueryQuarantine(
+	logContext string, qc *config.QuarantineConfig, constLabels []*dto.LabelPair, collector, query string) *queryQuarantine {
+	if qc == nil {
+		return nil
+	}
+	job, instance := jobAndInstance(constLabels)
+	gauge := queryQuarantined.WithLabelValues(job, instance, collector, query)
+	gauge.Set(0)
+	return &queryQuarantine{
+		config:     qc,
+		gauge:      gauge,
+		logContext: logContext,
+	}
+}
+
+// skip returns true if the query is quarantined at time now.
+func (qq *queryQuarantine) skip(now time.Time) bool {
+	qq.mtx.Lock()
+	defer qq.mtx.Unlock()
+	return now.Before(qq.until)
+}
+
+// record records the outcome of a query execution, quarantining the query once it failed often enough in a row.
+func (qq *queryQuarantine) record(success bool, now time.Time) {
+	qq.mtx.Lock()
+	defer qq.mtx.Unlock()
+
+	if success {
+		if qq.failures >= qq.config.Failures {
+			log.Infof("[%s] Query succeeded, released from quarantine", qq.logContext)
+		}
+		qq.failures = 0
+		qq.gauge.Set(0)
+		return
+	}
+
+	qq.failures++
+	if qq.failures >= qq.config.Failures {
+		qq.until = now.Add(time.Duration(qq.config.RetryInterval))
+		qq.gauge.Set(1)
+		log.Warningf("[%s] Query failed %d times in a row, quarantined until %s", qq.logContext, qq.failures,
+			qq.until.Format(time.RFC3339))
+	}
+}
+
+// jobAndInstance returns the values of the job and instance labels among constLabels, empty if missing.
+func jobAndInstance(constLabels []*dto.LabelPair) (job, instance string) {
+	for _, lp := range constLabels {
+		switch lp.GetName() {
+		case "job":
+			job = lp.GetValue()
+		case "instance":
+			instance = lp.GetValue()
+		}
+	}
+	return job, instance
+}
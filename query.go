@@ -4,35 +4,119 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/free/sql_exporter/config"
 	"github.com/free/sql_exporter/errors"
-	log "github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // Query wraps a sql.Stmt and all the metrics populated from it. It helps extract keys and values from result rows.
 type Query struct {
 	config         *config.QueryConfig
 	metricFamilies []*MetricFamily
+	// Log streams populated from the query, with all result columns as fields.
+	logFamilies []*LogFamily
+	// Checks evaluated by the query, every result row being a violation.
+	checkFamilies []*CheckFamily
 	// columnTypes maps column names to the column type expected by metrics: key (string) or value (float64).
 	columnTypes columnTypeMap
 	logContext  string
 
-	conn *sql.DB
-	stmt *sql.Stmt
+	// Protects conn and stmt.
+	stmtMtx sync.Mutex
+	conn    *sql.DB   // DB handle stmt was prepared on
+	stmt    *sql.Stmt // nil until prepared
+
+	// Only used in demo mode.
+	demo demoQuery
+	// Dialect of the database the query runs on.
+	dialect *Dialect
+	// Query text, rendered for dialect.
+	query string
+	// Identifies the query in logs and errors instead of its text, see queryFingerprint.
+	fingerprint string
+	// Captures the execution plan on repeated timeouts, nil if disabled.
+	explainer *explainer
+	// Skips the query after repeated failures, nil if disabled.
+	quarantine *queryQuarantine
+	// Post-processes result rows, nil if not configured.
+	rowProcessor RowProcessor
+	// Counts the rows dropped by rowProcessor, nil if not configured.
+	droppedRows prometheus.Counter
+	// Keeps track of the columns returned by the query.
+	schema *querySchema
+	// Counts executions whose results were only partially read.
+	truncations *queryTruncations
+	// Checksum of the full result set, nil unless result_checksum is enabled.
+	checksum prometheus.Gauge
+	// Descriptor of the row count metric, nil unless export_row_count is enabled.
+	rowCountDesc MetricDesc
+	// Statement labelling the session the query runs in with its collector, empty if disabled or not supported.
+	sessionSetup string
+	// Options of the transaction the query runs in, nil if it doesn't run in one.
+	txOptions *sql.TxOptions
+	// Time zone of the target's timestamps without an offset, see valueScanner.
+	location *time.Location
+	// Values of the query's named parameters, rendered for the target.
+	paramValues map[string]string
+	// Arguments bound to the query's placeholders, in order, and where their values come from. Only named parameters
+	// are set in args, the others are set on every run.
+	args       []interface{}
+	argSources []argSource
+
+	// True if the query text contains time window placeholders, see timeWindow().
+	hasPlaceholders bool
+	// Persists the query watermark, nil unless a watermark column is configured.
+	watermarks *watermarkStore
+	// Identifies the query's watermark in the store: job, instance, collector and query name.
+	watermarkKey string
+	// Protects lastCollection.
+	mtx sync.Mutex
+	// Start time of the last successful collection, zero if none yet.
+	lastCollection time.Time
 }
 
+const (
+	// Bound to the number of seconds since the last successful collection of the query.
+	intervalPlaceholder = ":__interval"
+	// Bound to the Unix timestamp (in seconds) of the last successful collection of the query.
+	lastScrapePlaceholder = ":__last_scrape"
+)
+
+// argSource tells where the value bound to a query placeholder comes from: the named parameter's value, fixed for the
+// target, or the page key, watermark or time window of the run.
+type argSource int
+
+const (
+	argParam argSource = iota
+	argPageKey
+	argWatermark
+	argInterval
+	argLastScrape
+)
+
 type columnType int
 type columnTypeMap map[string]columnType
 
 const (
 	columnTypeKey   = 1
 	columnTypeValue = 2
+	// A value column referenced by an emit_if condition, which may be NULL (read as NaN).
+	columnTypeNullableValue = 3
+	// A column only referenced by emit_if conditions, read as returned by the driver.
+	columnTypeCondition = 4
 )
 
 // NewQuery returns a new Query that will populate the given metric families.
 func NewQuery(logContext string, qc *config.QueryConfig, metricFamilies ...*MetricFamily) (*Query, errors.WithContext) {
-	logContext = fmt.Sprintf("%s, query=%q", logContext, qc.Name)
+	fingerprint := queryFingerprint(qc)
+	logContext = fmt.Sprintf("%s, query=%q", logContext, fingerprint)
 
 	columnTypes := make(columnTypeMap)
 
@@ -42,27 +126,110 @@ func NewQuery(logContext string, qc *config.QueryConfig, metricFamilies ...*Metr
 				return nil, err
 			}
 		}
+		for _, tcol := range mf.templateColumns() {
+			if err := setColumnType(logContext, tcol, columnTypeKey, columnTypes); err != nil {
+				return nil, err
+			}
+		}
 		for _, vcol := range mf.config.Values {
-			if err := setColumnType(logContext, vcol, columnTypeValue, columnTypes); err != nil {
+			// Exposition format text is read as a string, same as key columns.
+			ctype := columnType(columnTypeValue)
+			if mf.config.IsExposition() {
+				ctype = columnTypeKey
+			}
+			if err := setColumnType(logContext, vcol, ctype, columnTypes); err != nil {
+				return nil, err
+			}
+		}
+		if scol := mf.config.HistogramSum; scol != "" {
+			if err := setColumnType(logContext, scol, columnTypeValue, columnTypes); err != nil {
 				return nil, err
 			}
 		}
 	}
 
+	// Value columns referenced by emit_if conditions may be NULL, so the conditions can check for it.
+	for _, mf := range metricFamilies {
+		for _, column := range mf.config.EmitCondition().Columns() {
+			switch columnTypes[column] {
+			case 0:
+				columnTypes[column] = columnTypeCondition
+			case columnTypeValue:
+				columnTypes[column] = columnTypeNullableValue
+			}
+		}
+	}
+
+	if qc.WatermarkColumn != "" {
+		if err := setColumnType(logContext, qc.WatermarkColumn, columnTypeKey, columnTypes); err != nil {
+			return nil, err
+		}
+	}
+	if qc.Pagination != nil {
+		if err := setColumnType(logContext, qc.Pagination.KeyColumn, columnTypeKey, columnTypes); err != nil {
+			return nil, err
+		}
+	}
+
 	q := Query{
 		config:         qc,
 		metricFamilies: metricFamilies,
 		columnTypes:    columnTypes,
 		logContext:     logContext,
+		fingerprint:    fingerprint,
+	}
+	if err := q.setDialect(genericDialect); err != nil {
+		return nil, err
 	}
 	return &q, nil
 }
 
+// setDialect sets the dialect of the database the query runs on, rendering the query text for it.
+func (q *Query) setDialect(dialect *Dialect) errors.WithContext {
+	query, err := q.config.Render(dialect.Name)
+	if err != nil {
+		return errors.Wrap(q.logContext, err)
+	}
+	q.txOptions = nil
+	if q.config.Isolation != "" || q.config.ReadOnly {
+		q.txOptions = &sql.TxOptions{Isolation: isolationLevels[q.config.Isolation], ReadOnly: q.config.ReadOnly}
+	}
+	if dialect.Placeholder == nil &&
+		(len(q.config.Params) > 0 || q.config.Pagination != nil || q.config.WatermarkColumn != "") {
+		return errors.Errorf(q.logContext, "bind parameters are not supported by the %s dialect", dialect.Name)
+	}
+	q.dialect = dialect
+	q.query, q.args, q.argSources = q.bindParams(query)
+	q.hasPlaceholders = false
+	for _, p := range []string{intervalPlaceholder, lastScrapePlaceholder} {
+		q.hasPlaceholders = q.hasPlaceholders || strings.Contains(query, p)
+	}
+	return nil
+}
+
+// addCheckFamilies adds checks to be evaluated on the query's result rows, annotations read as key columns.
+func (q *Query) addCheckFamilies(checkFamilies ...*CheckFamily) errors.WithContext {
+	for _, cf := range checkFamilies {
+		for _, acol := range cf.config.Annotations {
+			if err := setColumnType(q.logContext, acol, columnTypeKey, q.columnTypes); err != nil {
+				return err
+			}
+		}
+	}
+	q.checkFamilies = append(q.checkFamilies, checkFamilies...)
+	return nil
+}
+
 // setColumnType stores the provided type for a given column, checking for conflicts in the process.
 func setColumnType(logContext, columnName string, ctype columnType, columnTypes columnTypeMap) errors.WithContext {
 	previousType, found := columnTypes[columnName]
 	if found {
-		if previousType != ctype {
+		if previousType == columnTypeCondition {
+			// Columns referenced by emit_if conditions may also be used otherwise.
+			columnTypes[columnName] = ctype
+		} else if previousType == columnTypeNullableValue && ctype == columnTypeValue {
+			// Already a value column.
+		} else if previousType != ctype {
 			return errors.Errorf(logContext, "column %q used both as key and value", columnName)
 		}
 	} else {
@@ -73,81 +240,566 @@ func setColumnType(logContext, columnName string, ctype columnType, columnTypes
 
 // Collect is the equivalent of prometheus.Collector.Collect() but takes a context to run in and a database to run on.
 func (q *Query) Collect(ctx context.Context, conn *sql.DB, ch chan<- Metric) {
+	q.collect(ctx, conn, nil, ch)
+}
+
+// collect implements Collect, running the query on the pinned connection if not nil, on any pooled connection of conn
+// otherwise.
+func (q *Query) collect(ctx context.Context, conn *sql.DB, pinned *sql.Conn, ch chan<- Metric) {
 	if ctx.Err() != nil {
 		ch <- NewInvalidMetric(errors.Wrap(q.logContext, ctx.Err()))
 		return
 	}
-	rows, err := q.run(ctx, conn)
-	if err != nil {
-		// TODO: increment an error counter
-		ch <- NewInvalidMetric(err)
+	scope := auditScopeFrom(ctx)
+	scope.query = q.config.Name
+	ctx = withAuditScope(ctx, scope)
+	metricFamilies := q.applicableMetricFamilies(ctx)
+	if len(metricFamilies) == 0 && len(q.metricFamilies) > 0 && len(q.logFamilies) == 0 && len(q.checkFamilies) == 0 &&
+		q.checksum == nil && q.rowCountDesc == nil {
+		// None of the query's metrics apply to the target, don't bother running it.
 		return
 	}
-	defer rows.Close()
-
-	dest, err := q.scanDest(rows)
-	if err != nil {
-		// TODO: increment an error counter
-		ch <- NewInvalidMetric(err)
+	if *demoMode {
+		for _, row := range q.demo.rows(q) {
+			for _, mf := range metricFamilies {
+				mf.Collect(row, ch)
+			}
+		}
 		return
 	}
-	for rows.Next() {
-		row, err := q.scanRow(rows, dest)
+	// Wait for other targets' queries on the same database server, if global.max_queries_per_host is set.
+	if hb := hostBudgetFrom(ctx); hb != nil {
+		if err := hb.acquire(ctx); err != nil {
+			ch <- NewInvalidMetric(errors.Wrapf(q.logContext, err, "waiting for max_queries_per_host failed"))
+			return
+		}
+		defer hb.release()
+	}
+	// Dry runs (debug traces and previews) have no lasting effects, see withDryRun.
+	dryRun := isDryRun(ctx)
+	start := time.Now()
+	// Set once all rows were successfully processed.
+	succeeded := false
+	if q.quarantine != nil && !dryRun {
+		if q.quarantine.skip(start) {
+			return
+		}
+		defer func() {
+			// Only count failures of the query itself, not the scrape timing out.
+			if succeeded || ctx.Err() == nil {
+				q.quarantine.record(succeeded, start)
+			}
+		}()
+	}
+	var (
+		success   = true
+		watermark string
+		entries   []logEntry
+		// Violations of each check in checkFamilies, in the same order.
+		violations = make([]*checkViolations, len(q.checkFamilies))
+		// Page key and total number of rows read so far.
+		pageKey   string
+		totalRows int
+		// Sum of the row checksums and whether any rows were left unread, see rowChecksum.
+		checksum   uint64
+		incomplete bool
+	)
+	for i, cf := range q.checkFamilies {
+		violations[i] = cf.newViolations()
+	}
+	pc := q.config.Pagination
+	if pc != nil {
+		pageKey = pc.InitialKey
+	}
+	if q.explainer != nil && !dryRun {
+		// Explain the page being read when timing out, as executed: bound to the same arguments.
+		defer func() {
+			query, args := q.bind(start, pageKey)
+			q.explainer.observe(ctx, conn, query, args)
+		}()
+	}
+	// Row limit of sampled runs, see Exporter.TraceCollector.
+	rowLimit := rowLimitFrom(ctx)
+	// Only record timings when tracing, see Exporter.TraceCollector.
+	var qt *QueryTrace
+	if trace := traceFrom(ctx); trace != nil {
+		qt = trace.startQuery(q.config.Name)
+	}
+	// Label the session and/or run in a transaction, on a connection of its own (rather than any pooled one) unless
+	// already pinned. Queries on pinned connections are not prepared.
+	if (q.sessionSetup != "" || q.txOptions != nil) && pinned == nil {
+		c, err := conn.Conn(ctx)
 		if err != nil {
+			ch <- NewInvalidMetric(errors.Wrapf(q.logContext, err, "acquiring connection failed"))
+			return
+		}
+		defer c.Close()
+		pinned = c
+	}
+	if q.sessionSetup != "" {
+		if _, err := pinned.ExecContext(ctx, q.sessionSetup); err != nil {
+			ch <- NewInvalidMetric(errors.Wrapf(q.logContext, err, "setting session label failed"))
+			return
+		}
+	}
+	var querier sqlQuerier
+	if pinned != nil {
+		querier = pinned
+	}
+	// All pages are read in the same transaction, so they are consistent with one another.
+	if q.txOptions != nil {
+		tx, err := pinned.BeginTx(ctx, q.txOptions)
+		if err != nil {
+			ch <- NewInvalidMetric(errors.Wrapf(q.logContext, err, "starting transaction failed"))
+			return
+		}
+		// Nothing to commit, the query only reads.
+		defer tx.Rollback()
+		querier = tx
+	}
+	for {
+		rows, err := q.run(ctx, conn, querier, start, pageKey, qt)
+		if err != nil {
+			// TODO: increment an error counter
+			if qt != nil {
+				qt.Error = err.Error()
+			}
 			ch <- NewInvalidMetric(err)
+			return
+		}
+		scanStart := time.Now()
+
+		dest, err := q.scanDest(rows, dryRun)
+		if err != nil && q.dialect.ColumnsFromRows && !rows.Next() && rows.Err() == nil {
+			// An empty result (e.g. an empty PromQL vector) has no columns to derive the key columns from.
+			err = nil
+		}
+		if err != nil {
+			// TODO: increment an error counter
+			rows.Close()
+			ch <- NewInvalidMetric(err)
+			return
+		}
+		pageRows, truncated, sampled, deadlineExceeded := 0, false, false, false
+		for rows.Next() {
+			if pc != nil && pc.MaxRows > 0 && totalRows+pageRows >= pc.MaxRows {
+				truncated = true
+				break
+			}
+			// Also enforced here, for dialects not supporting row limits.
+			if rowLimit > 0 && totalRows+pageRows >= rowLimit {
+				sampled = true
+				break
+			}
+			// Don't keep scanning (possibly millions of) rows once the scrape has timed out or was canceled.
+			if ctx.Err() != nil {
+				deadlineExceeded = true
+				break
+			}
+			pageRows++
+			row, err := q.scanRow(rows, dest)
+			if err == nil && q.config.LogRows {
+				Logf(SeverityInfo, "[%s] Result row: %s", q.logContext, formatRow(row))
+			}
+			dropped := false
+			if err == nil && q.rowProcessor != nil {
+				// Rows dropped by the row processor still move pagination forward.
+				if pc != nil {
+					if key, ok := row[pc.KeyColumn].(string); ok {
+						pageKey = key
+					}
+				}
+				dropped, err = q.processRow(row, dryRun)
+			}
+			if err != nil {
+				ch <- NewInvalidMetric(err)
+				success = false
+				// Without the row's key, the next page can't be fetched.
+				if pc != nil {
+					break
+				}
+				continue
+			}
+			if dropped {
+				continue
+			}
+			for _, mf := range metricFamilies {
+				mf.Collect(row, ch)
+			}
+			if q.checksum != nil {
+				checksum += rowChecksum(row)
+			}
+			if len(q.logFamilies) > 0 {
+				entries = append(entries, newLogEntry(start, row))
+			}
+			for i, cf := range q.checkFamilies {
+				cf.Add(violations[i], row)
+			}
+			if q.watermarks != nil {
+				if v := row[q.config.WatermarkColumn].(string); watermark == "" || watermarkLess(watermark, v) {
+					watermark = v
+				}
+			}
+			if pc != nil {
+				pageKey = row[pc.KeyColumn].(string)
+			}
+			if qt != nil {
+				qt.Rows++
+				qt.Bytes += rowBytes(row)
+			}
+		}
+		if err1 := rows.Err(); err1 != nil {
+			ch <- NewInvalidMetric(q.queryError(err1, q.query, ""))
+			success = false
+		}
+		rows.Close()
+		if qt != nil {
+			qt.ScanSeconds += time.Since(scanStart).Seconds()
+		}
+
+		// Fetch the next page, if any.
+		totalRows += pageRows
+		if deadlineExceeded {
+			if q.truncations != nil && !dryRun {
+				q.truncations.deadline.Inc()
+			}
+			err := errors.Wrapf(
+				q.logContext, ctx.Err(), "stopped scanning after %d rows, results are truncated", totalRows)
+			ch <- NewInvalidMetric(err)
+			success = false
+			break
+		}
+		if truncated {
+			incomplete = true
+			if q.truncations != nil && !dryRun {
+				q.truncations.maxRows.Inc()
+			}
+			Logf(SeverityWarning, "[%s] Stopping after max_rows (%d) rows, results are truncated",
+				q.logContext, pc.MaxRows)
+			break
+		}
+		if sampled || pc == nil || !success || pageRows < pc.PageSize {
+			break
+		}
+	}
+	// Only export check results and the row count if all rows were successfully read, as missing violations (or rows)
+	// would be misleading.
+	if !success {
+		return
+	}
+	for i, cf := range q.checkFamilies {
+		cf.Collect(violations[i], ch)
+	}
+	if q.rowCountDesc != nil {
+		ch <- NewMetric(q.rowCountDesc, float64(totalRows))
+	}
+	// Sampled runs only read part of the results, they don't write logs (which would be incomplete) nor move the time
+	// window or watermark forward. Nor do dry runs.
+	if rowLimit > 0 || dryRun {
+		succeeded = true
+		return
+	}
+	// Commit the watermark before writing logs, so that rows are logged once: if persisting it fails, the same rows are
+	// read (and logged) by the next run instead. Conversely, rows are not logged again if writing the logs fails.
+	if q.watermarks != nil && watermark != "" {
+		if err := q.watermarks.advance(q.watermarkKey, watermark); err != nil {
+			ch <- NewInvalidMetric(errors.Wrapf(q.logContext, err, "persisting watermark failed"))
+			succeeded = true
+			return
+		}
+	}
+	for _, lf := range q.logFamilies {
+		if err := lf.Write(ctx, entries); err != nil {
+			ch <- NewInvalidMetric(err)
+			success = false
+		}
+	}
+	if !success {
+		return
+	}
+	succeeded = true
+	if q.checksum != nil && !incomplete {
+		q.checksum.Set(checksumValue(checksum))
+	}
+	if q.hasPlaceholders {
+		q.mtx.Lock()
+		q.lastCollection = start
+		q.mtx.Unlock()
+	}
+}
+
+// applicableMetricFamilies returns the query's metric families whose `when` condition holds for the target metadata
+// carried by ctx.
+func (q *Query) applicableMetricFamilies(ctx context.Context) []*MetricFamily {
+	metricFamilies := make([]*MetricFamily, 0, len(q.metricFamilies))
+	for _, mf := range q.metricFamilies {
+		if applies(ctx, mf.config.Condition()) {
+			metricFamilies = append(metricFamilies, mf)
+		}
+	}
+	return metricFamilies
+}
+
+// timeWindow returns the values of the time window placeholders: the time elapsed since (`:__interval`, in seconds)
+// and the Unix timestamp of (`:__last_scrape`) the last successful collection. Before the first successful collection,
+// the window is empty, i.e. it ends and starts at now.
+func (q *Query) timeWindow(now time.Time) (interval, lastScrape float64) {
+	q.mtx.Lock()
+	last := q.lastCollection
+	q.mtx.Unlock()
+	if last.IsZero() {
+		last = now
+	}
+	return now.Sub(last).Seconds(), float64(last.UnixNano()) / 1e9
+}
+
+// expandPlaceholders returns the query text with the time window placeholders replaced by their values (see
+// timeWindow), for dialects not supporting bind parameters.
+func (q *Query) expandPlaceholders(now time.Time) string {
+	interval, lastScrape := q.timeWindow(now)
+	return strings.NewReplacer(
+		intervalPlaceholder, strconv.FormatFloat(interval, 'f', 3, 64),
+		lastScrapePlaceholder, strconv.FormatFloat(lastScrape, 'f', 3, 64),
+	).Replace(q.query)
+}
+
+// currentWatermark returns the query's persisted watermark, or the configured initial value if none, as the value to
+// bind to the `:__watermark` placeholder, see parseWatermark.
+func (q *Query) currentWatermark() interface{} {
+	watermark := q.config.WatermarkInitial
+	if mark, found := q.watermarks.get(q.watermarkKey); found {
+		watermark = mark
+	}
+	return parseWatermark(watermark)
+}
+
+// paginate returns the query text ordered by the pagination key column and limited to one page of results. Queries
+// without pagination are returned unchanged.
+func (q *Query) paginate(query string) string {
+	pc := q.config.Pagination
+	if pc == nil {
+		return query
+	}
+	return q.dialect.Page(query, pc.KeyColumn, pc.PageSize)
+}
+
+// bindParams replaces the named parameters (`:name`), page key, watermark and time window placeholders in query with
+// the dialect's bind parameter placeholders, returning the rewritten query, the arguments to bind, in order, and their
+// sources. Other colons (e.g. PostgreSQL `::` casts), as well as anything in string literals, quoted identifiers and
+// comments, are left alone. Queries are returned unchanged if the dialect doesn't support bind parameters.
+func (q *Query) bindParams(query string) (string, []interface{}, []argSource) {
+	if q.dialect.Placeholder == nil {
+		return query, nil, nil
+	}
+	var (
+		buf     strings.Builder
+		args    []interface{}
+		sources []argSource
+	)
+	for i := 0; i < len(query); i++ {
+		if j := q.dialect.skipQuoted(query, i); j > i {
+			buf.WriteString(query[i:j])
+			i = j - 1
+			continue
+		}
+		if query[i] != ':' || (i > 0 && query[i-1] == ':') {
+			buf.WriteByte(query[i])
+			continue
+		}
+		j := i + 1
+		for j < len(query) && isParamChar(query[j], j == i+1) {
+			j++
+		}
+		name := query[i+1 : j]
+		_, isParam := q.config.Params[name]
+		var source argSource
+		switch {
+		case isParam:
+			source = argParam
+		case q.config.Pagination != nil && ":"+name == config.PageKeyPlaceholder:
+			source = argPageKey
+		case q.config.WatermarkColumn != "" && ":"+name == watermarkPlaceholder:
+			source = argWatermark
+		case ":"+name == intervalPlaceholder:
+			source = argInterval
+		case ":"+name == lastScrapePlaceholder:
+			source = argLastScrape
+		default:
+			buf.WriteByte(query[i])
 			continue
 		}
-		for _, mf := range q.metricFamilies {
-			mf.Collect(row, ch)
+		var arg interface{}
+		if source == argParam {
+			arg = q.paramValues[name]
 		}
+		args = append(args, arg)
+		sources = append(sources, source)
+		buf.WriteString(q.dialect.Placeholder(len(args)))
+		i = j - 1
 	}
-	if err1 := rows.Err(); err1 != nil {
-		ch <- NewInvalidMetric(errors.Wrap(q.logContext, err1))
+	return buf.String(), args, sources
+}
+
+// isParamChar returns true if c may appear in a parameter name, at its start if first is true.
+func isParamChar(c byte, first bool) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || !first && '0' <= c && c <= '9'
+}
+
+// sqlQuerier runs queries: a pinned connection (*sql.Conn) or a transaction (*sql.Tx).
+type sqlQuerier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// isolationLevels maps configured isolation levels to their database/sql equivalents.
+var isolationLevels = map[string]sql.IsolationLevel{
+	"":                             sql.LevelDefault,
+	config.IsolationReadCommitted:  sql.LevelReadCommitted,
+	config.IsolationRepeatableRead: sql.LevelRepeatableRead,
+}
+
+// run executes the query on the provided database (on the pinned connection or transaction, if not nil), in the
+// provided context, binding the time window (relative to now), page key and watermark placeholders. Queries on pinned
+// connections, in transactions, sampled (limited to the row limit carried by ctx) or through a connection pooler are
+// executed directly rather than prepared, as are queries whose time window placeholders must
+// be expanded into the query text. Paginated queries fetch the page following pageKey. Timings are recorded into qt,
+// if not nil.
+func (q *Query) run(
+	ctx context.Context, conn *sql.DB, pinned sqlQuerier, now time.Time, pageKey string, qt *QueryTrace) (
+	*sql.Rows, errors.WithContext) {
+	query, args := q.bind(now, pageKey)
+
+	rowLimit := rowLimitFrom(ctx)
+	expand := q.hasPlaceholders && q.dialect.Placeholder == nil
+	if expand || pinned != nil || q.dialect.pooled || rowLimit > 0 {
+		if rowLimit > 0 && q.dialect.Limit != nil {
+			query = q.dialect.Limit(query, rowLimit)
+		}
+		var (
+			rows *sql.Rows
+			err  error
+		)
+		execStart := time.Now()
+		if pinned != nil {
+			rows, err = pinned.QueryContext(ctx, query, args...)
+		} else {
+			rows, err = conn.QueryContext(ctx, query, args...)
+		}
+		if qt != nil {
+			qt.ExecSeconds += time.Since(execStart).Seconds()
+		}
+		return rows, q.queryError(err, query, "")
+	}
+
+	stmt, err := q.prepare(ctx, conn, qt)
+	if err != nil {
+		return nil, err
+	}
+	execStart := time.Now()
+	rows, qerr := stmt.QueryContext(ctx, args...)
+	if qt != nil {
+		qt.ExecSeconds += time.Since(execStart).Seconds()
 	}
+	return rows, q.queryError(qerr, query, "")
 }
 
-// run executes the query on the provided database, in the provided context.
-func (q *Query) run(ctx context.Context, conn *sql.DB) (*sql.Rows, errors.WithContext) {
-	if q.conn != nil && q.conn != conn {
-		panic(fmt.Sprintf("[%s] Expecting to always run on the same database handle", q.logContext))
+// bind returns the query text as executed at now for the page following pageKey (with the time window placeholders
+// expanded, if the dialect has no bind parameters), and the arguments bound to its placeholders: named parameters,
+// time window (relative to now), page key and watermark.
+func (q *Query) bind(now time.Time, pageKey string) (string, []interface{}) {
+	args := append([]interface{}(nil), q.args...)
+	interval, lastScrape := q.timeWindow(now)
+	for i, source := range q.argSources {
+		switch source {
+		case argPageKey:
+			args[i] = pageKey
+		case argWatermark:
+			args[i] = q.currentWatermark()
+		case argInterval:
+			args[i] = interval
+		case argLastScrape:
+			args[i] = lastScrape
+		}
 	}
 
+	query := q.query
+	if q.hasPlaceholders && q.dialect.Placeholder == nil {
+		query = q.expandPlaceholders(now)
+	}
+	return q.paginate(query), args
+}
+
+// prepare returns the query prepared on conn, preparing it if not already done. If the target switched to a different
+// DB handle since (failover or replaced data source name), the query is prepared anew. Safe for concurrent use, e.g. by
+// concurrent scrapes of the same target.
+func (q *Query) prepare(ctx context.Context, conn *sql.DB, qt *QueryTrace) (*sql.Stmt, errors.WithContext) {
+	q.stmtMtx.Lock()
+	defer q.stmtMtx.Unlock()
+
+	if q.stmt != nil && q.conn != conn {
+		q.stmt.Close()
+		q.stmt = nil
+	}
 	if q.stmt == nil {
-		stmt, err := conn.PrepareContext(ctx, q.config.Query)
+		prepareStart := time.Now()
+		text := q.paginate(q.query)
+		stmt, err := conn.PrepareContext(ctx, text)
+		if qt != nil {
+			qt.PrepareSeconds += time.Since(prepareStart).Seconds()
+		}
 		if err != nil {
-			return nil, errors.Wrapf(q.logContext, err, "prepare query failed")
+			return nil, q.queryError(err, text, "prepare query failed")
 		}
 		q.conn = conn
 		q.stmt = stmt
 	}
-	rows, err := q.stmt.QueryContext(ctx)
-	return rows, errors.Wrap(q.logContext, err)
+	return q.stmt, nil
 }
 
-// scanDest creates a slice to scan the provided rows into, with strings for keys, float64s for values and interface{}
-// for any extra columns.
-func (q *Query) scanDest(rows *sql.Rows) ([]interface{}, errors.WithContext) {
+// scanDest creates a slice to scan the provided rows into, with strings for keys, valueScanners (numbers or timestamps)
+// for values and interface{} for any extra columns. The columns are recorded as the query's schema, unless dryRun is
+// true.
+func (q *Query) scanDest(rows *sql.Rows, dryRun bool) ([]interface{}, errors.WithContext) {
 	columns, err := rows.Columns()
 	if err != nil {
 		return nil, errors.Wrap(q.logContext, err)
 	}
+	// Columns depending on the rows returned (e.g. PromQL labels) change along with them, they are not a schema.
+	if q.schema != nil && !q.dialect.ColumnsFromRows && !dryRun {
+		q.schema.observe(columns)
+	}
 
-	// Create the slice to scan the row into, with strings for keys and float64s for values.
+	// Create the slice to scan the row into, with strings for keys and valueScanners for values.
 	dest := make([]interface{}, 0, len(columns))
 	have := make(map[string]bool, len(q.columnTypes))
+	// Columns added by the row processor are not expected from the query.
+	if rpc := q.config.RowProcessor; rpc != nil {
+		for _, column := range rpc.Columns {
+			if _, found := q.columnTypes[column]; found {
+				have[column] = true
+			}
+		}
+	}
 	for i, column := range columns {
 		switch q.columnTypes[column] {
 		case columnTypeKey:
 			dest = append(dest, new(string))
 			have[column] = true
 		case columnTypeValue:
-			dest = append(dest, new(float64))
+			dest = append(dest, &valueScanner{loc: q.location})
+			have[column] = true
+		case columnTypeNullableValue:
+			dest = append(dest, &valueScanner{loc: q.location, nullable: true})
+			have[column] = true
+		case columnTypeCondition:
+			dest = append(dest, new(interface{}))
 			have[column] = true
 		default:
+			// Extra columns are expected if the query populates logs (as all columns are logged), has a row
+			// processor or logs its rows.
 			if column == "" {
-				log.Warningf("[%s] Unnamed column %d returned by query", q.logContext, i)
-			} else {
-				log.Warningf("[%s] Extra column %q returned by query", q.logContext, column)
+				Logf(SeverityWarning, "[%s] Unnamed column %d returned by query", q.logContext, i)
+			} else if !q.keepsExtraColumns() {
+				Logf(SeverityWarning, "[%s] Extra column %q returned by query", q.logContext, column)
 			}
 			dest = append(dest, new(interface{}))
 		}
@@ -168,7 +820,8 @@ func (q *Query) scanDest(rows *sql.Rows) ([]interface{}, errors.WithContext) {
 }
 
 // scanRow scans the current row into a map of column name to value, with string values for key columns and float64
-// values for value columns, using dest as a buffer.
+// values for value columns, using dest as a buffer. If the query populates logs or has a row processor, other columns
+// are included as is.
 func (q *Query) scanRow(rows *sql.Rows, dest []interface{}) (map[string]interface{}, errors.WithContext) {
 	columns, err := rows.Columns()
 	if err != nil {
@@ -187,8 +840,77 @@ func (q *Query) scanRow(rows *sql.Rows, dest []interface{}) (map[string]interfac
 		case columnTypeKey:
 			result[column] = *dest[i].(*string)
 		case columnTypeValue:
-			result[column] = *dest[i].(*float64)
+			result[column] = dest[i].(*valueScanner).value
+		case columnTypeNullableValue:
+			if v := dest[i].(*valueScanner); v.valid {
+				result[column] = v.value
+			} else {
+				result[column] = math.NaN()
+			}
+		case columnTypeCondition:
+			result[column] = *dest[i].(*interface{})
+		default:
+			if q.keepsExtraColumns() && column != "" {
+				result[column] = normalizeValue(*dest[i].(*interface{}))
+			}
 		}
 	}
 	return result, nil
 }
+
+// keepsExtraColumns returns true if columns other than those populating metrics are included in result rows: if the
+// query populates logs, has a row processor, logs its rows or exports a result checksum.
+func (q *Query) keepsExtraColumns() bool {
+	return len(q.logFamilies) > 0 || q.rowProcessor != nil || q.config.LogRows || q.checksum != nil
+}
+
+// normalizeValue converts a value scanned into an interface{} to a string, number, bool or nil, so that it may be
+// logged and encoded (e.g. as JSON) consistently across drivers: byte slices (e.g. sql.RawBytes contents) become
+// strings, times RFC 3339 strings and other integer and floating point types int64 and float64 respectively. Any other
+// type is converted to its default string representation.
+func normalizeValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case nil, string, bool, int64, float64:
+		return v
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case int:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case int16:
+		return int64(v)
+	case int8:
+		return int64(v)
+	case uint64:
+		return float64(v)
+	case uint32:
+		return int64(v)
+	case uint16:
+		return int64(v)
+	case uint8:
+		return int64(v)
+	case float32:
+		return float64(v)
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// formatRow returns a human readable representation of a result row, as `column=value` pairs sorted by column name.
+func formatRow(row map[string]interface{}) string {
+	columns := make([]string, 0, len(row))
+	for column := range row {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+	pairs := make([]string, 0, len(columns))
+	for _, column := range columns {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", column, fmt.Sprint(row[column])))
+	}
+	return strings.Join(pairs, " ")
+}
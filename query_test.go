@@ -0,0 +1,40 @@
+package sql_exporter
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/free/sql_exporter/config"
+)
+
+func TestBindParams(t *testing.T) {
+	tests := []struct {
+		driver, query, want string
+		args                []interface{}
+	}{
+		{"postgres", "SELECT a::text FROM t WHERE db = :db", "SELECT a::text FROM t WHERE db = $1", []interface{}{"app"}},
+		{"postgres", "SELECT ':db', \":db\" FROM t -- :db\nWHERE /* :db */ db = :db",
+			"SELECT ':db', \":db\" FROM t -- :db\nWHERE /* :db */ db = $1", []interface{}{"app"}},
+		{"postgres", "SELECT 'it''s :db' FROM t WHERE db = :db", "SELECT 'it''s :db' FROM t WHERE db = $1",
+			[]interface{}{"app"}},
+		{"mysql", "SELECT 'it\\'s :db', `:db` FROM t WHERE db = :db", "SELECT 'it\\'s :db', `:db` FROM t WHERE db = ?",
+			[]interface{}{"app"}},
+		{"sqlserver", "SELECT [a:db] FROM t WHERE db = :db", "SELECT [a:db] FROM t WHERE db = @p1", []interface{}{"app"}},
+		{"postgres", "SELECT a FROM t /* :db", "SELECT a FROM t /* :db", nil},
+		// Time window placeholders are bound on every run.
+		{"postgres", "SELECT a FROM t WHERE ts > :__last_scrape AND db = :db",
+			"SELECT a FROM t WHERE ts > $1 AND db = $2", []interface{}{nil, "app"}},
+		{"prometheus", "increase(a[:__interval])", "increase(a[:__interval])", nil},
+	}
+	for _, test := range tests {
+		q := &Query{
+			config:      &config.QueryConfig{Params: map[string]string{"db": "app"}},
+			paramValues: map[string]string{"db": "app"},
+			dialect:     DialectFor(test.driver),
+		}
+		got, args, _ := q.bindParams(test.query)
+		if got != test.want || !reflect.DeepEqual(args, test.args) {
+			t.Errorf("%s: bindParams(%q) = %q, %v, want %q, %v", test.driver, test.query, got, args, test.want, test.args)
+		}
+	}
+}
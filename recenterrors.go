@@ -0,0 +1,96 @@
+package sql_exporter
+
+import (
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alecthomas/kingpin/v2"
+	"github.com/free/sql_exporter/errors"
+)
+
+var recentErrorsSize = flagValue(100, kingpin.Flag("web.recent-errors",
+	"Number of most recent distinct scrape errors kept for /api/v1/errors and the /targets page. 0 disables.").
+	Default("100").IntVar)
+
+// Matches `name="value"` pairs in a log context, e.g. `job="foo", target="bar", collector="baz"`.
+var logContextPairRE = regexp.MustCompile(`(\w+)=("(?:[^"\\]|\\.)*")`)
+
+// ScrapeError is a recent scrape error, with the target, collector and query it occurred on (where applicable).
+type ScrapeError struct {
+	Time      time.Time `json:"time"`
+	FirstTime time.Time `json:"first_time"` // time of the first of Count occurrences
+	Count     int       `json:"count"`
+	Job       string    `json:"job,omitempty"`
+	Target    string    `json:"target,omitempty"`
+	Collector string    `json:"collector,omitempty"`
+	Query     string    `json:"query,omitempty"`
+	Error     string    `json:"error"`
+}
+
+// recentErrors keeps the most recent distinct scrape errors, across all targets. An error occurring again (e.g. on
+// every scrape of a target that's down) replaces its previous occurrence rather than flushing out all other errors.
+var recentErrors = &scrapeErrors{}
+
+// scrapeErrors is a bounded list of scrape errors, oldest first.
+type scrapeErrors struct {
+	mtx    sync.Mutex
+	errors []ScrapeError
+}
+
+// record adds err, which occurred at time now, as the most recent error.
+func (se *scrapeErrors) record(err error, now time.Time) {
+	size := *recentErrorsSize
+	if size <= 0 {
+		return
+	}
+	e := ScrapeError{Time: now, FirstTime: now, Count: 1, Error: err.Error()}
+	if w, ok := err.(errors.WithContext); ok {
+		e.Error = w.RawError()
+		for _, m := range logContextPairRE.FindAllStringSubmatch(w.Context(), -1) {
+			value, uerr := strconv.Unquote(m[2])
+			if uerr != nil {
+				continue
+			}
+			switch m[1] {
+			case "job":
+				e.Job = value
+			case "target":
+				e.Target = value
+			case "collector":
+				e.Collector = value
+			case "query":
+				e.Query = value
+			}
+		}
+	}
+
+	se.mtx.Lock()
+	defer se.mtx.Unlock()
+
+	for i, prev := range se.errors {
+		if prev.Job == e.Job && prev.Target == e.Target && prev.Collector == e.Collector && prev.Query == e.Query &&
+			prev.Error == e.Error {
+			e.FirstTime, e.Count = prev.FirstTime, prev.Count+1
+			se.errors = append(se.errors[:i], se.errors[i+1:]...)
+			break
+		}
+	}
+	se.errors = append(se.errors, e)
+	if len(se.errors) > size {
+		se.errors = append(se.errors[:0], se.errors[len(se.errors)-size:]...)
+	}
+}
+
+// list returns a copy of the recorded errors, most recent first.
+func (se *scrapeErrors) list() []ScrapeError {
+	se.mtx.Lock()
+	defer se.mtx.Unlock()
+
+	list := make([]ScrapeError, len(se.errors))
+	for i, e := range se.errors {
+		list[len(list)-1-i] = e
+	}
+	return list
+}
@@ -0,0 +1,74 @@
+package sql_exporter
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"time"
+
+	"github.com/free/sql_exporter/config"
+	"github.com/free/sql_exporter/errors"
+	"github.com/free/sql_exporter/log"
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	replicaLagName = "sql_replica_lag_seconds"
+	replicaLagHelp = "Lag of the replica behind its primary in seconds, as returned by the replica_lag query"
+
+	// Label added to the metrics of lag sensitive collectors while the replica lags, see config.ReplicaLagConfig.
+	staleDataLabel = "stale_data"
+)
+
+// replicaLag checks the lag of a read replica target before its collectors run, see config.ReplicaLagConfig.
+type replicaLag struct {
+	config     *config.ReplicaLagConfig
+	desc       MetricDesc
+	logContext string
+}
+
+// stale runs the lag query on conn, pipes the lag into ch (if export is true) and returns true if the lag exceeds
+// max_lag. A failing lag query is piped into ch as an error and the replica's data is then considered stale, as there
+// is no telling how far behind it is. A NULL lag (e.g. on a primary) counts as no lag.
+func (rl *replicaLag) stale(ctx context.Context, conn *sql.DB, ch chan<- Metric, export bool) bool {
+	var lag sql.NullFloat64
+	if err := conn.QueryRowContext(ctx, rl.config.Query).Scan(&lag); err != nil {
+		ch <- NewInvalidMetric(errors.Wrapf(rl.logContext, err, "querying replica lag failed"))
+		return true
+	}
+	if export {
+		ch <- NewMetric(rl.desc, lag.Float64)
+	}
+	maxLag := time.Duration(rl.config.MaxLag)
+	if lag.Float64 <= maxLag.Seconds() {
+		return false
+	}
+	log.V(1).Infof("[%s] Replica lag of %.3fs exceeds max_lag (%s), lag sensitive collectors: %s",
+		rl.logContext, lag.Float64, maxLag, rl.config.Action)
+	return true
+}
+
+// staleMetric wraps a metric of a lag sensitive collector, adding the stale_data="true" label to it.
+type staleMetric struct {
+	Metric
+}
+
+// Write implements Metric.
+func (m staleMetric) Write(out *dto.Metric) errors.WithContext {
+	if err := m.Metric.Write(out); err != nil {
+		return err
+	}
+	// Metrics may share their label pairs, so copy rather than append to them.
+	labelPairs := make([]*dto.LabelPair, 0, len(out.Label)+1)
+	for _, lp := range out.Label {
+		if lp.GetName() == staleDataLabel {
+			return nil
+		}
+		labelPairs = append(labelPairs, lp)
+	}
+	labelPairs = append(labelPairs, &dto.LabelPair{Name: proto.String(staleDataLabel), Value: proto.String("true")})
+	sort.Sort(labelPairSorter(labelPairs))
+	out.Label = labelPairs
+	return nil
+}
@@ -0,0 +1,107 @@
+package sql_exporter
+
+import (
+	"fmt"
+
+	"github.com/free/sql_exporter/config"
+	"github.com/free/sql_exporter/errors"
+	"github.com/free/sql_exporter/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// RowProcessor is a function post-processing query result rows, loaded from a Go plugin or a Starlark script. See
+// config.RowProcessorConfig. Returning an error drops the row.
+type RowProcessor func(query string, row map[string]interface{}) error
+
+var rowProcessorDroppedRows = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "sql_exporter_row_processor_dropped_rows_total",
+	Help: "Number of result rows of the query on the target dropped by its row processor.",
+}, []string{"job", "instance", "collector", "query"})
+
+func init() {
+	prometheus.MustRegister(rowProcessorDroppedRows)
+}
+
+// loadScriptRowProcessor loads the row processing function of a Starlark script, executing at most maxSteps Starlark
+// instructions per call. Set by rowprocessor_starlark.go, nil unless built with the starlark tag.
+var loadScriptRowProcessor func(rpc *config.RowProcessorConfig, maxSteps uint64) (RowProcessor, error)
+
+// loadPluginRowProcessor loads the row processing function of a Go plugin. Set by rowprocessor_plugin.go, nil unless
+// built with cgo on a platform supporting plugins (the release binaries are built without cgo).
+var loadPluginRowProcessor func(rpc *config.RowProcessorConfig) (RowProcessor, error)
+
+// loadRowProcessor loads the configured row processing function, from a Go plugin or a Starlark script.
+func loadRowProcessor(
+	logContext string, rpc *config.RowProcessorConfig, maxSteps uint64) (RowProcessor, errors.WithContext) {
+	if rpc.Script != "" {
+		if loadScriptRowProcessor == nil {
+			return nil, errors.New(logContext, "row processor scripts require sql_exporter to be built with the starlark tag")
+		}
+		fn, err := loadScriptRowProcessor(rpc, maxSteps)
+		if err != nil {
+			return nil, errors.Wrapf(logContext, err, "loading row processor script failed")
+		}
+		return fn, nil
+	}
+
+	if loadPluginRowProcessor == nil {
+		return nil, errors.New(logContext, "row processor plugins require sql_exporter to be built with cgo "+
+			"(CGO_ENABLED=1) on Linux, macOS or FreeBSD, release binaries are not: use a script instead")
+	}
+	fn, err := loadPluginRowProcessor(rpc)
+	if err != nil {
+		return nil, errors.Wrapf(logContext, err, "loading row processor plugin failed")
+	}
+	return fn, nil
+}
+
+// processRow passes row to the query's row processor, then checks that it still has all the columns metrics are
+// populated from, of the expected types. Rows the processor drops are counted (except on dry runs), not errors.
+func (q *Query) processRow(row map[string]interface{}, dryRun bool) (dropped bool, err errors.WithContext) {
+	// Don't let a misbehaving plugin bring down the exporter.
+	defer func() {
+		if r := recover(); r != nil {
+			err = errors.Errorf(q.logContext, "row processor panicked: %v", r)
+		}
+	}()
+
+	if err := q.rowProcessor(q.config.Name, row); err != nil {
+		log.V(1).Infof("[%s] Row processor dropped row: %s", q.logContext, err)
+		if !dryRun {
+			q.droppedRows.Inc()
+		}
+		return true, nil
+	}
+	for column, ctype := range q.columnTypes {
+		var ok bool
+		switch ctype {
+		case columnTypeKey:
+			_, ok = row[column].(string)
+		case columnTypeValue, columnTypeNullableValue:
+			_, ok = row[column].(float64)
+		case columnTypeCondition:
+			ok = true
+		}
+		if !ok {
+			return false, errors.Errorf(q.logContext, "row processor returned %s for column %q, expecting a %s",
+				describeValue(row[column]), column, columnTypeName(ctype))
+		}
+	}
+	return false, nil
+}
+
+// describeValue returns a short description of a row value, for error messages.
+func describeValue(v interface{}) string {
+	if v == nil {
+		return "no value"
+	}
+	return fmt.Sprintf("%T value %v", v, v)
+}
+
+// columnTypeName returns the Go type of the values of a column type.
+func columnTypeName(ctype columnType) string {
+	if ctype == columnTypeKey {
+		return "string"
+	}
+	return "float64"
+}
@@ -0,0 +1,36 @@
+//go:build cgo && (linux || darwin || freebsd)
+// +build cgo
+// +build linux darwin freebsd
+
+package sql_exporter
+
+import (
+	"fmt"
+	"plugin"
+
+	"github.com/free/sql_exporter/config"
+)
+
+// Go plugins are only supported by cgo builds, on some platforms.
+func init() {
+	loadPluginRowProcessor = loadGoPluginRowProcessor
+}
+
+// loadGoPluginRowProcessor implements loadPluginRowProcessor. plugin.Open only opens a plugin once per process, no
+// matter how many queries use it.
+func loadGoPluginRowProcessor(rpc *config.RowProcessorConfig) (RowProcessor, error) {
+	p, err := plugin.Open(rpc.Plugin)
+	if err != nil {
+		return nil, err
+	}
+	sym, err := p.Lookup(rpc.Function)
+	if err != nil {
+		return nil, err
+	}
+	fn, ok := sym.(func(string, map[string]interface{}) error)
+	if !ok {
+		return nil, fmt.Errorf("row processor %s in plugin %s has type %T, expecting %T",
+			rpc.Function, rpc.Plugin, sym, fn)
+	}
+	return RowProcessor(fn), nil
+}
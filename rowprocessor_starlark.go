@@ -0,0 +1,111 @@
+//go:build starlark
+// +build starlark
+
+package sql_exporter
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/free/sql_exporter/config"
+	"go.starlark.net/starlark"
+)
+
+// Builds with the starlark tag (such as release builds, see .promu.yml) support row processor scripts.
+func init() {
+	loadScriptRowProcessor = loadStarlarkRowProcessor
+}
+
+// loadStarlarkRowProcessor implements loadScriptRowProcessor. The script is executed once, its globals frozen, so the
+// returned function may be called concurrently.
+func loadStarlarkRowProcessor(rpc *config.RowProcessorConfig, maxSteps uint64) (RowProcessor, error) {
+	src, err := os.ReadFile(rpc.Script)
+	if err != nil {
+		return nil, err
+	}
+	thread := &starlark.Thread{Name: rpc.Script}
+	thread.SetMaxExecutionSteps(maxSteps)
+	globals, err := starlark.ExecFile(thread, rpc.Script, src, nil)
+	if err != nil {
+		return nil, err
+	}
+	globals.Freeze()
+	fn, ok := globals[rpc.Function].(starlark.Callable)
+	if !ok {
+		return nil, fmt.Errorf("no function %s defined in %s", rpc.Function, rpc.Script)
+	}
+
+	return func(query string, row map[string]interface{}) error {
+		dict := starlark.NewDict(len(row))
+		for column, value := range row {
+			if err := dict.SetKey(starlark.String(column), toStarlark(value)); err != nil {
+				return err
+			}
+		}
+
+		thread := &starlark.Thread{Name: query}
+		thread.SetMaxExecutionSteps(maxSteps)
+		if _, err := starlark.Call(thread, fn, starlark.Tuple{starlark.String(query), dict}, nil); err != nil {
+			return err
+		}
+
+		// Replace the row contents with the (possibly modified) dict's.
+		for column := range row {
+			delete(row, column)
+		}
+		for _, item := range dict.Items() {
+			column, ok := starlark.AsString(item[0])
+			if !ok {
+				return fmt.Errorf("column name %s is not a string", item[0])
+			}
+			value, err := fromStarlark(item[1])
+			if err != nil {
+				return fmt.Errorf("column %q: %s", column, err)
+			}
+			row[column] = value
+		}
+		return nil
+	}, nil
+}
+
+// toStarlark converts a scanned row value to the equivalent Starlark value.
+func toStarlark(v interface{}) starlark.Value {
+	switch v := v.(type) {
+	case nil:
+		return starlark.None
+	case string:
+		return starlark.String(v)
+	case []byte:
+		return starlark.String(v)
+	case float64:
+		return starlark.Float(v)
+	case int64:
+		return starlark.MakeInt64(v)
+	case bool:
+		return starlark.Bool(v)
+	case time.Time:
+		return starlark.String(v.Format(time.RFC3339Nano))
+	default:
+		return starlark.String(fmt.Sprint(v))
+	}
+}
+
+// fromStarlark converts a Starlark value returned by a row processor to a row value. Numbers are converted to float64s,
+// the type of value columns.
+func fromStarlark(v starlark.Value) (interface{}, error) {
+	switch v := v.(type) {
+	case starlark.NoneType:
+		return nil, nil
+	case starlark.String:
+		return string(v), nil
+	case starlark.Float:
+		return float64(v), nil
+	case starlark.Int:
+		return float64(v.Float()), nil
+	case starlark.Bool:
+		return bool(v), nil
+	default:
+		return nil, fmt.Errorf("unsupported value %s of type %s", v, v.Type())
+	}
+}
@@ -0,0 +1,63 @@
+package sql_exporter
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestRowProcessorDroppedRows(t *testing.T) {
+	e := newTestExporter(t, `
+results:
+  - query: 'FROM pg_stat_database'
+    columns: [datname, xact_commit]
+    rows:
+      - [postgres, 1]
+      - [template0, 2]
+`, `
+jobs:
+  - job_name: pg
+    collectors: [pg_database]
+    static_configs:
+      - targets:
+          db1: 'RESULTS'
+collectors:
+  - collector_name: pg_database
+    metrics:
+      - metric_name: pg_xact_commit_total
+        type: counter
+        help: 'Committed transactions.'
+        key_labels: [datname]
+        values: [xact_commit]
+        query: SELECT datname, xact_commit FROM pg_stat_database
+`)
+	tgt, err := e.(*exporter).targets.lookup("pg", "db1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := tgt.collectors[0].(*collector).queries[0]
+	q.rowProcessor = func(query string, row map[string]interface{}) error {
+		if row["datname"] == "template0" {
+			return errors.New("template database")
+		}
+		return nil
+	}
+	q.droppedRows = rowProcessorDroppedRows.WithLabelValues("pg", "db1", "pg_database", q.config.Name)
+
+	got, err := gatherText(t, e)
+	if err != nil {
+		t.Fatalf("unexpected scrape error: %s", err)
+	}
+	if !strings.Contains(got, `datname="postgres"`) || strings.Contains(got, `datname="template0"`) {
+		t.Errorf("expected only the postgres row, got:\n%s", got)
+	}
+	m := &dto.Metric{}
+	if err := q.droppedRows.Write(m); err != nil {
+		t.Fatal(err)
+	}
+	if v := m.GetCounter().GetValue(); v != 1 {
+		t.Errorf("expected 1 dropped row, got %v", v)
+	}
+}
@@ -0,0 +1,82 @@
+package sql_exporter
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/free/sql_exporter/log"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+var querySchemaChanged = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "sql_exporter_query_schema_changed_total",
+	Help: "Number of times the set of columns returned by the query on the target changed between executions.",
+}, []string{"job", "instance", "collector", "query"})
+
+func init() {
+	prometheus.MustRegister(querySchemaChanged)
+}
+
+// querySchema keeps track of the columns returned by a query on one target, so that schema changes (e.g. a column
+// renamed by a database upgrade) are noticed even when they don't make the query fail.
+type querySchema struct {
+	counter    prometheus.Counter
+	logContext string
+
+	mtx sync.Mutex
+	// Columns returned by the last execution, sorted. Nil before the first execution.
+	columns []string
+}
+
+// newQuerySchema returns a querySchema for the named query of the named collector, running on the target identified
+// by constLabels (job and instance).
+func newQuerySchema(logContext string, constLabels []*dto.LabelPair, collector, query string) *querySchema {
+	job, instance := jobAndInstance(constLabels)
+	counter := querySchemaChanged.WithLabelValues(job, instance, collector, query)
+	counter.Add(0)
+	return &querySchema{
+		counter:    counter,
+		logContext: logContext,
+	}
+}
+
+// observe records the columns returned by an execution of the query, logging the difference and incrementing the
+// schema change counter if they differ from the previous execution's.
+func (qs *querySchema) observe(columns []string) {
+	sorted := make([]string, len(columns))
+	copy(sorted, columns)
+	sort.Strings(sorted)
+
+	qs.mtx.Lock()
+	defer qs.mtx.Unlock()
+
+	if qs.columns != nil {
+		added, removed := diffColumns(qs.columns, sorted)
+		if len(added) > 0 || len(removed) > 0 {
+			qs.counter.Inc()
+			log.Warningf("[%s] Query result columns changed: added %q, removed %q", qs.logContext, added, removed)
+		}
+	}
+	qs.columns = sorted
+}
+
+// diffColumns returns the columns in after but not in before and the columns in before but not in after. Both slices
+// must be sorted.
+func diffColumns(before, after []string) (added, removed []string) {
+	i, j := 0, 0
+	for i < len(before) || j < len(after) {
+		switch {
+		case j == len(after) || i < len(before) && before[i] < after[j]:
+			removed = append(removed, before[i])
+			i++
+		case i == len(before) || after[j] < before[i]:
+			added = append(added, after[j])
+			j++
+		default:
+			i++
+			j++
+		}
+	}
+	return added, removed
+}
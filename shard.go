@@ -0,0 +1,40 @@
+package sql_exporter
+
+import (
+	"hash/fnv"
+
+	"github.com/alecthomas/kingpin/v2"
+)
+
+var (
+	shardIndex = kingpin.Flag("shard.index",
+		"Index (0-based) of the target shard scraped by this exporter replica.").Default("0").Int()
+	shardTotal = flagValue(1, kingpin.Flag("shard.total",
+		"Number of exporter replicas splitting the configured targets between them. 1 disables sharding.").
+		Default("1").IntVar)
+)
+
+// checkShardFlags validates the --shard.index and --shard.total flags.
+func checkShardFlags() error {
+	if *shardTotal < 1 {
+		return flagErrorf("shard.total must be at least 1, got %d", *shardTotal)
+	}
+	if *shardIndex < 0 || *shardIndex >= *shardTotal {
+		return flagErrorf("shard.index must be between 0 and %d, got %d", *shardTotal-1, *shardIndex)
+	}
+	return nil
+}
+
+// inShard returns true if the target identified by job and instance names is assigned to this replica's shard. Targets
+// are assigned by hashing their job and instance names, so all replicas sharing the same configuration agree on the
+// assignment.
+func inShard(jobName, instance string) bool {
+	if *shardTotal <= 1 {
+		return true
+	}
+	h := fnv.New64a()
+	h.Write([]byte(jobName))
+	h.Write([]byte{0})
+	h.Write([]byte(instance))
+	return h.Sum64()%uint64(*shardTotal) == uint64(*shardIndex)
+}
@@ -0,0 +1,195 @@
+package sql_exporter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/free/sql_exporter/config"
+	"github.com/free/sql_exporter/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	silencedName = "sql_target_silenced"
+	silencedHelp = "1 if the target matches an active silence and is not scraped, 0 otherwise"
+
+	// Timeout for fetching silences.
+	silencesFetchTimeout = 10 * time.Second
+)
+
+var silencesRefreshFailures = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "sql_exporter_silences_refresh_failures_total",
+	Help: "Number of failed attempts to fetch silences. The previously fetched silences remain in effect.",
+})
+
+func init() {
+	prometheus.MustRegister(silencesRefreshFailures)
+}
+
+// silenceMatcher matches the value of a label, like an Alertmanager matcher. A missing label has an empty value.
+type silenceMatcher struct {
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+	IsRegex bool   `json:"isRegex"`
+	IsEqual *bool  `json:"isEqual"` // nil means true, for Alertmanager versions predating negative matchers
+
+	re *regexp.Regexp // Value, compiled; nil unless IsRegex
+}
+
+// matches returns true if the matcher matches the labels.
+func (m *silenceMatcher) matches(labels prometheus.Labels) bool {
+	value := labels[m.Name]
+	var matched bool
+	if m.re != nil {
+		matched = m.re.MatchString(value)
+	} else {
+		matched = value == m.Value
+	}
+	return matched == (m.IsEqual == nil || *m.IsEqual)
+}
+
+// silence is an active silence: a set of matchers, all of which must match for a target to be silenced.
+type silence struct {
+	matchers []*silenceMatcher
+	endsAt   time.Time // zero if the silence does not end on its own
+}
+
+// silenceSet is the set of active silences, as last fetched.
+type silenceSet struct {
+	mtx      sync.RWMutex
+	silences []*silence
+}
+
+// targetSilences is the one and only set of silences.
+var targetSilences = &silenceSet{}
+
+// set replaces the active silences.
+func (ss *silenceSet) set(silences []*silence) {
+	ss.mtx.Lock()
+	defer ss.mtx.Unlock()
+	ss.silences = silences
+}
+
+// isSilenced returns true if the labels (of a target) match any silence active at time now.
+func (ss *silenceSet) isSilenced(labels prometheus.Labels, now time.Time) bool {
+	ss.mtx.RLock()
+	defer ss.mtx.RUnlock()
+
+	for _, s := range ss.silences {
+		if !s.endsAt.IsZero() && !now.Before(s.endsAt) {
+			continue
+		}
+		matched := true
+		for _, m := range s.matchers {
+			if !m.matches(labels) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// pollSilences fetches silences as configured, every refresh interval, until ctx is done. If fetching fails, the
+// previously fetched silences remain in effect (until they end).
+func pollSilences(ctx context.Context, sc *config.SilencesConfig) {
+	for {
+		fetchCtx, cancel := context.WithTimeout(ctx, silencesFetchTimeout)
+		silences, err := fetchSilences(fetchCtx, sc)
+		cancel()
+		if err != nil {
+			silencesRefreshFailures.Inc()
+			log.Warningf("Fetching silences from %s failed: %s", sc.URL, err)
+		} else {
+			log.V(1).Infof("Fetched %d silences from %s", len(silences), sc.URL)
+			targetSilences.set(silences)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Duration(sc.RefreshInterval)):
+		}
+	}
+}
+
+// fetchSilences fetches the active silences: from the Alertmanager API v2; or from a JSON list of label sets, each of
+// them silencing the targets having all its labels.
+func fetchSilences(ctx context.Context, sc *config.SilencesConfig) ([]*silence, error) {
+	url := sc.URL
+	if sc.Type == config.SilencesAlertmanager {
+		url = strings.TrimSuffix(url, "/") + "/api/v2/silences"
+	}
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	if sc.Type == config.SilencesHTTP {
+		var labelSets []map[string]string
+		if err := json.NewDecoder(resp.Body).Decode(&labelSets); err != nil {
+			return nil, err
+		}
+		silences := make([]*silence, 0, len(labelSets))
+		for _, labelSet := range labelSets {
+			// An empty label set would silence all targets, more likely a mistake than intended.
+			if len(labelSet) == 0 {
+				continue
+			}
+			s := &silence{}
+			for name, value := range labelSet {
+				s.matchers = append(s.matchers, &silenceMatcher{Name: name, Value: value})
+			}
+			silences = append(silences, s)
+		}
+		return silences, nil
+	}
+
+	var amSilences []struct {
+		ID       string                 `json:"id"`
+		Status   struct{ State string } `json:"status"`
+		Matchers []*silenceMatcher      `json:"matchers"`
+		EndsAt   time.Time              `json:"endsAt"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&amSilences); err != nil {
+		return nil, err
+	}
+	silences := make([]*silence, 0, len(amSilences))
+	for _, as := range amSilences {
+		if as.Status.State != "active" || len(as.Matchers) == 0 {
+			continue
+		}
+		valid := true
+		for _, m := range as.Matchers {
+			if m.IsRegex {
+				// Alertmanager regexes are anchored.
+				if m.re, err = regexp.Compile("^(?:" + m.Value + ")$"); err != nil {
+					log.Warningf("Ignoring silence %s with invalid matcher: %s", as.ID, err)
+					valid = false
+					break
+				}
+			}
+		}
+		if valid {
+			silences = append(silences, &silence{matchers: as.Matchers, endsAt: as.EndsAt})
+		}
+	}
+	return silences, nil
+}
@@ -0,0 +1,50 @@
+package sql_exporter
+
+import (
+	"sort"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// SortMetricFamilies sorts mfs into a deterministic order, so that expositions of the same metrics are identical:
+// metric families by name; metrics by label pairs (names, then values, label pairs sorted by name) and timestamp;
+// histogram buckets by upper bound and summary quantiles by quantile. prometheus.Gatherers already sorts metrics by
+// label values, but leaves metrics whose label values are equal in whatever order they were collected.
+func SortMetricFamilies(mfs []*dto.MetricFamily) {
+	sort.SliceStable(mfs, func(i, j int) bool { return mfs[i].GetName() < mfs[j].GetName() })
+	for _, mf := range mfs {
+		for _, m := range mf.Metric {
+			if !sort.IsSorted(labelPairSorter(m.Label)) {
+				sort.Sort(labelPairSorter(m.Label))
+			}
+			if h := m.Histogram; h != nil {
+				sort.SliceStable(h.Bucket, func(i, j int) bool {
+					return h.Bucket[i].GetUpperBound() < h.Bucket[j].GetUpperBound()
+				})
+			}
+			if s := m.Summary; s != nil {
+				sort.SliceStable(s.Quantile, func(i, j int) bool {
+					return s.Quantile[i].GetQuantile() < s.Quantile[j].GetQuantile()
+				})
+			}
+		}
+		sort.SliceStable(mf.Metric, func(i, j int) bool { return metricLess(mf.Metric[i], mf.Metric[j]) })
+	}
+}
+
+// metricLess orders metrics by label pairs, compared pairwise by name then value (a metric whose label pairs are a
+// prefix of the other's first), then by timestamp.
+func metricLess(a, b *dto.Metric) bool {
+	for k := 0; k < len(a.Label) && k < len(b.Label); k++ {
+		if an, bn := a.Label[k].GetName(), b.Label[k].GetName(); an != bn {
+			return an < bn
+		}
+		if av, bv := a.Label[k].GetValue(), b.Label[k].GetValue(); av != bv {
+			return av < bv
+		}
+	}
+	if len(a.Label) != len(b.Label) {
+		return len(a.Label) < len(b.Label)
+	}
+	return a.GetTimestampMs() < b.GetTimestampMs()
+}
@@ -7,10 +7,12 @@ import (
 	"fmt"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/free/sql_exporter/config"
 	"github.com/free/sql_exporter/errors"
+	"github.com/free/sql_exporter/log"
 	"github.com/golang/protobuf/proto"
 	"github.com/prometheus/client_golang/prometheus"
 	dto "github.com/prometheus/client_model/go"
@@ -19,11 +21,15 @@ import (
 const (
 	// Capacity for the channel to collect metrics.
 	capMetricChan = 1000
+	// Number of dto.Metrics allocated at once when gathering.
+	dtoMetricChunkSize = 64
 
 	upMetricName       = "up"
 	upMetricHelp       = "1 if the target is reachable, or 0 if the scrape failed"
 	scrapeDurationName = "scrape_duration_seconds"
 	scrapeDurationHelp = "How long it took to scrape the target in seconds"
+	maintenanceName    = "sql_target_maintenance"
+	maintenanceHelp    = "1 if the target is in a maintenance window and not scraped, 0 otherwise"
 )
 
 // Target collects SQL metrics from a single sql.DB instance. It aggregates one or more Collectors and it looks much
@@ -31,28 +37,73 @@ const (
 type Target interface {
 	// Collect is the equivalent of prometheus.Collector.Collect(), but takes a context to run in.
 	Collect(ctx context.Context, ch chan<- Metric)
+	// Ping opens the DB handle, if not already open, and checks that the database is reachable.
+	Ping(ctx context.Context) errors.WithContext
+	// Labels returns the target's constant labels (e.g. job and instance). Nil in single target mode.
+	Labels() prometheus.Labels
+	// Close closes the DB handles, if open, and deletes the target's process metrics (e.g.
+	// sql_exporter_collector_last_success_timestamp_seconds) as soon as scrapes in progress are done. The target must not
+	// be used afterwards.
+	Close() error
 }
 
-// target implements Target. It wraps a sql.DB, which is initially nil but never changes once instantianted.
+// target implements Target. It wraps a sql.DB, which is initially nil but never changes once instantianted (unless
+// failing over to another data source or the data source name is replaced, e.g. after rotating credentials).
 type target struct {
 	name               string
-	dsn                string
+	dsn                atomic.Value        // the active data source name, a string; only changed with connMtx held
+	dialTimeout        time.Duration       // connection establishment timeout, 0 if none
+	pooler             string              // connection pooler the target is accessed via, empty if none
+	location           *time.Location      // time zone of the target's timestamps without an offset
+	failover           *dataSourceFailover // nil unless multiple data source names are configured
 	collectors         []Collector
+	collectorNames     []string            // names of collectors, in the same order
+	collectorWhen      []*config.Condition // `when` conditions of collectors, in the same order
 	constLabels        prometheus.Labels
 	globalConfig       *config.GlobalConfig
 	upDesc             MetricDesc
 	scrapeDurationDesc MetricDesc
+	failOnError        bool // true if any collector has on_error=fail
+	health             *targetHealth
+	databaseInfo       *databaseInfo // nil unless global.database_info_interval is set
+	databaseInfoDesc   MetricDesc
+	maintenance        []*config.MaintenanceWindow
+	maintenanceDesc    MetricDesc          // nil unless maintenance windows are defined
+	replicaLag         *replicaLag         // nil unless replica_lag is configured
+	lagSensitive       []bool              // lag_sensitive settings of collectors, in the same order
+	connParams         []map[string]string // connection_params of collectors, in the same order
+	failsOnError       []bool              // whether collectors have on_error=fail, in the same order
+	silencedDesc       MetricDesc          // nil unless silences are polled
+	metadata           *targetMetadata     // nil unless any collector or metric has a `when` condition
+	auditLog           *auditLog           // nil unless global.audit_log is set
 	logContext         string
 
-	conn *sql.DB
+	// Protects dsn and conn, as well as the reference counts of DB handles.
+	connMtx  sync.Mutex
+	conn     *sql.DB
+	connRefs map[*sql.DB]int  // number of scrapes using each DB handle
+	retired  map[*sql.DB]bool // handles replaced along with the data source name, closed once no longer in use
+	closed   bool             // true once Close was called, no new DB handles are opened
+	released bool             // true once the target's process metrics were deleted, see release
+
+	paramsConns map[string]*paramsConn // DB handles of collectors with connection_params, by connParamsKey
 }
 
-// NewTarget returns a new Target with the given instance name, data source name, collectors and constant labels.
-// An empty target name means the exporter is running in single target mode: no synthetic metrics will be exported.
+// NewTarget returns a new Target with the given instance name, data source names (in order of preference, failing over
+// to the next when one is unreachable), connection pooler (empty if none), time zone of timestamps without an offset,
+// collectors, constant labels, metric name prefix, maintenance windows and replica lag check (nil if none). An empty
+// target name means the exporter is running in single target mode: no synthetic metrics will be exported.
 func NewTarget(
-	logContext, name, dsn string, ccs []*config.CollectorConfig, constLabels prometheus.Labels, gc *config.GlobalConfig) (
-	Target, errors.WithContext) {
+	logContext, name string, dsns []string, dialTimeout time.Duration, pooler string, loc *time.Location,
+	ccs []*config.CollectorConfig,
+	constLabels prometheus.Labels,
+	metricPrefix string, gc *config.GlobalConfig, maintenance []*config.MaintenanceWindow,
+	rlc *config.ReplicaLagConfig) (Target, errors.WithContext) {
 
+	if len(dsns) == 0 {
+		return nil, errors.New(logContext, "no data source name")
+	}
+	dsn := dsns[0]
 	if name != "" {
 		logContext = fmt.Sprintf("%s, target=%q", logContext, name)
 	}
@@ -67,27 +118,115 @@ func NewTarget(
 	sort.Sort(labelPairSorter(constLabelPairs))
 
 	collectors := make([]Collector, 0, len(ccs))
+	collectorNames := make([]string, 0, len(ccs))
+	collectorWhen := make([]*config.Condition, 0, len(ccs))
+	lagSensitive := make([]bool, 0, len(ccs))
+	connParams := make([]map[string]string, 0, len(ccs))
+	failsOnError := make([]bool, 0, len(ccs))
+	var metadata *targetMetadata
 	for _, cc := range ccs {
-		c, err := NewCollector(logContext, cc, constLabelPairs)
+		c, err := NewCollector(logContext, DriverName(dsn), pooler, loc, cc, constLabelPairs, metricPrefix, gc)
 		if err != nil {
 			return nil, err
 		}
+		for _, d := range dsns {
+			if _, err := config.WithDSNParams(d, cc.ConnectionParams); err != nil {
+				return nil, errors.Wrapf(logContext, err, "invalid connection_params for collector %q", cc.Name)
+			}
+		}
 		collectors = append(collectors, c)
+		collectorNames = append(collectorNames, cc.Name)
+		collectorWhen = append(collectorWhen, cc.Condition())
+		lagSensitive = append(lagSensitive, cc.LagSensitive)
+		connParams = append(connParams, cc.ConnectionParams)
+		failsOnError = append(failsOnError, cc.OnError == config.OnErrorFail)
+		if cc.HasConditions() && metadata == nil {
+			metadata = &targetMetadata{driver: DriverName(dsn), logContext: logContext}
+		}
+	}
+
+	failOnError := false
+	for _, fails := range failsOnError {
+		failOnError = failOnError || fails
+	}
+
+	var dbInfo *databaseInfo
+	if gc.DatabaseInfoInterval > 0 {
+		dbInfo = &databaseInfo{
+			driver:     DriverName(dsn),
+			interval:   time.Duration(gc.DatabaseInfoInterval),
+			logContext: logContext,
+		}
+	}
+	databaseInfoDesc := NewAutomaticMetricDesc(
+		logContext, databaseInfoName, databaseInfoHelp, prometheus.GaugeValue, constLabelPairs, "driver", "version")
+
+	var silencedDesc MetricDesc
+	if gc.Silences != nil {
+		silencedDesc = NewAutomaticMetricDesc(
+			logContext, silencedName, silencedHelp, prometheus.GaugeValue, constLabelPairs)
+	}
+	var maintenanceDesc MetricDesc
+	if len(maintenance) > 0 {
+		maintenanceDesc = NewAutomaticMetricDesc(
+			logContext, maintenanceName, maintenanceHelp, prometheus.GaugeValue, constLabelPairs)
+	}
+
+	var rl *replicaLag
+	if rlc != nil {
+		rl = &replicaLag{
+			config: rlc,
+			desc: NewAutomaticMetricDesc(
+				logContext, replicaLagName, replicaLagHelp, prometheus.GaugeValue, constLabelPairs),
+			logContext: logContext,
+		}
+	}
+
+	auditLog, err := openAuditLog(gc.AuditLog)
+	if err != nil {
+		return nil, errors.Wrapf(logContext, err, "opening audit log failed")
 	}
 
 	upDesc := NewAutomaticMetricDesc(logContext, upMetricName, upMetricHelp, prometheus.GaugeValue, constLabelPairs)
 	scrapeDurationDesc :=
 		NewAutomaticMetricDesc(logContext, scrapeDurationName, scrapeDurationHelp, prometheus.GaugeValue, constLabelPairs)
+	var failover *dataSourceFailover
+	if len(dsns) > 1 {
+		failover = newDataSourceFailover(dsns, constLabels)
+	}
+
 	t := target{
 		name:               name,
-		dsn:                dsn,
+		dialTimeout:        dialTimeout,
+		failover:           failover,
 		collectors:         collectors,
+		collectorNames:     collectorNames,
+		collectorWhen:      collectorWhen,
+		pooler:             pooler,
+		location:           loc,
 		constLabels:        constLabels,
 		globalConfig:       gc,
 		upDesc:             upDesc,
 		scrapeDurationDesc: scrapeDurationDesc,
+		failOnError:        failOnError,
+		health:             newTargetHealth(constLabels, gc.FlapDamping),
+		databaseInfo:       dbInfo,
+		databaseInfoDesc:   databaseInfoDesc,
+		maintenance:        maintenance,
+		maintenanceDesc:    maintenanceDesc,
+		replicaLag:         rl,
+		lagSensitive:       lagSensitive,
+		connParams:         connParams,
+		failsOnError:       failsOnError,
+		silencedDesc:       silencedDesc,
+		metadata:           metadata,
+		auditLog:           auditLog,
 		logContext:         logContext,
+		connRefs:           make(map[*sql.DB]int),
+		retired:            make(map[*sql.DB]bool),
+		paramsConns:        make(map[string]*paramsConn),
 	}
+	t.dsn.Store(dsn)
 	return &t, nil
 }
 
@@ -98,68 +237,443 @@ func (t *target) Collect(ctx context.Context, ch chan<- Metric) {
 		targetUp    = true
 	)
 
-	err := t.ping(ctx)
-	if err != nil {
-		ch <- NewInvalidMetric(errors.Wrap(t.logContext, err))
-		targetUp = false
+	// Skip the scrape altogether during maintenance windows, but say why `up` is 0.
+	if config.InMaintenance(t.maintenance, scrapeStart) {
+		log.V(1).Infof("[%s] In maintenance window, skipping scrape", t.logContext)
+		if t.name != "" {
+			ch <- NewMetric(t.maintenanceDesc, 1)
+			ch <- NewMetric(t.upDesc, 0)
+			ch <- NewMetric(t.scrapeDurationDesc, float64(time.Since(scrapeStart))*1e-9)
+		}
+		return
 	}
-	if t.name != "" {
+	if t.name != "" && t.maintenanceDesc != nil {
+		ch <- NewMetric(t.maintenanceDesc, 0)
+	}
+
+	// Likewise for targets silenced in an external system (e.g. Alertmanager).
+	if t.silencedDesc != nil && targetSilences.isSilenced(t.constLabels, scrapeStart) {
+		log.V(1).Infof("[%s] Silenced, skipping scrape", t.logContext)
+		if t.name != "" {
+			ch <- NewMetric(t.silencedDesc, 1)
+			ch <- NewMetric(t.upDesc, 0)
+			ch <- NewMetric(t.scrapeDurationDesc, float64(time.Since(scrapeStart))*1e-9)
+		}
+		return
+	}
+	if t.name != "" && t.silencedDesc != nil {
+		ch <- NewMetric(t.silencedDesc, 0)
+	}
+
+	// No database to ping in demo mode, the target is always up.
+	var conn *sql.DB
+	if !*demoMode {
+		if t.health.damped(scrapeStart) {
+			// Don't record damped scrapes, we haven't actually tried to connect.
+			ch <- NewInvalidMetric(errors.New(t.logContext, "target is flapping, connection attempts damped"))
+			targetUp = false
+		} else {
+			var err errors.WithContext
+			if conn, err = t.connect(ctx); err != nil {
+				ch <- NewInvalidMetric(errors.Wrap(t.logContext, err))
+				targetUp = false
+			} else {
+				defer t.releaseConn(conn)
+			}
+			t.health.record(targetUp, scrapeStart)
+		}
+	}
+	if t.name != "" && !t.failOnError {
 		// Export the target's `up` metric as early as we know what it should be.
 		ch <- NewMetric(t.upDesc, boolToFloat64(targetUp))
 	}
 
-	var wg sync.WaitGroup
+	if targetUp && t.databaseInfo != nil && !*demoMode {
+		version, err := t.databaseInfo.get(ctx, conn)
+		if err != nil {
+			ch <- NewInvalidMetric(err)
+		}
+		if version != "" {
+			ch <- NewMetric(t.databaseInfoDesc, 1, t.databaseInfo.driver, version)
+		}
+	}
+
 	// Don't bother with the collectors if target is down.
 	if targetUp {
-		wg.Add(len(t.collectors))
-		for _, c := range t.collectors {
-			// If using a single DB connection, collectors will likely run sequentially anyway. But we might have more.
-			go func(collector Collector) {
-				defer wg.Done()
-				collector.Collect(ctx, t.conn, ch)
-			}(c)
+		ctx = t.metadataContext(ctx, conn, ch)
+		if hb := hostBudgetFor(t.dataSourceName(), t.globalConfig.MaxQueriesPerHost); hb != nil {
+			ctx = withHostBudget(ctx, hb)
+		}
+		stale := false
+		if t.replicaLag != nil && !*demoMode {
+			stale = t.replicaLag.stale(ctx, conn, ch, t.name != "")
+		}
+		if t.failOnError {
+			targetUp = t.collectOrFail(ctx, conn, stale, ch)
+		} else {
+			t.runCollectors(ctx, conn, stale, ch)
 		}
 	}
-	// Wait for all collectors (if any) to complete.
-	wg.Wait()
 
 	if t.name != "" {
+		if t.failOnError {
+			// Only now do we know whether the scrape failed.
+			ch <- NewMetric(t.upDesc, boolToFloat64(targetUp))
+		}
 		// And export a `scrape duration` metric once we're done scraping.
 		ch <- NewMetric(t.scrapeDurationDesc, float64(time.Since(scrapeStart))*1e-9)
 	}
 }
 
-func (t *target) ping(ctx context.Context) errors.WithContext {
-	// Create the DB handle, if necessary. It won't usually open an actual connection, so we'll need to ping afterwards.
-	// We cannot do this only once at creation time because the sql.Open() documentation says it "may" open an actual
-	// connection, so it "may" actually fail to open a handle to a DB that's initially down.
-	if t.conn == nil {
-		conn, err := OpenConnection(ctx, t.logContext, t.dsn, t.globalConfig.MaxConns, t.globalConfig.MaxIdleConns)
-		if err != nil {
-			if err != ctx.Err() {
-				return errors.Wrap(t.logContext, err)
+// runCollectors runs all collectors (except paused ones and those whose `when` condition does not hold) concurrently
+// on conn, piping their metrics into ch, and returns once all have completed. If the replica's data is stale, lag
+// sensitive collectors are skipped or their metrics labelled, see config.ReplicaLagConfig.
+func (t *target) runCollectors(ctx context.Context, conn *sql.DB, stale bool, ch chan<- Metric) {
+	var (
+		wg  sync.WaitGroup
+		now = time.Now()
+	)
+	for i, c := range t.collectors {
+		if collectorPauses.isPaused(t.collectorNames[i], now) || !applies(ctx, t.collectorWhen[i]) {
+			continue
+		}
+		lagging := stale && t.lagSensitive[i]
+		if lagging && t.replicaLag.config.Action == config.ReplicaLagSkip {
+			continue
+		}
+		wg.Add(1)
+		// If using a single DB connection, collectors will likely run sequentially anyway. But we might have more.
+		go func(i int, collector Collector, name string) {
+			defer wg.Done()
+			defer recoverCollect(t.logContext, ch)
+			conn := conn
+			// Collectors with connection_params run on a DB handle of their own (none in demo mode).
+			if len(t.connParams[i]) > 0 && conn != nil {
+				var err errors.WithContext
+				if conn, err = t.connectWithParams(ctx, t.connParams[i]); err != nil {
+					err = errors.Wrapf(t.logContext, err, "connecting with connection_params of collector %q failed", name)
+					if t.failsOnError[i] {
+						ch <- NewFatalMetric(err)
+					} else {
+						ch <- NewInvalidMetric(err)
+					}
+					return
+				}
+				defer t.releaseConn(conn)
 			}
-			// if err == ctx.Err() fall through
-		} else {
-			t.conn = conn
+			t.collectAndMeasure(ctx, conn, collector, name, lagging, ch)
+		}(i, c, t.collectorNames[i])
+	}
+	// Wait for all collectors to complete.
+	wg.Wait()
+}
+
+// collectAndMeasure runs the named collector on conn, piping its metrics into ch (labelled stale_data="true" if stale
+// is true) as sizedMetrics, for gatherTargets to record their approximate size as it writes them.
+func (t *target) collectAndMeasure(
+	ctx context.Context, conn *sql.DB, collector Collector, name string, stale bool, ch chan<- Metric) {
+	collChan := make(chan Metric, capMetricChan)
+	go func() {
+		defer close(collChan)
+		defer recoverCollect(t.logContext, collChan)
+		collector.Collect(ctx, conn, collChan)
+	}()
+
+	measured := false
+	for metric := range collChan {
+		if !isInvalid(metric) {
+			if stale {
+				metric = staleMetric{metric}
+			}
+			metric = sizedMetric{Metric: metric, target: t, collector: name}
+			measured = true
+		}
+		ch <- metric
+	}
+	if !measured {
+		t.recordCollectorSize(name, 0, 0)
+	}
+}
+
+// recordCollectorSize records the size of the metrics produced by the named collector in the last scrape, unless the
+// target was closed meanwhile (so the sizes deleted by releaseLocked aren't recreated).
+func (t *target) recordCollectorSize(collector string, samples, bytes int) {
+	t.connMtx.Lock()
+	defer t.connMtx.Unlock()
+	if !t.closed {
+		collectorSizes.record(t.constLabels["job"], t.constLabels["instance"], collector, samples, bytes)
+	}
+}
+
+// collectOrFail runs all collectors on conn, buffering their metrics. If any on_error=fail collector failed, only the
+// errors are piped into ch and false is returned. Else all metrics are piped into ch and it returns true.
+func (t *target) collectOrFail(ctx context.Context, conn *sql.DB, stale bool, ch chan<- Metric) bool {
+	bufChan := make(chan Metric, capMetricChan)
+	go func() {
+		defer close(bufChan)
+		defer recoverCollect(t.logContext, bufChan)
+		t.runCollectors(ctx, conn, stale, bufChan)
+	}()
+
+	var (
+		metrics = make([]Metric, 0, capMetricChan)
+		failed  = false
+	)
+	for metric := range bufChan {
+		metrics = append(metrics, metric)
+		failed = failed || isFatal(metric)
+	}
+	for _, metric := range metrics {
+		if !failed || isInvalid(metric) {
+			ch <- metric
 		}
 	}
+	return !failed
+}
+
+// connAuditor returns an auditor for the connections to the data source named dsn, nil if auditing is disabled.
+func (t *target) connAuditor(dsn string) *connAuditor {
+	if t.auditLog == nil {
+		return nil
+	}
+	return &connAuditor{
+		log:        t.auditLog,
+		job:        t.constLabels["job"],
+		instance:   t.constLabels["instance"],
+		target:     redactDSN(dsn),
+		logContext: t.logContext,
+	}
+}
+
+// metadataContext detects the target metadata on conn, if any collector or metric has a `when` condition, and returns
+// a copy of ctx carrying it. Detection errors are piped into ch, leaving conditional collectors and metrics out.
+func (t *target) metadataContext(ctx context.Context, conn *sql.DB, ch chan<- Metric) context.Context {
+	if t.metadata == nil {
+		return ctx
+	}
+	metadata, err := t.metadata.get(ctx, conn)
+	if err != nil {
+		ch <- NewInvalidMetric(err)
+		return ctx
+	}
+	return withMetadata(ctx, metadata)
+}
+
+// Ping implements Target.
+func (t *target) Ping(ctx context.Context) errors.WithContext {
+	return t.ping(ctx)
+}
 
-	// If we have a handle and the context is not closed, test whether the database is up.
-	if t.conn != nil && ctx.Err() == nil {
-		var err error
-		// Ping up to max_connections + 1 times as long as the returned error is driver.ErrBadConn, to purge the connection
-		// pool of bad connections. This might happen if the previous scrape timed out and in-flight queries got canceled.
-		for i := 0; i <= t.globalConfig.MaxConns; i++ {
-			if err = PingDB(ctx, t.conn); err != driver.ErrBadConn {
-				break
+// Labels implements Target.
+func (t *target) Labels() prometheus.Labels {
+	return t.constLabels
+}
+
+// Close implements Target.
+func (t *target) Close() error {
+	t.connMtx.Lock()
+	defer t.connMtx.Unlock()
+
+	// DB handles still in use by scrapes in progress are only closed once those complete, see releaseConn.
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+	if t.failover != nil {
+		close(t.failover.stop)
+		for i, conn := range t.failover.conns {
+			if conn != nil {
+				t.retireLocked(conn)
+				t.failover.conns[i] = nil
 			}
 		}
+	} else if t.conn != nil {
+		t.retireLocked(t.conn)
+	}
+	t.conn = nil
+	for key, pc := range t.paramsConns {
+		if pc.conn != nil {
+			t.retireLocked(pc.conn)
+		}
+		delete(t.paramsConns, key)
+	}
+	if len(t.connRefs) == 0 {
+		t.releaseLocked()
+	}
+	return nil
+}
+
+// releaseLocked deletes the process metrics of the closed target and its collectors, once no scrapes are in progress
+// (so they aren't recreated). Must be called with connMtx held.
+func (t *target) releaseLocked() {
+	if t.released {
+		return
+	}
+	t.released = true
+
+	job, instance := t.constLabels["job"], t.constLabels["instance"]
+	constLabels := make([]*dto.LabelPair, 0, len(t.constLabels))
+	for n, v := range t.constLabels {
+		constLabels = append(constLabels, &dto.LabelPair{Name: proto.String(n), Value: proto.String(v)})
+	}
+	for _, coll := range t.collectors {
+		if c := rawCollector(coll); c != nil {
+			c.release(constLabels)
+		}
+	}
+	collectorSizes.remove(job, instance)
+	targetFlaps.DeleteLabelValues(job, instance)
+	targetLastStateChange.DeleteLabelValues(job, instance)
+	startupProbeSuccess.DeleteLabelValues(job, instance)
+	if t.failover != nil {
+		for _, dsn := range t.failover.dsns {
+			dataSourceActive.DeleteLabelValues(job, instance, redactDSN(dsn))
+		}
+	}
+}
+
+func (t *target) ping(ctx context.Context) errors.WithContext {
+	conn, err := t.connect(ctx)
+	if err != nil {
+		return err
+	}
+	t.releaseConn(conn)
+	return nil
+}
+
+// connect pings the target and returns its DB handle, which remains open until released via releaseConn, even if the
+// data source name is replaced in the meantime. The database is pinged without holding connMtx, so an unreachable
+// database doesn't hold up concurrent scrapes of the target (or reloads) for as long as it takes to time out.
+func (t *target) connect(ctx context.Context) (*sql.DB, errors.WithContext) {
+	if t.failover != nil {
+		return t.connectFailover(ctx)
+	}
+
+	t.connMtx.Lock()
+	conn, err := t.acquireLocked(ctx, t.dataSourceName(), &t.conn)
+	t.connMtx.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return t.pingAcquired(ctx, conn)
+}
+
+// acquireLocked returns the DB handle in *conn, first opening one for dsn if nil, and takes a reference to it, to be
+// released via releaseConn. Must be called with connMtx held.
+func (t *target) acquireLocked(ctx context.Context, dsn string, conn **sql.DB) (*sql.DB, errors.WithContext) {
+	if t.closed {
+		return nil, errors.New(t.logContext, "target closed")
+	}
+	// Create the DB handle, if necessary. It won't open an actual connection (see openDB), so it's fine to do it with
+	// connMtx held. We cannot do this only once at creation time because the sql.Open() documentation says it "may"
+	// open an actual connection, so it "may" actually fail to open a handle to a DB that's initially down.
+	if *conn == nil {
+		c, err := openConnection(ctx, t.logContext, dsn, t.dialTimeout, t.globalConfig.MaxConns,
+			t.globalConfig.MaxIdleConns, t.connAuditor(dsn))
 		if err != nil {
-			return errors.Wrap(t.logContext, err)
+			return nil, errors.Wrap(t.logContext, err)
+		}
+		*conn = c
+	}
+	t.connRefs[*conn]++
+	return *conn, nil
+}
+
+// pingAcquired pings conn, returned by acquireLocked, and returns it if the database is reachable. Else it releases
+// conn and returns the error. Must be called without connMtx held.
+func (t *target) pingAcquired(ctx context.Context, conn *sql.DB) (*sql.DB, errors.WithContext) {
+	if err := t.pingConn(ctx, conn); err != nil {
+		t.releaseConn(conn)
+		return nil, err
+	}
+	return conn, nil
+}
+
+// releaseConn releases a DB handle returned by connect. If the handle was retired in the meantime and this was its last
+// user, it is closed.
+func (t *target) releaseConn(conn *sql.DB) {
+	t.connMtx.Lock()
+	defer t.connMtx.Unlock()
+
+	t.connRefs[conn]--
+	if t.connRefs[conn] > 0 {
+		return
+	}
+	delete(t.connRefs, conn)
+	if t.retired[conn] {
+		delete(t.retired, conn)
+		log.V(1).Infof("[%s] Closing retired DB handle", t.logContext)
+		conn.Close()
+	}
+	if t.closed && len(t.connRefs) == 0 {
+		t.releaseLocked()
+	}
+}
+
+// dataSourceName returns the active data source name.
+func (t *target) dataSourceName() string {
+	return t.dsn.Load().(string)
+}
+
+// setDataSources replaces the target's data source names, e.g. with ones carrying rotated credentials. Subsequent
+// scrapes open new DB handles for the data sources that changed, while scrapes in progress complete on the previous
+// ones, which are only closed once they are done. Neither the number of data source names nor the driver can change.
+// Returns true if any data source name was actually replaced.
+func (t *target) setDataSources(dsns []string) (bool, error) {
+	t.connMtx.Lock()
+	defer t.connMtx.Unlock()
+
+	current := []string{t.dataSourceName()}
+	if t.failover != nil {
+		current = t.failover.dsns
+	}
+	if len(dsns) != len(current) {
+		return false, fmt.Errorf("cannot change the number of data source names from %d to %d", len(current), len(dsns))
+	}
+	// Collectors' queries are prepared for the driver, it cannot change.
+	for i, dsn := range dsns {
+		if driver, previous := DriverName(dsn), DriverName(current[i]); driver != previous {
+			return false, fmt.Errorf("cannot replace %s data source name with a %s one", previous, driver)
 		}
 	}
 
+	if t.failover != nil {
+		return t.failover.replace(t, dsns), nil
+	}
+	if dsns[0] == current[0] {
+		return false, nil
+	}
+	log.Infof("[%s] Data source name replaced, draining the previous DB handle", t.logContext)
+	t.dsn.Store(dsns[0])
+	if t.conn != nil {
+		t.retireLocked(t.conn)
+		t.conn = nil
+	}
+	return true, nil
+}
+
+// retireLocked closes conn, deferring it until released by all scrapes still using it. Must be called with connMtx held.
+func (t *target) retireLocked(conn *sql.DB) {
+	if t.connRefs[conn] > 0 {
+		t.retired[conn] = true
+	} else {
+		conn.Close()
+	}
+}
+
+// pingConn checks that the database behind conn is reachable.
+func (t *target) pingConn(ctx context.Context, conn *sql.DB) errors.WithContext {
+	var err error
+	// Ping up to max_connections + 1 times as long as the returned error is driver.ErrBadConn, to purge the connection
+	// pool of bad connections. This might happen if the previous scrape timed out and in-flight queries got canceled.
+	for i := 0; i <= t.globalConfig.MaxConns && ctx.Err() == nil; i++ {
+		if err = PingDB(ctx, conn); err != driver.ErrBadConn {
+			break
+		}
+	}
+	if err != nil {
+		return errors.Wrap(t.logContext, err)
+	}
 	if ctx.Err() != nil {
 		return errors.Wrap(t.logContext, ctx.Err())
 	}
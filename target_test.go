@@ -0,0 +1,252 @@
+package sql_exporter
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/free/sql_exporter/config"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// TestTargetConcurrentScrapes scrapes a target concurrently while its data source name is repeatedly replaced (as when
+// rotating credentials), to be run with -race. Every scrape must succeed, on either data source.
+func TestTargetConcurrentScrapes(t *testing.T) {
+	const (
+		scrapers  = 8
+		scrapes   = 50
+		rotations = 100
+	)
+
+	// Two results files, returning different values so we can tell which data source a scrape ran on.
+	dir := t.TempDir()
+	dsns := make([]string, 2)
+	for i := range dsns {
+		path := filepath.Join(dir, fmt.Sprintf("results%d.yml", i))
+		results := fmt.Sprintf("results:\n  - query: 'FROM pg_stat_database'\n    columns: [datname, xact_commit]\n"+
+			"    rows:\n      - [postgres, %d]\n", i+1)
+		if err := os.WriteFile(path, []byte(results), 0644); err != nil {
+			t.Fatal(err)
+		}
+		dsns[i] = "testdriver://" + filepath.ToSlash(path)
+	}
+	e := newTestExporter(t, "results: []", `
+global:
+  max_connections: 2
+  max_idle_connections: 2
+jobs:
+  - job_name: pg
+    collectors: [pg_database]
+    static_configs:
+      - targets:
+          db1: '`+dsns[0]+`'
+collectors:
+  - collector_name: pg_database
+    metrics:
+      - metric_name: pg_xact_commit_total
+        type: counter
+        help: 'Committed transactions.'
+        key_labels: [datname]
+        values: [xact_commit]
+        query: SELECT datname, xact_commit FROM pg_stat_database
+`)
+	tgt, err := e.(*exporter).targets.lookup("pg", "db1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, scrapers*scrapes)
+	for i := 0; i < scrapers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < scrapes; j++ {
+				mfs, err := e.GatherContext(context.Background())
+				if err != nil {
+					errs <- err
+					continue
+				}
+				var found bool
+				for _, mf := range mfs {
+					if mf.GetName() != "pg_xact_commit_total" {
+						continue
+					}
+					for _, m := range mf.Metric {
+						if v := m.GetCounter().GetValue(); v != 1 && v != 2 {
+							errs <- fmt.Errorf("unexpected value %v", v)
+						}
+						found = true
+					}
+				}
+				if !found {
+					errs <- fmt.Errorf("missing pg_xact_commit_total in %v", mfs)
+				}
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rotations; i++ {
+			if _, err := tgt.setDataSources(dsns[i%2 : i%2+1]); err != nil {
+				errs <- err
+			}
+		}
+	}()
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+var xactCommitRE = regexp.MustCompile(`(?m)^pg_xact_commit_total{.*} (\d+)$`)
+
+func TestUpdateDataSources(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return filepath.ToSlash(path)
+	}
+	results := func(value int) string {
+		return fmt.Sprintf("results:\n  - query: 'FROM pg_stat_database'\n    columns: [datname, xact_commit]\n"+
+			"    rows:\n      - [postgres, %d]\n", value)
+	}
+	dsns := []string{"testdriver://" + write("results1.yml", results(1)), "testdriver://" + write("results2.yml", results(2))}
+
+	tests := []struct {
+		name   string
+		config string
+		files  []string // contents of dsn.txt, before and after the update
+	}{
+		{
+			name: "job",
+			config: `
+jobs:
+  - job_name: pg
+    collectors: [pg_database]
+    static_configs:
+      - target_files:
+          db1: '` + filepath.ToSlash(filepath.Join(dir, "dsn.txt")) + `'`,
+			files: []string{dsns[0], dsns[1]},
+		},
+		{
+			name: "failover",
+			config: `
+target:
+  data_source_name_file: '` + filepath.ToSlash(filepath.Join(dir, "dsn.txt")) + `'
+  collectors: [pg_database]`,
+			files: []string{dsns[0] + "\n" + dsns[1], dsns[1] + "\n" + dsns[0]},
+		},
+	}
+	const collectors = `
+collectors:
+  - collector_name: pg_database
+    metrics:
+      - metric_name: pg_xact_commit_total
+        type: counter
+        help: 'Committed transactions.'
+        key_labels: [datname]
+        values: [xact_commit]
+        query: SELECT datname, xact_commit FROM pg_stat_database
+`
+
+	for _, test := range tests {
+		write("dsn.txt", test.files[0])
+		e := newTestExporter(t, "results: []", test.config+collectors)
+		for i, want := range []string{"1", "2"} {
+			if i > 0 {
+				write("dsn.txt", test.files[i])
+				c, err := config.Parse([]byte(test.config + collectors))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := e.UpdateDataSources(c); err != nil {
+					t.Fatalf("%s: unexpected error: %s", test.name, err)
+				}
+			}
+			got, err := gatherText(t, e)
+			if err != nil {
+				t.Fatalf("%s: unexpected scrape error: %s", test.name, err)
+			}
+			// The value of pg_xact_commit_total tells which data source the scrape ran on.
+			if m := xactCommitRE.FindStringSubmatch(got); m == nil || m[1] != want {
+				t.Errorf("%s: expected pg_xact_commit_total %s, got:\n%s", test.name, want, got)
+			}
+		}
+		e.Close()
+	}
+}
+
+// TestUpdateDataSourcesProbe checks that targets are probed again when their data source names change, if configured.
+func TestUpdateDataSourcesProbe(t *testing.T) {
+	dir := t.TempDir()
+	dsnFile := filepath.ToSlash(filepath.Join(dir, "dsn.txt"))
+	write := func(dsn string) {
+		if err := os.WriteFile(dsnFile, []byte(dsn), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	results := filepath.ToSlash(filepath.Join(dir, "results.yml"))
+	if err := os.WriteFile(results, []byte("results: []"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	configYAML := `
+global:
+  startup_probe: {}
+jobs:
+  - job_name: probe
+    collectors: [empty]
+    static_configs:
+      - target_files:
+          db1: '` + dsnFile + `'
+collectors:
+  - collector_name: empty
+    metrics:
+      - metric_name: empty
+        type: gauge
+        help: 'Empty.'
+        values: [v]
+        query: SELECT v
+`
+	// waitForProbe waits for the target's probe result to be value.
+	waitForProbe := func(value float64) {
+		t.Helper()
+		var m dto.Metric
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+			if err := startupProbeSuccess.WithLabelValues("probe", "db1").Write(&m); err != nil {
+				t.Fatal(err)
+			}
+			if m.GetGauge().GetValue() == value {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("expected sql_exporter_startup_probe_success %v, got %v", value, m.GetGauge().GetValue())
+	}
+
+	write("testdriver://" + results)
+	e := newTestExporter(t, "results: []", configYAML)
+	waitForProbe(1)
+
+	// A data source name the target can't connect to, found by the probe following the update.
+	write("testdriver://" + filepath.ToSlash(filepath.Join(dir, "missing.yml")))
+	c, err := config.Parse([]byte(configYAML))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.UpdateDataSources(c); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	waitForProbe(0)
+}
@@ -0,0 +1,14 @@
+//go:build testdriver
+// +build testdriver
+
+package sql_exporter
+
+import (
+	"github.com/free/sql_exporter/internal/testdriver" // register the canned results driver
+)
+
+// The canned results driver reads (and parses) any file named by a data source name, so it is only compiled in on
+// request, for trying out configurations locally: `go build -tags testdriver ./cmd/sql_exporter`.
+func init() {
+	RegisterDriverPackage(testdriver.DriverName, exporterPackage+"/internal/testdriver")
+}
@@ -0,0 +1,98 @@
+package sql_exporter
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// timestampLayouts are the formats of timestamps without an offset returned as text, e.g. MySQL DATETIME columns
+// (unless the `parseTime` driver option is set).
+var timestampLayouts = []string{
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02",
+}
+
+// valueScanner is a sql.Scanner reading a value column into a float64: numbers as is and timestamps as seconds since
+// the epoch. Timestamps without an offset (returned as text, or as times in UTC, like MySQL and SQL Server DATETIME
+// columns) are interpreted in loc.
+type valueScanner struct {
+	loc *time.Location
+	// If true, NULL is read as an invalid value rather than failing.
+	nullable bool
+
+	value float64
+	valid bool
+}
+
+// Scan implements sql.Scanner.
+func (vs *valueScanner) Scan(src interface{}) error {
+	vs.valid = true
+	switch v := src.(type) {
+	case float64:
+		vs.value = v
+	case int64:
+		vs.value = float64(v)
+	case time.Time:
+		vs.value = float64(vs.inLocation(v).UnixNano()) / 1e9
+	case []byte:
+		return vs.scanText(string(v))
+	case string:
+		return vs.scanText(v)
+	case nil:
+		if !vs.nullable {
+			return errors.New("converting NULL to float64 is unsupported")
+		}
+		vs.valid = false
+	default:
+		// Drivers not limiting themselves to driver.Value types, e.g. ClickHouse.
+		rv := reflect.ValueOf(src)
+		switch rv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			vs.value = float64(rv.Int())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			vs.value = float64(rv.Uint())
+		case reflect.Float32, reflect.Float64:
+			vs.value = rv.Float()
+		default:
+			return fmt.Errorf("converting %T to float64 is unsupported", src)
+		}
+	}
+	return nil
+}
+
+// scanText reads a number or a timestamp without an offset from its text representation.
+func (vs *valueScanner) scanText(text string) error {
+	v, err := strconv.ParseFloat(text, 64)
+	if err == nil {
+		vs.value = v
+		return nil
+	}
+	for _, layout := range timestampLayouts {
+		if t, terr := time.ParseInLocation(layout, text, vs.location()); terr == nil {
+			vs.value = float64(t.UnixNano()) / 1e9
+			return nil
+		}
+	}
+	return fmt.Errorf("converting %q to float64: %s", text, err)
+}
+
+// inLocation returns t, interpreted in the configured location if it has no offset (i.e. it is in UTC).
+func (vs *valueScanner) inLocation(t time.Time) time.Time {
+	loc := vs.location()
+	if t.Location() != time.UTC || loc == time.UTC {
+		return t
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), loc)
+}
+
+// location returns the time zone of timestamps without an offset, UTC if not configured.
+func (vs *valueScanner) location() *time.Location {
+	if vs.loc == nil {
+		return time.UTC
+	}
+	return vs.loc
+}
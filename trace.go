@@ -0,0 +1,157 @@
+package sql_exporter
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/free/sql_exporter/errors"
+)
+
+// CollectorTrace is the timing breakdown of a single traced collector run, see Exporter.TraceCollector.
+type CollectorTrace struct {
+	Job       string        `json:"job,omitempty"`
+	Target    string        `json:"target,omitempty"`
+	Collector string        `json:"collector"`
+	Seconds   float64       `json:"seconds"`
+	Metrics   int           `json:"metrics"`
+	Errors    []string      `json:"errors,omitempty"`
+	Queries   []*QueryTrace `json:"queries"`
+
+	mtx sync.Mutex
+}
+
+// QueryTrace is the timing breakdown of one query of a traced collector run. Times are summed over all pages of
+// paginated queries.
+type QueryTrace struct {
+	Query string `json:"query"`
+	// Time spent preparing the statement, zero if already prepared or executed directly.
+	PrepareSeconds float64 `json:"prepare_seconds"`
+	// Time spent executing the query, up to the first result row being available.
+	ExecSeconds float64 `json:"exec_seconds"`
+	// Time spent reading, scanning and processing result rows.
+	ScanSeconds float64 `json:"scan_seconds"`
+	Rows        int     `json:"rows"`
+	// Approximate size of the scanned rows: string lengths plus 8 bytes per numeric value.
+	Bytes int    `json:"bytes"`
+	Error string `json:"error,omitempty"`
+}
+
+// traceKey is the context key under which a *CollectorTrace is stored.
+type traceKey struct{}
+
+// withTrace returns a copy of ctx carrying the provided trace.
+func withTrace(ctx context.Context, trace *CollectorTrace) context.Context {
+	return context.WithValue(ctx, traceKey{}, trace)
+}
+
+// traceFrom returns the trace carried by ctx, if any.
+func traceFrom(ctx context.Context) *CollectorTrace {
+	trace, _ := ctx.Value(traceKey{}).(*CollectorTrace)
+	return trace
+}
+
+// rowLimitKey is the context key under which the row limit of sampled runs is stored.
+type rowLimitKey struct{}
+
+// withRowLimit returns a copy of ctx limiting the queries run in it to n result rows each, for sampled debugging runs.
+func withRowLimit(ctx context.Context, n int) context.Context {
+	return context.WithValue(ctx, rowLimitKey{}, n)
+}
+
+// rowLimitFrom returns the row limit carried by ctx, 0 if none.
+func rowLimitFrom(ctx context.Context) int {
+	n, _ := ctx.Value(rowLimitKey{}).(int)
+	return n
+}
+
+// dryRunKey is the context key marking runs without lasting effects, see withDryRun.
+type dryRunKey struct{}
+
+// withDryRun returns a copy of ctx marking the collector runs in it as dry runs (debug traces and previews), which only
+// return their results: they don't write logs, advance watermarks or time windows, update quarantines, checksums,
+// schemas or cached values, nor count as successful collections.
+func withDryRun(ctx context.Context) context.Context {
+	return context.WithValue(ctx, dryRunKey{}, true)
+}
+
+// isDryRun returns true if ctx is marked as a dry run, see withDryRun.
+func isDryRun(ctx context.Context) bool {
+	dryRun, _ := ctx.Value(dryRunKey{}).(bool)
+	return dryRun
+}
+
+// startQuery adds and returns the trace for the named query. Safe to call from concurrently running queries.
+func (ct *CollectorTrace) startQuery(name string) *QueryTrace {
+	qt := &QueryTrace{Query: name}
+	ct.mtx.Lock()
+	defer ct.mtx.Unlock()
+	ct.Queries = append(ct.Queries, qt)
+	return qt
+}
+
+// rowBytes returns the approximate size of a scanned row: the length of string and []byte values, 8 bytes for any
+// other value.
+func rowBytes(row map[string]interface{}) int {
+	n := 0
+	for _, v := range row {
+		switch v := v.(type) {
+		case string:
+			n += len(v)
+		case []byte:
+			n += len(v)
+		default:
+			n += 8
+		}
+	}
+	return n
+}
+
+// traceCollector runs the named collector of t once, bypassing any caching and without lasting effects (see
+// withDryRun), and returns its timing breakdown. If rowLimit is positive, every query is limited to that many result
+// rows (see Exporter.TraceCollector).
+func traceCollector(ctx context.Context, t *target, name string, rowLimit int) (*CollectorTrace, error) {
+	var coll Collector
+	for i, n := range t.collectorNames {
+		if n == name {
+			coll = t.collectors[i]
+		}
+	}
+	if coll == nil {
+		return nil, fmt.Errorf("collector %q not defined for target", name)
+	}
+
+	trace := &CollectorTrace{Job: t.constLabels["job"], Target: t.name, Collector: name, Queries: []*QueryTrace{}}
+	start := time.Now()
+	// Identify all statements executed by the trace in the audit log (if enabled), including the ping.
+	ctx = withAuditScope(ctx, auditScope{scrapeID: "trace-" + newScrapeID()})
+	var conn *sql.DB
+	if !*demoMode {
+		var err errors.WithContext
+		if conn, err = t.connect(ctx); err != nil {
+			return nil, err
+		}
+		defer t.releaseConn(conn)
+	}
+
+	ch := make(chan Metric, capMetricChan)
+	go func() {
+		ctx := t.metadataContext(ctx, conn, ch)
+		if rowLimit > 0 {
+			ctx = withRowLimit(ctx, rowLimit)
+		}
+		coll.Collect(withTrace(withDryRun(ctx), trace), conn, ch)
+		close(ch)
+	}()
+	for metric := range ch {
+		if isInvalid(metric) {
+			trace.Errors = append(trace.Errors, metric.(invalidMetric).err.Error())
+		} else {
+			trace.Metrics++
+		}
+	}
+	trace.Seconds = time.Since(start).Seconds()
+	return trace, nil
+}
@@ -0,0 +1,71 @@
+package sql_exporter
+
+import (
+	"context"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestTraceCollectorDryRun(t *testing.T) {
+	e := newTestExporter(t, `
+results:
+  - query: 'FROM events'
+    columns: [kind, events]
+    rows:
+      - [login, 3]
+`, `
+jobs:
+  - job_name: app
+    collectors: [events]
+    static_configs:
+      - targets:
+          db1: 'RESULTS'
+collectors:
+  - collector_name: events
+    metrics:
+      - metric_name: app_events
+        type: gauge
+        help: 'Events since the last scrape.'
+        key_labels: [kind]
+        values: [events]
+        query: SELECT kind, COUNT(*) AS events FROM events WHERE ts > :__last_scrape GROUP BY kind
+`)
+	tgt, err := e.(*exporter).targets.lookup("app", "db1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := tgt.collectors[0].(*collector).queries[0]
+	lastSuccess := func() float64 {
+		m := &dto.Metric{}
+		if err := collectorLastSuccess.WithLabelValues("app", "db1", "events").Write(m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetGauge().GetValue()
+	}
+
+	trace, err := e.TraceCollector(context.Background(), "app", "db1", "events", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if trace.Metrics != 1 || len(trace.Errors) > 0 || len(trace.Queries) != 1 || trace.Queries[0].Rows != 1 {
+		t.Errorf("unexpected trace %+v", trace)
+	}
+	// Traces don't move the time window forward, nor count as successful collections.
+	if !q.lastCollection.IsZero() {
+		t.Errorf("time window moved by trace, last collection at %s", q.lastCollection)
+	}
+	if v := lastSuccess(); v != 0 {
+		t.Errorf("collector last success set by trace, to %v", v)
+	}
+
+	if _, err := e.GatherContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if q.lastCollection.IsZero() {
+		t.Errorf("time window not moved by scrape")
+	}
+	if v := lastSuccess(); v == 0 {
+		t.Errorf("collector last success not set by scrape")
+	}
+}
@@ -0,0 +1,41 @@
+package sql_exporter
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	// Values of the `reason` label of sql_exporter_query_truncated_total.
+	truncatedMaxRows  = "max_rows"
+	truncatedDeadline = "deadline"
+)
+
+var queryTruncated = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "sql_exporter_query_truncated_total",
+	Help: "Number of executions of the query on the target whose results were only partially read, by reason: " +
+		"pagination max_rows reached or scrape deadline exceeded.",
+}, []string{"job", "instance", "collector", "query", "reason"})
+
+func init() {
+	prometheus.MustRegister(queryTruncated)
+}
+
+// queryTruncations counts the executions of a query on one target whose results were only partially read.
+type queryTruncations struct {
+	maxRows  prometheus.Counter
+	deadline prometheus.Counter
+}
+
+// newQueryTruncations returns a queryTruncations for the named query of the named collector, running on the target
+// identified by constLabels (job and instance).
+func newQueryTruncations(constLabels []*dto.LabelPair, collector, query string) *queryTruncations {
+	job, instance := jobAndInstance(constLabels)
+	qt := &queryTruncations{
+		maxRows:  queryTruncated.WithLabelValues(job, instance, collector, query, truncatedMaxRows),
+		deadline: queryTruncated.WithLabelValues(job, instance, collector, query, truncatedDeadline),
+	}
+	qt.maxRows.Add(0)
+	qt.deadline.Add(0)
+	return qt
+}
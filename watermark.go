@@ -0,0 +1,152 @@
+package sql_exporter
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// watermarkPlaceholder is bound to the query's current watermark, see QueryConfig.WatermarkColumn.
+const watermarkPlaceholder = ":__watermark"
+
+var (
+	// Protects watermarkStores.
+	watermarkStoresMtx sync.Mutex
+	// Open watermark stores, keyed by file path, so that all queries persisting to the same file share one store.
+	watermarkStores = make(map[string]*watermarkStore)
+)
+
+// watermarkStore persists per-query watermarks (the maximum value of a column collected so far) to a JSON file, so that
+// incremental queries survive restarts. Watermarks are keyed by job, instance, collector and query name, see
+// watermarkKey.
+type watermarkStore struct {
+	path string
+
+	mtx   sync.Mutex
+	marks map[string]string
+}
+
+// openWatermarkStore returns the watermark store backed by the file at path, loading it on first use. A missing file
+// is not an error, it is created on the first update.
+func openWatermarkStore(path string) (*watermarkStore, error) {
+	watermarkStoresMtx.Lock()
+	defer watermarkStoresMtx.Unlock()
+
+	if s, found := watermarkStores[path]; found {
+		return s, nil
+	}
+
+	s := &watermarkStore{
+		path:  path,
+		marks: make(map[string]string),
+	}
+	buf, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(buf, &s.marks); err != nil {
+			return nil, err
+		}
+	}
+	watermarkStores[path] = s
+	return s, nil
+}
+
+// get returns the watermark stored under key, if any.
+func (s *watermarkStore) get(key string) (string, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	mark, found := s.marks[key]
+	return mark, found
+}
+
+// advance sets the watermark stored under key to value, if greater than the current one, and persists the store. The
+// watermark is left unchanged if persisting it fails.
+func (s *watermarkStore) advance(key, value string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	mark, found := s.marks[key]
+	if found && !watermarkLess(mark, value) {
+		return nil
+	}
+	s.marks[key] = value
+	if err := s.persistLocked(); err != nil {
+		// Keep the watermark in sync with the file, so that the rows are read again.
+		if found {
+			s.marks[key] = mark
+		} else {
+			delete(s.marks, key)
+		}
+		return err
+	}
+	return nil
+}
+
+// persistLocked writes all watermarks to the store's file. The caller must hold the lock.
+func (s *watermarkStore) persistLocked() error {
+	buf, err := json.MarshalIndent(s.marks, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file and rename it, so the store is never left half written.
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// watermarkKey returns the key of a query's watermark in the store.
+func watermarkKey(job, instance, collector, query string) string {
+	return job + "/" + instance + "/" + collector + "/" + query
+}
+
+// parseWatermark parses a watermark as read from the watermark column: an int64 or float64 if numeric, a time.Time if
+// an RFC 3339 timestamp (as timestamp columns are read), else the string itself.
+func parseWatermark(s string) interface{} {
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return i
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t
+	}
+	return s
+}
+
+// watermarkLess compares two watermarks numerically if both are numbers, chronologically if both are timestamps and
+// lexicographically otherwise.
+func watermarkLess(a, b string) bool {
+	switch av, bv := parseWatermark(a), parseWatermark(b); av := av.(type) {
+	case int64:
+		if bv, ok := bv.(int64); ok {
+			return av < bv
+		}
+	case time.Time:
+		if bv, ok := bv.(time.Time); ok {
+			return av.Before(bv)
+		}
+	}
+	af, aerr := strconv.ParseFloat(a, 64)
+	bf, berr := strconv.ParseFloat(b, 64)
+	if aerr == nil && berr == nil {
+		return af < bf
+	}
+	return a < b
+}
@@ -0,0 +1,81 @@
+package sql_exporter
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func TestWatermarkBeforeLogs(t *testing.T) {
+	var pushes int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&pushes, 1)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+	// The watermark file's directory doesn't exist yet, so persisting the watermark fails.
+	dir := filepath.Join(t.TempDir(), "state")
+
+	e := newTestExporter(t, `
+results:
+  - query: 'FROM events'
+    columns: [id, msg]
+    rows:
+      - [1, started]
+      - [2, stopped]
+`, `
+global:
+  watermark_file: '`+filepath.ToSlash(filepath.Join(dir, "watermarks.json"))+`'
+  log_output:
+    type: loki
+    url: '`+srv.URL+`'
+jobs:
+  - job_name: app
+    collectors: [events]
+    static_configs:
+      - targets:
+          db1: 'RESULTS'
+collectors:
+  - collector_name: events
+    logs:
+      - log_name: app_events
+        query_ref: events
+    queries:
+      - query_name: events
+        query: SELECT id, msg FROM events WHERE id > :__watermark
+        watermark_column: id
+`)
+	tgt, err := e.(*exporter).targets.lookup("app", "db1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := tgt.collectors[0].(*collector).queries[0]
+
+	// The rows are not logged, as the next run reads them again.
+	if _, err := e.GatherContext(context.Background()); err == nil {
+		t.Error("expected a watermark persistence error")
+	}
+	if n := atomic.LoadInt32(&pushes); n != 0 {
+		t.Errorf("expected no logs pushed, got %d pushes", n)
+	}
+	if mark, found := q.watermarks.get(q.watermarkKey); found {
+		t.Errorf("watermark advanced to %q despite the persistence error", mark)
+	}
+
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.GatherContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&pushes); n != 1 {
+		t.Errorf("expected the logs pushed once, got %d pushes", n)
+	}
+	if mark, _ := q.watermarks.get(q.watermarkKey); mark != "2" {
+		t.Errorf("expected watermark 2, got %q", mark)
+	}
+}